@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+	"github.com/docker/distribution/registry/storage/driver/middleware/mirror"
+)
+
+// mirrorBackfill copies the files of the primary driver of the configured
+// mirror storage middleware missing in the secondary, or the files of the
+// secondary missing in the primary with -reverse, to migrate content to a
+// new backend. Events are written to standard output as JSON lines.
+func mirrorBackfill(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("mirror-backfill", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report missing files without copying them")
+	reverse := flags.Bool("reverse", false, "copy files from the secondary to the primary")
+	flags.Parse(args)
+
+	config, err := resolveConfiguration(flags.Arg(0))
+	if err != nil {
+		fatalf("configuration error: %v", err)
+	}
+
+	ctx, err = configureLogging(ctx, config)
+	if err != nil {
+		fatalf("error configuring logger: %v", err)
+	}
+
+	primary, secondary, err := mirrorDrivers(config)
+	if err != nil {
+		fatalf("error configuring storage: %v", err)
+	}
+
+	from, to := primary, secondary
+	if *reverse {
+		from, to = secondary, primary
+	}
+
+	result, err := mirror.Backfill(ctx, from, to, *dryRun, os.Stdout)
+	context.GetLogger(ctx).Infof("Walked %d files: %d missing, %d mismatched, %d copied, %d failed",
+		result.Files, result.Missing, result.Mismatched, result.Copied, result.Failed)
+	if err != nil {
+		context.GetLogger(ctx).Error(err)
+		os.Exit(1)
+	}
+}
+
+// mirrorDrivers returns the primary driver of the configured mirror storage
+// middleware, wrapped by the middlewares preceding it, and its secondary
+func mirrorDrivers(config *configuration.Configuration) (storagedriver.StorageDriver, storagedriver.StorageDriver, error) {
+	primary, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, mw := range config.Middleware["storage"] {
+		if mw.Name == "mirror" {
+			secondary, err := mirror.Secondary(mw.Options)
+			if err != nil {
+				return nil, nil, err
+			}
+			return primary, secondary, nil
+		}
+
+		primary, err = storagemiddleware.Get(mw.Name, mw.Options, primary)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to configure storage middleware (%s): %v", mw.Name, err)
+		}
+	}
+
+	return nil, nil, fmt.Errorf("mirror storage middleware not configured")
+}
@@ -7,9 +7,13 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -18,17 +22,25 @@ import (
 	"github.com/docker/distribution/configuration"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/health"
+	_ "github.com/docker/distribution/registry/auth/clientcert"
 	_ "github.com/docker/distribution/registry/auth/htpasswd"
+	_ "github.com/docker/distribution/registry/auth/ldap"
 	_ "github.com/docker/distribution/registry/auth/silly"
 	_ "github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/distribution/registry/auth/tokenserver"
 	"github.com/docker/distribution/registry/handlers"
 	"github.com/docker/distribution/registry/listener"
-	_ "github.com/docker/distribution/registry/proxy"
 	_ "github.com/docker/distribution/registry/storage/driver/azure"
-	_ "github.com/docker/distribution/registry/storage/driver/filesystem"
+	"github.com/docker/distribution/registry/storage/driver/base"
+	"github.com/docker/distribution/registry/storage/driver/filesystem"
 	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
 	_ "github.com/docker/distribution/registry/storage/driver/ipfs"
 	_ "github.com/docker/distribution/registry/storage/driver/middleware/cloudfront"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/encrypt"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/faulty"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/localcache"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/mirror"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/retry"
 	_ "github.com/docker/distribution/registry/storage/driver/oss"
 	_ "github.com/docker/distribution/registry/storage/driver/s3"
 	_ "github.com/docker/distribution/registry/storage/driver/swift"
@@ -56,7 +68,17 @@ func main() {
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, "version", version.Version)
 
-	config, err := resolveConfiguration()
+	if flag.Arg(0) == "proxy-prefetch" {
+		proxyPrefetch(ctx, flag.Args()[1:])
+		return
+	}
+
+	if flag.Arg(0) == "mirror-backfill" {
+		mirrorBackfill(ctx, flag.Args()[1:])
+		return
+	}
+
+	config, err := resolveConfiguration(flag.Arg(0))
 	if err != nil {
 		fatalf("configuration error: %v", err)
 	}
@@ -71,17 +93,25 @@ func main() {
 	uuid.Loggerf = context.GetLogger(ctx).Warnf
 
 	app := handlers.NewApp(ctx, *config)
+	app.Start()
 	app.RegisterHealthChecks()
 	handler := configureReporting(app)
+	handler = configureTokenServer(ctx, config, handler)
 	handler = alive("/", handler)
 	handler = health.Handler(handler)
 	handler = panicHandler(handler)
 	handler = gorhandlers.CombinedLoggingHandler(os.Stdout, handler)
+	inflight := &inflightHandler{handler: handler}
+	handler = inflight
 
 	if config.HTTP.Debug.Addr != "" {
 		go debugServer(config.HTTP.Debug.Addr)
 	}
 
+	if config.Storage.Type() == "filesystem" {
+		urlServer(config.Storage.Parameters())
+	}
+
 	server := &http.Server{
 		Handler: handler,
 	}
@@ -144,13 +174,34 @@ func main() {
 		context.GetLogger(app).Infof("listening on %v", ln.Addr())
 	}
 
+	stopping := make(chan struct{})
+	go stopOnSignal(ln, stopping)
+
 	if err := server.Serve(ln); err != nil {
-		context.GetLogger(app).Fatalln(err)
+		select {
+		case <-stopping:
+		default:
+			context.GetLogger(app).Fatalln(err)
+		}
+	}
+
+	// Requests in flight may still use the app, and connections kept alive
+	// deliver new ones until closed
+	server.SetKeepAlivesEnabled(false)
+	if !inflight.drain(drainTimeout) {
+		log.Warnf("requests still in flight after %v, closing anyway", drainTimeout)
+	}
+
+	if err := app.Close(); err != nil {
+		log.Errorf("error closing app: %v", err)
+		os.Exit(1)
 	}
 }
 
 func usage() {
 	fmt.Fprintln(os.Stderr, "usage:", os.Args[0], "<config>")
+	fmt.Fprintln(os.Stderr, "      ", os.Args[0], "proxy-prefetch <config> [repository:tag...]")
+	fmt.Fprintln(os.Stderr, "      ", os.Args[0], "mirror-backfill [-dry-run] [-reverse] <config>")
 	flag.PrintDefaults()
 }
 
@@ -160,12 +211,10 @@ func fatalf(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
-func resolveConfiguration() (*configuration.Configuration, error) {
-	var configurationPath string
-
-	if flag.NArg() > 0 {
-		configurationPath = flag.Arg(0)
-	} else if os.Getenv("REGISTRY_CONFIGURATION_PATH") != "" {
+// resolveConfiguration parses the configuration at configurationPath, falling
+// back to REGISTRY_CONFIGURATION_PATH if it is empty.
+func resolveConfiguration(configurationPath string) (*configuration.Configuration, error) {
+	if configurationPath == "" && os.Getenv("REGISTRY_CONFIGURATION_PATH") != "" {
 		configurationPath = os.Getenv("REGISTRY_CONFIGURATION_PATH")
 	}
 
@@ -224,6 +273,43 @@ func configureReporting(app *handlers.App) http.Handler {
 	return handler
 }
 
+// configureTokenServer routes requests for the token and jwks endpoints to
+// the embedded token server, if enabled. Other requests are passed to the
+// provided handler.
+func configureTokenServer(ctx context.Context, config *configuration.Configuration, handler http.Handler) http.Handler {
+	if !config.TokenServer.Enabled {
+		return handler
+	}
+
+	ts, err := tokenserver.New(ctx, config)
+	if err != nil {
+		context.GetLogger(ctx).Fatalln(err)
+	}
+
+	path := config.TokenServer.Path
+	if path == "" {
+		path = tokenserver.DefaultPath
+	}
+
+	jwksPath := config.TokenServer.JWKSPath
+	if jwksPath == "" {
+		jwksPath = tokenserver.DefaultJWKSPath
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case path:
+			ts.ServeHTTP(w, r)
+			return
+		case jwksPath:
+			ts.ServeJWKS(w, r)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
 // configureLogging prepares the context with a logger using the
 // configuration.
 func configureLogging(ctx context.Context, config *configuration.Configuration) (context.Context, error) {
@@ -293,15 +379,84 @@ func logLevel(level configuration.Loglevel) log.Level {
 }
 
 // debugServer starts the debug server with pprof, expvar among other
-// endpoints. The addr should not be exposed externally. For most of these to
+// endpoints, and the storage driver metrics in the Prometheus text format at
+// /metrics. The addr should not be exposed externally. For most of these to
 // work, tls cannot be enabled on the endpoint, so it is generally separate.
 func debugServer(addr string) {
+	http.Handle("/metrics", base.MetricsHandler())
+
 	log.Infof("debug server listening %v", addr)
 	if err := http.ListenAndServe(addr, nil); err != nil {
 		log.Fatalf("error listening on debug interface: %v", err)
 	}
 }
 
+// urlServer starts serving the signed URLs returned by the filesystem driver
+// on its urladdr parameter, if set.
+func urlServer(parameters configuration.Parameters) {
+	addr, handler, err := filesystem.URLServerFromParameters(parameters)
+	if err != nil {
+		log.Fatalf("error configuring filesystem urls: %v", err)
+	}
+	if addr == "" {
+		return
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("error listening on filesystem urls interface: %v", err)
+	}
+
+	log.Infof("filesystem urls listening %v", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, handler); err != nil {
+			log.Fatalf("error serving filesystem urls: %v", err)
+		}
+	}()
+}
+
+// drainTimeout is how long requests in flight are waited for on shutdown
+const drainTimeout = 30 * time.Second
+
+// stopOnSignal closes the listener when the registry is interrupted or
+// terminated, closing stopping first, for the server to stop accepting
+// connections and the app to be closed once requests in flight complete.
+func stopOnSignal(ln net.Listener, stopping chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+
+	log.Infof("received %v, shutting down", sig)
+	close(stopping)
+	ln.Close()
+}
+
+// inflightHandler counts the requests being served by the wrapped handler.
+type inflightHandler struct {
+	handler http.Handler
+	n       int64
+}
+
+func (h *inflightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&h.n, 1)
+	defer atomic.AddInt64(&h.n, -1)
+
+	h.handler.ServeHTTP(w, r)
+}
+
+// drain waits for the requests in flight to complete, returning false if
+// some are still in flight after the timeout.
+func (h *inflightHandler) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&h.n) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
 // panicHandler add a HTTP handler to web app. The handler recover the happening
 // panic. logrus.Panic transmits panic message to pre-config log hooks, which is
 // defined in config.yml.
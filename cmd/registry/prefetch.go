@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/handlers"
+)
+
+// proxyPrefetch pulls images into the storage of a proxy cache ahead of
+// clients. The arguments are the configuration path, followed by the
+// "repository:tag" references to fetch. If no references are given, they are
+// read from standard input, one per line. Progress is written to standard
+// output as JSON lines. The registry being warmed should not be running, as
+// both would write the cache expiry state.
+func proxyPrefetch(ctx context.Context, args []string) {
+	var configurationPath string
+	if len(args) > 0 {
+		configurationPath, args = args[0], args[1:]
+	}
+
+	config, err := resolveConfiguration(configurationPath)
+	if err != nil {
+		fatalf("configuration error: %v", err)
+	}
+
+	ctx, err = configureLogging(ctx, config)
+	if err != nil {
+		fatalf("error configuring logger: %v", err)
+	}
+
+	references := args
+	if len(references) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if reference := strings.TrimSpace(scanner.Text()); reference != "" {
+				references = append(references, reference)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fatalf("error reading references: %v", err)
+		}
+	}
+
+	app := handlers.NewApp(ctx, *config)
+	err = app.ProxyPrefetch(ctx, references, os.Stdout)
+	if cerr := app.Close(); cerr != nil {
+		context.GetLogger(ctx).Errorf("error closing registry: %v", cerr)
+	}
+
+	if err != nil {
+		context.GetLogger(ctx).Error(err)
+		os.Exit(1)
+	}
+}
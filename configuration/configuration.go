@@ -99,6 +99,15 @@ type Configuration struct {
 			// Addr specifies the bind address for the debug server.
 			Addr string `yaml:"addr,omitempty"`
 		} `yaml:"debug,omitempty"`
+
+		// Admin configures the administrative API, served under the /admin/
+		// path. Requests are authorized by the configured access controller
+		// against the "registry:admin" resource, which is required. Left
+		// disabled by default.
+		Admin struct {
+			// Enabled turns on the administrative API.
+			Enabled bool `yaml:"enabled,omitempty"`
+		} `yaml:"admin,omitempty"`
 	} `yaml:"http,omitempty"`
 
 	// Notifications specifies configuration about various endpoint to which
@@ -138,6 +147,10 @@ type Configuration struct {
 	Health Health `yaml:"health,omitempty"`
 
 	Proxy Proxy `yaml:"proxy,omitempty"`
+
+	// TokenServer configures an embedded token server, issuing bearer
+	// tokens accepted by the token access controller.
+	TokenServer TokenServer `yaml:"tokenserver,omitempty"`
 }
 
 // LogHook is composed of hook Level and Type.
@@ -449,6 +462,16 @@ type Notifications struct {
 	// respond to webhook notifications. In the future, we may allow other
 	// kinds of endpoints, such as external queues.
 	Endpoints []Endpoint `yaml:"endpoints,omitempty"`
+
+	// EventLog configures a durable log of all events dispatched by the
+	// registry, from which events may be replayed to endpoints.
+	EventLog EventLog `yaml:"eventlog,omitempty"`
+}
+
+// EventLog describes the configuration of the local event log.
+type EventLog struct {
+	Path    string `yaml:"path,omitempty"`    // file to which events are appended
+	MaxSize int64  `yaml:"maxsize,omitempty"` // size in bytes past which the file is rotated
 }
 
 // Endpoint describes the configuration of an http webhook notification
@@ -512,6 +535,130 @@ type Proxy struct {
 
 	// Password of the hub user
 	Password string `yaml:"password"`
+
+	// TTL is how long content pulled from the remote registry is cached,
+	// defaulting to one week
+	TTL time.Duration `yaml:"ttl,omitempty"`
+
+	// Upstreams lists further remote registries, each mirrored for the
+	// repositories under its prefix
+	Upstreams []ProxyUpstream `yaml:"upstreams,omitempty"`
+
+	// Local lists prefixes, such as "myteam/*", of repositories hosted by
+	// the registry itself, which accept pushes and are never pulled from a
+	// remote registry
+	Local []string `yaml:"local,omitempty"`
+
+	// Mixed lets repositories that do not exist on their remote registry,
+	// or that match no upstream, be pushed to and served locally
+	Mixed bool `yaml:"mixed,omitempty"`
+
+	// TTLPolicies set how long content is cached for the repositories
+	// matching a pattern, overriding the TTL of their upstream
+	TTLPolicies []ProxyTTLPolicy `yaml:"ttlpolicies,omitempty"`
+
+	// MaxSize is the budget, in bytes, for the content pulled into the
+	// cache. When exceeded, the least recently pulled content is removed
+	// before its TTL expires.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+
+	// SpoolDirectory is the local directory in which blobs being pulled
+	// from a remote registry are spooled for the clients reading them
+	// concurrently, defaulting to the system temporary directory
+	SpoolDirectory string `yaml:"spooldirectory,omitempty"`
+
+	// Watch lists repositories whose tags are polled on the remote
+	// registry, so that new and changed tags are pulled into the cache
+	// ahead of clients
+	Watch []ProxyWatch `yaml:"watch,omitempty"`
+}
+
+// ProxyWatch configures the polling of a repository on its remote registry
+type ProxyWatch struct {
+	// Repository is the name of the repository in the cache
+	Repository string `yaml:"repository"`
+
+	// Tags are patterns, such as "1.*", matched against tag names as by
+	// path.Match. All tags are synced if none are given.
+	Tags []string `yaml:"tags,omitempty"`
+
+	// Interval is the time between polls, defaulting to ten minutes
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// ProxyTTLPolicy sets how long content is cached for the repositories
+// matching a pattern
+type ProxyTTLPolicy struct {
+	// Repository is a pattern, such as "library/*", matched against
+	// repository names as by path.Match
+	Repository string `yaml:"repository"`
+
+	// TTL is how long content pulled for the repositories is cached
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// ProxyUpstream configures a remote registry mirrored by the pull through
+// cache for the repositories matching a prefix
+type ProxyUpstream struct {
+	// Prefix selects the repositories mirrored from this upstream, such as
+	// "quay/*". The prefix is removed from the repository name on the remote.
+	Prefix string `yaml:"prefix"`
+
+	// RemotePrefix, if set, is prepended to the repository name on the
+	// remote, such as "mirror/*"
+	RemotePrefix string `yaml:"remoteprefix,omitempty"`
+
+	// RemoteURL is the URL of the remote registry
+	RemoteURL string `yaml:"remoteurl"`
+
+	// Username for the remote registry
+	Username string `yaml:"username,omitempty"`
+
+	// Password for the remote registry
+	Password string `yaml:"password,omitempty"`
+
+	// TTL is how long content pulled from the remote registry is cached,
+	// defaulting to one week
+	TTL time.Duration `yaml:"ttl,omitempty"`
+}
+
+// TokenServer configures the embedded token server, implementing the docker
+// token authentication specification.
+type TokenServer struct {
+	// Enabled turns on the token server.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Path is the path at which tokens are served, /auth/token by default.
+	Path string `yaml:"path,omitempty"`
+
+	// JWKSPath is the path at which the public signing key is served as a
+	// JSON Web Key Set, /auth/jwks by default.
+	JWKSPath string `yaml:"jwkspath,omitempty"`
+
+	// Issuer and Service are the issuer and audience of issued tokens. They
+	// default to the issuer and service of the token access controller.
+	Issuer  string `yaml:"issuer,omitempty"`
+	Service string `yaml:"service,omitempty"`
+
+	// Expiration is the lifetime of issued tokens, five minutes by default.
+	Expiration time.Duration `yaml:"expiration,omitempty"`
+
+	// SigningKey is the path to the libtrust private key, in PEM or JWK
+	// format, with which tokens are signed.
+	SigningKey string `yaml:"signingkey,omitempty"`
+
+	// Certificate is the path to a PEM bundle holding the certificate of the
+	// signing key followed by any intermediates. The chain is included in
+	// issued tokens and must lead to the rootcertbundle of the token access
+	// controller.
+	Certificate string `yaml:"certificate,omitempty"`
+
+	// Backend authenticates users requesting tokens. It is configured like
+	// auth, accepting htpasswd, ldap or static.
+	Backend Auth `yaml:"backend,omitempty"`
+
+	// Policy is the path to the acl policy file granting scopes to users.
+	Policy string `yaml:"policy,omitempty"`
 }
 
 // Parse parses an input configuration yaml document into a Configuration struct
@@ -74,6 +74,9 @@ var configStruct = Configuration{
 		Debug   struct {
 			Addr string `yaml:"addr,omitempty"`
 		} `yaml:"debug,omitempty"`
+		Admin struct {
+			Enabled bool `yaml:"enabled,omitempty"`
+		} `yaml:"admin,omitempty"`
 	}{
 		TLS: struct {
 			Certificate string   `yaml:"certificate,omitempty"`
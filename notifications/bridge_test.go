@@ -1,6 +1,7 @@
 package notifications
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/docker/distribution/digest"
@@ -24,7 +25,8 @@ var (
 	ub = mustUB(v2.NewURLBuilderFromString("http://test.example.com/"))
 
 	actor = ActorRecord{
-		Name: "test",
+		Name:   "test",
+		Groups: []string{"testers"},
 	}
 	request = RequestRecord{}
 	m       = schema1.Manifest{
@@ -131,7 +133,7 @@ func checkCommon(t *testing.T, events ...Event) {
 		t.Fatalf("request not equal: %#v != %#v", event.Request, request)
 	}
 
-	if event.Actor != actor {
+	if !reflect.DeepEqual(event.Actor, actor) {
 		t.Fatalf("request not equal: %#v != %#v", event.Actor, actor)
 	}
 
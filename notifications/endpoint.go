@@ -55,7 +55,8 @@ func NewEndpoint(name, url string, config EndpointConfig) *Endpoint {
 	endpoint.Sink = newHTTPSink(
 		endpoint.url, endpoint.Timeout, endpoint.Headers,
 		endpoint.metrics.httpStatusListener())
-	endpoint.Sink = newRetryingSink(endpoint.Sink, endpoint.Threshold, endpoint.Backoff)
+	endpoint.Sink = newRetryingSink(endpoint.Sink, endpoint.Threshold, endpoint.Backoff,
+		endpoint.metrics.retryingSinkListener())
 	endpoint.Sink = newEventQueue(endpoint.Sink, endpoint.metrics.eventQueueListener())
 
 	register(&endpoint)
@@ -84,3 +85,14 @@ func (e *Endpoint) ReadMetrics(em *EndpointMetrics) {
 		em.Statuses[k] = v
 	}
 }
+
+// ReadFailures returns the envelopes that most recently failed delivery to
+// the endpoint, oldest first.
+func (e *Endpoint) ReadFailures() []FailedEnvelope {
+	e.metrics.Lock()
+	defer e.metrics.Unlock()
+
+	failed := make([]FailedEnvelope, len(e.metrics.failed))
+	copy(failed, e.metrics.failed)
+	return failed
+}
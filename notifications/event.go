@@ -87,6 +87,10 @@ type ActorRecord struct {
 	// request context that generated the event.
 	Name string `json:"name,omitempty"`
 
+	// Groups lists the groups of the user, as reported by the access
+	// controller, such as the organizational units of a client certificate.
+	Groups []string `json:"groups,omitempty"`
+
 	// TODO(stevvooe): Look into setting a session cookie to get this
 	// without docker daemon.
 	//    SessionID
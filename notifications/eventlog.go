@@ -0,0 +1,221 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EventLogConfig configures the rotation of an event log.
+type EventLogConfig struct {
+	// MaxSize is the size in bytes of the log past which it is rotated: the
+	// file is renamed with a ".1" suffix, replacing the previous one, and a
+	// new file is started. The log takes at most about twice this size.
+	MaxSize int64
+}
+
+// defaults set any zero-valued fields to a reasonable default.
+func (ec *EventLogConfig) defaults() {
+	if ec.MaxSize <= 0 {
+		ec.MaxSize = 100 << 20
+	}
+}
+
+// EventLog is a durable sink that appends every event written to it to a
+// local file, one json encoded event per line. Events can be read back by
+// time range, allowing them to be replayed to endpoints that missed them.
+type EventLog struct {
+	path string
+	EventLogConfig
+
+	mu     sync.Mutex
+	fp     *os.File
+	size   int64
+	enc    *json.Encoder
+	closed bool
+}
+
+var _ Sink = &EventLog{}
+
+// NewEventLog opens the event log at path, creating it if it does not exist.
+// Events written to the log are appended to any existing content.
+func NewEventLog(path string, config EventLogConfig) (*EventLog, error) {
+	config.defaults()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	el := &EventLog{
+		path:           path,
+		EventLogConfig: config,
+	}
+	if err := el.open(); err != nil {
+		return nil, err
+	}
+
+	return el, nil
+}
+
+// open opens the file of the log for appending.
+func (el *EventLog) open() error {
+	fp, err := os.OpenFile(el.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	el.fp = fp
+	el.size = fi.Size()
+	el.enc = json.NewEncoder(&countingWriter{w: fp, n: &el.size})
+	return nil
+}
+
+// rotate replaces the previous file of the log with the current one, and
+// starts a new file.
+func (el *EventLog) rotate() error {
+	if err := el.fp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(el.path, el.rotatedPath()); err != nil {
+		return err
+	}
+
+	return el.open()
+}
+
+func (el *EventLog) rotatedPath() string {
+	return el.path + ".1"
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	*cw.n += int64(n)
+	return n, err
+}
+
+// Write appends the events to the log. The events are committed to the
+// underlying file before returning.
+func (el *EventLog) Write(events ...Event) error {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	if el.closed {
+		return ErrSinkClosed
+	}
+
+	if el.size >= el.MaxSize {
+		if err := el.rotate(); err != nil {
+			return fmt.Errorf("%v: error rotating: %v", el, err)
+		}
+	}
+
+	for _, event := range events {
+		if err := el.enc.Encode(event); err != nil {
+			return fmt.Errorf("%v: error writing event: %v", el, err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the underlying file.
+func (el *EventLog) Close() error {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	if el.closed {
+		return fmt.Errorf("eventlog: already closed")
+	}
+
+	el.closed = true
+	return el.fp.Close()
+}
+
+// Walk calls fn with each event from the log with a timestamp in the range
+// [from, to), in the order they were written, including the previous file of
+// the log. A zero value for to leaves the range unbounded. The files are read
+// as streams, stopping at the first event at or after to, so that only one
+// event is held in memory at a time. An error returned by fn stops the walk
+// and is returned.
+func (el *EventLog) Walk(from, to time.Time, fn func(Event) error) error {
+	// Both files are opened together, so that a rotation while reading
+	// neither skips nor repeats events
+	el.mu.Lock()
+	rotated, err := os.Open(el.rotatedPath())
+	if err != nil && !os.IsNotExist(err) {
+		el.mu.Unlock()
+		return err
+	}
+	current, err := os.Open(el.path)
+	el.mu.Unlock()
+	if err != nil {
+		if rotated != nil {
+			rotated.Close()
+		}
+		return err
+	}
+	defer current.Close()
+
+	if rotated != nil {
+		defer rotated.Close()
+
+		done, err := el.walkFile(rotated, from, to, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+
+	_, err = el.walkFile(current, from, to, fn)
+	return err
+}
+
+// walkFile calls fn with the events of the file in the range [from, to),
+// returning true if an event at or after to was reached.
+func (el *EventLog) walkFile(r io.Reader, from, to time.Time, fn func(Event) error) (bool, error) {
+	dec := json.NewDecoder(r)
+	for {
+		var event Event
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// An unexpected EOF means a write is in progress at the tail
+				// of the log. That event will be picked up on the next read.
+				return false, nil
+			}
+
+			return false, fmt.Errorf("%v: error reading event: %v", el, err)
+		}
+
+		if !to.IsZero() && !event.Timestamp.Before(to) {
+			return true, nil
+		}
+
+		if event.Timestamp.Before(from) {
+			continue
+		}
+
+		if err := fn(event); err != nil {
+			return false, err
+		}
+	}
+}
+
+func (el *EventLog) String() string {
+	return fmt.Sprintf("eventLog{%s}", el.path)
+}
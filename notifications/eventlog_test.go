@@ -0,0 +1,198 @@
+package notifications
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	root, err := ioutil.TempDir("", "eventlog-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "events", "events.log")
+	el, err := NewEventLog(path, EventLogConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error creating event log: %v", err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	var events []Event
+	for i := 0; i < 10; i++ {
+		event := createTestEvent("push", "library/test", layerMediaType)
+		event.Timestamp = start.Add(time.Duration(i) * time.Minute)
+		events = append(events, event)
+	}
+
+	if err := el.Write(events[:5]...); err != nil {
+		t.Fatalf("unexpected error writing events: %v", err)
+	}
+	checkClose(t, el)
+
+	// reopening the log must append, rather than truncate.
+	el, err = NewEventLog(path, EventLogConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error reopening event log: %v", err)
+	}
+	defer el.Close()
+
+	if err := el.Write(events[5:]...); err != nil {
+		t.Fatalf("unexpected error writing events: %v", err)
+	}
+
+	for _, tc := range []struct {
+		from, to time.Time
+		expected []Event
+	}{
+		{
+			from:     start,
+			expected: events,
+		},
+		{
+			from:     start.Add(2 * time.Minute),
+			to:       start.Add(5 * time.Minute),
+			expected: events[2:5],
+		},
+		{
+			from:     start.Add(time.Hour),
+			expected: nil,
+		},
+	} {
+		read, err := readEvents(el, tc.from, tc.to)
+		if err != nil {
+			t.Fatalf("unexpected error reading events: %v", err)
+		}
+
+		if len(read) != len(tc.expected) {
+			t.Fatalf("unexpected number of events in [%v, %v): %d != %d", tc.from, tc.to, len(read), len(tc.expected))
+		}
+
+		for i := range read {
+			if read[i].ID != tc.expected[i].ID {
+				t.Fatalf("unexpected event at %d: %v != %v", i, read[i].ID, tc.expected[i].ID)
+			}
+
+			if !read[i].Timestamp.Equal(tc.expected[i].Timestamp) {
+				t.Fatalf("unexpected timestamp at %d: %v != %v", i, read[i].Timestamp, tc.expected[i].Timestamp)
+			}
+		}
+	}
+}
+
+func TestEventLogRotation(t *testing.T) {
+	root, err := ioutil.TempDir("", "eventlog-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "events.log")
+	el, err := NewEventLog(path, EventLogConfig{MaxSize: 2048})
+	if err != nil {
+		t.Fatalf("unexpected error creating event log: %v", err)
+	}
+	defer el.Close()
+
+	start := time.Now().Add(-time.Hour)
+	var events []Event
+	for i := 0; i < 30; i++ {
+		event := createTestEvent("push", "library/test", layerMediaType)
+		event.Timestamp = start.Add(time.Duration(i) * time.Minute)
+		if err := el.Write(event); err != nil {
+			t.Fatalf("unexpected error writing events: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	// Only the current and previous files are kept
+	for _, p := range []string{path, path + ".1"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("unexpected error checking %s: %v", p, err)
+		}
+		if fi.Size() > 2048+1024 {
+			t.Fatalf("unexpected size of %s: %d", p, fi.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected older file: %v", err)
+	}
+
+	read, err := readEvents(el, start, time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error reading events: %v", err)
+	}
+	if len(read) == 0 || len(read) >= len(events) {
+		t.Fatalf("unexpected number of events after rotation: %d", len(read))
+	}
+
+	// The events kept are the latest, in order
+	kept := events[len(events)-len(read):]
+	for i := range read {
+		if read[i].ID != kept[i].ID {
+			t.Fatalf("unexpected event at %d: %v != %v", i, read[i].ID, kept[i].ID)
+		}
+	}
+
+	// Reading stops at the end of the range, across files
+	first := kept[0].Timestamp
+	read, err = readEvents(el, first, first.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error reading events: %v", err)
+	}
+	if len(read) != 2 || read[0].ID != kept[0].ID || read[1].ID != kept[1].ID {
+		t.Fatalf("unexpected events in range: %v", read)
+	}
+}
+
+func TestEventLogWalkStops(t *testing.T) {
+	root, err := ioutil.TempDir("", "eventlog-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	el, err := NewEventLog(filepath.Join(root, "events.log"), EventLogConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error creating event log: %v", err)
+	}
+	defer el.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := el.Write(createTestEvent("push", "library/test", layerMediaType)); err != nil {
+			t.Fatalf("unexpected error writing events: %v", err)
+		}
+	}
+
+	errStop := errors.New("stop")
+	var walked int
+	err = el.Walk(time.Time{}, time.Time{}, func(Event) error {
+		walked++
+		if walked == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Fatalf("unexpected error walking events: %v != %v", err, errStop)
+	}
+	if walked != 2 {
+		t.Fatalf("unexpected number of events walked: %d != 2", walked)
+	}
+}
+
+// readEvents collects the events of the log in the range [from, to).
+func readEvents(el *EventLog, from, to time.Time) ([]Event, error) {
+	var events []Event
+	err := el.Walk(from, to, func(event Event) error {
+		events = append(events, event)
+		return nil
+	})
+	return events, err
+}
@@ -131,6 +131,20 @@ func TestHTTPSink(t *testing.T) {
 			}
 		}
 
+		if tc.failure {
+			if metrics.LastError == "" || metrics.LastErrorTime.IsZero() {
+				t.Fatalf("last error not recorded for failure: %#v", metrics.EndpointMetrics)
+			}
+
+			failed := metrics.failed[len(metrics.failed)-1]
+			if failed.Status != tc.statusCode || len(failed.Events) != len(tc.events) {
+				t.Fatalf("unexpected failed envelope: %#v", failed)
+			}
+
+			expectedMetrics.LastError = metrics.LastError
+			expectedMetrics.LastErrorTime = metrics.LastErrorTime
+		}
+
 		if !reflect.DeepEqual(metrics.EndpointMetrics, expectedMetrics) {
 			t.Fatalf("metrics not as expected: %#v != %#v", metrics.EndpointMetrics, expectedMetrics)
 		}
@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 )
 
+// maxFailedEnvelopes is the number of failed envelopes retained for each
+// endpoint. Older failures are discarded.
+const maxFailedEnvelopes = 100
+
 // EndpointMetrics track various actions taken by the endpoint, typically by
 // number of events. The goal of this to export it via expvar but we may find
 // some other future solution to be better.
@@ -17,13 +22,34 @@ type EndpointMetrics struct {
 	Failures  int            // total events failed
 	Errors    int            // total events errored
 	Statuses  map[string]int // status code histogram, per call event
+
+	CircuitOpen   bool      // endpoint is backing off after repeated failures
+	LastError     string    // most recent error writing to the endpoint
+	LastErrorTime time.Time // time at which the last error occurred
+}
+
+// FailedEnvelope records an envelope that could not be delivered to an
+// endpoint. Delivery of the events may have succeeded on a later retry.
+type FailedEnvelope struct {
+	Envelope
+
+	// Timestamp is the time at which the delivery failed.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Status is the http status returned by the endpoint, if a response was
+	// received.
+	Status int `json:"status,omitempty"`
+
+	// Error describes the failure.
+	Error string `json:"error"`
 }
 
 // safeMetrics guards the metrics implementation with a lock and provides a
 // safe update function.
 type safeMetrics struct {
 	EndpointMetrics
-	sync.Mutex // protects statuses map
+	failed     []FailedEnvelope // recently failed envelopes, oldest first
+	sync.Mutex                  // protects statuses map and failed envelopes
 }
 
 // newSafeMetrics returns safeMetrics with map allocated.
@@ -48,6 +74,33 @@ func (sm *safeMetrics) eventQueueListener() eventQueueListener {
 	}
 }
 
+// retryingSinkListener returns a listener that tracks the circuit breaker
+// state of the retrying sink.
+func (sm *safeMetrics) retryingSinkListener() retryingSinkListener {
+	return &endpointMetricsRetryingSinkListener{
+		safeMetrics: sm,
+	}
+}
+
+// recordFailure records the failed delivery of events, retaining at most
+// maxFailedEnvelopes. The caller must hold the lock.
+func (sm *safeMetrics) recordFailure(status int, err string, events ...Event) {
+	now := time.Now().UTC()
+	sm.LastError = err
+	sm.LastErrorTime = now
+
+	sm.failed = append(sm.failed, FailedEnvelope{
+		Envelope:  Envelope{Events: events},
+		Timestamp: now,
+		Status:    status,
+		Error:     err,
+	})
+
+	if len(sm.failed) > maxFailedEnvelopes {
+		sm.failed = sm.failed[len(sm.failed)-maxFailedEnvelopes:]
+	}
+}
+
 // endpointMetricsHTTPStatusListener increments counters related to http sinks
 // for the relevent events.
 type endpointMetricsHTTPStatusListener struct {
@@ -68,12 +121,33 @@ func (emsl *endpointMetricsHTTPStatusListener) failure(status int, events ...Eve
 	defer emsl.safeMetrics.Unlock()
 	emsl.Statuses[fmt.Sprintf("%d %s", status, http.StatusText(status))] += len(events)
 	emsl.Failures += len(events)
+	emsl.recordFailure(status, fmt.Sprintf("response status %d %s unaccepted", status, http.StatusText(status)), events...)
 }
 
 func (emsl *endpointMetricsHTTPStatusListener) err(err error, events ...Event) {
 	emsl.safeMetrics.Lock()
 	defer emsl.safeMetrics.Unlock()
 	emsl.Errors += len(events)
+	emsl.recordFailure(0, err.Error(), events...)
+}
+
+// endpointMetricsRetryingSinkListener maintains the circuit breaker state.
+type endpointMetricsRetryingSinkListener struct {
+	*safeMetrics
+}
+
+var _ retryingSinkListener = &endpointMetricsRetryingSinkListener{}
+
+func (emrl *endpointMetricsRetryingSinkListener) active(events ...Event) {
+	emrl.Lock()
+	defer emrl.Unlock()
+	emrl.CircuitOpen = false
+}
+
+func (emrl *endpointMetricsRetryingSinkListener) retry(events ...Event) {
+	emrl.Lock()
+	defer emrl.Unlock()
+	emrl.CircuitOpen = true
 }
 
 // endpointMetricsEventQueueListener maintains the incoming events counter and
@@ -216,9 +216,10 @@ func (eq *eventQueue) next() []Event {
 // Concurrent calls to a retrying sink are serialized through the sink,
 // meaning that if one is in-flight, another will not proceed.
 type retryingSink struct {
-	mu     sync.Mutex
-	sink   Sink
-	closed bool
+	mu        sync.Mutex
+	sink      Sink
+	listeners []retryingSinkListener
+	closed    bool
 
 	// circuit breaker heuristics
 	failures struct {
@@ -229,6 +230,10 @@ type retryingSink struct {
 	}
 }
 
+// retryingSinkListener is called when the circuit breaker of a retrying sink
+// changes state. The method retry is called when the sink backs off after
+// repeated failures and active is called when events are written
+// successfully.
 type retryingSinkListener interface {
 	active(events ...Event)
 	retry(events ...Event)
@@ -240,10 +245,12 @@ type retryingSinkListener interface {
 
 // newRetryingSink returns a sink that will retry writes to a sink, backing
 // off on failure. Parameters threshold and backoff adjust the behavior of the
-// circuit breaker.
-func newRetryingSink(sink Sink, threshold int, backoff time.Duration) *retryingSink {
+// circuit breaker. The listeners, if any, are notified of changes in the
+// state of the circuit breaker.
+func newRetryingSink(sink Sink, threshold int, backoff time.Duration, listeners ...retryingSinkListener) *retryingSink {
 	rs := &retryingSink{
-		sink: sink,
+		sink:      sink,
+		listeners: listeners,
 	}
 	rs.failures.threshold = threshold
 	rs.failures.backoff = backoff
@@ -265,6 +272,9 @@ retry:
 
 	if !rs.proceed() {
 		logrus.Warnf("%v encountered too many errors, backing off", rs.sink)
+		for _, listener := range rs.listeners {
+			listener.retry(events...)
+		}
 		rs.wait(rs.failures.backoff)
 		goto retry
 	}
@@ -279,6 +289,10 @@ retry:
 		goto retry
 	}
 
+	for _, listener := range rs.listeners {
+		listener.active(events...)
+	}
+
 	return nil
 }
 
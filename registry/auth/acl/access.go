@@ -0,0 +1,120 @@
+package acl
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// ErrAccessDenied is returned when an authenticated user is not granted the
+// requested access by the policy.
+var ErrAccessDenied = errors.New("access denied by policy")
+
+// accessController wraps another access controller, which authenticates
+// requests, and authorizes them against a policy.
+type accessController struct {
+	auth.AccessController
+	source Source
+}
+
+var _ auth.AccessController = &accessController{}
+
+// NewAccessController returns an access controller that authenticates
+// requests with ac, then checks each access record against the policy
+// provided by source for the authenticated user.
+func NewAccessController(ac auth.AccessController, source Source) auth.AccessController {
+	return &accessController{
+		AccessController: ac,
+		source:           source,
+	}
+}
+
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	authCtx, err := ac.AccessController.Authorized(ctx, accessRecords...)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo, _ := authCtx.Value("auth.user").(auth.UserInfo)
+	policy := ac.source.Policy()
+
+	for _, access := range accessRecords {
+		if !policy.Permitted(userInfo, access) {
+			context.GetLogger(ctx).Errorf("user %q denied %s access to %s:%s by policy", userInfo.Name, access.Action, access.Type, access.Name)
+			return nil, ac.challenge(ctx, accessRecords)
+		}
+	}
+
+	return authCtx, nil
+}
+
+// Close closes the wrapped access controller, if it keeps background work to
+// stop.
+func (ac *accessController) Close() error {
+	if closer, ok := ac.AccessController.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// challenge returns the challenge of the wrapped access controller for the
+// access records, as issued to a request without credentials. This lets the
+// client know how to authenticate, whatever scheme is used.
+func (ac *accessController) challenge(ctx context.Context, accessRecords []auth.Access) error {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return err
+	}
+
+	anonymous := new(http.Request)
+	*anonymous = *req
+	anonymous.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		if k != "Authorization" {
+			anonymous.Header[k] = v
+		}
+	}
+
+	_, err = ac.AccessController.Authorized(requestContext{Context: ctx, r: anonymous}, accessRecords...)
+	if ch, ok := err.(auth.Challenge); ok {
+		return challenge{Challenge: ch}
+	}
+
+	return challenge{}
+}
+
+// requestContext replaces the request of a context, which context.WithRequest
+// does not allow.
+type requestContext struct {
+	context.Context
+	r *http.Request
+}
+
+func (rc requestContext) Value(key interface{}) interface{} {
+	if key == "http.request" {
+		return rc.r
+	}
+	return rc.Context.Value(key)
+}
+
+// challenge implements the auth.Challenge interface, reporting
+// ErrAccessDenied with the headers of the wrapped challenge, if any.
+type challenge struct {
+	auth.Challenge
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the headers of the wrapped challenge on the response.
+func (ch challenge) SetHeaders(w http.ResponseWriter) {
+	if ch.Challenge != nil {
+		ch.Challenge.SetHeaders(w)
+	}
+}
+
+func (ch challenge) Error() string {
+	return ErrAccessDenied.Error()
+}
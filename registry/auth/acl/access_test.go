@@ -0,0 +1,73 @@
+package acl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	_ "github.com/docker/distribution/registry/auth/silly"
+)
+
+func TestAccessController(t *testing.T) {
+	policy, err := Parse(strings.NewReader(`
+rules:
+  - accounts: [silly]
+    names: [silly/*]
+    actions: [pull]
+`))
+	if err != nil {
+		t.Fatalf("error parsing policy: %v", err)
+	}
+
+	silly, err := auth.GetAccessController("silly", map[string]interface{}{
+		"realm":   "http://auth.example.com/token",
+		"service": "registry.example.com",
+	})
+	if err != nil {
+		t.Fatalf("error creating silly access controller: %v", err)
+	}
+
+	ac := NewAccessController(silly, policy)
+
+	authorize := func(authorization string, access ...auth.Access) (context.Context, error) {
+		req, err := http.NewRequest("GET", "/v2/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		return ac.Authorized(context.WithRequest(context.Background(), req), access...)
+	}
+
+	// Authentication is left to the wrapped access controller.
+	if _, err := authorize(""); err == nil {
+		t.Fatalf("expected challenge without credentials")
+	}
+
+	authCtx, err := authorize("Bearer whatever", repository("silly/app", "pull"))
+	if err != nil {
+		t.Fatalf("unexpected error authorizing permitted access: %v", err)
+	}
+
+	if userInfo, _ := authCtx.Value("auth.user").(auth.UserInfo); userInfo.Name != "silly" {
+		t.Fatalf("unexpected user in authorized context: %#v", userInfo)
+	}
+
+	_, err = authorize("Bearer whatever", repository("silly/app", "pull"), repository("silly/app", "push"))
+	ch, ok := err.(auth.Challenge)
+	if !ok {
+		t.Fatalf("expected challenge for denied access, got: %v", err)
+	}
+
+	// The challenge of the wrapped access controller is used.
+	w := httptest.NewRecorder()
+	ch.SetHeaders(w)
+	if header := w.Header().Get("WWW-Authenticate"); !strings.Contains(header, `scope="repository:silly/app:pull repository:silly/app:push"`) {
+		t.Fatalf("unexpected challenge header: %q", header)
+	}
+}
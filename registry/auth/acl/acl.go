@@ -0,0 +1,256 @@
+// Package acl provides a policy engine granting accounts access to registry
+// resources, as described by a policy file.
+//
+// A policy is a list of rules, each granting the matching accounts, or the
+// members of the listed groups, a set of actions on the resources matching
+// any of the name patterns:
+//
+//	groups:
+//	  developers: [alice, bob]
+//	rules:
+//	  - groups: [developers]
+//	    names: [team/*]
+//	    actions: [pull, push]
+//	  - accounts: ["*"]
+//	    names: [library/*]
+//	    actions: [pull]
+//	  - accounts: ["*"]
+//	    names: ["${user}/*"]
+//	    actions: [pull, push, delete]
+//	  - accounts: [admin]
+//	    type: registry
+//	    names: [catalog]
+//	    actions: ["*"]
+//
+// Groups reported by the access controller, such as those from a directory
+// or a client certificate, are matched along with the groups of the policy.
+//
+// Account and name patterns use the syntax of path.Match. In name patterns,
+// ${user} is replaced by the account name, granting personal namespaces.
+// Rules apply to repositories unless another resource type is given. The
+// "delete" action grants the "*" action requested by the registry for
+// repository deletes, while a rule listing "*" grants every action.
+package acl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/distribution/registry/auth"
+	"gopkg.in/yaml.v2"
+)
+
+// Rule grants the accounts matching any of the Accounts patterns, and the
+// members of any of the Groups, the listed actions on resources of the given
+// type matching any of the Names patterns.
+type Rule struct {
+	Accounts []string `yaml:"accounts"`
+	Groups   []string `yaml:"groups,omitempty"`
+	Type     string   `yaml:"type,omitempty"`
+	Names    []string `yaml:"names"`
+	Actions  []string `yaml:"actions"`
+}
+
+// Policy is a set of rules. An access is permitted if any rule grants it.
+type Policy struct {
+	// Groups maps group names to the accounts they contain. Rules may also
+	// refer to groups reported by the access controller.
+	Groups map[string][]string `yaml:"groups,omitempty"`
+
+	Rules []Rule `yaml:"rules"`
+}
+
+// Parse reads a yaml or json policy from rd, validating its rules.
+func Parse(rd io.Reader) (*Policy, error) {
+	p, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	if err := yaml.Unmarshal(p, &policy); err != nil {
+		return nil, err
+	}
+
+	for i := range policy.Rules {
+		r := &policy.Rules[i]
+		if r.Type == "" {
+			r.Type = "repository"
+		}
+
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("acl: rule %d: %v", i, err)
+		}
+	}
+
+	return &policy, nil
+}
+
+// Load parses the policy file at the given path.
+func Load(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Permitted returns true if the user is granted the access by any rule. The
+// user is a member of the groups listed in the UserInfo, as well as of the
+// groups of the policy containing the user name.
+func (p *Policy) Permitted(user auth.UserInfo, access auth.Access) bool {
+	groups := append(p.groupsOf(user.Name), user.Groups...)
+
+	for _, r := range p.Rules {
+		if r.permits(user.Name, groups, access) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Policy returns the policy itself, so that a parsed policy may be used as a
+// static Source.
+func (p *Policy) Policy() *Policy {
+	return p
+}
+
+// groupsOf returns the names of the groups containing the account.
+func (p *Policy) groupsOf(account string) []string {
+	var groups []string
+	for group, members := range p.Groups {
+		for _, member := range members {
+			if member == account {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+
+	return groups
+}
+
+// Grant returns the subset of the requested access permitted for the user,
+// preserving order.
+func (p *Policy) Grant(user auth.UserInfo, requested []auth.Access) []auth.Access {
+	var granted []auth.Access
+	for _, access := range requested {
+		if p.Permitted(user, access) {
+			granted = append(granted, access)
+		}
+	}
+
+	return granted
+}
+
+func (r *Rule) validate() error {
+	if len(r.Accounts) == 0 && len(r.Groups) == 0 {
+		return fmt.Errorf("no accounts or groups")
+	}
+
+	if len(r.Names) == 0 {
+		return fmt.Errorf("no names")
+	}
+
+	for _, patterns := range [][]string{r.Accounts, r.Names} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(strings.Replace(pattern, userTemplate, "", -1), ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	for _, action := range r.Actions {
+		if action == "" {
+			return fmt.Errorf("empty action")
+		}
+	}
+
+	return nil
+}
+
+func (r *Rule) permits(account string, groups []string, access auth.Access) bool {
+	if access.Type != r.Type || !r.grants(access.Action) {
+		return false
+	}
+
+	if !match(r.Accounts, account) && !intersects(r.Groups, groups) {
+		return false
+	}
+
+	// Names are matched against the patterns with the template expanded
+	// to the account, escaped so that it only matches itself.
+	user := escape(account)
+	for _, pattern := range r.Names {
+		pattern = strings.Replace(pattern, userTemplate, user, -1)
+		if matched, _ := path.Match(pattern, access.Name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// grants returns true if the rule grants the action.
+func (r *Rule) grants(action string) bool {
+	// The "*" action on a repository is requested for deletes.
+	if action == "*" && r.Type == "repository" {
+		action = "delete"
+	}
+
+	for _, a := range r.Actions {
+		if a == action || a == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// userTemplate is replaced by the account name in name patterns.
+const userTemplate = "${user}"
+
+// escape quotes the characters of s which are special to path.Match.
+func escape(s string) string {
+	var b bytes.Buffer
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// intersects returns true if any string is in both lists.
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// match returns true if s matches any of the patterns.
+func match(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, s); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,114 @@
+package acl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/registry/auth"
+)
+
+const testPolicy = `
+groups:
+  ops: [carol, dave]
+rules:
+  - accounts: [alice, bob]
+    names: [team/*]
+    actions: [pull, push]
+  - accounts: ["*"]
+    names: [library/*]
+    actions: [pull]
+  - accounts: [alice]
+    names: [team/*]
+    actions: [delete]
+  - accounts: [admin]
+    type: registry
+    names: [catalog]
+    actions: ["*"]
+  - groups: [ops]
+    names: [team/*, infra/*]
+    actions: [pull]
+  - accounts: ["*"]
+    names: ["${user}/*"]
+    actions: [pull, push, delete]
+`
+
+func repository(name, action string) auth.Access {
+	return auth.Access{
+		Resource: auth.Resource{Type: "repository", Name: name},
+		Action:   action,
+	}
+}
+
+func TestPolicyPermitted(t *testing.T) {
+	policy, err := Parse(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("error parsing policy: %v", err)
+	}
+
+	catalog := auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}
+
+	for _, tc := range []struct {
+		account   string
+		access    auth.Access
+		permitted bool
+	}{
+		{"alice", repository("team/app", "pull"), true},
+		{"alice", repository("team/app", "push"), true},
+		{"alice", repository("team/app", "*"), true},
+		{"bob", repository("team/app", "push"), true},
+		{"bob", repository("team/app", "*"), false},
+		{"bob", repository("team/nested/app", "pull"), false},
+		{"carol", repository("team/app", "pull"), true},
+		{"carol", repository("team/app", "push"), false},
+		{"carol", repository("library/ubuntu", "pull"), true},
+		{"carol", repository("library/ubuntu", "push"), false},
+		{"erin", repository("team/app", "pull"), false},
+		{"erin", repository("erin/app", "push"), true},
+		{"erin", repository("erin/app", "*"), true},
+		{"erin", repository("alice/app", "pull"), false},
+		{"er*", repository("erin/app", "pull"), false},
+		{"er*", repository("er*/app", "pull"), true},
+		{"admin", catalog, true},
+		{"alice", catalog, false},
+		{"admin", repository("catalog", "pull"), false},
+	} {
+		if permitted := policy.Permitted(auth.UserInfo{Name: tc.account}, tc.access); permitted != tc.permitted {
+			t.Errorf("%s %v: expected permitted=%v, got %v", tc.account, tc.access, tc.permitted, permitted)
+		}
+	}
+
+	// Groups reported by the access controller are matched like those of
+	// the policy.
+	if !policy.Permitted(auth.UserInfo{Name: "frank", Groups: []string{"ops"}}, repository("infra/dns", "pull")) {
+		t.Errorf("expected reported group to be permitted")
+	}
+
+	granted := policy.Grant(auth.UserInfo{Name: "bob"}, []auth.Access{
+		repository("team/app", "pull"),
+		repository("team/app", "*"),
+		repository("library/ubuntu", "pull"),
+	})
+
+	expected := []auth.Access{
+		repository("team/app", "pull"),
+		repository("library/ubuntu", "pull"),
+	}
+
+	if !reflect.DeepEqual(granted, expected) {
+		t.Fatalf("unexpected grant: %v != %v", granted, expected)
+	}
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	for _, policy := range []string{
+		"rules: [{names: [foo], actions: [pull]}]",
+		"rules: [{accounts: [foo], actions: [pull]}]",
+		"rules: [{accounts: [foo], names: ['[foo'], actions: [pull]}]",
+		"rules: {}",
+	} {
+		if _, err := Parse(strings.NewReader(policy)); err == nil {
+			t.Errorf("expected error parsing %q", policy)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package acl
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefaultReloadInterval is the minimum time between checks of a policy file
+// for changes.
+const DefaultReloadInterval = 5 * time.Second
+
+// Source provides the current policy.
+type Source interface {
+	Policy() *Policy
+}
+
+// File is a Source backed by a policy file, which is reloaded when it
+// changes. The file is checked at most once per interval, when the policy is
+// requested. If a changed file fails to parse, the previous policy is kept.
+type File struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	policy  *Policy
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+var _ Source = &File{}
+
+// NewFile loads the policy file at path, returning an error if it cannot be
+// parsed.
+func NewFile(path string, interval time.Duration) (*File, error) {
+	f := &File{
+		path:     path,
+		interval: interval,
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.policy, err = Load(path); err != nil {
+		return nil, err
+	}
+
+	f.modTime, f.size, f.checked = fi.ModTime(), fi.Size(), time.Now()
+	return f, nil
+}
+
+// Policy returns the current policy, reloading the file if it has changed
+// since it was last loaded.
+func (f *File) Policy() *Policy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.checked) < f.interval {
+		return f.policy
+	}
+	f.checked = now
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		log.Errorf("acl: error checking policy file %s: %v", f.path, err)
+		return f.policy
+	}
+
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.policy
+	}
+
+	policy, err := Load(f.path)
+	if err != nil {
+		log.Errorf("acl: error reloading policy file %s, keeping previous policy: %v", f.path, err)
+		return f.policy
+	}
+
+	log.Infof("acl: reloaded policy file %s", f.path)
+	f.policy, f.modTime, f.size = policy, fi.ModTime(), fi.Size()
+	return f.policy
+}
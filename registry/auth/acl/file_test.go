@@ -0,0 +1,58 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/auth"
+)
+
+func TestFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.yml")
+	write := func(policy string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write("rules: [{accounts: [alice], names: [foo], actions: [pull]}]", now.Add(-time.Hour))
+
+	f, err := NewFile(path, 0)
+	if err != nil {
+		t.Fatalf("error loading policy file: %v", err)
+	}
+
+	if !f.Policy().Permitted(auth.UserInfo{Name: "alice"}, repository("foo", "pull")) {
+		t.Fatalf("expected alice to be permitted")
+	}
+
+	write("rules: [{accounts: [bob], names: [foo], actions: [pull]}]", now)
+
+	if f.Policy().Permitted(auth.UserInfo{Name: "alice"}, repository("foo", "pull")) || !f.Policy().Permitted(auth.UserInfo{Name: "bob"}, repository("foo", "pull")) {
+		t.Fatalf("expected policy to be reloaded")
+	}
+
+	// An invalid policy is ignored, keeping the previous one.
+	write("rules: [{names: [foo]}]", now.Add(time.Hour))
+
+	if !f.Policy().Permitted(auth.UserInfo{Name: "bob"}, repository("foo", "pull")) {
+		t.Fatalf("expected previous policy to be kept")
+	}
+
+	if _, err := NewFile(filepath.Join(dir, "missing.yml"), 0); err == nil {
+		t.Fatalf("expected error loading missing policy file")
+	}
+}
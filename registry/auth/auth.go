@@ -41,6 +41,10 @@ import (
 // an autenticated/authorized client.
 type UserInfo struct {
 	Name string
+
+	// Groups lists the groups of the client known to the access controller,
+	// such as the organizational units of a client certificate.
+	Groups []string
 }
 
 // Resource describes a resource by type and name.
@@ -104,6 +108,8 @@ func (uic userInfoContext) Value(key interface{}) interface{} {
 		return uic.user
 	case "auth.user.name":
 		return uic.user.Name
+	case "auth.user.groups":
+		return uic.user.Groups
 	}
 
 	return uic.Context.Value(key)
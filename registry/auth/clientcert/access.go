@@ -0,0 +1,161 @@
+// Package clientcert provides an access controller identifying clients by the
+// certificate presented during a mutual TLS handshake.
+//
+// The registry must be configured to verify client certificates, by listing
+// the accepted certificate authorities in http.tls.clientcas. The controller
+// only considers verified chains, and maps the subject of the leaf certificate
+// to the name and groups of the user. Access is granted to any identified
+// client, unless restricted with a policy.
+package clientcert
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+)
+
+var (
+	// ErrNoCertificate is returned when the request was not made with a
+	// verified client certificate.
+	ErrNoCertificate = errors.New("no verified client certificate")
+
+	// ErrNoIdentity is returned when the client certificate lacks the
+	// attribute from which the user name is taken.
+	ErrNoIdentity = errors.New("no identity in client certificate")
+)
+
+// The attributes of a certificate from which the user name may be taken.
+const (
+	attributeCommonName = "cn"
+	attributeEmail      = "email"
+	attributeDNS        = "dns"
+)
+
+// The attributes of a certificate from which groups may be taken.
+const (
+	attributeOrganizationalUnit = "ou"
+	attributeOrganization       = "o"
+	attributeNone               = "none"
+)
+
+type accessController struct {
+	userAttribute  string
+	groupAttribute string
+}
+
+var _ auth.AccessController = &accessController{}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	ac := &accessController{
+		userAttribute:  attributeCommonName,
+		groupAttribute: attributeOrganizationalUnit,
+	}
+
+	for _, optional := range []struct {
+		name    string
+		value   *string
+		allowed []string
+	}{
+		{"userattribute", &ac.userAttribute, []string{attributeCommonName, attributeEmail, attributeDNS}},
+		{"groupattribute", &ac.groupAttribute, []string{attributeOrganizationalUnit, attributeOrganization, attributeNone}},
+	} {
+		v, present := options[optional.name]
+		if !present {
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok || !contains(optional.allowed, s) {
+			return nil, fmt.Errorf("%q must be one of %v for clientcert access controller", optional.name, optional.allowed)
+		}
+		*optional.value = s
+	}
+
+	return ac, nil
+}
+
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, &challenge{err: ErrNoCertificate}
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+
+	name := ac.userName(cert)
+	if name == "" {
+		context.GetLogger(ctx).Errorf("client certificate %q has no %s", cert.Subject.CommonName, ac.userAttribute)
+		return nil, &challenge{err: ErrNoIdentity}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: name, Groups: ac.groups(cert)}), nil
+}
+
+// userName returns the user name from the configured attribute of the
+// certificate. The first subject alternative name of the type is used.
+func (ac *accessController) userName(cert *x509.Certificate) string {
+	switch ac.userAttribute {
+	case attributeEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case attributeDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
+
+// groups returns the groups from the configured attribute of the
+// certificate subject.
+func (ac *accessController) groups(cert *x509.Certificate) []string {
+	switch ac.groupAttribute {
+	case attributeOrganizationalUnit:
+		return cert.Subject.OrganizationalUnit
+	case attributeOrganization:
+		return cert.Subject.Organization
+	}
+
+	return nil
+}
+
+// challenge implements the auth.Challenge interface. There is no http
+// authentication scheme for client certificates, so no header is set.
+type challenge struct {
+	err error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders does nothing, as clients cannot be asked to present a
+// certificate after the handshake.
+func (ch challenge) SetHeaders(w http.ResponseWriter) {}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("client certificate challenge: %v", ch.err)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	auth.Register("clientcert", auth.InitFunc(newAccessController))
+}
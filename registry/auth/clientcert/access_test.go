@@ -0,0 +1,91 @@
+package clientcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+)
+
+func TestClientCertAccessController(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "bilbo",
+			Organization:       []string{"The Shire"},
+			OrganizationalUnit: []string{"hobbits", "burglars"},
+		},
+		EmailAddresses: []string{"bilbo@shire.example.com"},
+	}
+
+	authorize := func(options map[string]interface{}, state *tls.ConnectionState) (auth.UserInfo, error) {
+		ac, err := newAccessController(options)
+		if err != nil {
+			t.Fatalf("error creating access controller: %v", err)
+		}
+
+		req, err := http.NewRequest("GET", "/v2/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.TLS = state
+
+		authCtx, err := ac.Authorized(context.WithRequest(context.Background(), req))
+		if err != nil {
+			return auth.UserInfo{}, err
+		}
+
+		userInfo, ok := authCtx.Value("auth.user").(auth.UserInfo)
+		if !ok {
+			t.Fatalf("clientcert accessController did not set auth.user context")
+		}
+		return userInfo, nil
+	}
+
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	for _, tc := range []struct {
+		options map[string]interface{}
+		state   *tls.ConnectionState
+		user    auth.UserInfo
+	}{
+		{nil, verified, auth.UserInfo{Name: "bilbo", Groups: []string{"hobbits", "burglars"}}},
+		{map[string]interface{}{"userattribute": "email", "groupattribute": "o"}, verified,
+			auth.UserInfo{Name: "bilbo@shire.example.com", Groups: []string{"The Shire"}}},
+		{map[string]interface{}{"groupattribute": "none"}, verified, auth.UserInfo{Name: "bilbo"}},
+	} {
+		userInfo, err := authorize(tc.options, tc.state)
+		if err != nil {
+			t.Fatalf("unexpected error authorizing with %v: %v", tc.options, err)
+		}
+
+		if !reflect.DeepEqual(userInfo, tc.user) {
+			t.Fatalf("unexpected user with %v: %#v != %#v", tc.options, userInfo, tc.user)
+		}
+	}
+
+	// Requests without a verified certificate, or without the configured
+	// attribute, are challenged.
+	for _, tc := range []struct {
+		options map[string]interface{}
+		state   *tls.ConnectionState
+	}{
+		{nil, nil},
+		{nil, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+		{map[string]interface{}{"userattribute": "dns"}, verified},
+	} {
+		if _, err := authorize(tc.options, tc.state); err == nil {
+			t.Fatalf("expected challenge with %v", tc.options)
+		} else if _, ok := err.(auth.Challenge); !ok {
+			t.Fatalf("expected challenge with %v, got: %v", tc.options, err)
+		}
+	}
+
+	if _, err := newAccessController(map[string]interface{}{"userattribute": "serial"}); err == nil {
+		t.Fatalf("expected error with unknown user attribute")
+	}
+}
@@ -0,0 +1,246 @@
+// Package ldap provides an access controller that authenticates users with
+// basic credentials against an LDAP directory, such as Active Directory, and
+// reports their group membership.
+//
+// The controller binds with a service account to find the entry of the user,
+// then binds as the user to verify the password. The groups listed in the
+// user's group attribute (memberOf by default) are reported with the user, so
+// that an acl policy may grant access to the members of a group.
+//
+// This authentication method MUST be used under TLS, as credentials are sent
+// with every request.
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	// ErrInvalidCredential is returned when the auth token does not authenticate correctly.
+	ErrInvalidCredential = errors.New("invalid authorization credential")
+
+	// ErrAuthenticationFailure returned when authentication failure to be presented to agent.
+	ErrAuthenticationFailure = errors.New("authentication failure")
+)
+
+const (
+	defaultUserAttribute    = "uid"
+	defaultGroupAttribute   = "memberOf"
+	defaultTimeout          = 5 * time.Second
+	defaultCacheTTL         = time.Minute
+	defaultNegativeCacheTTL = 10 * time.Second
+)
+
+type accessController struct {
+	realm          string
+	url            string
+	bindDN         string
+	bindPassword   string
+	baseDN         string
+	userAttribute  string
+	groupAttribute string
+	timeout        time.Duration
+	tlsConfig      *tls.Config
+
+	cache *credentialCache
+}
+
+var _ auth.AccessController = &accessController{}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	ac := &accessController{
+		userAttribute:  defaultUserAttribute,
+		groupAttribute: defaultGroupAttribute,
+		timeout:        defaultTimeout,
+		tlsConfig:      &tls.Config{},
+	}
+
+	for _, required := range []struct {
+		name  string
+		value *string
+	}{
+		{"realm", &ac.realm},
+		{"url", &ac.url},
+		{"basedn", &ac.baseDN},
+	} {
+		v, present := options[required.name]
+		if s, ok := v.(string); !present || !ok || s == "" {
+			return nil, fmt.Errorf("%q must be set for ldap access controller", required.name)
+		}
+		*required.value = v.(string)
+	}
+
+	for _, optional := range []struct {
+		name  string
+		value *string
+	}{
+		{"binddn", &ac.bindDN},
+		{"bindpassword", &ac.bindPassword},
+		{"userattribute", &ac.userAttribute},
+		{"groupattribute", &ac.groupAttribute},
+	} {
+		if v, present := options[optional.name]; present {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%q must be a string for ldap access controller", optional.name)
+			}
+			*optional.value = s
+		}
+	}
+
+	if v, present := options["insecureskipverify"]; present {
+		insecure, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf(`"insecureskipverify" must be a boolean for ldap access controller`)
+		}
+		ac.tlsConfig.InsecureSkipVerify = insecure
+	}
+
+	var err error
+	if ac.timeout, err = durationOption(options, "timeout", defaultTimeout); err != nil {
+		return nil, err
+	}
+
+	cacheTTL, err := durationOption(options, "cachettl", defaultCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	negativeCacheTTL, err := durationOption(options, "negativecachettl", defaultNegativeCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	ac.cache = newCredentialCache(cacheTTL, negativeCacheTTL)
+
+	return ac, nil
+}
+
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok || username == "" || password == "" {
+		// An empty password would result in an anonymous bind, which most
+		// directories accept.
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   ErrInvalidCredential,
+		}
+	}
+
+	groups, err := ac.cache.lookup(username, password, func() ([]string, error) {
+		return ac.authenticate(username, password)
+	})
+	if err != nil {
+		if err != ErrAuthenticationFailure {
+			return nil, err
+		}
+
+		context.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   ErrAuthenticationFailure,
+		}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: username, Groups: groups}), nil
+}
+
+// authenticate verifies the credentials against the directory, returning the
+// groups of the user. ErrAuthenticationFailure is returned if the user does
+// not exist or the password is incorrect.
+func (ac *accessController) authenticate(username, password string) ([]string, error) {
+	conn, err := ldap.DialURL(ac.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ac.timeout}),
+		ldap.DialWithTLSConfig(ac.tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: error connecting to %s: %v", ac.url, err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(ac.timeout)
+
+	if ac.bindDN != "" {
+		if err := conn.Bind(ac.bindDN, ac.bindPassword); err != nil {
+			return nil, fmt.Errorf("ldap: error binding service account: %v", err)
+		}
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		ac.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ac.timeout/time.Second), false,
+		fmt.Sprintf("(%s=%s)", ldap.EscapeFilter(ac.userAttribute), ldap.EscapeFilter(username)),
+		[]string{ac.groupAttribute}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: error searching for user: %v", err)
+	}
+
+	if len(result.Entries) != 1 {
+		// the user is unknown or ambiguous
+		return nil, ErrAuthenticationFailure
+	}
+
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrAuthenticationFailure
+		}
+		return nil, fmt.Errorf("ldap: error binding user: %v", err)
+	}
+
+	return entry.GetEqualFoldAttributeValues(ac.groupAttribute), nil
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge: %#v", ch)
+}
+
+// durationOption parses the named option as a duration, accepting either a
+// duration string or a number of seconds.
+func durationOption(options map[string]interface{}, name string, defaultValue time.Duration) (time.Duration, error) {
+	v, present := options[name]
+	if !present {
+		return defaultValue, nil
+	}
+
+	switch v := v.(type) {
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("%q must be a duration for ldap access controller: %v", name, err)
+		}
+		return d, nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	}
+
+	return 0, fmt.Errorf("%q must be a duration for ldap access controller", name)
+}
+
+func init() {
+	auth.Register("ldap", auth.InitFunc(newAccessController))
+}
@@ -0,0 +1,373 @@
+package ldap
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/auth/acl"
+	"github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testDirectory is an in-process LDAP server stub, supporting just enough of
+// the protocol to serve simple binds and equality searches from a fixed set
+// of entries.
+type testDirectory struct {
+	ln        net.Listener
+	passwords map[string]string // maps dn to password
+	entries   []testEntry
+
+	mu    sync.Mutex
+	binds int
+}
+
+type testEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	td := &testDirectory{
+		ln: ln,
+		passwords: map[string]string{
+			"cn=registry,dc=example,dc=com":         "servicepass",
+			"uid=bilbo,ou=people,dc=example,dc=com": "baggins",
+			"uid=frodo,ou=people,dc=example,dc=com": "ring",
+		},
+		entries: []testEntry{
+			{
+				dn: "uid=bilbo,ou=people,dc=example,dc=com",
+				attributes: map[string][]string{
+					"uid":      {"bilbo"},
+					"memberOf": {"cn=developers,ou=groups,dc=example,dc=com"},
+				},
+			},
+			{
+				dn: "uid=frodo,ou=people,dc=example,dc=com",
+				attributes: map[string][]string{
+					"uid":      {"frodo"},
+					"memberOf": {"cn=admins,ou=groups,dc=example,dc=com"},
+				},
+			},
+		},
+	}
+
+	go td.serve()
+	return td
+}
+
+func (td *testDirectory) url() string {
+	return "ldap://" + td.ln.Addr().String()
+}
+
+func (td *testDirectory) bindCount() int {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	return td.binds
+}
+
+func (td *testDirectory) serve() {
+	for {
+		nc, err := td.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go td.handle(nc)
+	}
+}
+
+func (td *testDirectory) handle(nc net.Conn) {
+	defer nc.Close()
+	rd := bufio.NewReader(nc)
+
+	for {
+		msg, err := ber.ReadPacket(rd)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+
+		id := msg.Children[0].Value
+		op := msg.Children[1]
+
+		reply := func(op *ber.Packet) {
+			envelope := ber.NewSequence("")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			envelope.AppendChild(op)
+			nc.Write(envelope.Bytes())
+		}
+
+		result := func(tag ber.Tag, code uint16) *ber.Packet {
+			op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+			op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+			op.AppendChild(octetString(""))
+			op.AppendChild(octetString(""))
+			return op
+		}
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			td.mu.Lock()
+			td.binds++
+			td.mu.Unlock()
+
+			dn, password := op.Children[1].Value.(string), op.Children[2].Data.String()
+			if expected, ok := td.passwords[dn]; !ok || expected != password {
+				reply(result(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials))
+				continue
+			}
+			reply(result(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess))
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Value.(string)
+			filter := op.Children[6]
+			attr, value := filter.Children[0].Value.(string), filter.Children[1].Value.(string)
+
+			for _, e := range td.entries {
+				if !contains(e.attributes[attr], value) || !strings.HasSuffix(e.dn, base) {
+					continue
+				}
+
+				attributes := ber.NewSequence("")
+				for _, requested := range op.Children[7].Children {
+					name := requested.Value.(string)
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range e.attributes[name] {
+						values.AppendChild(octetString(v))
+					}
+
+					attribute := ber.NewSequence("")
+					attribute.AppendChild(octetString(name))
+					attribute.AppendChild(values)
+					attributes.AppendChild(attribute)
+				}
+
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(octetString(e.dn))
+				entry.AppendChild(attributes)
+				reply(entry)
+			}
+			reply(result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func octetString(s string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, "")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLDAPAccessController(t *testing.T) {
+	td := newTestDirectory(t)
+	defer td.ln.Close()
+
+	options := map[string]interface{}{
+		"realm":        "The-Shire",
+		"url":          td.url(),
+		"binddn":       "cn=registry,dc=example,dc=com",
+		"bindpassword": "servicepass",
+		"basedn":       "ou=people,dc=example,dc=com",
+	}
+
+	accessController, err := newAccessController(options)
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	for _, tc := range []struct {
+		username, password string
+		groups             []string
+	}{
+		{"", "", nil},
+		{"bilbo", "", nil},
+		{"bilbo", "wrong", nil},
+		{"gollum", "precious", nil},
+		{"bilbo", "baggins", []string{"cn=developers,ou=groups,dc=example,dc=com"}},
+		{"frodo", "ring", []string{"cn=admins,ou=groups,dc=example,dc=com"}},
+	} {
+		req, err := http.NewRequest("GET", "/v2/", nil)
+		if err != nil {
+			t.Fatalf("error allocating new request: %v", err)
+		}
+
+		if tc.username != "" {
+			req.SetBasicAuth(tc.username, tc.password)
+		}
+
+		authCtx, err := accessController.Authorized(context.WithRequest(context.Background(), req))
+		if tc.groups == nil {
+			if _, ok := err.(auth.Challenge); !ok {
+				t.Fatalf("expected challenge for %q, got: %v", tc.username, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error authorizing %q: %v", tc.username, err)
+		}
+
+		userInfo, ok := authCtx.Value("auth.user").(auth.UserInfo)
+		if !ok || userInfo.Name != tc.username {
+			t.Fatalf("ldap accessController did not set auth.user context: %#v", userInfo)
+		}
+
+		if len(userInfo.Groups) != len(tc.groups) || userInfo.Groups[0] != tc.groups[0] {
+			t.Fatalf("unexpected groups of %q: %v != %v", tc.username, userInfo.Groups, tc.groups)
+		}
+	}
+}
+
+// TestLDAPAccessControllerPolicy checks that the groups of directory users
+// are granted access by an acl policy.
+func TestLDAPAccessControllerPolicy(t *testing.T) {
+	td := newTestDirectory(t)
+	defer td.ln.Close()
+
+	ldapController, err := newAccessController(map[string]interface{}{
+		"realm":  "The-Shire",
+		"url":    td.url(),
+		"basedn": "ou=people,dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	policy, err := acl.Parse(strings.NewReader(`
+rules:
+  - groups: ["cn=developers,ou=groups,dc=example,dc=com"]
+    names: [team/*, library/*]
+    actions: [pull]
+  - groups: ["cn=developers,ou=groups,dc=example,dc=com"]
+    names: [team/*]
+    actions: [push]
+  - groups: ["cn=admins,ou=groups,dc=example,dc=com"]
+    names: ["*", "*/*", "*/*/*"]
+    actions: ["*"]
+  - groups: ["cn=admins,ou=groups,dc=example,dc=com"]
+    type: registry
+    names: [catalog]
+    actions: ["*"]
+`))
+	if err != nil {
+		t.Fatalf("error parsing policy: %v", err)
+	}
+	accessController := acl.NewAccessController(ldapController, policy)
+
+	access := func(name string, actions ...string) []auth.Access {
+		var records []auth.Access
+		for _, action := range actions {
+			records = append(records, auth.Access{
+				Resource: auth.Resource{Type: "repository", Name: name},
+				Action:   action,
+			})
+		}
+		return records
+	}
+	catalog := []auth.Access{{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}}
+
+	for _, tc := range []struct {
+		username, password string
+		access             []auth.Access
+		authorized         bool
+	}{
+		{"bilbo", "wrong", nil, false},
+		{"bilbo", "baggins", nil, true},
+		{"bilbo", "baggins", access("team/app", "pull", "push"), true},
+		{"bilbo", "baggins", access("library/ubuntu", "pull"), true},
+		{"bilbo", "baggins", access("library/ubuntu", "pull", "push"), false},
+		{"bilbo", "baggins", access("team/app", "*"), false},
+		{"bilbo", "baggins", access("team/nested/app", "pull"), false},
+		{"bilbo", "baggins", catalog, false},
+		{"frodo", "ring", access("anything/at/all", "pull", "push", "*"), true},
+		{"frodo", "ring", catalog, true},
+	} {
+		req, err := http.NewRequest("GET", "/v2/", nil)
+		if err != nil {
+			t.Fatalf("error allocating new request: %v", err)
+		}
+		req.SetBasicAuth(tc.username, tc.password)
+
+		_, err = accessController.Authorized(context.WithRequest(context.Background(), req), tc.access...)
+		if !tc.authorized {
+			if _, ok := err.(auth.Challenge); !ok {
+				t.Fatalf("expected challenge for %q with %v, got: %v", tc.username, tc.access, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error authorizing %q with %v: %v", tc.username, tc.access, err)
+		}
+	}
+}
+
+func TestLDAPAccessControllerCache(t *testing.T) {
+	td := newTestDirectory(t)
+	defer td.ln.Close()
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":            "The-Shire",
+		"url":              td.url(),
+		"basedn":           "dc=example,dc=com",
+		"cachettl":         "1h",
+		"negativecachettl": "1h",
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	authorize := func(username, password string) error {
+		req, err := http.NewRequest("GET", "/v2/", nil)
+		if err != nil {
+			t.Fatalf("error allocating new request: %v", err)
+		}
+		req.SetBasicAuth(username, password)
+
+		_, err = ac.Authorized(context.WithRequest(context.Background(), req))
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := authorize("bilbo", "baggins"); err != nil {
+			t.Fatalf("unexpected error authorizing: %v", err)
+		}
+
+		if err := authorize("bilbo", "wrong"); err == nil {
+			t.Fatalf("expected error authorizing with wrong password")
+		}
+	}
+
+	// Without a service account, each lookup binds once as the user.
+	if binds := td.bindCount(); binds != 2 {
+		t.Fatalf("expected results to be cached, directory saw %d binds", binds)
+	}
+
+	// Errors talking to the directory are not cached.
+	td.ln.Close()
+	ac.(*accessController).url = "ldap://127.0.0.1:1"
+	if err := authorize("frodo", "ring"); err == nil {
+		t.Fatalf("expected error with directory unavailable")
+	} else if _, ok := err.(auth.Challenge); ok {
+		t.Fatalf("directory errors should not result in a challenge: %v", err)
+	}
+}
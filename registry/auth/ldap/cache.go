@@ -0,0 +1,124 @@
+package ldap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// credentialCache remembers the outcome of authenticating a set of
+// credentials for a short time, limiting the load placed on the directory by
+// clients issuing many requests. Successful authentications are cached with
+// the positive ttl and failed ones with the negative ttl. Errors talking to
+// the directory are never cached.
+type credentialCache struct {
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+
+	// key is a random key, generated for each process, with which the
+	// credentials are hashed. Without it, the hashes retained in memory
+	// could be checked against guessed passwords at the cost of a single
+	// sha256 each.
+	key []byte
+
+	mu        sync.Mutex
+	entries   map[[sha256.Size]byte]cacheEntry
+	nextSweep time.Time
+}
+
+type cacheEntry struct {
+	groups  []string
+	err     error
+	expires time.Time
+}
+
+func newCredentialCache(positiveTTL, negativeTTL time.Duration) *credentialCache {
+	key := make([]byte, sha256.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		panic("ldap: error generating credential cache key: " + err.Error())
+	}
+
+	return &credentialCache{
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		key:         key,
+		entries:     make(map[[sha256.Size]byte]cacheEntry),
+	}
+}
+
+// lookup returns the cached outcome for the credentials, calling
+// authenticate on a miss. Only a keyed hash of the credentials is retained.
+func (cc *credentialCache) lookup(username, password string, authenticate func() ([]string, error)) ([]string, error) {
+	key := cc.hash(username, password)
+	now := time.Now()
+
+	cc.mu.Lock()
+	e, ok := cc.entries[key]
+	cc.mu.Unlock()
+
+	if ok && now.Before(e.expires) {
+		return e.groups, e.err
+	}
+
+	groups, err := authenticate()
+
+	var ttl time.Duration
+	switch err {
+	case nil:
+		ttl = cc.positiveTTL
+	case ErrAuthenticationFailure:
+		ttl = cc.negativeTTL
+	default:
+		return nil, err
+	}
+
+	if ttl > 0 {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+
+		cc.sweep(now)
+		cc.entries[key] = cacheEntry{
+			groups:  groups,
+			err:     err,
+			expires: now.Add(ttl),
+		}
+	}
+
+	return groups, err
+}
+
+// hash returns the keyed hash identifying the credentials.
+func (cc *credentialCache) hash(username, password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, cc.key)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+
+	var sum [sha256.Size]byte
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+// sweep removes expired entries. The entries are scanned at most once per
+// the longest ttl, so that the cost of a scan is spread over the entries
+// inserted since the previous one, while expired entries are dropped within
+// twice their ttl. The caller must hold the lock.
+func (cc *credentialCache) sweep(now time.Time) {
+	if now.Before(cc.nextSweep) {
+		return
+	}
+
+	for key, e := range cc.entries {
+		if !now.Before(e.expires) {
+			delete(cc.entries, key)
+		}
+	}
+
+	interval := cc.positiveTTL
+	if cc.negativeTTL > interval {
+		interval = cc.negativeTTL
+	}
+	cc.nextSweep = now.Add(interval)
+}
@@ -0,0 +1,50 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCredentialCacheKey(t *testing.T) {
+	a := newCredentialCache(time.Minute, time.Minute)
+	b := newCredentialCache(time.Minute, time.Minute)
+
+	if a.hash("bilbo", "baggins") != a.hash("bilbo", "baggins") {
+		t.Fatalf("expected the same credentials to hash alike")
+	}
+
+	if a.hash("bilbo", "baggins") == a.hash("bilbo", "wrong") {
+		t.Fatalf("expected different passwords to hash differently")
+	}
+
+	if a.hash("bilbo", "baggins") == b.hash("bilbo", "baggins") {
+		t.Fatalf("expected caches to hash with different keys")
+	}
+}
+
+func TestCredentialCacheSweep(t *testing.T) {
+	cc := newCredentialCache(time.Hour, time.Hour)
+	authenticate := func() ([]string, error) { return nil, nil }
+
+	now := time.Now()
+	cc.sweep(now)
+
+	// Entries inserted between sweeps are left alone, even if expired.
+	for _, username := range []string{"bilbo", "frodo", "sam"} {
+		cc.lookup(username, "password", authenticate)
+	}
+	for key, e := range cc.entries {
+		e.expires = now
+		cc.entries[key] = e
+	}
+
+	cc.sweep(now.Add(time.Minute))
+	if len(cc.entries) != 3 {
+		t.Fatalf("unexpected sweep before the interval: %d entries", len(cc.entries))
+	}
+
+	cc.sweep(now.Add(time.Hour))
+	if len(cc.entries) != 0 {
+		t.Fatalf("expected expired entries to be swept: %d entries", len(cc.entries))
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/registry/auth"
@@ -71,6 +72,7 @@ func (s accessSet) scopeParam() string {
 var (
 	ErrInsufficientScope = errors.New("insufficient scope")
 	ErrTokenRequired     = errors.New("authorization token required")
+	ErrTokenRevoked      = errors.New("token revoked")
 )
 
 // authChallenge implements the auth.Challenge interface.
@@ -103,7 +105,7 @@ func (ac authChallenge) challengeParams() string {
 		str = fmt.Sprintf("%s,scope=%q", str, scope)
 	}
 
-	if ac.err == ErrInvalidToken || ac.err == ErrMalformedToken {
+	if ac.err == ErrInvalidToken || ac.err == ErrMalformedToken || ac.err == ErrTokenRevoked {
 		str = fmt.Sprintf("%s,error=%q", str, "invalid_token")
 	} else if ac.err == ErrInsufficientScope {
 		str = fmt.Sprintf("%s,error=%q", str, "insufficient_scope")
@@ -124,6 +126,11 @@ type accessController struct {
 	service     string
 	rootCerts   *x509.CertPool
 	trustedKeys map[string]libtrust.PublicKey
+
+	revocations  []revocationList
+	introspector *introspector
+
+	jwks *jwksKeySet
 }
 
 // tokenAccessOptions is a convenience type for handling
@@ -133,6 +140,7 @@ type tokenAccessOptions struct {
 	issuer         string
 	service        string
 	rootCertBundle string
+	jwks           string
 }
 
 // checkOptions gathers the necessary options
@@ -140,11 +148,15 @@ type tokenAccessOptions struct {
 func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 	var opts tokenAccessOptions
 
+	// The root certificate bundle may be omitted if the signing keys are
+	// provided as a JSON Web Key Set.
+	opts.jwks, _ = options["jwks"].(string)
+
 	keys := []string{"realm", "issuer", "service", "rootcertbundle"}
 	vals := make([]string, 0, len(keys))
 	for _, key := range keys {
 		val, ok := options[key].(string)
-		if !ok {
+		if !ok && !(key == "rootcertbundle" && opts.jwks != "") {
 			return opts, fmt.Errorf("token auth requires a valid option string: %q", key)
 		}
 		vals = append(vals, val)
@@ -162,15 +174,18 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		return nil, err
 	}
 
-	fp, err := os.Open(config.rootCertBundle)
-	if err != nil {
-		return nil, fmt.Errorf("unable to open token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
-	}
-	defer fp.Close()
+	var rawCertBundle []byte
+	if config.rootCertBundle != "" {
+		fp, err := os.Open(config.rootCertBundle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
+		}
+		defer fp.Close()
 
-	rawCertBundle, err := ioutil.ReadAll(fp)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
+		rawCertBundle, err = ioutil.ReadAll(fp)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
+		}
 	}
 
 	var rootCerts []*x509.Certificate
@@ -186,7 +201,7 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		pemBlock, rawCertBundle = pem.Decode(rawCertBundle)
 	}
 
-	if len(rootCerts) == 0 {
+	if len(rootCerts) == 0 && config.jwks == "" {
 		return nil, errors.New("token auth requires at least one token signing root certificate")
 	}
 
@@ -201,13 +216,188 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		trustedKeys[pubKey.KeyID()] = pubKey
 	}
 
-	return &accessController{
+	ac := &accessController{
 		realm:       config.realm,
 		issuer:      config.issuer,
 		service:     config.service,
 		rootCerts:   rootPool,
 		trustedKeys: trustedKeys,
-	}, nil
+	}
+
+	if config.jwks != "" {
+		refresh, err := durationOption(options, "jwksrefresh", defaultJWKSRefreshInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		grace, err := durationOption(options, "jwksgraceperiod", defaultJWKSGracePeriod)
+		if err != nil {
+			return nil, err
+		}
+
+		if ac.jwks, err = newJWKSKeySet(config.jwks, refresh, grace); err != nil {
+			return nil, fmt.Errorf("unable to load token auth jwks %q: %s", config.jwks, err)
+		}
+	}
+
+	if err := ac.configureRevocation(options); err != nil {
+		return nil, err
+	}
+
+	return ac, nil
+}
+
+// currentTrustedKeys returns the keys trusted to sign tokens: the keys of the
+// root certificates, along with the current keys of the jwks, if configured.
+// The keys of the root certificates take precedence over jwks keys with the
+// same kid.
+func (ac *accessController) currentTrustedKeys() map[string]libtrust.PublicKey {
+	if ac.jwks == nil {
+		return ac.trustedKeys
+	}
+
+	trustedKeys := make(map[string]libtrust.PublicKey, len(ac.trustedKeys))
+	for kid, key := range ac.trustedKeys {
+		trustedKeys[kid] = key
+	}
+	ac.jwks.addTo(trustedKeys)
+
+	return trustedKeys
+}
+
+// configureRevocation sets up the optional revocation lists and token
+// introspection from the "revocation" and "introspection" options.
+func (ac *accessController) configureRevocation(options map[string]interface{}) error {
+	revocation, err := subOptions(options, "revocation")
+	if err != nil {
+		return err
+	}
+
+	if path, ok := revocation["file"].(string); ok && path != "" {
+		interval, err := durationOption(revocation, "reloadinterval", defaultRevocationReloadInterval)
+		if err != nil {
+			return err
+		}
+
+		list, err := newFileRevocationList(path, interval)
+		if err != nil {
+			return fmt.Errorf("unable to load token auth revocation file %q: %s", path, err)
+		}
+		ac.revocations = append(ac.revocations, list)
+	}
+
+	redisOptions, err := subOptions(revocation, "redis")
+	if err != nil {
+		return err
+	}
+
+	if addr, ok := redisOptions["addr"].(string); ok && addr != "" {
+		password, _ := redisOptions["password"].(string)
+		db, _ := redisOptions["db"].(int)
+		prefix, ok := redisOptions["keyprefix"].(string)
+		if !ok {
+			prefix = "revoked::"
+		}
+		ac.revocations = append(ac.revocations, newRedisRevocationList(addr, password, db, prefix))
+	}
+
+	introspection, err := subOptions(options, "introspection")
+	if err != nil {
+		return err
+	}
+
+	if introspectionURL, ok := introspection["url"].(string); ok && introspectionURL != "" {
+		clientID, _ := introspection["clientid"].(string)
+		clientSecret, _ := introspection["clientsecret"].(string)
+		failOpen, _ := introspection["failopen"].(bool)
+
+		cacheTTL, err := durationOption(introspection, "cachettl", defaultIntrospectionCacheTTL)
+		if err != nil {
+			return err
+		}
+
+		timeout, err := durationOption(introspection, "timeout", defaultIntrospectionTimeout)
+		if err != nil {
+			return err
+		}
+
+		ac.introspector = newIntrospector(introspectionURL, clientID, clientSecret, cacheTTL, timeout, failOpen)
+	}
+
+	return nil
+}
+
+// checkRevoked returns ErrTokenRevoked if the verified token has been
+// revoked, either by its JWT ID appearing in a revocation list or by the
+// issuer reporting it inactive. Other errors indicate that revocation could
+// not be checked.
+func (ac *accessController) checkRevoked(token *Token, rawToken string) error {
+	if token.Claims.JWTID != "" {
+		for _, list := range ac.revocations {
+			revoked, err := list.revoked(token.Claims.JWTID)
+			if err != nil {
+				return err
+			}
+
+			if revoked {
+				return ErrTokenRevoked
+			}
+		}
+	}
+
+	if ac.introspector != nil {
+		active, err := ac.introspector.active(rawToken, time.Unix(token.Claims.Expiration, 0))
+		if err != nil {
+			return err
+		}
+
+		if !active {
+			return ErrTokenRevoked
+		}
+	}
+
+	return nil
+}
+
+// subOptions returns the named map of options, decoded from yaml or json.
+func subOptions(options map[string]interface{}, name string) (map[string]interface{}, error) {
+	switch v := options[name].(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("token auth option %q has invalid key %v", name, k)
+			}
+			m[key] = value
+		}
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("token auth option %q must be a map", name)
+}
+
+// durationOption parses the named option as a duration, accepting either a
+// duration string or a number of seconds.
+func durationOption(options map[string]interface{}, name string, defaultValue time.Duration) (time.Duration, error) {
+	switch v := options[name].(type) {
+	case nil:
+		return defaultValue, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("token auth option %q must be a duration: %v", name, err)
+		}
+		return d, nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	}
+
+	return 0, fmt.Errorf("token auth option %q must be a duration", name)
 }
 
 // Authorized handles checking whether the given request is authorized
@@ -243,7 +433,7 @@ func (ac *accessController) Authorized(ctx context.Context, accessItems ...auth.
 		TrustedIssuers:    []string{ac.issuer},
 		AcceptedAudiences: []string{ac.service},
 		Roots:             ac.rootCerts,
-		TrustedKeys:       ac.trustedKeys,
+		TrustedKeys:       ac.currentTrustedKeys(),
 	}
 
 	if err = token.Verify(verifyOpts); err != nil {
@@ -251,6 +441,16 @@ func (ac *accessController) Authorized(ctx context.Context, accessItems ...auth.
 		return nil, challenge
 	}
 
+	if err = ac.checkRevoked(token, rawToken); err != nil {
+		if err != ErrTokenRevoked {
+			return nil, err
+		}
+
+		context.GetLogger(ctx).Errorf("revoked token %q used by %q", token.Claims.JWTID, token.Claims.Subject)
+		challenge.err = err
+		return nil, challenge
+	}
+
 	accessSet := token.accessSet()
 	for _, access := range accessItems {
 		if !accessSet.contains(access) {
@@ -262,6 +462,14 @@ func (ac *accessController) Authorized(ctx context.Context, accessItems ...auth.
 	return auth.WithUser(ctx, auth.UserInfo{Name: token.Claims.Subject}), nil
 }
 
+// Close stops refreshing the jwks, if configured.
+func (ac *accessController) Close() error {
+	if ac.jwks != nil {
+		ac.jwks.Stop()
+	}
+	return nil
+}
+
 // init handles registering the token auth backend.
 func init() {
 	auth.Register("token", auth.InitFunc(newAccessController))
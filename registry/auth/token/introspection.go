@@ -0,0 +1,131 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultIntrospectionCacheTTL = 30 * time.Second
+	defaultIntrospectionTimeout  = 5 * time.Second
+)
+
+// introspector asks the token issuer whether a token is still active, using
+// OAuth 2.0 token introspection (RFC 7662). Results are cached for the cache
+// ttl, but never past the expiration of the token.
+type introspector struct {
+	url          string
+	clientID     string
+	clientSecret string
+	cacheTTL     time.Duration
+	failOpen     bool
+	client       *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspectionResult
+}
+
+type introspectionResult struct {
+	active  bool
+	expires time.Time
+}
+
+func newIntrospector(url, clientID, clientSecret string, cacheTTL, timeout time.Duration, failOpen bool) *introspector {
+	return &introspector{
+		url:          url,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		cacheTTL:     cacheTTL,
+		failOpen:     failOpen,
+		client:       &http.Client{Timeout: timeout},
+		cache:        make(map[[sha256.Size]byte]introspectionResult),
+	}
+}
+
+// active returns true if the issuer reports the raw token as active. If the
+// issuer cannot be reached, the token is considered active only when failing
+// open, and an error is returned otherwise.
+func (i *introspector) active(rawToken string, expiration time.Time) (bool, error) {
+	key := sha256.Sum256([]byte(rawToken))
+	now := time.Now()
+
+	i.mu.Lock()
+	result, ok := i.cache[key]
+	i.mu.Unlock()
+
+	if ok && now.Before(result.expires) {
+		return result.active, nil
+	}
+
+	active, err := i.introspect(rawToken)
+	if err != nil {
+		if i.failOpen {
+			log.Warnf("accepting token without introspection: %v", err)
+			return true, nil
+		}
+		return false, err
+	}
+
+	expires := now.Add(i.cacheTTL)
+	if expiration.Before(expires) {
+		expires = expiration
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for k, r := range i.cache {
+		if !now.Before(r.expires) {
+			delete(i.cache, k)
+		}
+	}
+	i.cache[key] = introspectionResult{active: active, expires: expires}
+
+	return active, nil
+}
+
+// introspect makes the introspection request for the raw token.
+func (i *introspector) introspect(rawToken string) (bool, error) {
+	form := url.Values{
+		"token":           {rawToken},
+		"token_type_hint": {"access_token"},
+	}
+
+	req, err := http.NewRequest("POST", i.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if i.clientID != "" {
+		req.SetBasicAuth(i.clientID, i.clientSecret)
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("token: error introspecting token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("token: unexpected status introspecting token: %s", resp.Status)
+	}
+
+	var body struct {
+		Active bool `json:"active"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, fmt.Errorf("token: error decoding introspection response: %v", err)
+	}
+
+	return body.Active, nil
+}
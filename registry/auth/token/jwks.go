@@ -0,0 +1,276 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libtrust"
+)
+
+const (
+	defaultJWKSRefreshInterval = 5 * time.Minute
+	defaultJWKSGracePeriod     = time.Hour
+)
+
+// jwksKeySet holds the signing keys published by the token issuer as a JSON
+// Web Key Set, identified by their "kid". The set is loaded from a url or a
+// local file and refreshed periodically. Keys removed from the set remain
+// trusted for a grace period, so that tokens signed just before a rotation
+// are still accepted.
+type jwksKeySet struct {
+	source string
+	grace  time.Duration
+	client *http.Client
+
+	mu      sync.RWMutex
+	keys    map[string]libtrust.PublicKey
+	retired map[string]retiredKey
+
+	// stop is closed to stop refreshing the set
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// retiredKey is a key no longer published, trusted until the given time.
+type retiredKey struct {
+	key   libtrust.PublicKey
+	until time.Time
+}
+
+// newJWKSKeySet loads the key set from source, returning an error if it
+// cannot be loaded. If the refresh interval is positive, the set is reloaded
+// in the background at that interval.
+func newJWKSKeySet(source string, refresh, grace time.Duration) (*jwksKeySet, error) {
+	ks := &jwksKeySet{
+		source:  source,
+		grace:   grace,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		retired: make(map[string]retiredKey),
+		stop:    make(chan struct{}),
+	}
+
+	if err := ks.refresh(); err != nil {
+		return nil, err
+	}
+
+	if refresh > 0 {
+		go ks.refreshEvery(refresh)
+	}
+
+	return ks, nil
+}
+
+// refreshEvery reloads the key set at the given interval, until stopped.
+func (ks *jwksKeySet) refreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ks.refresh(); err != nil {
+				log.Errorf("token: error refreshing jwks from %s, keeping previous keys: %v", ks.source, err)
+			}
+		case <-ks.stop:
+			return
+		}
+	}
+}
+
+// Stop stops refreshing the key set. The keys loaded remain trusted.
+func (ks *jwksKeySet) Stop() {
+	ks.stopOnce.Do(func() {
+		close(ks.stop)
+	})
+}
+
+// refresh reloads the key set, retiring keys that are no longer published.
+func (ks *jwksKeySet) refresh() error {
+	p, err := ks.fetch()
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(p)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for kid, key := range ks.keys {
+		if _, ok := keys[kid]; !ok {
+			ks.retired[kid] = retiredKey{key: key, until: now.Add(ks.grace)}
+		}
+	}
+
+	for kid, rk := range ks.retired {
+		if _, ok := keys[kid]; ok || !now.Before(rk.until) {
+			delete(ks.retired, kid)
+		}
+	}
+
+	ks.keys = keys
+	return nil
+}
+
+// fetch reads the raw key set from the url or file.
+func (ks *jwksKeySet) fetch() ([]byte, error) {
+	if !strings.HasPrefix(ks.source, "http://") && !strings.HasPrefix(ks.source, "https://") {
+		return ioutil.ReadFile(ks.source)
+	}
+
+	resp, err := ks.client.Get(ks.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching jwks: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// addTo adds the trusted keys of the set, including retired keys still
+// within their grace period, to the given map. Keys already in the map are
+// kept, so that a key of the set cannot replace a key trusted otherwise,
+// such as the key of a root certificate, by publishing the same kid.
+func (ks *jwksKeySet) addTo(trustedKeys map[string]libtrust.PublicKey) {
+	now := time.Now()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for kid, key := range ks.keys {
+		if _, ok := trustedKeys[kid]; !ok {
+			trustedKeys[kid] = key
+		}
+	}
+
+	for kid, rk := range ks.retired {
+		if _, ok := trustedKeys[kid]; !ok && now.Before(rk.until) {
+			trustedKeys[kid] = rk.key
+		}
+	}
+}
+
+// jsonWebKey holds the fields of a JSON Web Key (RFC 7517) used for RSA and
+// EC signing keys.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+// parseJWKS parses a JSON Web Key Set, returning the RS256 and ES256 signing
+// keys by "kid". Keys meant for encryption or other algorithms are skipped.
+func parseJWKS(p []byte) (map[string]libtrust.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(p, &set); err != nil {
+		return nil, fmt.Errorf("unable to decode jwks: %v", err)
+	}
+
+	keys := make(map[string]libtrust.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.KeyID == "" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode jwk %q: %v", jwk.KeyID, err)
+		}
+
+		if key != nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RS256 or ES256 signing keys in jwks")
+	}
+
+	return keys, nil
+}
+
+// publicKey returns the key, or nil if it is not an RS256 or ES256 key.
+func (jwk *jsonWebKey) publicKey() (libtrust.PublicKey, error) {
+	switch {
+	case jwk.KeyType == "RSA" && (jwk.Algorithm == "" || jwk.Algorithm == "RS256"):
+		n, err := joseBase64UrlDecode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := joseBase64UrlDecode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(e) == 0 || len(e) > 3 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+
+		var exponent int
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+
+		return libtrust.FromCryptoPublicKey(&rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: exponent,
+		})
+	case jwk.KeyType == "EC" && jwk.Curve == "P-256" && (jwk.Algorithm == "" || jwk.Algorithm == "ES256"):
+		x, err := joseBase64UrlDecode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := joseBase64UrlDecode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("point is not on curve")
+		}
+
+		return libtrust.FromCryptoPublicKey(pub)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,337 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/libtrust"
+)
+
+// makeJWK returns the JSON Web Key for the public part of the given key.
+func makeJWK(kid string, key libtrust.PrivateKey) map[string]string {
+	switch pub := key.PublicKey().CryptoPublicKey().(type) {
+	case *ecdsa.PublicKey:
+		return map[string]string{
+			"kty": "EC",
+			"kid": kid,
+			"crv": "P-256",
+			"x":   joseBase64UrlEncode(padBytes(pub.X, 32)),
+			"y":   joseBase64UrlEncode(padBytes(pub.Y, 32)),
+		}
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   joseBase64UrlEncode(pub.N.Bytes()),
+			"e":   joseBase64UrlEncode(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	}
+	return nil
+}
+
+func padBytes(i *big.Int, size int) []byte {
+	p := i.Bytes()
+	return append(make([]byte, size-len(p)), p...)
+}
+
+// makeKidToken returns a raw token signed by key, identified by kid.
+func makeKidToken(issuer, audience, kid string, key libtrust.PrivateKey, access []*ResourceActions) (string, error) {
+	_, alg, err := key.Sign(strings.NewReader(""), crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(&Header{Type: "JWT", SigningAlg: alg, KeyID: kid})
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims, err := json.Marshal(&ClaimSet{
+		Issuer:     issuer,
+		Subject:    "foo",
+		Audience:   audience,
+		Expiration: now.Add(5 * time.Minute).Unix(),
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		JWTID:      kid + "-token",
+		Access:     access,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := joseBase64UrlEncode(header) + "." + joseBase64UrlEncode(claims)
+	signature, _, err := key.Sign(strings.NewReader(payload), crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	return payload + "." + joseBase64UrlEncode(signature), nil
+}
+
+func TestJWKSAccessController(t *testing.T) {
+	ecKey, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := libtrust.GenerateRSA2048PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu   sync.Mutex
+		jwks []map[string]string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": jwks})
+	}))
+	defer server.Close()
+
+	jwks = []map[string]string{
+		makeJWK("ec-1", ecKey),
+		makeJWK("rsa-1", rsaKey),
+		{"kty": "RSA", "kid": "enc-1", "use": "enc"},
+	}
+
+	issuer := "test-issuer.example.com"
+	service := "test-service.example.com"
+
+	accessController, err := newAccessController(map[string]interface{}{
+		"realm":       "https://auth.example.com/token/",
+		"issuer":      issuer,
+		"service":     service,
+		"jwks":        server.URL,
+		"jwksrefresh": "0s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testAccess := auth.Access{
+		Resource: auth.Resource{Type: "repository", Name: "foo/bar"},
+		Action:   "pull",
+	}
+	resourceActions := []*ResourceActions{{
+		Type:    testAccess.Type,
+		Name:    testAccess.Name,
+		Actions: []string{testAccess.Action},
+	}}
+
+	authorize := func(kid string, key libtrust.PrivateKey) error {
+		rawToken, err := makeKidToken(issuer, service, kid, key, resourceActions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "http://example.com/v2/foo/bar/manifests/latest", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", rawToken))
+
+		_, err = accessController.Authorized(context.WithRequest(context.Background(), req), testAccess)
+		return err
+	}
+
+	for _, kid := range []string{"ec-1", "rsa-1"} {
+		key := ecKey
+		if kid == "rsa-1" {
+			key = rsaKey
+		}
+		if err := authorize(kid, key); err != nil {
+			t.Fatalf("unexpected error authorizing token signed with %s: %v", kid, err)
+		}
+	}
+
+	// A token signed with a key from the set, but naming another key, is
+	// rejected.
+	if err := authorize("rsa-1", ecKey); err == nil {
+		t.Fatalf("expected token with mismatched kid to be rejected")
+	}
+
+	if err := authorize("unknown", ecKey); err == nil {
+		t.Fatalf("expected token with unknown kid to be rejected")
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	writeJWKS := func(keys ...map[string]string) {
+		p, err := json.Marshal(map[string]interface{}{"keys": keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(f.Name(), p, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trusted := func(ks *jwksKeySet) map[string]libtrust.PublicKey {
+		keys := make(map[string]libtrust.PublicKey)
+		ks.addTo(keys)
+		return keys
+	}
+
+	for _, grace := range []time.Duration{time.Hour, 0} {
+		writeJWKS(makeJWK("old", oldKey))
+
+		ks, err := newJWKSKeySet(f.Name(), 0, grace)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := trusted(ks)["old"]; !ok {
+			t.Fatalf("expected old key to be trusted")
+		}
+
+		writeJWKS(makeJWK("new", newKey))
+		if err := ks.refresh(); err != nil {
+			t.Fatal(err)
+		}
+
+		keys := trusted(ks)
+		if _, ok := keys["new"]; !ok {
+			t.Fatalf("expected new key to be trusted")
+		}
+
+		if _, ok := keys["old"]; ok != (grace > 0) {
+			t.Fatalf("unexpected trust of old key with grace period %v: %v", grace, ok)
+		}
+
+		// A key set that cannot be parsed leaves the trusted keys unchanged.
+		writeJWKS()
+		if err := ks.refresh(); err == nil {
+			t.Fatalf("expected error refreshing empty key set")
+		}
+
+		if _, ok := trusted(ks)["new"]; !ok {
+			t.Fatalf("expected new key to still be trusted")
+		}
+	}
+}
+
+// TestJWKSKidCollision checks that a key of the set cannot replace a trusted
+// key with the same kid, such as the key of a root certificate.
+func TestJWKSKidCollision(t *testing.T) {
+	rootKey, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	kid := rootKey.KeyID()
+	if err := json.NewEncoder(f).Encode(map[string]interface{}{
+		"keys": []map[string]string{makeJWK(kid, otherKey), makeJWK("other", otherKey)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	ks, err := newJWKSKeySet(f.Name(), 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]libtrust.PublicKey{kid: rootKey.PublicKey()}
+	ks.addTo(keys)
+
+	if keys[kid].KeyID() != rootKey.KeyID() {
+		t.Fatalf("expected root key to be kept for kid %s", kid)
+	}
+	if _, ok := keys["other"]; !ok {
+		t.Fatalf("expected other key to be trusted")
+	}
+}
+
+// TestJWKSStop checks that the key set is no longer refreshed once stopped.
+func TestJWKSStop(t *testing.T) {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		fetches int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{makeJWK("key", key)}})
+	}))
+	defer server.Close()
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+
+	ks, err := newJWKSKeySet(server.URL, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for count() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ks.Stop()
+	ks.Stop()
+	time.Sleep(10 * time.Millisecond)
+
+	stopped := count()
+	time.Sleep(20 * time.Millisecond)
+	if count() != stopped {
+		t.Fatalf("key set refreshed after being stopped: %d != %d", count(), stopped)
+	}
+}
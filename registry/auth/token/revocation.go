@@ -0,0 +1,160 @@
+package token
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+const defaultRevocationReloadInterval = 30 * time.Second
+
+// revocationList reports whether a token has been revoked, given its JWT ID.
+type revocationList interface {
+	revoked(jti string) (bool, error)
+}
+
+// fileRevocationList is a deny-list of JWT IDs read from a file, with one ID
+// per line. Blank lines and lines starting with "#" are ignored. The file is
+// reloaded when it changes, checking at most once per interval. If the file
+// cannot be read, the previous list is kept.
+type fileRevocationList struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	ids     map[string]struct{}
+	modTime time.Time
+	checked time.Time
+}
+
+func newFileRevocationList(path string, interval time.Duration) (*fileRevocationList, error) {
+	l := &fileRevocationList{
+		path:     path,
+		interval: interval,
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.ids, err = readRevocationFile(path); err != nil {
+		return nil, err
+	}
+
+	l.modTime, l.checked = fi.ModTime(), time.Now()
+	return l, nil
+}
+
+func (l *fileRevocationList) revoked(jti string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now := time.Now(); now.Sub(l.checked) >= l.interval {
+		l.checked = now
+		l.reload()
+	}
+
+	_, revoked := l.ids[jti]
+	return revoked, nil
+}
+
+// reload reads the file again if it has changed. The caller must hold the
+// lock.
+func (l *fileRevocationList) reload() {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		log.Errorf("token: error checking revocation file %s: %v", l.path, err)
+		return
+	}
+
+	if fi.ModTime().Equal(l.modTime) {
+		return
+	}
+
+	ids, err := readRevocationFile(l.path)
+	if err != nil {
+		log.Errorf("token: error reloading revocation file %s, keeping previous list: %v", l.path, err)
+		return
+	}
+
+	l.ids, l.modTime = ids, fi.ModTime()
+}
+
+func readRevocationFile(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[line] = struct{}{}
+	}
+
+	return ids, scanner.Err()
+}
+
+// redisRevocationList checks for a key named after the JWT ID in redis. Keys
+// are expected to be set with an expiry matching that of the revoked token,
+// so that the list does not grow without bound.
+type redisRevocationList struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+func newRedisRevocationList(addr, password string, db int, prefix string) *redisRevocationList {
+	return &redisRevocationList{
+		prefix: prefix,
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				conn, err := redis.DialTimeout("tcp", addr, 5*time.Second, time.Second, time.Second)
+				if err != nil {
+					return nil, err
+				}
+
+				if password != "" {
+					if _, err := conn.Do("AUTH", password); err != nil {
+						conn.Close()
+						return nil, err
+					}
+				}
+
+				if db != 0 {
+					if _, err := conn.Do("SELECT", db); err != nil {
+						conn.Close()
+						return nil, err
+					}
+				}
+
+				return conn, nil
+			},
+			MaxIdle:     4,
+			IdleTimeout: time.Minute,
+		},
+	}
+}
+
+func (l *redisRevocationList) revoked(jti string) (bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	revoked, err := redis.Bool(conn.Do("EXISTS", l.prefix+jti))
+	if err != nil {
+		return false, fmt.Errorf("token: error checking revocation of %q: %v", jti, err)
+	}
+
+	return revoked, nil
+}
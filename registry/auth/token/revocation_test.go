@@ -0,0 +1,215 @@
+package token
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// setupRevocationTest creates a token access controller with the given extra
+// options, along with a valid token and a function authorizing a request
+// presenting it.
+func setupRevocationTest(t *testing.T, extra map[string]interface{}) (*Token, func() error) {
+	rootKeys, err := makeRootKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootCertBundleFilename, err := writeTempRootCerts(rootKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(rootCertBundleFilename)
+
+	issuer := "test-issuer.example.com"
+	service := "test-service.example.com"
+
+	options := map[string]interface{}{
+		"realm":          "https://auth.example.com/token/",
+		"issuer":         issuer,
+		"service":        service,
+		"rootcertbundle": rootCertBundleFilename,
+	}
+	for k, v := range extra {
+		options[k] = v
+	}
+
+	accessController, err := newAccessController(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testAccess := auth.Access{
+		Resource: auth.Resource{Type: "repository", Name: "foo/bar"},
+		Action:   "pull",
+	}
+
+	token, err := makeTestToken(issuer, service, []*ResourceActions{{
+		Type:    testAccess.Type,
+		Name:    testAccess.Name,
+		Actions: []string{testAccess.Action},
+	}}, rootKeys[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func() error {
+		req, err := http.NewRequest("GET", "http://example.com/v2/foo/bar/manifests/latest", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.compactRaw()))
+
+		_, err = accessController.Authorized(context.WithRequest(context.Background(), req), testAccess)
+		return err
+	}
+
+	return token, authorize
+}
+
+func TestRevocationFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "revoked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	token, authorize := setupRevocationTest(t, map[string]interface{}{
+		"revocation": map[interface{}]interface{}{
+			"file":           f.Name(),
+			"reloadinterval": "0s",
+		},
+	})
+
+	if err := authorize(); err != nil {
+		t.Fatalf("unexpected error authorizing token: %v", err)
+	}
+
+	contents := fmt.Sprintf("# revoked tokens\nsome-other-id\n%s\n", token.Claims.JWTID)
+	if err := ioutil.WriteFile(f.Name(), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(f.Name(), future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	err = authorize()
+	if challenge, ok := err.(auth.Challenge); !ok || challenge.Error() != ErrTokenRevoked.Error() {
+		t.Fatalf("expected revoked token challenge, got: %v", err)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		active   = true
+		failing  = false
+		requests = 0
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+
+		if username, password, ok := r.BasicAuth(); !ok || username != "registry" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if failing || r.PostFormValue("token") == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintf(w, `{"active": %v}`, active)
+	}))
+	defer server.Close()
+
+	set := func(a, f bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		active, failing = a, f
+	}
+
+	for _, failOpen := range []bool{false, true} {
+		_, authorize := setupRevocationTest(t, map[string]interface{}{
+			"introspection": map[interface{}]interface{}{
+				"url":          server.URL,
+				"clientid":     "registry",
+				"clientsecret": "secret",
+				"cachettl":     "1h",
+				"failopen":     failOpen,
+			},
+		})
+
+		set(true, true)
+		err := authorize()
+		if failOpen && err != nil {
+			t.Fatalf("expected token to be accepted when failing open: %v", err)
+		}
+		if !failOpen {
+			if err == nil {
+				t.Fatalf("expected error when failing closed")
+			} else if _, ok := err.(auth.Challenge); ok {
+				t.Fatalf("introspection errors should not result in a challenge: %v", err)
+			}
+		}
+	}
+
+	_, authorize := setupRevocationTest(t, map[string]interface{}{
+		"introspection": map[interface{}]interface{}{
+			"url":          server.URL,
+			"clientid":     "registry",
+			"clientsecret": "secret",
+			"cachettl":     "1h",
+		},
+	})
+
+	set(true, false)
+	mu.Lock()
+	requests = 0
+	mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		if err := authorize(); err != nil {
+			t.Fatalf("unexpected error authorizing active token: %v", err)
+		}
+	}
+
+	// The result is cached, so revoking the token at the issuer is only
+	// noticed once the cache entry expires.
+	set(false, false)
+	if err := authorize(); err != nil {
+		t.Fatalf("expected cached result to be used: %v", err)
+	}
+
+	mu.Lock()
+	if requests != 1 {
+		t.Fatalf("expected a single introspection request, got %d", requests)
+	}
+	mu.Unlock()
+
+	_, authorize = setupRevocationTest(t, map[string]interface{}{
+		"introspection": map[interface{}]interface{}{
+			"url":          server.URL,
+			"clientid":     "registry",
+			"clientsecret": "secret",
+		},
+	})
+
+	err := authorize()
+	if challenge, ok := err.(auth.Challenge); !ok || challenge.Error() != ErrTokenRevoked.Error() {
+		t.Fatalf("expected revoked token challenge for inactive token, got: %v", err)
+	}
+}
@@ -178,8 +178,9 @@ func (t *Token) Verify(verifyOpts VerifyOptions) error {
 //      `jwk` - The JSON Web Key representation of the signing key.
 //              May contain its own `x5c` field which needs to be verified.
 //      `kid` - The unique identifier for the key. This library interprets it
-//              as a libtrust fingerprint. The key itself can be looked up in
-//              the trustedKeys field of the given verify options.
+//              as a libtrust fingerprint, or as the key ID of a key from a
+//              JSON Web Key Set. The key itself can be looked up in the
+//              trustedKeys field of the given verify options.
 // Each of these methods are tried in that order of preference until the
 // signing key is found or an error is returned.
 func (t *Token) VerifySigningKey(verifyOpts VerifyOptions) (signingKey libtrust.PublicKey, err error) {
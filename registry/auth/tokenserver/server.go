@@ -0,0 +1,436 @@
+// Package tokenserver provides an embedded token server, implementing the
+// docker token authentication specification.
+//
+// Clients authenticate to the server with basic credentials, which are
+// checked by a backend access controller such as htpasswd or ldap. The
+// requested scopes are evaluated against an acl policy, and a token granting
+// the permitted subset is signed with a libtrust key. Tokens are verifiable by
+// the token access controller configured with the issuer, service and either
+// a rootcertbundle holding the certificate of the signing key, or the jwks
+// served by ServeJWKS.
+package tokenserver
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/auth/acl"
+	"github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/distribution/uuid"
+	"github.com/docker/libtrust"
+)
+
+const (
+	// DefaultPath is the path at which tokens are served if none is
+	// configured.
+	DefaultPath = "/auth/token"
+
+	// DefaultJWKSPath is the path at which the signing key is served if
+	// none is configured.
+	DefaultJWKSPath = "/auth/jwks"
+
+	defaultExpiration = 5 * time.Minute
+)
+
+const errGroup = "tokenserver"
+
+var (
+	// ErrorCodeServiceUnknown is returned when a token is requested for a
+	// service other than the one served.
+	ErrorCodeServiceUnknown = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "SERVICE_UNKNOWN",
+		Message: "service unknown to token server",
+		Description: `This is returned if the "service" parameter of a token
+		request does not name the service for which tokens are issued.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	// ErrorCodeScopeInvalid is returned when a requested scope cannot be
+	// parsed.
+	ErrorCodeScopeInvalid = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "SCOPE_INVALID",
+		Message: "invalid scope",
+		Description: `Scopes must be of the form "type:name:actions", where
+		actions is a comma separated list.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+)
+
+// Server issues tokens to authenticated users. It implements http.Handler.
+type Server struct {
+	context.Context
+
+	issuer     string
+	service    string
+	expiration time.Duration
+
+	signingKey libtrust.PrivateKey
+	signingAlg string
+	chain      []string // base64 DER certificates included as x5c
+	jwks       []byte   // public signing key, as a JSON Web Key Set
+
+	backend auth.AccessController
+	policy  acl.Source
+}
+
+var _ http.Handler = &Server{}
+
+// New creates a token server from the tokenserver section of the
+// configuration. The issuer and service default to those of the token access
+// controller, if one is configured.
+func New(ctx context.Context, config *configuration.Configuration) (*Server, error) {
+	tsConfig := config.TokenServer
+
+	s := &Server{
+		Context:    ctx,
+		issuer:     tsConfig.Issuer,
+		service:    tsConfig.Service,
+		expiration: tsConfig.Expiration,
+	}
+
+	if config.Auth.Type() == "token" {
+		params := config.Auth.Parameters()
+		if s.issuer == "" {
+			s.issuer, _ = params["issuer"].(string)
+		}
+		if s.service == "" {
+			s.service, _ = params["service"].(string)
+		}
+	}
+
+	if s.issuer == "" || s.service == "" {
+		return nil, fmt.Errorf("tokenserver: issuer and service must be configured")
+	}
+
+	if s.expiration <= 0 {
+		s.expiration = defaultExpiration
+	}
+
+	if tsConfig.SigningKey == "" {
+		return nil, fmt.Errorf("tokenserver: signingkey must be configured")
+	}
+
+	var err error
+	if s.signingKey, err = libtrust.LoadKeyFile(tsConfig.SigningKey); err != nil {
+		return nil, fmt.Errorf("tokenserver: unable to load signing key: %v", err)
+	}
+
+	// The algorithm is determined by the key type, but must be known before
+	// signing as it is part of the signed header.
+	if _, s.signingAlg, err = s.signingKey.Sign(strings.NewReader(""), crypto.SHA256); err != nil {
+		return nil, fmt.Errorf("tokenserver: unable to sign with signing key: %v", err)
+	}
+
+	if s.jwks, err = marshalJWKS(s.signingKey.PublicKey()); err != nil {
+		return nil, fmt.Errorf("tokenserver: unable to encode signing key: %v", err)
+	}
+
+	if tsConfig.Certificate != "" {
+		if s.chain, err = loadChain(tsConfig.Certificate); err != nil {
+			return nil, fmt.Errorf("tokenserver: unable to load certificate: %v", err)
+		}
+	} else if config.Auth.Type() == "token" {
+		if err := checkTrusted(s.signingKey.PublicKey(), config.Auth.Parameters()); err != nil {
+			return nil, fmt.Errorf("tokenserver: %v", err)
+		}
+	}
+
+	if s.backend, err = newBackend(tsConfig.Backend); err != nil {
+		return nil, fmt.Errorf("tokenserver: unable to configure backend: %v", err)
+	}
+
+	if tsConfig.Policy == "" {
+		return nil, fmt.Errorf("tokenserver: policy must be configured")
+	}
+
+	if s.policy, err = acl.NewFile(tsConfig.Policy, acl.DefaultReloadInterval); err != nil {
+		return nil, fmt.Errorf("tokenserver: unable to load policy: %v", err)
+	}
+
+	return s, nil
+}
+
+// newBackend creates the access controller authenticating users. The static
+// backend is private to the token server, while other types are looked up
+// from the registered access controllers.
+func newBackend(config configuration.Auth) (auth.AccessController, error) {
+	switch config.Type() {
+	case "":
+		return nil, fmt.Errorf("no backend configured")
+	case "static":
+		return newStaticBackend(config.Parameters())
+	}
+
+	return auth.GetAccessController(config.Type(), config.Parameters())
+}
+
+// checkTrusted returns an error unless tokens identifying the key by id are
+// accepted by the token access controller with the given parameters: its
+// rootcertbundle must hold a certificate of the key, or it must load the key
+// from a jwks.
+func checkTrusted(key libtrust.PublicKey, params configuration.Parameters) error {
+	if jwks, _ := params["jwks"].(string); jwks != "" {
+		return nil
+	}
+
+	bundle, _ := params["rootcertbundle"].(string)
+	if bundle == "" {
+		return fmt.Errorf("the token access controller requires a rootcertbundle or jwks trusting the signing key")
+	}
+
+	certs, err := libtrust.LoadCertificateBundle(bundle)
+	if err != nil {
+		return fmt.Errorf("unable to load rootcertbundle: %v", err)
+	}
+
+	for _, cert := range certs {
+		pub, err := libtrust.FromCryptoPublicKey(cert.PublicKey)
+		if err == nil && pub.KeyID() == key.KeyID() {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the rootcertbundle %s holds no certificate of the signing key %s", bundle, key.KeyID())
+}
+
+// loadChain reads the PEM encoded certificates from path, returning them in
+// the base64 DER encoding used by the x5c header.
+func loadChain(path string) ([]string, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []string
+	for {
+		var block *pem.Block
+		block, p = pem.Decode(p)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, base64.StdEncoding.EncodeToString(block.Bytes))
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return chain, nil
+}
+
+// marshalJWKS returns a JSON Web Key Set holding the key, identified by the
+// libtrust key id with which tokens are signed.
+func marshalJWKS(key libtrust.PublicKey) ([]byte, error) {
+	return json.Marshal(struct {
+		Keys []libtrust.PublicKey `json:"keys"`
+	}{
+		Keys: []libtrust.PublicKey{key},
+	})
+}
+
+// tokenResponse is the body of a successful token request.
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// ServeHTTP authenticates the request with the backend and responds with a
+// token for the permitted subset of the requested scopes.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithRequest(s, r)
+	ctx = context.WithLogger(ctx, context.GetRequestLogger(ctx))
+
+	if r.Method != "GET" {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	if service := r.FormValue("service"); service != s.service {
+		errcode.ServeJSON(w, ErrorCodeServiceUnknown.WithDetail(service))
+		return
+	}
+
+	requested, err := parseScopes(r.Form["scope"])
+	if err != nil {
+		errcode.ServeJSON(w, ErrorCodeScopeInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	authCtx, err := s.backend.Authorized(ctx)
+	if err != nil {
+		switch err := err.(type) {
+		case auth.Challenge:
+			err.SetHeaders(w)
+			errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized)
+		default:
+			context.GetLogger(ctx).Errorf("error authenticating token request: %v", err)
+			errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	userInfo, _ := authCtx.Value("auth.user").(auth.UserInfo)
+	if account := r.FormValue("account"); account != "" && account != userInfo.Name {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized.WithDetail("account does not match credentials"))
+		return
+	}
+
+	granted := s.policy.Policy().Grant(userInfo, requested)
+	if len(granted) < len(requested) {
+		context.GetLogger(ctx).Infof("user %q granted %d of %d requested actions", userInfo.Name, len(granted), len(requested))
+	}
+
+	now := time.Now()
+	rawToken, err := s.sign(userInfo.Name, granted, now)
+	if err != nil {
+		context.GetLogger(ctx).Errorf("error signing token: %v", err)
+		errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tokenResponse{
+		Token:       rawToken,
+		AccessToken: rawToken,
+		ExpiresIn:   int(s.expiration / time.Second),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	})
+}
+
+// ServeJWKS responds with the public signing key as a JSON Web Key Set, which
+// the token access controller loads with its jwks option. Tokens carrying a
+// certificate chain are verified against the rootcertbundle instead.
+func (s *Server) ServeJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.jwks)
+}
+
+// sign returns a signed token for the subject, granting the access.
+func (s *Server) sign(subject string, granted []auth.Access, now time.Time) (string, error) {
+	header := token.Header{
+		Type:       "JWT",
+		SigningAlg: s.signingAlg,
+		KeyID:      s.signingKey.KeyID(),
+		X5c:        s.chain,
+	}
+
+	claims := token.ClaimSet{
+		Issuer:     s.issuer,
+		Subject:    subject,
+		Audience:   s.service,
+		Expiration: now.Add(s.expiration).Unix(),
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		JWTID:      uuid.Generate().String(),
+		Access:     resourceActions(granted),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	payload := joseBase64UrlEncode(headerJSON) + token.TokenSeparator + joseBase64UrlEncode(claimsJSON)
+
+	signature, _, err := s.signingKey.Sign(strings.NewReader(payload), crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	return payload + token.TokenSeparator + joseBase64UrlEncode(signature), nil
+}
+
+// parseScopes parses the scope parameters of a token request. Each parameter
+// may hold several space separated scopes.
+func parseScopes(params []string) ([]auth.Access, error) {
+	var requested []auth.Access
+	for _, param := range params {
+		for _, scope := range strings.Fields(param) {
+			// The name may itself contain colons, when it includes a
+			// registry host and port.
+			first, last := strings.Index(scope, ":"), strings.LastIndex(scope, ":")
+			if first < 1 || first == last || last == len(scope)-1 {
+				return nil, fmt.Errorf("invalid scope %q", scope)
+			}
+
+			resource := auth.Resource{
+				Type: scope[:first],
+				Name: scope[first+1 : last],
+			}
+
+			for _, action := range strings.Split(scope[last+1:], ",") {
+				if action == "" {
+					continue
+				}
+
+				requested = append(requested, auth.Access{
+					Resource: resource,
+					Action:   action,
+				})
+			}
+		}
+	}
+
+	return requested, nil
+}
+
+// resourceActions groups the granted access by resource for the access claim
+// of a token.
+func resourceActions(granted []auth.Access) []*token.ResourceActions {
+	access := []*token.ResourceActions{}
+	index := make(map[auth.Resource]*token.ResourceActions)
+
+	for _, a := range granted {
+		ra, ok := index[a.Resource]
+		if !ok {
+			ra = &token.ResourceActions{Type: a.Type, Name: a.Name}
+			index[a.Resource] = ra
+			access = append(access, ra)
+		}
+		ra.Actions = append(ra.Actions, a.Action)
+	}
+
+	return access
+}
+
+// joseBase64UrlEncode encodes the given data using the standard base64 url
+// encoding format but with all trailing '=' characters omitted in accordance
+// with the jose specification.
+// http://tools.ietf.org/html/draft-ietf-jose-json-web-signature-31#section-2
+func joseBase64UrlEncode(b []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(b), "=")
+}
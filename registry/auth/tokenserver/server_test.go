@@ -0,0 +1,276 @@
+package tokenserver
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	_ "github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/libtrust"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPolicy = `
+rules:
+  - accounts: [bilbo]
+    names: [shire/*]
+    actions: [pull, push]
+  - accounts: ["*"]
+    names: [library/*]
+    actions: [pull]
+`
+
+// Ways in which the token access controller trusts the signing key
+const (
+	// trustChain includes the certificate chain in tokens
+	trustChain = "chain"
+	// trustRootCertBundle gives the certificate to the access controller
+	// only, tokens identifying the key by id
+	trustRootCertBundle = "rootcertbundle"
+	// trustJWKS has the access controller load the key from the jwks
+	// served by the token server, without a rootcertbundle
+	trustJWKS = "jwks"
+)
+
+// setupTokenServer writes a signing key, its certificate and a policy to a
+// temporary directory and starts a token server using them, along with the
+// token access controller configured to accept its tokens as given by trust.
+func setupTokenServer(t *testing.T, dir string, trust string) (*httptest.Server, auth.AccessController) {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := libtrust.GenerateCACert(key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := libtrust.SaveKey(keyPath, key); err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policyPath := filepath.Join(dir, "policy.yml")
+	if err := ioutil.WriteFile(policyPath, []byte(testPolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("baggins"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+
+	tokenParams := configuration.Parameters{
+		"realm":   "http://localhost/auth/token",
+		"issuer":  "test-issuer",
+		"service": "test-service",
+	}
+	if trust == trustJWKS {
+		tokenParams["jwks"] = server.URL + DefaultJWKSPath
+	} else {
+		tokenParams["rootcertbundle"] = certPath
+	}
+
+	config := &configuration.Configuration{
+		Auth: configuration.Auth{"token": tokenParams},
+	}
+	config.TokenServer.Enabled = true
+	config.TokenServer.SigningKey = keyPath
+	config.TokenServer.Policy = policyPath
+	config.TokenServer.Backend = configuration.Auth{
+		"static": configuration.Parameters{
+			"realm": "test-realm",
+			"users": map[interface{}]interface{}{"bilbo": string(hash)},
+		},
+	}
+	if trust == trustChain {
+		config.TokenServer.Certificate = certPath
+	}
+
+	s, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatalf("error creating token server: %v", err)
+	}
+	mux.Handle(DefaultPath, s)
+	mux.HandleFunc(DefaultJWKSPath, s.ServeJWKS)
+
+	ac, err := auth.GetAccessController("token", tokenParams)
+	if err != nil {
+		t.Fatalf("error creating token access controller: %v", err)
+	}
+
+	return server, ac
+}
+
+func TestTokenServer(t *testing.T) {
+	for _, trust := range []string{trustChain, trustRootCertBundle, trustJWKS} {
+		dir, err := ioutil.TempDir("", "tokenserver")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		server, ac := setupTokenServer(t, dir, trust)
+		defer server.Close()
+		defer ac.(io.Closer).Close()
+
+		requestToken := func(username, password, query string) (*http.Response, tokenResponse) {
+			req, err := http.NewRequest("GET", server.URL+"/auth/token?"+query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != "" {
+				req.SetBasicAuth(username, password)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("error requesting token: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var tr tokenResponse
+			if resp.StatusCode == http.StatusOK {
+				if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+					t.Fatalf("error decoding token response: %v", err)
+				}
+			}
+			return resp, tr
+		}
+
+		// Requests without valid credentials are challenged.
+		resp, _ := requestToken("", "", "service=test-service")
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("expected challenge without credentials, got %d", resp.StatusCode)
+		}
+
+		resp, _ = requestToken("bilbo", "wrong", "service=test-service")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected challenge with wrong password, got %d", resp.StatusCode)
+		}
+
+		resp, _ = requestToken("bilbo", "baggins", "service=other-service")
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected bad request for unknown service, got %d", resp.StatusCode)
+		}
+
+		resp, _ = requestToken("bilbo", "baggins", "service=test-service&scope=repository")
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected bad request for invalid scope, got %d", resp.StatusCode)
+		}
+
+		resp, _ = requestToken("bilbo", "baggins", "service=test-service&account=frodo")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected unauthorized for mismatched account, got %d", resp.StatusCode)
+		}
+
+		resp, tr := requestToken("bilbo", "baggins",
+			"service=test-service&account=bilbo&scope=repository:shire/hobbiton:pull,push,*&scope=repository:library/ubuntu:pull,push")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status requesting token: %d", resp.StatusCode)
+		}
+
+		if tr.Token == "" || tr.AccessToken != tr.Token || tr.ExpiresIn != 300 {
+			t.Fatalf("unexpected token response: %#v", tr)
+		}
+
+		for _, tc := range []struct {
+			access     auth.Access
+			authorized bool
+		}{
+			{auth.Access{Resource: auth.Resource{Type: "repository", Name: "shire/hobbiton"}, Action: "pull"}, true},
+			{auth.Access{Resource: auth.Resource{Type: "repository", Name: "shire/hobbiton"}, Action: "push"}, true},
+			{auth.Access{Resource: auth.Resource{Type: "repository", Name: "shire/hobbiton"}, Action: "*"}, false},
+			{auth.Access{Resource: auth.Resource{Type: "repository", Name: "library/ubuntu"}, Action: "pull"}, true},
+			{auth.Access{Resource: auth.Resource{Type: "repository", Name: "library/ubuntu"}, Action: "push"}, false},
+		} {
+			req, err := http.NewRequest("GET", "http://registry/v2/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tr.Token)
+
+			authCtx, err := ac.Authorized(context.WithRequest(context.Background(), req), tc.access)
+			if !tc.authorized {
+				if _, ok := err.(auth.Challenge); !ok {
+					t.Fatalf("expected challenge for %v, got: %v", tc.access, err)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("token not accepted for %v (trust: %s): %v", tc.access, trust, err)
+			}
+
+			if userInfo, _ := authCtx.Value("auth.user").(auth.UserInfo); userInfo.Name != "bilbo" {
+				t.Fatalf("unexpected user in authorized context: %#v", userInfo)
+			}
+		}
+	}
+}
+
+// TestUntrustedSigningKey checks that the token server refuses to start if
+// the token access controller would not accept its tokens.
+func TestUntrustedSigningKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokenserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := libtrust.SaveKey(keyPath, key); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := libtrust.GenerateCACert(other, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, params := range []configuration.Parameters{
+		{"issuer": "test-issuer", "service": "test-service"},
+		{"issuer": "test-issuer", "service": "test-service", "rootcertbundle": certPath},
+	} {
+		config := &configuration.Configuration{
+			Auth: configuration.Auth{"token": params},
+		}
+		config.TokenServer.Enabled = true
+		config.TokenServer.SigningKey = keyPath
+
+		if _, err := New(context.Background(), config); err == nil || !strings.Contains(err.Error(), "signing key") {
+			t.Fatalf("expected error for untrusted signing key with %v, got: %v", params, err)
+		}
+	}
+}
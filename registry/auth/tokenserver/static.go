@@ -0,0 +1,110 @@
+package tokenserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrAuthenticationFailure is returned when the credentials of a token
+// request do not match any configured user of the static backend.
+var ErrAuthenticationFailure = errors.New("authentication failure")
+
+// staticBackend authenticates users listed in the configuration, with bcrypt
+// hashed passwords, much like an htpasswd file.
+type staticBackend struct {
+	realm string
+	users map[string][]byte
+}
+
+var _ auth.AccessController = &staticBackend{}
+
+// newStaticBackend creates the static backend from its options. The "users"
+// option maps user names to bcrypt password hashes.
+func newStaticBackend(options map[string]interface{}) (auth.AccessController, error) {
+	realm, present := options["realm"]
+	if _, ok := realm.(string); !present || !ok {
+		return nil, fmt.Errorf(`"realm" must be set for static backend`)
+	}
+
+	sb := &staticBackend{
+		realm: realm.(string),
+		users: make(map[string][]byte),
+	}
+
+	var users map[interface{}]interface{}
+	switch v := options["users"].(type) {
+	case map[interface{}]interface{}:
+		users = v
+	case map[string]interface{}:
+		users = make(map[interface{}]interface{}, len(v))
+		for k, hash := range v {
+			users[k] = hash
+		}
+	default:
+		return nil, fmt.Errorf(`"users" must be a map of user names to password hashes for static backend`)
+	}
+
+	for k, v := range users {
+		username, ok := k.(string)
+		hash, ok2 := v.(string)
+		if !ok || !ok2 || username == "" {
+			return nil, fmt.Errorf(`"users" must be a map of user names to password hashes for static backend`)
+		}
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("password of user %q must be a bcrypt hash: %v", username, err)
+		}
+
+		sb.users[username] = []byte(hash)
+	}
+
+	return sb, nil
+}
+
+func (sb *staticBackend) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, &challenge{realm: sb.realm, err: ErrAuthenticationFailure}
+	}
+
+	hash, ok := sb.users[username]
+	if !ok {
+		// timing attack paranoia
+		bcrypt.CompareHashAndPassword([]byte{}, []byte(password))
+		return nil, &challenge{realm: sb.realm, err: ErrAuthenticationFailure}
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		context.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
+		return nil, &challenge{realm: sb.realm, err: ErrAuthenticationFailure}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: username}), nil
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge: %#v", ch)
+}
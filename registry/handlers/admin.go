@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+// The following are the names of the routes of the administrative api. All
+// of them share the adminRoutePrefix, which is used to recognize them during
+// dispatch.
+const (
+	adminRoutePrefix = "admin-"
+
+	routeNameAdminEndpoints        = "admin-notifications-endpoints"
+	routeNameAdminEndpointFailures = "admin-notifications-endpoint-failures"
+	routeNameAdminEndpointReplay   = "admin-notifications-endpoint-replay"
+	routeNameAdminProxyPrefetch    = "admin-proxy-prefetch"
+)
+
+// adminRoutes lists the routes of the administrative api, relative to the
+// configured http prefix.
+var adminRoutes = []struct {
+	name     string
+	path     string
+	dispatch dispatchFunc
+}{
+	{routeNameAdminEndpoints, "/admin/notifications/endpoints", adminEndpointsDispatcher},
+	{routeNameAdminEndpointFailures, "/admin/notifications/endpoints/{endpoint}/failures", adminEndpointsDispatcher},
+	{routeNameAdminEndpointReplay, "/admin/notifications/endpoints/{endpoint}/replay", adminEndpointsDispatcher},
+	{routeNameAdminProxyPrefetch, "/admin/proxy/prefetch", adminProxyPrefetchDispatcher},
+}
+
+const adminErrGroup = "registry.api.admin"
+
+var (
+	// ErrorCodeEndpointUnknown is returned when an administrative request
+	// refers to a notification endpoint that is not configured.
+	ErrorCodeEndpointUnknown = errcode.Register(adminErrGroup, errcode.ErrorDescriptor{
+		Value:   "ENDPOINT_UNKNOWN",
+		Message: "notification endpoint not known to registry",
+		Description: `This is returned if the notification endpoint named in
+		the request is not configured or has been disabled.`,
+		HTTPStatusCode: http.StatusNotFound,
+	})
+
+	// ErrorCodeTimeRangeInvalid is returned when the time range of a replay
+	// request cannot be parsed.
+	ErrorCodeTimeRangeInvalid = errcode.Register(adminErrGroup, errcode.ErrorDescriptor{
+		Value:   "TIME_RANGE_INVALID",
+		Message: "invalid time range",
+		Description: `The "from" and "to" parameters of a replay request must
+		be RFC 3339 timestamps, and "from" is required.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	// ErrorCodePrefetchInvalid is returned when the body of a prefetch
+	// request cannot be parsed.
+	ErrorCodePrefetchInvalid = errcode.Register(adminErrGroup, errcode.ErrorDescriptor{
+		Value:   "PREFETCH_INVALID",
+		Message: "invalid prefetch request",
+		Description: `The body of a prefetch request must be a JSON object
+		with a non-empty "references" list.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+)
+
+// registerAdmin adds the routes of the administrative api to the app router.
+// The routes are dispatched like any other route, so access is checked by
+// the access controller.
+func (app *App) registerAdmin() {
+	router := app.router
+	if app.Config.HTTP.Prefix != "" {
+		router = router.PathPrefix(app.Config.HTTP.Prefix).Subrouter()
+	}
+
+	for _, route := range adminRoutes {
+		router.Path(route.path).Name(route.name).Handler(app.dispatcher(route.dispatch))
+	}
+}
+
+// isAdminRoute returns true if the request was routed to the administrative
+// api.
+func isAdminRoute(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	return route != nil && strings.HasPrefix(route.GetName(), adminRoutePrefix)
+}
+
+// adminGrantable reports whether the auth configuration grants access to the
+// administrative api only when it is asked for explicitly: the token access
+// controller checks the claims of the token, and a policy denies any
+// resource that none of its rules grant.
+func adminGrantable(config configuration.Auth) bool {
+	if config.Type() == "token" {
+		return true
+	}
+
+	policy, ok := config.Parameters()["policy"].(string)
+	return ok && policy != ""
+}
+
+// appendAdminAccessRecord adds the access record for the administrative api
+// if it's our current route.
+func appendAdminAccessRecord(accessRecords []auth.Access, r *http.Request) []auth.Access {
+	if isAdminRoute(r) {
+		accessRecords = append(accessRecords,
+			auth.Access{
+				Resource: auth.Resource{
+					Type: "registry",
+					Name: "admin",
+				},
+				Action: "*",
+			})
+	}
+	return accessRecords
+}
+
+// adminEndpointsDispatcher constructs the handler for the notification
+// endpoint administration routes.
+func adminEndpointsDispatcher(ctx *Context, r *http.Request) http.Handler {
+	adminHandler := &adminEndpointsHandler{
+		Context: ctx,
+	}
+
+	switch mux.CurrentRoute(r).GetName() {
+	case routeNameAdminEndpointFailures:
+		return handlers.MethodHandler{
+			"GET": http.HandlerFunc(adminHandler.GetFailures),
+		}
+	case routeNameAdminEndpointReplay:
+		return handlers.MethodHandler{
+			"POST": http.HandlerFunc(adminHandler.Replay),
+		}
+	}
+
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(adminHandler.GetEndpoints),
+	}
+}
+
+// adminEndpointsHandler reports on the state of notification endpoints and
+// replays events to them.
+type adminEndpointsHandler struct {
+	*Context
+}
+
+type endpointStatus struct {
+	Name          string    `json:"name"`
+	URL           string    `json:"url"`
+	CircuitOpen   bool      `json:"circuitOpen"`
+	Pending       int       `json:"pending"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+}
+
+type adminEndpointsAPIResponse struct {
+	Endpoints []endpointStatus `json:"endpoints"`
+}
+
+type adminFailuresAPIResponse struct {
+	Name     string                         `json:"name"`
+	Failures []notifications.FailedEnvelope `json:"failures"`
+}
+
+type adminReplayAPIResponse struct {
+	Name     string `json:"name"`
+	Replayed int    `json:"replayed"`
+}
+
+// GetEndpoints returns the state of all configured notification endpoints.
+func (ah *adminEndpointsHandler) GetEndpoints(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]endpointStatus, 0, len(ah.App.events.endpoints))
+	for _, endpoint := range ah.App.events.endpoints {
+		var metrics notifications.EndpointMetrics
+		endpoint.ReadMetrics(&metrics)
+
+		statuses = append(statuses, endpointStatus{
+			Name:          endpoint.Name(),
+			URL:           endpoint.URL(),
+			CircuitOpen:   metrics.CircuitOpen,
+			Pending:       metrics.Pending,
+			LastError:     metrics.LastError,
+			LastErrorTime: metrics.LastErrorTime,
+		})
+	}
+
+	ah.serveJSON(w, http.StatusOK, adminEndpointsAPIResponse{Endpoints: statuses})
+}
+
+// GetFailures returns the envelopes that recently failed delivery to the
+// endpoint.
+func (ah *adminEndpointsHandler) GetFailures(w http.ResponseWriter, r *http.Request) {
+	endpoint := ah.endpoint()
+	if endpoint == nil {
+		return
+	}
+
+	ah.serveJSON(w, http.StatusOK, adminFailuresAPIResponse{
+		Name:     endpoint.Name(),
+		Failures: endpoint.ReadFailures(),
+	})
+}
+
+// adminReplayBatchSize is the number of events read from the event log before
+// they are queued to the endpoint during a replay.
+const adminReplayBatchSize = 100
+
+// Replay queues the events from the event log with a timestamp in the
+// requested range for delivery to the endpoint.
+func (ah *adminEndpointsHandler) Replay(w http.ResponseWriter, r *http.Request) {
+	endpoint := ah.endpoint()
+	if endpoint == nil {
+		return
+	}
+
+	if ah.App.events.log == nil {
+		ah.Errors = append(ah.Errors, errcode.ErrorCodeUnavailable.WithDetail("event log not configured"))
+		return
+	}
+
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		ah.Errors = append(ah.Errors, ErrorCodeTimeRangeInvalid.WithDetail(err))
+		return
+	}
+
+	// The events are streamed from the log to the endpoint in batches, so
+	// that a large range is never held in memory at once.
+	var (
+		batch    []notifications.Event
+		replayed int
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := endpoint.Write(batch...); err != nil {
+			return err
+		}
+		// The endpoint queues the slice itself, so it is not reused.
+		replayed += len(batch)
+		batch = nil
+		return nil
+	}
+
+	err = ah.App.events.log.Walk(from, to, func(event notifications.Event) error {
+		batch = append(batch, event)
+		if len(batch) < adminReplayBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		ah.Errors = append(ah.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	ctxu.GetLogger(ah).Infof("replaying %d events to endpoint %s", replayed, endpoint.Name())
+	ah.serveJSON(w, http.StatusAccepted, adminReplayAPIResponse{
+		Name:     endpoint.Name(),
+		Replayed: replayed,
+	})
+}
+
+// endpoint resolves the endpoint named in the request. If it is not found, an
+// error is added to the context and nil is returned.
+func (ah *adminEndpointsHandler) endpoint() *notifications.Endpoint {
+	name := ctxu.GetStringValue(ah, "vars.endpoint")
+	for _, endpoint := range ah.App.events.endpoints {
+		if endpoint.Name() == name {
+			return endpoint
+		}
+	}
+
+	ah.Errors = append(ah.Errors, ErrorCodeEndpointUnknown.WithDetail(map[string]string{"name": name}))
+	return nil
+}
+
+func (ah *adminEndpointsHandler) serveJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(v); err != nil {
+		ctxu.GetLogger(ah).Errorf("error encoding admin response: %v", err)
+	}
+}
+
+// adminProxyPrefetchDispatcher constructs the handler for the proxy cache
+// prefetch route.
+func adminProxyPrefetchDispatcher(ctx *Context, r *http.Request) http.Handler {
+	prefetchHandler := &adminProxyPrefetchHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		"POST": http.HandlerFunc(prefetchHandler.Prefetch),
+	}
+}
+
+// adminProxyPrefetchHandler pulls images into the proxy cache ahead of
+// clients.
+type adminProxyPrefetchHandler struct {
+	*Context
+}
+
+type adminPrefetchAPIRequest struct {
+	References []string `json:"references"`
+}
+
+// Prefetch pulls the requested references into the cache, streaming progress
+// to the client as JSON lines. Since the status is sent before any work is
+// done, failures are only reported in the stream.
+func (ph *adminProxyPrefetchHandler) Prefetch(w http.ResponseWriter, r *http.Request) {
+	if !ph.App.isCache {
+		ph.Errors = append(ph.Errors, errcode.ErrorCodeUnsupported.WithDetail("registry is not configured as a proxy cache"))
+		return
+	}
+
+	var request adminPrefetchAPIRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		ph.Errors = append(ph.Errors, ErrorCodePrefetchInvalid.WithDetail(err))
+		return
+	}
+
+	if len(request.References) == 0 {
+		ph.Errors = append(ph.Errors, ErrorCodePrefetchInvalid.WithDetail("no references"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	if err := ph.App.ProxyPrefetch(ph, request.References, flushWriter{w}); err != nil {
+		ctxu.GetLogger(ph).Errorf("error prefetching into proxy cache: %v", err)
+	}
+}
+
+// flushWriter flushes each write to the client, so that progress is streamed
+type flushWriter struct {
+	w io.Writer
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// parseTimeRange parses the "from" and "to" query parameters of the request.
+// The "to" parameter is optional and a zero time is returned if absent.
+func parseTimeRange(r *http.Request) (from, to time.Time, err error) {
+	q := r.URL.Query()
+
+	if q.Get("from") == "" {
+		return from, to, fmt.Errorf(`"from" parameter required`)
+	}
+
+	from, err = time.Parse(time.RFC3339, q.Get("from"))
+	if err != nil {
+		return from, to, err
+	}
+
+	if q.Get("to") != "" {
+		to, err = time.Parse(time.RFC3339, q.Get("to"))
+		if err != nil {
+			return from, to, err
+		}
+
+		if to.Before(from) {
+			return from, to, fmt.Errorf(`"to" precedes "from"`)
+		}
+	}
+
+	return from, to, nil
+}
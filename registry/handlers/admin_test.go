@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/registry/api/errcode"
+	_ "github.com/docker/distribution/registry/auth/htpasswd"
+	"github.com/docker/distribution/registry/proxy"
+)
+
+// adminPolicy grants the silly user access to the administrative api.
+const adminPolicy = `
+rules:
+  - accounts: [silly]
+    type: registry
+    names: [admin]
+    actions: ["*"]
+`
+
+// adminAuth configures the silly access controller, with a policy in dir
+// authorizing the requests of adminClient.
+func adminAuth(t *testing.T, dir string) configuration.Auth {
+	policy := filepath.Join(dir, "policy.yml")
+	if err := ioutil.WriteFile(policy, []byte(adminPolicy), 0644); err != nil {
+		t.Fatalf("unexpected error writing policy: %v", err)
+	}
+
+	return configuration.Auth{
+		"silly": {
+			"realm":   "realm-test",
+			"service": "service-test",
+			"policy":  policy,
+		},
+	}
+}
+
+// adminClient sends requests with an authorization header.
+var adminClient = &http.Client{Transport: authorizingTransport{}}
+
+type authorizingTransport struct{}
+
+func (authorizingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.Header.Set("Authorization", "Bearer admin")
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// TestAdminNotificationsAPI exercises the notification endpoint
+// administration routes: listing endpoints, browsing failures and replaying
+// events from the event log.
+func TestAdminNotificationsAPI(t *testing.T) {
+	root, err := ioutil.TempDir("", "admin-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	var (
+		mu       sync.Mutex
+		received int
+	)
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var envelope notifications.Envelope
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		received += len(envelope.Events)
+		mu.Unlock()
+	}))
+	defer listener.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+		Notifications: configuration.Notifications{
+			Endpoints: []configuration.Endpoint{
+				{Name: "listener", URL: listener.URL, Backoff: time.Millisecond},
+				{Name: "broken", URL: broken.URL, Threshold: 1, Backoff: time.Hour},
+			},
+			EventLog: configuration.EventLog{
+				Path: filepath.Join(root, "events.log"),
+			},
+		},
+	}
+	config.Auth = adminAuth(t, root)
+	config.HTTP.Headers = headerConfig
+	config.HTTP.Admin.Enabled = true
+
+	env := newTestEnvWithConfig(t, &config)
+	adminURL := env.server.URL + "/admin/notifications/endpoints"
+
+	start := time.Now().Add(-time.Minute)
+	if err := env.app.events.sink.Write(
+		notifications.Event{ID: "one", Timestamp: time.Now(), Action: notifications.EventActionPush},
+		notifications.Event{ID: "two", Timestamp: time.Now(), Action: notifications.EventActionPush}); err != nil {
+		t.Fatalf("unexpected error writing events: %v", err)
+	}
+
+	waitFor(t, "events delivered", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return received == 2
+	})
+
+	waitFor(t, "broken endpoint circuit open", func() bool {
+		var metrics notifications.EndpointMetrics
+		env.app.events.endpoints[1].ReadMetrics(&metrics)
+		return metrics.CircuitOpen
+	})
+
+	// list the endpoints
+	resp, err := adminClient.Get(adminURL)
+	if err != nil {
+		t.Fatalf("unexpected error listing endpoints: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "listing endpoints", resp, http.StatusOK)
+
+	var endpoints adminEndpointsAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+		t.Fatalf("error decoding endpoints: %v", err)
+	}
+
+	if len(endpoints.Endpoints) != 2 {
+		t.Fatalf("unexpected endpoints: %#v", endpoints)
+	}
+
+	if endpoints.Endpoints[0].Name != "listener" || endpoints.Endpoints[0].CircuitOpen || endpoints.Endpoints[0].LastError != "" {
+		t.Fatalf("unexpected status for healthy endpoint: %#v", endpoints.Endpoints[0])
+	}
+
+	if endpoints.Endpoints[1].Name != "broken" || !endpoints.Endpoints[1].CircuitOpen || endpoints.Endpoints[1].LastError == "" {
+		t.Fatalf("unexpected status for broken endpoint: %#v", endpoints.Endpoints[1])
+	}
+
+	// browse the failures of the broken endpoint
+	resp, err = adminClient.Get(adminURL + "/broken/failures")
+	if err != nil {
+		t.Fatalf("unexpected error listing failures: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "listing failures", resp, http.StatusOK)
+
+	var failures adminFailuresAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&failures); err != nil {
+		t.Fatalf("error decoding failures: %v", err)
+	}
+
+	if len(failures.Failures) == 0 || failures.Failures[0].Status != http.StatusInternalServerError || len(failures.Failures[0].Events) != 2 {
+		t.Fatalf("unexpected failures: %#v", failures)
+	}
+
+	resp, err = adminClient.Get(adminURL + "/unknown/failures")
+	if err != nil {
+		t.Fatalf("unexpected error listing failures: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "listing failures of unknown endpoint", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "listing failures of unknown endpoint", resp, ErrorCodeEndpointUnknown)
+
+	// replay the logged events
+	resp, err = adminClient.Post(adminURL+"/listener/replay?from="+start.Format(time.RFC3339), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error replaying events: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "replaying events", resp, http.StatusAccepted)
+
+	var replay adminReplayAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&replay); err != nil {
+		t.Fatalf("error decoding replay response: %v", err)
+	}
+
+	if replay.Replayed != 2 {
+		t.Fatalf("unexpected number of events replayed: %d != 2", replay.Replayed)
+	}
+
+	waitFor(t, "events replayed", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return received == 4
+	})
+
+	resp, err = adminClient.Post(adminURL+"/listener/replay?from=yesterday", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error replaying events: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "replaying events with invalid range", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "replaying events with invalid range", resp, ErrorCodeTimeRangeInvalid)
+}
+
+// TestAdminProxyPrefetch exercises the proxy cache prefetch route.
+func TestAdminProxyPrefetch(t *testing.T) {
+	root, err := ioutil.TempDir("", "admin-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer remote.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: remote.URL,
+		},
+	}
+	config.Auth = adminAuth(t, root)
+	config.HTTP.Headers = headerConfig
+	config.HTTP.Admin.Enabled = true
+
+	env := newTestEnvWithConfig(t, &config)
+	prefetchURL := env.server.URL + "/admin/proxy/prefetch"
+
+	resp, err := adminClient.Post(prefetchURL, "application/json", strings.NewReader(`{"references": ["library/missing:latest"]}`))
+	if err != nil {
+		t.Fatalf("unexpected error prefetching: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "prefetching", resp, http.StatusOK)
+
+	var event proxy.PrefetchEvent
+	if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+		t.Fatalf("error decoding prefetch event: %v", err)
+	}
+
+	if event.Reference != "library/missing:latest" || event.Status != proxy.PrefetchStatusError || event.Error == "" {
+		t.Fatalf("unexpected prefetch event: %#v", event)
+	}
+
+	resp, err = adminClient.Post(prefetchURL, "application/json", strings.NewReader(`{"references": []}`))
+	if err != nil {
+		t.Fatalf("unexpected error prefetching: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "prefetching without references", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "prefetching without references", resp, ErrorCodePrefetchInvalid)
+
+	// A registry that is not a cache has nothing to prefetch into
+	config.Proxy = configuration.Proxy{}
+	env = newTestEnvWithConfig(t, &config)
+
+	resp, err = adminClient.Post(env.server.URL+"/admin/proxy/prefetch", "application/json", strings.NewReader(`{"references": ["library/ubuntu"]}`))
+	if err != nil {
+		t.Fatalf("unexpected error prefetching: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "prefetching without proxy", resp, http.StatusMethodNotAllowed)
+	checkBodyHasErrorCodes(t, "prefetching without proxy", resp, errcode.ErrorCodeUnsupported)
+}
+
+// TestAdminDisabled ensures the administrative api is not routed unless
+// enabled.
+func TestAdminDisabled(t *testing.T) {
+	env := newTestEnv(t, false)
+
+	resp, err := http.Get(env.server.URL + "/admin/notifications/endpoints")
+	if err != nil {
+		t.Fatalf("unexpected error listing endpoints: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status with admin disabled: %v != %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// TestAdminRequiresAuth ensures the administrative api cannot be enabled
+// unless access to it is granted explicitly, and denies unauthorized
+// requests.
+func TestAdminRequiresAuth(t *testing.T) {
+	root, err := ioutil.TempDir("", "admin-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	htpasswd := filepath.Join(root, "htpasswd")
+	if err := ioutil.WriteFile(htpasswd, []byte("frodo:$2y$05$926C3y10Quzn/LnqQH86VOEVh/18T6RnLaS.khre96jLNL/7e.K5W\n"), 0644); err != nil {
+		t.Fatalf("unexpected error writing htpasswd: %v", err)
+	}
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.HTTP.Admin.Enabled = true
+
+	// Neither no access controller, nor one authorizing every authenticated
+	// user, is accepted.
+	for _, a := range []configuration.Auth{
+		nil,
+		{
+			"htpasswd": {
+				"realm": "realm-test",
+				"path":  htpasswd,
+			},
+		},
+	} {
+		config.Auth = a
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected app creation to fail with auth %v", a.Type())
+				}
+			}()
+			NewApp(context.Background(), config)
+		}()
+	}
+
+	config.Auth = adminAuth(t, root)
+	env := newTestEnvWithConfig(t, &config)
+	defer env.server.Close()
+
+	resp, err := http.Post(env.server.URL+"/admin/proxy/prefetch", "application/json", strings.NewReader(`{"references": ["library/ubuntu"]}`))
+	if err != nil {
+		t.Fatalf("unexpected error prefetching: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "prefetching without authorization", resp, http.StatusUnauthorized)
+
+	// A user granted access to repositories by the policy is denied the
+	// administrative api.
+	policy := filepath.Join(root, "users.yml")
+	if err := ioutil.WriteFile(policy, []byte(`
+rules:
+  - accounts: ["*"]
+    names: ["*"]
+    actions: ["*"]
+`), 0644); err != nil {
+		t.Fatalf("unexpected error writing policy: %v", err)
+	}
+	config.Auth = configuration.Auth{
+		"htpasswd": {
+			"realm":  "realm-test",
+			"path":   htpasswd,
+			"policy": policy,
+		},
+	}
+	env = newTestEnvWithConfig(t, &config)
+	defer env.server.Close()
+
+	for _, tc := range []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/admin/notifications/endpoints"},
+		{"POST", "/admin/proxy/prefetch"},
+	} {
+		req, err := http.NewRequest(tc.method, env.server.URL+tc.path, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.SetBasicAuth("frodo", "baggins")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error requesting %s: %v", tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("unexpected status of %s %s as htpasswd user: %v", tc.method, tc.path, resp.Status)
+		}
+	}
+
+	// The same user is granted access to repositories
+	req, err := http.NewRequest("GET", env.server.URL+"/v2/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	req.SetBasicAuth("frodo", "baggins")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error checking base: %v", err)
+	}
+	resp.Body.Close()
+	checkResponse(t, "checking base as htpasswd user", resp, http.StatusOK)
+}
+
+// waitFor polls condition until it is true, failing the test if it does not
+// become true in a reasonable amount of time.
+func waitFor(t *testing.T, msg string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
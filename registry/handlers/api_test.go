@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -25,7 +27,11 @@ import (
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/registry/api/errcode"
 	"github.com/docker/distribution/registry/api/v2"
+	_ "github.com/docker/distribution/registry/storage/driver/filesystem"
 	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/faulty"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/mirror"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/retry"
 	"github.com/docker/distribution/testutil"
 	"github.com/docker/libtrust"
 	"github.com/gorilla/handlers"
@@ -1489,3 +1495,357 @@ func TestCheckContextNotifier(t *testing.T) {
 		t.Fatalf("wrong status code - expected 200, got %d", resp.StatusCode)
 	}
 }
+
+// newTestEnvFaulty returns a test environment whose storage driver injects
+// the faults, wrapped by the given storage middlewares
+func newTestEnvFaulty(t *testing.T, faults []interface{}, middlewares ...configuration.Middleware) *testEnv {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"storage": append([]configuration.Middleware{{
+				Name:    "faulty",
+				Options: configuration.Parameters{"faults": faults, "seed": 1},
+			}}, middlewares...),
+		},
+	}
+
+	config.HTTP.Headers = headerConfig
+
+	return newTestEnvWithConfig(t, &config)
+}
+
+func makeRandomBlob(t *testing.T) ([]byte, digest.Digest) {
+	content := make([]byte, 1<<20)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("error creating random blob: %v", err)
+	}
+
+	dgst, err := digest.FromBytes(content)
+	if err != nil {
+		t.Fatalf("error digesting random blob: %v", err)
+	}
+
+	return content, dgst
+}
+
+// checkBlobNotFound checks that the blob was not made available by a failed
+// push
+func checkBlobNotFound(t *testing.T, env *testEnv, name string, dgst digest.Digest) {
+	blobURL, err := env.builder.BuildBlobURL(name, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error building blob url: %v", err)
+	}
+
+	resp, err := http.Head(blobURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking head on blob: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "checking head on blob after failed push", resp, http.StatusNotFound)
+}
+
+// pullBlob returns the content of the blob, and the error reading it
+func pullBlob(t *testing.T, env *testEnv, name string, dgst digest.Digest) (*http.Response, []byte, error) {
+	blobURL, err := env.builder.BuildBlobURL(name, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error building blob url: %v", err)
+	}
+
+	resp, err := http.Get(blobURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	return resp, content, err
+}
+
+// TestFaultyStorageErrors checks that pushes and pulls failing in the
+// storage driver are reported as errors, without making content available.
+func TestFaultyStorageErrors(t *testing.T) {
+	name := "foo/faulty"
+	env := newTestEnvFaulty(t, []interface{}{
+		map[string]interface{}{
+			"fault":   "error",
+			"methods": []interface{}{"WriteStream"},
+			"pattern": "/_uploads/",
+		},
+		map[string]interface{}{
+			"fault":   "error",
+			"methods": []interface{}{"Stat"},
+			"pattern": "^/docker/registry/v2/blobs/",
+			"count":   1,
+		},
+	})
+
+	content, dgst := makeRandomBlob(t)
+	uploadURLBase, _ := startPushLayer(t, env.builder, name)
+	resp, err := doPushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("unexpected error pushing layer: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "pushing layer failing to write", resp, http.StatusInternalServerError)
+	checkBodyHasErrorCodes(t, "pushing layer failing to write", resp, errcode.ErrorCodeUnknown)
+	checkBlobNotFound(t, env, name, dgst)
+
+	// The blob is pushed once writes succeed, but its first pull fails
+	env = newTestEnvFaulty(t, []interface{}{
+		map[string]interface{}{
+			"fault":   "error",
+			"methods": []interface{}{"Stat"},
+			"pattern": "^/docker/registry/v2/blobs/.*/data$",
+			"count":   1,
+		},
+	})
+	uploadURLBase, _ = startPushLayer(t, env.builder, name)
+	resp, err = doPushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("unexpected error pushing layer: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The first Stat of the blob, checking whether it exists, fails
+	checkResponse(t, "pushing layer failing to stat", resp, http.StatusInternalServerError)
+	checkBodyHasErrorCodes(t, "pushing layer failing to stat", resp, errcode.ErrorCodeUnknown)
+	checkBlobNotFound(t, env, name, dgst)
+
+	// Pushed again, once the storage recovered
+	uploadURLBase, _ = startPushLayer(t, env.builder, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+
+	resp, pulled, err := pullBlob(t, env, name, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error pulling layer: %v", err)
+	}
+	checkResponse(t, "pulling layer", resp, http.StatusOK)
+	if !bytes.Equal(pulled, content) {
+		t.Fatalf("unexpected content pulled")
+	}
+}
+
+// TestFaultyStorageShortWrites checks that content partially written by the
+// storage driver is rejected.
+func TestFaultyStorageShortWrites(t *testing.T) {
+	name := "foo/faulty"
+	env := newTestEnvFaulty(t, []interface{}{
+		map[string]interface{}{
+			"fault":   "shortwrite",
+			"methods": []interface{}{"WriteStream"},
+			"pattern": "/_uploads/",
+		},
+	})
+
+	content, dgst := makeRandomBlob(t)
+	uploadURLBase, _ := startPushLayer(t, env.builder, name)
+	resp, err := doPushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("unexpected error pushing layer: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "pushing layer partially written", resp, http.StatusInternalServerError)
+	checkBodyHasErrorCodes(t, "pushing layer partially written", resp, errcode.ErrorCodeUnknown)
+	checkBlobNotFound(t, env, name, dgst)
+}
+
+// TestFaultyStorageTruncatedReads checks that content partially read from
+// the storage driver is not served as complete.
+func TestFaultyStorageTruncatedReads(t *testing.T) {
+	name := "foo/faulty"
+	env := newTestEnvFaulty(t, []interface{}{
+		map[string]interface{}{
+			"fault":   "truncate",
+			"methods": []interface{}{"ReadStream"},
+			"pattern": "^/docker/registry/v2/blobs/",
+		},
+	})
+
+	content, dgst := makeRandomBlob(t)
+	uploadURLBase, _ := startPushLayer(t, env.builder, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+
+	resp, pulled, err := pullBlob(t, env, name, dgst)
+	if err == nil && bytes.Equal(pulled, content) {
+		t.Fatalf("expected truncated pull to fail")
+	}
+	if err == nil && resp.ContentLength == int64(len(pulled)) {
+		t.Fatalf("truncated content served as complete: %d bytes", len(pulled))
+	}
+}
+
+// TestFaultyStorageRecovers checks that pushes and pulls succeed despite
+// transient errors and latency of the storage driver, retried by the retry
+// storage middleware.
+func TestFaultyStorageRecovers(t *testing.T) {
+	name := "foo/faulty"
+	env := newTestEnvFaulty(t, []interface{}{
+		map[string]interface{}{
+			"fault":   "error",
+			"methods": []interface{}{"GetContent", "Stat", "List", "ReadStream"},
+			"count":   2,
+		},
+		map[string]interface{}{
+			"fault":       "latency",
+			"latency":     "5ms",
+			"probability": 0.5,
+		},
+	}, configuration.Middleware{
+		Name: "retry",
+		Options: configuration.Parameters{
+			"maxattempts":    3,
+			"initialbackoff": "1ms",
+			"maxbackoff":     "10ms",
+		},
+	})
+
+	content, dgst := makeRandomBlob(t)
+	uploadURLBase, _ := startPushLayer(t, env.builder, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+
+	resp, pulled, err := pullBlob(t, env, name, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error pulling layer: %v", err)
+	}
+	checkResponse(t, "pulling layer", resp, http.StatusOK)
+	if !bytes.Equal(pulled, content) {
+		t.Fatalf("unexpected content pulled")
+	}
+}
+
+// TestFaultyStorageStaleList checks that repositories missing from stale
+// listings of the storage driver are eventually listed by the catalog.
+func TestFaultyStorageStaleList(t *testing.T) {
+	name := "foo/faulty"
+	env := newTestEnvFaulty(t, []interface{}{
+		map[string]interface{}{
+			"fault":   "stale",
+			"methods": []interface{}{"List"},
+			"pattern": "^/docker/registry/v2/repositories$",
+			"count":   1,
+		},
+	})
+
+	content, dgst := makeRandomBlob(t)
+	uploadURLBase, _ := startPushLayer(t, env.builder, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+
+	catalogURL, err := env.builder.BuildCatalogURL()
+	if err != nil {
+		t.Fatalf("unexpected error building catalog url: %v", err)
+	}
+
+	for _, expected := range [][]string{{}, {name}} {
+		resp, err := http.Get(catalogURL)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		checkResponse(t, "issuing catalog api check", resp, http.StatusOK)
+
+		var ctlg struct {
+			Repositories []string `json:"repositories"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&ctlg); err != nil {
+			t.Fatalf("error decoding fetched manifest: %v", err)
+		}
+
+		if len(ctlg.Repositories) != len(expected) || (len(expected) > 0 && ctlg.Repositories[0] != expected[0]) {
+			t.Fatalf("unexpected repositories: %v != %v", ctlg.Repositories, expected)
+		}
+	}
+}
+
+// TestInmemorySnapshot checks that the content pushed to a registry with the
+// inmemory driver is saved to its snapshot path when the app is closed, and
+// loaded by the next app.
+func TestInmemorySnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inmemory-snapshot-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{"snapshotpath": dir + "/snapshot.tar"},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+
+	name := "foo/snapshot"
+	env := newTestEnvWithConfig(t, &config)
+	content, dgst := makeRandomBlob(t)
+	uploadURLBase, _ := startPushLayer(t, env.builder, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+
+	env.server.Close()
+	if err := env.app.Close(); err != nil {
+		t.Fatalf("unexpected error closing app: %v", err)
+	}
+
+	env = newTestEnvWithConfig(t, &config)
+	defer env.server.Close()
+
+	resp, pulled, err := pullBlob(t, env, name, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error pulling layer: %v", err)
+	}
+	checkResponse(t, "pulling layer", resp, http.StatusOK)
+	if !bytes.Equal(pulled, content) {
+		t.Fatalf("unexpected content pulled")
+	}
+}
+
+// TestMirrorClose checks that the writes queued by the mirror storage
+// middleware are replicated to the secondary when the app is closed.
+func TestMirrorClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"storage": {{
+				Name: "mirror",
+				Options: configuration.Parameters{
+					"driver":     "filesystem",
+					"parameters": map[string]interface{}{"rootdirectory": dir},
+					"async":      true,
+				},
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+
+	name := "foo/mirror"
+	env := newTestEnvWithConfig(t, &config)
+	content, dgst := makeRandomBlob(t)
+	uploadURLBase, _ := startPushLayer(t, env.builder, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+
+	env.server.Close()
+	if err := env.app.Close(); err != nil {
+		t.Fatalf("unexpected error closing app: %v", err)
+	}
+
+	hex := dgst.Hex()
+	replicated, err := ioutil.ReadFile(filepath.Join(dir, "docker/registry/v2/blobs", string(dgst.Algorithm()), hex[:2], hex, "data"))
+	if err != nil {
+		t.Fatalf("unexpected error reading replicated blob: %v", err)
+	}
+	if !bytes.Equal(replicated, content) {
+		t.Fatalf("unexpected content replicated")
+	}
+}
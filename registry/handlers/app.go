@@ -4,10 +4,13 @@ import (
 	cryptorand "crypto/rand"
 	"expvar"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -16,19 +19,23 @@ import (
 	ctxu "github.com/docker/distribution/context"
 	"github.com/docker/distribution/health"
 	"github.com/docker/distribution/health/checks"
+	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/notifications"
 	"github.com/docker/distribution/registry/api/errcode"
 	"github.com/docker/distribution/registry/api/v2"
 	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/auth/acl"
 	registrymiddleware "github.com/docker/distribution/registry/middleware/registry"
 	repositorymiddleware "github.com/docker/distribution/registry/middleware/repository"
 	"github.com/docker/distribution/registry/proxy"
 	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/cache"
 	memorycache "github.com/docker/distribution/registry/storage/cache/memory"
 	rediscache "github.com/docker/distribution/registry/storage/cache/redis"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/factory"
 	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+	"github.com/docker/distribution/uuid"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/mux"
 	"golang.org/x/net/context"
@@ -54,16 +61,28 @@ type App struct {
 	registry         distribution.Namespace      // registry is the primary registry backend for the app instance.
 	accessController auth.AccessController       // main access controller for application
 
+	// driverClosers close the storage driver and the storage middlewares
+	// that keep state to write on shutdown, such as the snapshot of the
+	// inmemory driver or the replication queue of the mirror middleware,
+	// outermost first.
+	driverClosers []io.Closer
+
 	// events contains notification related configuration.
 	events struct {
-		sink   notifications.Sink
-		source notifications.SourceRecord
+		sink      notifications.Sink
+		source    notifications.SourceRecord
+		endpoints []*notifications.Endpoint // configured endpoints, for administration
+		log       *notifications.EventLog   // durable event log, may be nil
 	}
 
 	redis *redis.Pool
 
 	// true if this registry is configured as a pull through cache
 	isCache bool
+
+	// watcher syncs the watched repositories of a pull through cache, may
+	// be nil
+	watcher *proxy.Watcher
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
@@ -74,7 +93,7 @@ func NewApp(ctx context.Context, configuration configuration.Configuration) *App
 		Config:  configuration,
 		Context: ctx,
 		router:  v2.RouterWithPrefix(configuration.HTTP.Prefix),
-		isCache: configuration.Proxy.RemoteURL != "",
+		isCache: configuration.Proxy.RemoteURL != "" || len(configuration.Proxy.Upstreams) > 0,
 	}
 
 	app.Context = ctxu.WithLogger(app.Context, ctxu.GetLogger(app, "instance.id"))
@@ -90,6 +109,16 @@ func NewApp(ctx context.Context, configuration configuration.Configuration) *App
 	app.register(v2.RouteNameBlobUpload, blobUploadDispatcher)
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
 
+	if configuration.HTTP.Admin.Enabled {
+		// Access to the administrative api must be granted explicitly, by
+		// the claims of a token or by a policy. Any other access controller
+		// would authorize every authenticated user.
+		if !adminGrantable(configuration.Auth) {
+			panic("the administrative api requires token auth, or a policy granting access to the registry:admin resource")
+		}
+		app.registerAdmin()
+	}
+
 	var err error
 	app.driver, err = factory.Create(configuration.Storage.Type(), configuration.Storage.Parameters())
 	if err != nil {
@@ -98,6 +127,9 @@ func NewApp(ctx context.Context, configuration configuration.Configuration) *App
 		// a health check.
 		panic(err)
 	}
+	if closer, ok := app.driver.(io.Closer); ok {
+		app.driverClosers = append(app.driverClosers, closer)
+	}
 
 	purgeConfig := uploadPurgeDefaultConfig()
 	if mc, ok := configuration.Storage["maintenance"]; ok {
@@ -112,10 +144,12 @@ func NewApp(ctx context.Context, configuration configuration.Configuration) *App
 
 	startUploadPurger(app, app.driver, ctxu.GetLogger(app), purgeConfig)
 
-	app.driver, err = applyStorageMiddleware(app.driver, configuration.Middleware["storage"])
+	var closers []io.Closer
+	app.driver, closers, err = applyStorageMiddleware(app.driver, configuration.Middleware["storage"])
 	if err != nil {
 		panic(err)
 	}
+	app.driverClosers = append(closers, app.driverClosers...)
 
 	app.configureSecret(&configuration)
 	app.configureEvents(&configuration)
@@ -176,13 +210,26 @@ func NewApp(ctx context.Context, configuration configuration.Configuration) *App
 			}
 			ctxu.GetLogger(app).Infof("using redis blob descriptor cache")
 		case "inmemory":
-			cacheProvider := memorycache.NewInMemoryBlobDescriptorCacheProvider()
+			cacheProvider := newMemoryCacheProvider(cc)
 			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
 			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
 			if err != nil {
 				panic("could not create registry: " + err.Error())
 			}
 			ctxu.GetLogger(app).Infof("using inmemory blob descriptor cache")
+		case "layered":
+			if app.redis == nil {
+				panic("redis configuration required to use for layered blob descriptor cache")
+			}
+			cacheProvider := cache.NewLayeredBlobDescriptorCacheProvider(
+				newMemoryCacheProvider(cc),
+				rediscache.NewRedisBlobDescriptorCacheProvider(app.redis))
+			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
+			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
+			if err != nil {
+				panic("could not create registry: " + err.Error())
+			}
+			ctxu.GetLogger(app).Infof("using layered inmemory and redis blob descriptor cache")
 		default:
 			if v != "" {
 				ctxu.GetLogger(app).Warnf("unknown cache type %q, caching disabled", configuration.Storage["cache"])
@@ -210,23 +257,93 @@ func NewApp(ctx context.Context, configuration configuration.Configuration) *App
 		if err != nil {
 			panic(fmt.Sprintf("unable to configure authorization (%s): %v", authType, err))
 		}
+
+		// Any access controller may be further restricted by a policy.
+		if policy, ok := configuration.Auth.Parameters()["policy"].(string); ok && policy != "" {
+			source, err := acl.NewFile(policy, acl.DefaultReloadInterval)
+			if err != nil {
+				panic(fmt.Sprintf("unable to configure authorization policy (%s): %v", policy, err))
+			}
+			accessController = acl.NewAccessController(accessController, source)
+		}
+
 		app.accessController = accessController
 		ctxu.GetLogger(app).Debugf("configured %q access controller", authType)
 	}
 
 	// configure as a pull through cache
-	if configuration.Proxy.RemoteURL != "" {
+	if configuration.Proxy.RemoteURL != "" || len(configuration.Proxy.Upstreams) > 0 {
 		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, configuration.Proxy)
 		if err != nil {
 			panic(err.Error())
 		}
 		app.isCache = true
-		ctxu.GetLogger(app).Info("Registry configured as a proxy cache to ", configuration.Proxy.RemoteURL)
+		if configuration.Proxy.RemoteURL != "" {
+			ctxu.GetLogger(app).Info("Registry configured as a proxy cache to ", configuration.Proxy.RemoteURL)
+		}
+		for _, upstream := range configuration.Proxy.Upstreams {
+			ctxu.GetLogger(app).Infof("Registry configured as a proxy cache of %s to %s", upstream.Prefix, upstream.RemoteURL)
+		}
+
+		if len(configuration.Proxy.Watch) > 0 {
+			app.watcher, err = proxy.NewWatcher(app, app.registry, configuration.Proxy.Watch, app.proxyTagSynced(&configuration))
+			if err != nil {
+				panic(err.Error())
+			}
+		}
 	}
 
 	return app
 }
 
+// ProxyPrefetch pulls the given "repository:tag" references into the proxy
+// cache, writing progress to w as JSON lines. It fails if the registry is not
+// configured as a pull through cache.
+func (app *App) ProxyPrefetch(ctx context.Context, references []string, w io.Writer) error {
+	if !app.isCache {
+		return fmt.Errorf("registry is not configured as a proxy cache")
+	}
+
+	return proxy.Prefetch(ctx, app.registry, references, w)
+}
+
+// Start starts the background work of the app only needed while serving
+// requests, such as syncing the watched repositories of a pull through cache.
+// It is not called by commands using the app for maintenance.
+func (app *App) Start() {
+	if app.watcher != nil {
+		app.watcher.Start()
+	}
+}
+
+// Close stops the background work of the app that keeps state in storage,
+// such as the expiry scheduler of a proxy cache, and writes that state. The
+// storage middlewares and driver are closed last, outermost first, so that
+// writes queued by a middleware reach the driver before it is closed.
+func (app *App) Close() error {
+	if app.watcher != nil {
+		app.watcher.Stop()
+	}
+
+	var err error
+	if closer, ok := app.registry.(io.Closer); ok {
+		err = closer.Close()
+	}
+
+	if closer, ok := app.accessController.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	for _, closer := range app.driverClosers {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 // RegisterHealthChecks is an awful hack to defer health check registration
 // control to callers. This should only ever be called once per registry
 // process, typically in a main function. The correct way would be register
@@ -343,6 +460,20 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 		})
 
 		sinks = append(sinks, endpoint)
+		app.events.endpoints = append(app.events.endpoints, endpoint)
+	}
+
+	if configuration.Notifications.EventLog.Path != "" {
+		log, err := notifications.NewEventLog(configuration.Notifications.EventLog.Path, notifications.EventLogConfig{
+			MaxSize: configuration.Notifications.EventLog.MaxSize,
+		})
+		if err != nil {
+			panic(fmt.Sprintf("unable to open event log: %v", err))
+		}
+
+		ctxu.GetLogger(app).Infof("logging events to %v", configuration.Notifications.EventLog.Path)
+		sinks = append(sinks, log)
+		app.events.log = log
 	}
 
 	// NOTE(stevvooe): Moving to a new queueing implementation is as easy as
@@ -679,6 +810,7 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			return fmt.Errorf("forbidden: no repository name")
 		}
 		accessRecords = appendCatalogAccessRecord(accessRecords, r)
+		accessRecords = appendAdminAccessRecord(accessRecords, r)
 	}
 
 	ctx, err := app.accessController.Authorized(context.Context, accessRecords...)
@@ -716,16 +848,39 @@ func (app *App) eventBridge(ctx *Context, r *http.Request) notifications.Listene
 	actor := notifications.ActorRecord{
 		Name: getUserName(ctx, r),
 	}
+	if groups, ok := ctx.Value("auth.user.groups").([]string); ok {
+		actor.Groups = groups
+	}
 	request := notifications.NewRequestRecord(ctxu.GetRequestID(ctx), r)
 
 	return notifications.NewBridge(ctx.urlBuilder, app.events.source, actor, request, app.events.sink)
 }
 
+// proxyTagSynced returns the function notifying listeners of the tags of
+// watched repositories synced into the proxy cache. Since there is no client
+// request, these are reported as pushes by the registry itself.
+func (app *App) proxyTagSynced(configuration *configuration.Configuration) proxy.SyncFunc {
+	scheme := "http"
+	if configuration.HTTP.TLS.Certificate != "" {
+		scheme = "https"
+	}
+	ub := v2.NewURLBuilder(&url.URL{Scheme: scheme, Host: app.events.source.Addr})
+
+	return func(repo string, sm *schema1.SignedManifest) {
+		request := notifications.RequestRecord{ID: uuid.Generate().String()}
+
+		bridge := notifications.NewBridge(ub, app.events.source, notifications.ActorRecord{}, request, app.events.sink)
+		if err := bridge.ManifestPushed(repo, sm); err != nil {
+			ctxu.GetLogger(app).Errorf("error dispatching synced manifest to listener: %v", err)
+		}
+	}
+}
+
 // nameRequired returns true if the route requires a name.
 func (app *App) nameRequired(r *http.Request) bool {
 	route := mux.CurrentRoute(r)
 	routeName := route.GetName()
-	return route == nil || (routeName != v2.RouteNameBase && routeName != v2.RouteNameCatalog)
+	return route == nil || (routeName != v2.RouteNameBase && routeName != v2.RouteNameCatalog && !isAdminRoute(r))
 }
 
 // apiBase implements a simple yes-man for doing overall checks against the
@@ -820,16 +975,49 @@ func applyRepoMiddleware(ctx context.Context, repository distribution.Repository
 	return repository, nil
 }
 
-// applyStorageMiddleware wraps a storage driver with the configured middlewares
-func applyStorageMiddleware(driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (storagedriver.StorageDriver, error) {
+// applyStorageMiddleware wraps a storage driver with the configured
+// middlewares. The middlewares to close on shutdown are returned, outermost
+// first.
+func applyStorageMiddleware(driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (storagedriver.StorageDriver, []io.Closer, error) {
+	var closers []io.Closer
 	for _, mw := range middlewares {
 		smw, err := storagemiddleware.Get(mw.Name, mw.Options, driver)
 		if err != nil {
-			return nil, fmt.Errorf("unable to configure storage middleware (%s): %v", mw.Name, err)
+			return nil, nil, fmt.Errorf("unable to configure storage middleware (%s): %v", mw.Name, err)
+		}
+		if closer, ok := smw.(io.Closer); ok {
+			closers = append([]io.Closer{closer}, closers...)
 		}
 		driver = smw
 	}
-	return driver, nil
+	return driver, closers, nil
+}
+
+// newMemoryCacheProvider returns an in memory blob descriptor cache, bounded
+// by the "maxentries" and "maxbytes" cache parameters, if set.
+func newMemoryCacheProvider(parameters configuration.Parameters) cache.BlobDescriptorCacheProvider {
+	bound := func(name string) int64 {
+		var n int64
+		switch v := parameters[name].(type) {
+		case nil:
+		case int:
+			n = int64(v)
+		case string:
+			var err error
+			if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+				panic(fmt.Sprintf("invalid %s for blob descriptor cache: %v", name, err))
+			}
+		default:
+			panic(fmt.Sprintf("invalid type for %s of blob descriptor cache: %#v", name, v))
+		}
+
+		if n < 0 {
+			panic(fmt.Sprintf("invalid %s for blob descriptor cache: %d", name, n))
+		}
+		return n
+	}
+
+	return memorycache.NewBoundedInMemoryBlobDescriptorCacheProvider(int(bound("maxentries")), bound("maxbytes"))
 }
 
 // uploadPurgeDefaultConfig provides a default configuration for upload
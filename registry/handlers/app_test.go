@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution/configuration"
 	"github.com/docker/distribution/context"
@@ -214,6 +215,51 @@ func TestNewApp(t *testing.T) {
 	}
 }
 
+// TestAppStartsWatcher checks that the watched repositories of a pull through
+// cache are only polled once the app is started, not by commands only
+// creating the app.
+func TestAppStartsWatcher(t *testing.T) {
+	polled := make(chan struct{}, 1)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/library/ubuntu/tags/list" {
+			select {
+			case polled <- struct{}{}:
+			default:
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer remote.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: remote.URL,
+			Watch: []configuration.ProxyWatch{
+				{Repository: "library/ubuntu", Interval: 10 * time.Millisecond},
+			},
+		},
+	}
+
+	app := NewApp(context.Background(), config)
+	defer app.Close()
+
+	select {
+	case <-polled:
+		t.Fatal("watched repository polled before the app is started")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	app.Start()
+	select {
+	case <-polled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watched repository not polled once the app is started")
+	}
+}
+
 // Test the access record accumulator
 func TestAppendAccessRecords(t *testing.T) {
 	repo := "testRepo"
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// breakerThreshold is the number of consecutive failures after which
+	// an upstream is no longer contacted
+	breakerThreshold = 3
+
+	// breakerCooldown is how long an upstream is left alone before it is
+	// tried again
+	breakerCooldown = 30 * time.Second
+)
+
+// circuitBreaker stops requests to an upstream that keeps failing. After
+// threshold consecutive failures the circuit opens, and no requests are
+// attempted until the cooldown has passed. A single request is then let
+// through: if it succeeds the circuit closes, otherwise it opens again. A nil
+// circuitBreaker allows all requests.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow returns true if a request to the upstream should be attempted. The
+// outcome of an allowed request must be reported with success or failure.
+func (cb *circuitBreaker) allow() bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.threshold {
+		return true
+	}
+
+	if cb.probing || time.Since(cb.openedAt) < cb.cooldown {
+		return false
+	}
+
+	cb.probing = true
+	return true
+}
+
+// success records that the upstream responded, closing the circuit
+func (cb *circuitBreaker) success() {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+	cb.probing = false
+}
+
+// failure records that the upstream could not be reached
+func (cb *circuitBreaker) failure() {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	cb.probing = false
+	if cb.failures >= cb.threshold {
+		cb.openedAt = time.Now()
+	}
+}
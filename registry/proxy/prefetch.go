@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+)
+
+// PrefetchEvent reports the progress of a prefetch. One event is written for
+// the manifest and for each blob of a reference, followed by a final "done"
+// or "error" event.
+type PrefetchEvent struct {
+	Reference string        `json:"reference"`
+	Status    string        `json:"status"`
+	Digest    digest.Digest `json:"digest,omitempty"`
+	Size      int64         `json:"size,omitempty"`
+	Cached    bool          `json:"cached,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Prefetch statuses
+const (
+	PrefetchStatusManifest = "manifest"
+	PrefetchStatusBlob     = "blob"
+	PrefetchStatusDone     = "done"
+	PrefetchStatusError    = "error"
+)
+
+// Prefetch pulls the manifests of the given "repository:tag" references, and
+// all the blobs they reference, into a pull through cache, as if a client had
+// pulled them. A reference without a tag refers to "latest". Progress is
+// written to w as a stream of JSON encoded PrefetchEvents, one per line. A
+// failed reference does not stop the others from being fetched, but causes
+// an error to be returned at the end.
+func Prefetch(ctx context.Context, registry distribution.Namespace, references []string, w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	var failed []string
+	for _, reference := range references {
+		if err := prefetch(ctx, registry, reference, enc); err != nil {
+			context.GetLogger(ctx).Errorf("Error prefetching %s: %v", reference, err)
+			enc.Encode(PrefetchEvent{Reference: reference, Status: PrefetchStatusError, Error: err.Error()})
+			failed = append(failed, reference)
+			continue
+		}
+
+		if err := enc.Encode(PrefetchEvent{Reference: reference, Status: PrefetchStatusDone}); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("proxy: error prefetching %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func prefetch(ctx context.Context, registry distribution.Namespace, reference string, enc *json.Encoder) error {
+	name, tag := parseReference(reference)
+
+	repo, err := registry.Repository(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	pbs, ok := repo.Blobs(ctx).(proxyBlobStore)
+	if !ok {
+		return fmt.Errorf("repository %s is not proxied", name)
+	}
+
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+
+	sm, err := manifests.GetByTag(tag)
+	if err != nil {
+		return err
+	}
+
+	dgst, err := manifestDigest(sm)
+	if err != nil {
+		return err
+	}
+
+	if err := enc.Encode(PrefetchEvent{
+		Reference: reference,
+		Status:    PrefetchStatusManifest,
+		Digest:    dgst,
+		Size:      int64(len(sm.Raw)),
+	}); err != nil {
+		return err
+	}
+
+	return fetchLayers(ctx, pbs, sm, func(desc distribution.Descriptor, cached bool) error {
+		return enc.Encode(PrefetchEvent{
+			Reference: reference,
+			Status:    PrefetchStatusBlob,
+			Digest:    desc.Digest,
+			Size:      desc.Size,
+			Cached:    cached,
+		})
+	})
+}
+
+// fetchLayers makes sure the blobs referenced by the manifest are in the
+// cache, calling fetched, if not nil, as each is found or pulled.
+func fetchLayers(ctx context.Context, pbs proxyBlobStore, sm *schema1.SignedManifest, fetched func(desc distribution.Descriptor, cached bool) error) error {
+	seen := make(map[digest.Digest]struct{})
+	for _, layer := range sm.FSLayers {
+		if _, ok := seen[layer.BlobSum]; ok {
+			continue
+		}
+		seen[layer.BlobSum] = struct{}{}
+
+		desc, cached, err := pbs.fetch(ctx, layer.BlobSum)
+		if err != nil {
+			return fmt.Errorf("error fetching blob %s: %v", layer.BlobSum, err)
+		}
+
+		if fetched != nil {
+			if err := fetched(desc, cached); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseReference splits a "repository:tag" reference. The tag defaults to
+// "latest".
+func parseReference(reference string) (string, string) {
+	i := strings.LastIndex(reference, ":")
+	if i < 0 || strings.Contains(reference[i+1:], "/") {
+		return reference, "latest"
+	}
+
+	return reference[:i], reference[i+1:]
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/registry/proxy/scheduler"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/cache/memory"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/libtrust"
+)
+
+// singleRepositoryNamespace returns the same repository for every name
+type singleRepositoryNamespace struct {
+	repo distribution.Repository
+}
+
+func (ns singleRepositoryNamespace) Scope() distribution.Scope {
+	return distribution.GlobalScope
+}
+
+func (ns singleRepositoryNamespace) Repository(ctx context.Context, name string) (distribution.Repository, error) {
+	return ns.repo, nil
+}
+
+func (ns singleRepositoryNamespace) Repositories(ctx context.Context, repos []string, last string) (int, error) {
+	return 0, distribution.ErrUnsupported
+}
+
+// localRemoteManifests stands in for the manifests of a remote repository,
+// ignoring the client-only options passed by the proxy
+type localRemoteManifests struct {
+	distribution.ManifestService
+}
+
+func (m localRemoteManifests) GetByTag(tag string, options ...distribution.ManifestServiceOption) (*schema1.SignedManifest, error) {
+	return m.ManifestService.GetByTag(tag)
+}
+
+// newProxiedTestRepo returns a namespace holding a proxied repository, and
+// the local and remote repositories behind it.
+func newProxiedTestRepo(t *testing.T, name string) (distribution.Namespace, distribution.Repository, distribution.Repository) {
+	ctx := context.Background()
+
+	newRepo := func(options ...storage.RegistryOption) distribution.Repository {
+		options = append(options, storage.BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+		registry, err := storage.NewRegistry(ctx, inmemory.New(), options...)
+		if err != nil {
+			t.Fatalf("error creating registry: %v", err)
+		}
+		repo, err := registry.Repository(ctx, name)
+		if err != nil {
+			t.Fatalf("unexpected error getting repo: %v", err)
+		}
+		return repo
+	}
+	truthRepo := newRepo()
+	localRepo := newRepo(storage.EnableDelete)
+
+	truthManifests, err := truthRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localManifests, err := localRepo.Manifests(ctx, storage.SkipLayerVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := scheduler.New(ctx, inmemory.New(), "/scheduler-state.json")
+	namespace := singleRepositoryNamespace{
+		repo: &proxiedRepository{
+			blobStore: proxyBlobStore{
+				localStore:  localRepo.Blobs(ctx),
+				remoteStore: truthRepo.Blobs(ctx),
+				scheduler:   s,
+			},
+			manifests: proxyManifestStore{
+				ctx:             ctx,
+				repositoryName:  name,
+				localManifests:  localManifests,
+				remoteManifests: localRemoteManifests{truthManifests},
+				scheduler:       s,
+			},
+			name: name,
+		},
+	}
+
+	return namespace, localRepo, truthRepo
+}
+
+// pushTestManifest pushes a manifest for the tag, with two random layers,
+// the first of which is referenced twice.
+func pushTestManifest(t *testing.T, repo distribution.Repository, tag string) (*schema1.SignedManifest, []distribution.Descriptor) {
+	ctx := context.Background()
+
+	m := schema1.Manifest{
+		Versioned: manifest.Versioned{SchemaVersion: 1},
+		Name:      repo.Name(),
+		Tag:       tag,
+	}
+
+	var layers []distribution.Descriptor
+	for i := 0; i < 2; i++ {
+		p := make([]byte, 1024)
+		rand.Read(p)
+
+		desc, err := repo.Blobs(ctx).Put(ctx, "application/octet-stream", p)
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %v", err)
+		}
+		layers = append(layers, desc)
+	}
+
+	for _, desc := range append(layers, layers[0]) {
+		m.FSLayers = append(m.FSLayers, schema1.FSLayer{BlobSum: desc.Digest})
+		m.History = append(m.History, schema1.History{V1Compatibility: "{}"})
+	}
+
+	pk, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatalf("unexpected error generating private key: %v", err)
+	}
+
+	sm, err := schema1.Sign(&m, pk)
+	if err != nil {
+		t.Fatalf("error signing manifest: %v", err)
+	}
+
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifests.Put(sm); err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+
+	return sm, layers
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	name := "foo/bar"
+
+	namespace, localRepo, truthRepo := newProxiedTestRepo(t, name)
+	_, layers := pushTestManifest(t, truthRepo, "latest")
+
+	prefetch := func(references ...string) ([]PrefetchEvent, error) {
+		var buf bytes.Buffer
+		err := Prefetch(ctx, namespace, references, &buf)
+
+		var events []PrefetchEvent
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var event PrefetchEvent
+			if err := dec.Decode(&event); err != nil {
+				t.Fatalf("error decoding prefetch event: %v", err)
+			}
+			events = append(events, event)
+		}
+
+		return events, err
+	}
+
+	events, err := prefetch(name+":latest", name+":missing")
+	if err == nil {
+		t.Fatalf("expected error prefetching missing tag")
+	}
+
+	if len(events) != 5 {
+		t.Fatalf("unexpected prefetch events: %#v", events)
+	}
+
+	for i, status := range []string{
+		PrefetchStatusManifest,
+		PrefetchStatusBlob,
+		PrefetchStatusBlob,
+		PrefetchStatusDone,
+		PrefetchStatusError,
+	} {
+		if events[i].Status != status {
+			t.Fatalf("unexpected status of event %d: %q != %q", i, events[i].Status, status)
+		}
+	}
+
+	for i, desc := range layers {
+		event := events[i+1]
+		if event.Digest != desc.Digest || event.Size != desc.Size || event.Cached {
+			t.Fatalf("unexpected blob event: %#v", event)
+		}
+
+		if _, err := localRepo.Blobs(ctx).Stat(ctx, desc.Digest); err != nil {
+			t.Fatalf("blob %s not fetched: %v", desc.Digest, err)
+		}
+	}
+
+	if events[4].Reference != name+":missing" || events[4].Error == "" {
+		t.Fatalf("unexpected error event: %#v", events[4])
+	}
+
+	// The tag defaults to latest, and blobs now come from the cache
+	events, err = prefetch(name)
+	if err != nil {
+		t.Fatalf("unexpected error prefetching: %v", err)
+	}
+
+	if len(events) != 4 || !events[1].Cached || !events[2].Cached {
+		t.Fatalf("unexpected prefetch events: %#v", events)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	for reference, expected := range map[string][2]string{
+		"library/ubuntu":                  {"library/ubuntu", "latest"},
+		"library/ubuntu:14.04":            {"library/ubuntu", "14.04"},
+		"localhost:5000/library/ubuntu":   {"localhost:5000/library/ubuntu", "latest"},
+		"localhost:5000/library/ubuntu:1": {"localhost:5000/library/ubuntu", "1"},
+	} {
+		name, tag := parseReference(reference)
+		if name != expected[0] || tag != expected[1] {
+			t.Fatalf("unexpected parse of %q: %q %q", reference, name, tag)
+		}
+	}
+}
@@ -19,23 +19,47 @@ type credentials struct {
 }
 
 func (c credentials) Basic(u *url.URL) (string, string) {
-	up := c.creds[u.String()]
+	up, ok := c.creds[u.String()]
+	if !ok {
+		// basic auth challenges are answered for the requested url, so
+		// fall back to the credentials for its host
+		up = c.creds[u.Host]
+	}
 
 	return up.username, up.password
 }
 
-// ConfigureAuth authorizes with the upstream registry
+// ConfigureAuth authorizes with the upstream registry. The credentials are
+// offered to the token realms in the challenges of the registry, and in
+// basic auth challenges from the registry itself.
 func ConfigureAuth(remoteURL, username, password string, cm auth.ChallengeManager) (auth.CredentialStore, error) {
-	if err := ping(cm, remoteURL+"/v2/", "Docker-Distribution-Api-Version"); err != nil {
+	endpoint := remoteURL + "/v2/"
+	if err := ping(cm, endpoint, "Docker-Distribution-Api-Version"); err != nil {
 		return nil, err
 	}
 
+	up := userpass{
+		username: username,
+		password: password,
+	}
 	creds := map[string]userpass{
-		tokenURL: {
-			username: username,
-			password: password,
-		},
+		tokenURL: up,
+	}
+
+	if u, err := url.Parse(remoteURL); err == nil {
+		creds[u.Host] = up
+	}
+
+	challenges, err := cm.GetChallenges(endpoint)
+	if err != nil {
+		return nil, err
 	}
+	for _, c := range challenges {
+		if realm, ok := c.Parameters["realm"]; ok && c.Scheme == "bearer" {
+			creds[realm] = up
+		}
+	}
+
 	return credentials{creds: creds}, nil
 }
 
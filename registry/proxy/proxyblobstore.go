@@ -2,8 +2,9 @@ package proxy
 
 import (
 	"io"
+	"io/ioutil"
 	"net/http"
-	"strconv"
+	"os"
 	"sync"
 	"time"
 
@@ -13,20 +14,32 @@ import (
 	"github.com/docker/distribution/registry/proxy/scheduler"
 )
 
-// todo(richardscothern): from cache control header or config file
-const blobTTL = time.Duration(24 * 7 * time.Hour)
-
 type proxyBlobStore struct {
 	localStore  distribution.BlobStore
 	remoteStore distribution.BlobService
 	scheduler   *scheduler.TTLExpirationScheduler
+	origin      string        // url of the remote registry
+	ttl         time.Duration // how long pulled blobs are cached
+	spoolDir    string        // where downloads are spooled, the system temporary directory if empty
 }
 
 var _ distribution.BlobStore = proxyBlobStore{}
 
+// inflightBlob is a blob being fetched from the remote. As it is written to
+// local storage, the download is also spooled to a temporary file, from which
+// any number of clients read concurrently, each at its own offset, while the
+// download is in progress. Readers wait for data not yet received on a
+// condition variable.
 type inflightBlob struct {
-	refCount int
-	bw       distribution.BlobWriter
+	desc distribution.Descriptor
+	file *os.File
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	written  int64 // bytes spooled to file
+	done     bool  // download finished, successfully or not
+	err      error // download error, if any
+	refCount int   // clients and download using file
 }
 
 // inflight tracks currently downloading blobs
@@ -35,13 +48,6 @@ var inflight = make(map[digest.Digest]*inflightBlob)
 // mu protects inflight
 var mu sync.Mutex
 
-func setResponseHeaders(w http.ResponseWriter, length int64, mediaType string, digest digest.Digest) {
-	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
-	w.Header().Set("Content-Type", mediaType)
-	w.Header().Set("Docker-Content-Digest", digest.String())
-	w.Header().Set("Etag", digest.String())
-}
-
 func (pbs proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
 	desc, err := pbs.localStore.Stat(ctx, dgst)
 	if err != nil && err != distribution.ErrBlobUnknown {
@@ -50,6 +56,7 @@ func (pbs proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 
 	if err == nil {
 		proxyMetrics.BlobPush(uint64(desc.Size))
+		pbs.scheduler.AccessBlob(dgst.String())
 		return pbs.localStore.ServeBlob(ctx, w, r, dgst)
 	}
 
@@ -58,121 +65,277 @@ func (pbs proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 		return err
 	}
 
-	remoteReader, err := pbs.remoteStore.Open(ctx, dgst)
-	if err != nil {
-		return err
-	}
-
-	bw, isNew, cleanup, err := getOrCreateBlobWriter(ctx, pbs.localStore, desc)
+	blob, isNew, err := getOrCreateInflightBlob(desc, pbs.spoolDir)
 	if err != nil {
 		return err
 	}
-	defer cleanup()
+	defer blob.release()
 
 	if isNew {
-		go func() {
-			err := streamToStorage(ctx, remoteReader, desc, bw)
-			if err != nil {
-				context.GetLogger(ctx).Error(err)
-			}
-
-			proxyMetrics.BlobPull(uint64(desc.Size))
-		}()
-		err := streamToClient(ctx, w, desc, bw)
-		if err != nil {
+		if err := pbs.startDownload(ctx, blob); err != nil {
 			return err
 		}
-
-		proxyMetrics.BlobPush(uint64(desc.Size))
-		pbs.scheduler.AddBlob(dgst.String(), blobTTL)
-		return nil
 	}
 
-	err = streamToClient(ctx, w, desc, bw)
-	if err != nil {
+	if err := blob.serve(w, r); err != nil {
 		return err
 	}
+
 	proxyMetrics.BlobPush(uint64(desc.Size))
 	return nil
 }
 
-type cleanupFunc func()
+// startDownload fetches the blob from the remote in the background, writing
+// it to local storage and scheduling it for expiry once committed.
+func (pbs proxyBlobStore) startDownload(ctx context.Context, blob *inflightBlob) error {
+	remoteReader, err := pbs.remoteStore.Open(ctx, blob.desc.Digest)
+	if err != nil {
+		blob.finish(err)
+		return err
+	}
 
-// getOrCreateBlobWriter will track which blobs are currently being downloaded and enable client requesting
-// the same blob concurrently to read from the existing stream.
-func getOrCreateBlobWriter(ctx context.Context, blobs distribution.BlobService, desc distribution.Descriptor) (distribution.BlobWriter, bool, cleanupFunc, error) {
-	mu.Lock()
-	defer mu.Unlock()
-	dgst := desc.Digest
-
-	cleanup := func() {
-		mu.Lock()
-		defer mu.Unlock()
-		inflight[dgst].refCount--
-
-		if inflight[dgst].refCount == 0 {
-			defer delete(inflight, dgst)
-			_, err := inflight[dgst].bw.Commit(ctx, desc)
-			if err != nil {
-				// There is a narrow race here where Commit can be called while this blob's TTL is expiring
-				// and its being removed from storage.  In that case, the client stream will continue
-				// uninterruped and the blob will be pulled through on the next request, so just log it
-				context.GetLogger(ctx).Errorf("Error committing blob: %q", err)
-			}
+	bw, err := pbs.localStore.Create(ctx)
+	if err != nil {
+		remoteReader.Close()
+		blob.finish(err)
+		return err
+	}
+
+	blob.acquire()
+	go func() {
+		defer blob.release()
+		defer remoteReader.Close()
 
+		err := blob.download(ctx, remoteReader, bw)
+		if err != nil {
+			context.GetLogger(ctx).Errorf("Error fetching blob %s: %v", blob.desc.Digest, err)
+			bw.Cancel(ctx)
+		} else if _, err = bw.Commit(ctx, blob.desc); err != nil {
+			// There is a narrow race here where Commit can be called while this blob's TTL is expiring
+			// and its being removed from storage.  In that case, the client stream will continue
+			// uninterruped and the blob will be pulled through on the next request, so just log it
+			context.GetLogger(ctx).Errorf("Error committing blob: %q", err)
+		} else {
+			proxyMetrics.BlobPull(uint64(blob.desc.Size))
+			pbs.scheduler.AddBlob(blob.desc.Digest.String(), pbs.origin, blob.desc.Size, pbs.ttl)
 		}
+
+		blob.finish(err)
+	}()
+
+	return nil
+}
+
+// fetch makes sure the blob is in local storage, pulling it from the remote
+// if needed, without serving it to a client. It returns true if the blob was
+// already cached.
+func (pbs proxyBlobStore) fetch(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, bool, error) {
+	desc, err := pbs.localStore.Stat(ctx, dgst)
+	if err != nil && err != distribution.ErrBlobUnknown {
+		return distribution.Descriptor{}, false, err
 	}
 
-	var bw distribution.BlobWriter
-	_, ok := inflight[dgst]
-	if ok {
-		bw = inflight[dgst].bw
-		inflight[dgst].refCount++
-		return bw, false, cleanup, nil
+	if err == nil {
+		pbs.scheduler.AccessBlob(dgst.String())
+		return desc, true, nil
 	}
 
-	var err error
-	bw, err = blobs.Create(ctx)
+	desc, err = pbs.remoteStore.Stat(ctx, dgst)
 	if err != nil {
-		return nil, false, nil, err
+		return distribution.Descriptor{}, false, err
+	}
+
+	blob, isNew, err := getOrCreateInflightBlob(desc, pbs.spoolDir)
+	if err != nil {
+		return distribution.Descriptor{}, false, err
+	}
+	defer blob.release()
+
+	if isNew {
+		if err := pbs.startDownload(ctx, blob); err != nil {
+			return distribution.Descriptor{}, false, err
+		}
 	}
 
-	inflight[dgst] = &inflightBlob{refCount: 1, bw: bw}
-	return bw, true, cleanup, nil
+	return desc, false, blob.wait()
 }
 
-func streamToStorage(ctx context.Context, remoteReader distribution.ReadSeekCloser, desc distribution.Descriptor, bw distribution.BlobWriter) error {
-	_, err := io.CopyN(bw, remoteReader, desc.Size)
+// getOrCreateInflightBlob returns the download of the blob in progress, or a
+// new one if there is none, in which case the caller must start it. The
+// caller must release the returned blob when done with it. A new download is
+// spooled to a file in dir.
+func getOrCreateInflightBlob(desc distribution.Descriptor, dir string) (*inflightBlob, bool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if blob, ok := inflight[desc.Digest]; ok {
+		blob.acquire()
+		return blob, false, nil
+	}
+
+	file, err := ioutil.TempFile(dir, "proxy-blob-")
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	return nil
+	blob := &inflightBlob{
+		desc:     desc,
+		file:     file,
+		refCount: 1,
+	}
+	blob.cond = sync.NewCond(&blob.mu)
+
+	inflight[desc.Digest] = blob
+	return blob, true, nil
 }
 
-func streamToClient(ctx context.Context, w http.ResponseWriter, desc distribution.Descriptor, bw distribution.BlobWriter) error {
-	setResponseHeaders(w, desc.Size, desc.MediaType, desc.Digest)
+func (blob *inflightBlob) acquire() {
+	blob.mu.Lock()
+	defer blob.mu.Unlock()
+	blob.refCount++
+}
 
-	reader, err := bw.Reader()
-	if err != nil {
-		return err
+// release removes the spooled download once it is no longer used
+func (blob *inflightBlob) release() {
+	blob.mu.Lock()
+	defer blob.mu.Unlock()
+
+	blob.refCount--
+	if blob.refCount == 0 {
+		blob.file.Close()
+		os.Remove(blob.file.Name())
+	}
+}
+
+// download copies the blob from the remote to the local blob writer and the
+// spool file.
+func (blob *inflightBlob) download(ctx context.Context, remoteReader io.Reader, bw distribution.BlobWriter) error {
+	_, err := io.CopyN(io.MultiWriter(bw, spoolWriter{blob}), remoteReader, blob.desc.Size)
+	return err
+}
+
+// finish records the end of the download, waking up waiting readers. New
+// requests are then served from local storage, or fetch the blob again,
+// while clients already reading from the spooled download continue
+// undisturbed.
+func (blob *inflightBlob) finish(err error) {
+	mu.Lock()
+	if inflight[blob.desc.Digest] == blob {
+		delete(inflight, blob.desc.Digest)
+	}
+	mu.Unlock()
+
+	blob.mu.Lock()
+	defer blob.mu.Unlock()
+
+	if blob.done {
+		return
+	}
+
+	if err == nil && blob.written < blob.desc.Size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	blob.done, blob.err = true, err
+	blob.cond.Broadcast()
+}
+
+// wait blocks until the download has finished and returns its error
+func (blob *inflightBlob) wait() error {
+	blob.mu.Lock()
+	defer blob.mu.Unlock()
+
+	for !blob.done {
+		blob.cond.Wait()
+	}
+
+	return blob.err
+}
+
+// spoolWriter appends to the spool file of a blob, waking up readers
+// waiting for the data
+type spoolWriter struct {
+	blob *inflightBlob
+}
+
+func (sw spoolWriter) Write(p []byte) (int, error) {
+	n, err := sw.blob.file.Write(p)
+
+	sw.blob.mu.Lock()
+	sw.blob.written += int64(n)
+	sw.blob.cond.Broadcast()
+	sw.blob.mu.Unlock()
+
+	return n, err
+}
+
+// ReadAt reads the downloaded blob at off, waiting until len(p) bytes, or the
+// rest of the blob, have been received.
+func (blob *inflightBlob) ReadAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > blob.desc.Size {
+		end = blob.desc.Size
+	}
+
+	blob.mu.Lock()
+	for blob.written < end && !blob.done {
+		blob.cond.Wait()
 	}
-	defer reader.Close()
-	teeReader := io.TeeReader(reader, w)
-	buf := make([]byte, 32768, 32786)
-	var soFar int64
-	for {
-		rd, err := teeReader.Read(buf)
-		if err == nil || err == io.EOF {
-			soFar += int64(rd)
-			if soFar < desc.Size {
-				// buffer underflow, keep trying
-				continue
-			}
-			return nil
+	written, err := blob.written, blob.err
+	blob.mu.Unlock()
+
+	if off >= written {
+		if err != nil {
+			return 0, err
 		}
-		return err
+		return 0, io.EOF
+	}
+
+	if end > written {
+		end = written
+	}
+
+	n, rerr := blob.file.ReadAt(p[:end-off], off)
+	if rerr != nil {
+		return n, rerr
+	}
+
+	if n < len(p) {
+		if err != nil {
+			return n, err
+		}
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// serve writes the blob to the client as it is downloaded, honoring range
+// requests.
+func (blob *inflightBlob) serve(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", blob.desc.MediaType)
+	w.Header().Set("Docker-Content-Digest", blob.desc.Digest.String())
+	w.Header().Set("Etag", blob.desc.Digest.String())
+
+	content := &errorRecorder{ReadSeeker: io.NewSectionReader(blob, 0, blob.desc.Size)}
+	http.ServeContent(w, r, "", time.Time{}, content)
+
+	return content.err
+}
+
+// errorRecorder keeps the first read error other than io.EOF, as
+// http.ServeContent does not report errors.
+type errorRecorder struct {
+	io.ReadSeeker
+	err error
+}
+
+func (er *errorRecorder) Read(p []byte) (int, error) {
+	n, err := er.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF && er.err == nil {
+		er.err = err
 	}
+	return n, err
 }
 
 func (pbs proxyBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
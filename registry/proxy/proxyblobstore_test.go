@@ -1,10 +1,17 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/rand"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/context"
@@ -235,3 +242,167 @@ func TestProxyStoreServe(t *testing.T) {
 	}
 
 }
+
+// pipeBlobService serves a single blob, whose content is sent through a pipe
+// by the test as the remote download progresses
+type pipeBlobService struct {
+	distribution.BlobService
+	desc  distribution.Descriptor
+	pr    *io.PipeReader
+	opens *int32
+}
+
+type pipeReadSeekCloser struct {
+	*io.PipeReader
+}
+
+func (pipeReadSeekCloser) Seek(offset int64, whence int) (int64, error) {
+	return 0, fmt.Errorf("seek not supported")
+}
+
+func (pbs pipeBlobService) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	if dgst != pbs.desc.Digest {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	return pbs.desc, nil
+}
+
+func (pbs pipeBlobService) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	atomic.AddInt32(pbs.opens, 1)
+	return pipeReadSeekCloser{pbs.pr}, nil
+}
+
+func TestProxyStoreServeInflight(t *testing.T) {
+	te := makeTestEnv(t, "foo/bar")
+
+	content := make([]byte, 1<<20)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := digest.FromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opens int32
+	pr, pw := io.Pipe()
+	te.store.remoteStore = pipeBlobService{
+		desc:  distribution.Descriptor{Digest: dgst, Size: int64(len(content)), MediaType: "application/octet-stream"},
+		pr:    pr,
+		opens: &opens,
+	}
+
+	spoolDir, err := ioutil.TempDir("", "proxy-spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+	te.store.spoolDir = spoolDir
+
+	spooled := func() int {
+		files, err := ioutil.ReadDir(spoolDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+
+	type result struct {
+		status int
+		body   []byte
+		err    error
+	}
+
+	serve := func(rangeHeader string) <-chan result {
+		results := make(chan result, 1)
+		go func() {
+			r, err := http.NewRequest("GET", "", nil)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			if rangeHeader != "" {
+				r.Header.Set("Range", rangeHeader)
+			}
+
+			w := httptest.NewRecorder()
+			err = te.store.ServeBlob(te.ctx, w, r, dgst)
+			results <- result{w.Code, w.Body.Bytes(), err}
+		}()
+		return results
+	}
+
+	check := func(res result, status int, expected []byte) {
+		if res.err != nil {
+			t.Fatalf("error serving blob: %v", res.err)
+		}
+		if res.status != status {
+			t.Fatalf("unexpected status: %d != %d", res.status, status)
+		}
+		if !bytes.Equal(res.body, expected) {
+			t.Fatalf("unexpected content of %d bytes, expected %d bytes", len(res.body), len(expected))
+		}
+	}
+
+	// Start a full download, and send half the blob from the remote
+	full := serve("")
+	half := len(content) / 2
+	if _, err := pw.Write(content[:half]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The download is spooled to the configured directory
+	if n := spooled(); n != 1 {
+		t.Fatalf("expected the download to be spooled to %s, found %d files", spoolDir, n)
+	}
+
+	// A range already received is served before the download completes
+	select {
+	case res := <-serve("bytes=100-199"):
+		check(res, http.StatusPartialContent, content[100:200])
+	case <-time.After(5 * time.Second):
+		t.Fatalf("range request within received data did not complete")
+	}
+
+	// A range not yet received waits for the data
+	late := serve(fmt.Sprintf("bytes=%d-%d", half+100, half+199))
+	select {
+	case <-late:
+		t.Fatalf("range request completed before the data was received")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := pw.Write(content[half:]); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+
+	check(<-late, http.StatusPartialContent, content[half+100:half+200])
+	check(<-full, http.StatusOK, content)
+
+	if atomic.LoadInt32(&opens) != 1 {
+		t.Fatalf("expected a single download from the remote, got %d", opens)
+	}
+
+	// Once committed, the blob is served from local storage
+	for i := 0; ; i++ {
+		if _, err := te.store.localStore.Stat(te.ctx, dgst); err == nil {
+			break
+		} else if i == 100 {
+			t.Fatalf("blob was not committed to local storage: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	check(<-serve("bytes=0-9"), http.StatusPartialContent, content[:10])
+	if atomic.LoadInt32(&opens) != 1 {
+		t.Fatalf("expected a single download from the remote, got %d", opens)
+	}
+
+	for i := 0; spooled() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("spooled download was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
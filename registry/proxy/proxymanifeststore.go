@@ -1,25 +1,53 @@
 package proxy
 
 import (
+	"sync"
 	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/digest"
 	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/registry/api/errcode"
 	"github.com/docker/distribution/registry/client"
 	"github.com/docker/distribution/registry/proxy/scheduler"
 )
 
-// todo(richardscothern): from cache control header or config
+// repositoryTTL is how long content is cached unless configured otherwise
 const repositoryTTL = time.Duration(24 * 7 * time.Hour)
 
+const (
+	// staleWarning marks a cached manifest served without contacting the
+	// remote, as its circuit is open
+	staleWarning = `110 - "Response is Stale"`
+
+	// revalidationFailedWarning marks a cached manifest served because the
+	// remote could not be reached
+	revalidationFailedWarning = `111 - "Revalidation Failed"`
+
+	// staleRetries is the number of times a stale tag is fetched again in
+	// the background, waiting staleRetryBackoff, then twice as long, and so
+	// on between attempts
+	staleRetries      = 5
+	staleRetryBackoff = time.Second
+)
+
+// refreshing tracks the tags being fetched again in the background, by
+// repository and tag
+var refreshing = make(map[string]struct{})
+
+// refreshingMu protects refreshing
+var refreshingMu sync.Mutex
+
 type proxyManifestStore struct {
 	ctx             context.Context
 	localManifests  distribution.ManifestService
 	remoteManifests distribution.ManifestService
 	repositoryName  string
 	scheduler       *scheduler.TTLExpirationScheduler
+	origin          string        // url of the remote registry
+	ttl             time.Duration // how long pulled manifests are cached
+	breaker         *circuitBreaker
 }
 
 var _ distribution.ManifestService = &proxyManifestStore{}
@@ -40,6 +68,7 @@ func (pms proxyManifestStore) Get(dgst digest.Digest) (*schema1.SignedManifest,
 	sm, err := pms.localManifests.Get(dgst)
 	if err == nil {
 		proxyMetrics.ManifestPush(uint64(len(sm.Raw)))
+		pms.scheduler.AccessManifest(pms.repositoryName)
 		return sm, err
 	}
 
@@ -54,11 +83,12 @@ func (pms proxyManifestStore) Get(dgst digest.Digest) (*schema1.SignedManifest,
 		return nil, err
 	}
 
-	// Schedule the repo for removal
-	pms.scheduler.AddManifest(pms.repositoryName, repositoryTTL)
+	// Schedule the repo for removal. The size of the manifest is accounted
+	// to the repository, so that it is evicted as a whole.
+	pms.scheduler.AddManifest(pms.repositoryName, pms.origin, int64(len(sm.Raw)), pms.ttl)
 
 	// Ensure the manifest blob is cleaned up
-	pms.scheduler.AddBlob(dgst.String(), repositoryTTL)
+	pms.scheduler.AddBlob(dgst.String(), pms.origin, 0, pms.ttl)
 
 	proxyMetrics.ManifestPush(uint64(len(sm.Raw)))
 
@@ -100,16 +130,55 @@ func (pms proxyManifestStore) GetByTag(tag string, options ...distribution.Manif
 	}
 
 fromremote:
+	// Serve a cached manifest without waiting on a remote known to be down
+	if localManifest != nil && !pms.breaker.allow() {
+		context.GetLogger(pms.ctx).Warnf("Serving stale manifest for %q, remote %s unavailable", tag, pms.origin)
+		pms.serveStale(localManifest, staleWarning)
+		return localManifest, nil
+	}
+
 	var sm *schema1.SignedManifest
-	sm, err = pms.remoteManifests.GetByTag(tag, client.AddEtagToTag(tag, localDigest.String()))
+	sm, err = pms.pullByTag(tag, localDigest)
 	if err != nil {
-		return nil, err
+		if localManifest == nil || !isUpstreamFailure(err) {
+			return nil, err
+		}
+
+		context.GetLogger(pms.ctx).Warnf("Serving stale manifest for %q, error contacting remote %s: %v", tag, pms.origin, err)
+		pms.serveStale(localManifest, revalidationFailedWarning)
+		pms.refreshInBackground(tag, localDigest)
+		return localManifest, nil
 	}
 
 	if sm == nil {
 		context.GetLogger(pms.ctx).Debugf("Local manifest for %q is latest, dgst=%s", tag, localDigest.String())
+		pms.scheduler.AccessManifest(pms.repositoryName)
 		return localManifest, nil
 	}
+
+	proxyMetrics.ManifestPush(uint64(len(sm.Raw)))
+
+	return sm, err
+}
+
+// pullByTag fetches the manifest of the tag from the remote and caches it,
+// unless the remote manifest has localDigest, in which case nil is returned.
+// The outcome is recorded by the circuit breaker.
+func (pms proxyManifestStore) pullByTag(tag string, localDigest digest.Digest) (*schema1.SignedManifest, error) {
+	sm, err := pms.remoteManifests.GetByTag(tag, client.AddEtagToTag(tag, localDigest.String()))
+	if err != nil {
+		if isUpstreamFailure(err) {
+			pms.breaker.failure()
+		} else {
+			pms.breaker.success()
+		}
+		return nil, err
+	}
+	pms.breaker.success()
+
+	if sm == nil {
+		return nil, nil
+	}
 	context.GetLogger(pms.ctx).Debugf("Updated manifest for %q, dgst=%s", tag, localDigest.String())
 
 	err = pms.localManifests.Put(sm)
@@ -121,13 +190,81 @@ fromremote:
 	if err != nil {
 		return nil, err
 	}
-	pms.scheduler.AddBlob(dgst.String(), repositoryTTL)
-	pms.scheduler.AddManifest(pms.repositoryName, repositoryTTL)
+	pms.scheduler.AddBlob(dgst.String(), pms.origin, 0, pms.ttl)
+	pms.scheduler.AddManifest(pms.repositoryName, pms.origin, int64(len(sm.Raw)), pms.ttl)
 
 	proxyMetrics.ManifestPull(uint64(len(sm.Raw)))
+
+	return sm, nil
+}
+
+// serveStale counts a cached manifest served without being revalidated, and
+// adds the warning to the response.
+func (pms proxyManifestStore) serveStale(sm *schema1.SignedManifest, warning string) {
+	proxyMetrics.ManifestStale()
 	proxyMetrics.ManifestPush(uint64(len(sm.Raw)))
 
-	return sm, err
+	if w, err := context.GetResponseWriter(pms.ctx); err == nil {
+		w.Header().Add("Warning", warning)
+	}
+}
+
+// refreshInBackground keeps trying to fetch the tag from the remote, with
+// exponential backoff, so that the cached manifest is updated once the
+// remote recovers. Attempts are skipped while the circuit is open.
+func (pms proxyManifestStore) refreshInBackground(tag string, localDigest digest.Digest) {
+	key := pms.repositoryName + ":" + tag
+
+	refreshingMu.Lock()
+	defer refreshingMu.Unlock()
+
+	if _, ok := refreshing[key]; ok {
+		return
+	}
+	refreshing[key] = struct{}{}
+
+	go func() {
+		defer func() {
+			refreshingMu.Lock()
+			delete(refreshing, key)
+			refreshingMu.Unlock()
+		}()
+
+		backoff := staleRetryBackoff
+		for i := 0; i < staleRetries; i++ {
+			time.Sleep(backoff)
+			backoff *= 2
+
+			if !pms.breaker.allow() {
+				continue
+			}
+
+			_, err := pms.pullByTag(tag, localDigest)
+			if err == nil {
+				context.GetLogger(pms.ctx).Infof("Refreshed stale manifest for %q from %s", key, pms.origin)
+				return
+			}
+
+			if !isUpstreamFailure(err) {
+				context.GetLogger(pms.ctx).Errorf("Error refreshing stale manifest for %q: %v", key, err)
+				return
+			}
+		}
+
+		context.GetLogger(pms.ctx).Errorf("Giving up refreshing stale manifest for %q from %s", key, pms.origin)
+	}()
+}
+
+// isUpstreamFailure returns true if err is a failure to get an answer from
+// the remote, such as a network error, a timeout or a server error, rather
+// than an error response from the registry.
+func isUpstreamFailure(err error) bool {
+	switch err.(type) {
+	case errcode.Errors, errcode.Error, errcode.ErrorCode, *client.UnexpectedHTTPResponseError:
+		return false
+	}
+
+	return true
 }
 
 func manifestDigest(sm *schema1.SignedManifest) (digest.Digest, error) {
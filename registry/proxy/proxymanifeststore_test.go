@@ -2,13 +2,18 @@ package proxy
 
 import (
 	"io"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/digest"
 	"github.com/docker/distribution/manifest"
 	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/client"
 	"github.com/docker/distribution/registry/proxy/scheduler"
 	"github.com/docker/distribution/registry/storage"
 	"github.com/docker/distribution/registry/storage/cache/memory"
@@ -240,3 +245,92 @@ func TestProxyManifests(t *testing.T) {
 	}
 
 }
+
+// fixedManifests serves a single manifest by tag, or fails with err
+type fixedManifests struct {
+	distribution.ManifestService
+	sm    *schema1.SignedManifest
+	err   error
+	calls *int
+}
+
+func (fm fixedManifests) GetByTag(tag string, options ...distribution.ManifestServiceOption) (*schema1.SignedManifest, error) {
+	if fm.calls != nil {
+		*fm.calls++
+	}
+	return fm.sm, fm.err
+}
+
+func TestProxyManifestsStale(t *testing.T) {
+	pk, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm, err := schema1.Sign(&schema1.Manifest{
+		Versioned: manifest.Versioned{SchemaVersion: 1},
+		Name:      "foo/bar",
+		Tag:       "latest",
+	}, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var remoteCalls int
+	ctx := context.Background()
+	pms := proxyManifestStore{
+		localManifests:  fixedManifests{sm: sm},
+		remoteManifests: fixedManifests{err: &client.UnexpectedHTTPStatusError{Status: "503 Service Unavailable"}, calls: &remoteCalls},
+		repositoryName:  "foo/bar",
+		scheduler:       scheduler.New(ctx, inmemory.New(), "/scheduler-state.json"),
+		breaker:         newCircuitBreaker(2, time.Hour),
+	}
+
+	stale := proxyMetrics.manifestMetrics.Stale
+	for i, expected := range []struct {
+		warning     string
+		remoteCalls int
+	}{
+		{revalidationFailedWarning, 1},
+		{revalidationFailedWarning, 2},
+		{staleWarning, 2}, // the circuit is open
+	} {
+		recorder := httptest.NewRecorder()
+		pms.ctx, _ = context.WithResponseWriter(ctx, recorder)
+
+		got, err := pms.GetByTag("latest")
+		if err != nil {
+			t.Fatalf("expected stale manifest when remote fails: %v", err)
+		}
+
+		if got != sm {
+			t.Fatalf("expected the cached manifest")
+		}
+
+		if warning := recorder.Header().Get("Warning"); warning != expected.warning {
+			t.Fatalf("unexpected warning for request %d: %q", i, warning)
+		}
+
+		if remoteCalls != expected.remoteCalls {
+			t.Fatalf("unexpected number of calls to remote for request %d: %d", i, remoteCalls)
+		}
+	}
+
+	if count := proxyMetrics.manifestMetrics.Stale - stale; count != 3 {
+		t.Fatalf("unexpected stale count: %d", count)
+	}
+
+	// Errors from the remote registry itself are returned
+	pms.breaker = nil
+	pms.remoteManifests = fixedManifests{err: errcode.Errors{v2.ErrorCodeManifestUnknown}}
+	if _, err := pms.GetByTag("latest"); err == nil {
+		t.Fatalf("expected error from remote registry to be returned")
+	}
+
+	// Without a cached manifest, remote failures are returned
+	pms.localManifests = fixedManifests{err: distribution.ErrManifestUnknown{Name: "foo/bar", Tag: "latest"}}
+	pms.remoteManifests = fixedManifests{err: &client.UnexpectedHTTPStatusError{Status: "503 Service Unavailable"}}
+	if _, err := pms.GetByTag("latest"); err == nil {
+		t.Fatalf("expected remote failure to be returned without cached manifest")
+	}
+}
@@ -13,6 +13,10 @@ type Metrics struct {
 	Misses      uint64
 	BytesPulled uint64
 	BytesPushed uint64
+
+	// Stale counts cached content served without being revalidated, as
+	// the remote registry could not be reached
+	Stale uint64
 }
 
 type proxyMetricsCollector struct {
@@ -46,6 +50,12 @@ func (pmc *proxyMetricsCollector) ManifestPush(bytesPushed uint64) {
 	atomic.AddUint64(&pmc.manifestMetrics.BytesPushed, bytesPushed)
 }
 
+// ManifestStale tracks cached manifests served to clients without being
+// revalidated against the remote
+func (pmc *proxyMetricsCollector) ManifestStale() {
+	atomic.AddUint64(&pmc.manifestMetrics.Stale, 1)
+}
+
 // proxyMetrics tracks metrics about the proxy cache.  This is
 // kept globally and made available via expvar.
 var proxyMetrics = &proxyMetricsCollector{}
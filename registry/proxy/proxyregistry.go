@@ -1,12 +1,22 @@
 package proxy
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/configuration"
 	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
 	"github.com/docker/distribution/registry/client"
 	"github.com/docker/distribution/registry/client/auth"
 	"github.com/docker/distribution/registry/client/transport"
@@ -15,22 +25,120 @@ import (
 	"github.com/docker/distribution/registry/storage/driver"
 )
 
-// proxyingRegistry fetches content from a remote registry and caches it locally
+// proxyingRegistry fetches content from remote registries and caches it locally
 type proxyingRegistry struct {
 	embedded distribution.Namespace // provides local registry functionality
 
 	scheduler *scheduler.TTLExpirationScheduler
 
-	remoteURL        string
+	// upstreams are ordered from the longest prefix to the shortest, so
+	// that the first match is the most specific
+	upstreams []*upstream
+
+	// localPrefixes are the name prefixes of repositories hosted locally
+	localPrefixes []string
+
+	// mixed allows repositories not found upstream to be hosted locally
+	mixed bool
+
+	// locality caches, in mixed mode, whether repositories not pulled
+	// through the cache are hosted locally
+	locality *localityCache
+
+	// ttlPolicies override the ttl of upstreams for matching repositories
+	ttlPolicies []configuration.ProxyTTLPolicy
+
+	// spoolDir is where blobs being pulled are spooled, the system
+	// temporary directory if empty
+	spoolDir string
+}
+
+// upstream is a remote registry mirrored for the repositories under prefix
+type upstream struct {
+	prefix       string // local repository name prefix, empty for all repositories
+	remotePrefix string // prefix of the repository name on the remote
+	remoteURL    string
+	ttl          time.Duration
+
+	// anonymous is true if no credentials are configured for the upstream
+	anonymous bool
+
 	credentialStore  auth.CredentialStore
 	challengeManager auth.ChallengeManager
+
+	transport http.RoundTripper
+	breaker   *circuitBreaker
+}
+
+// upstreamResponseTimeout is how long to wait for the response headers of an
+// upstream before the request is considered failed
+const upstreamResponseTimeout = 30 * time.Second
+
+// newUpstreamTransport returns a transport like http.DefaultTransport that
+// gives up on upstreams that do not respond.
+func newUpstreamTransport() http.RoundTripper {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: upstreamResponseTimeout,
+	}
 }
 
 // NewRegistryPullThroughCache creates a registry acting as a pull through cache
 func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy) (distribution.Namespace, error) {
-	_, err := url.Parse(config.RemoteURL)
-	if err != nil {
-		return nil, err
+	upstreamConfigs := config.Upstreams
+	if config.RemoteURL != "" {
+		upstreamConfigs = append(upstreamConfigs, configuration.ProxyUpstream{
+			Prefix:    "*",
+			RemoteURL: config.RemoteURL,
+			Username:  config.Username,
+			Password:  config.Password,
+			TTL:       config.TTL,
+		})
+	}
+
+	var upstreams []*upstream
+	for _, uc := range upstreamConfigs {
+		u, err := newUpstream(uc)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, other := range upstreams {
+			if other.prefix == u.prefix {
+				return nil, fmt.Errorf("proxy: more than one upstream for prefix %q", uc.Prefix)
+			}
+		}
+		upstreams = append(upstreams, u)
+	}
+	sort.Sort(byPrefixLength(upstreams))
+
+	var localPrefixes []string
+	for _, pattern := range config.Local {
+		prefix, err := parsePrefix(pattern)
+		if err != nil {
+			return nil, err
+		}
+		localPrefixes = append(localPrefixes, prefix)
+	}
+
+	for _, policy := range config.TTLPolicies {
+		if _, err := path.Match(policy.Repository, ""); err != nil {
+			return nil, fmt.Errorf("proxy: invalid ttl policy repository %q: %v", policy.Repository, err)
+		}
+		if policy.TTL <= 0 {
+			return nil, fmt.Errorf("proxy: ttl policy for %q requires a positive ttl", policy.Repository)
+		}
+	}
+
+	if config.SpoolDirectory != "" {
+		if err := os.MkdirAll(config.SpoolDirectory, 0700); err != nil {
+			return nil, fmt.Errorf("proxy: error creating spool directory: %v", err)
+		}
 	}
 
 	v := storage.NewVacuum(ctx, driver)
@@ -42,26 +150,126 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 	s.OnManifestExpire(func(repoName string) error {
 		return v.RemoveRepository(repoName)
 	})
-	err = s.Start()
+	s.SetMaxSize(config.MaxSize)
+	err := s.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyingRegistry{
+		embedded:      registry,
+		scheduler:     s,
+		upstreams:     upstreams,
+		localPrefixes: localPrefixes,
+		mixed:         config.Mixed,
+		locality:      newLocalityCache(localityTTL),
+		ttlPolicies:   config.TTLPolicies,
+		spoolDir:      config.SpoolDirectory,
+	}, nil
+}
+
+func newUpstream(config configuration.ProxyUpstream) (*upstream, error) {
+	if _, err := url.Parse(config.RemoteURL); err != nil {
+		return nil, err
+	}
+
+	prefix, err := parsePrefix(config.Prefix)
 	if err != nil {
 		return nil, err
 	}
 
+	remotePrefix := ""
+	if config.RemotePrefix != "" {
+		if remotePrefix, err = parsePrefix(config.RemotePrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = repositoryTTL
+	}
+
 	challengeManager := auth.NewSimpleChallengeManager()
 	cs, err := ConfigureAuth(config.RemoteURL, config.Username, config.Password, challengeManager)
 	if err != nil {
 		return nil, err
 	}
 
-	return &proxyingRegistry{
-		embedded:         registry,
-		scheduler:        s,
-		challengeManager: challengeManager,
-		credentialStore:  cs,
+	return &upstream{
+		prefix:           prefix,
+		remotePrefix:     remotePrefix,
 		remoteURL:        config.RemoteURL,
+		ttl:              ttl,
+		anonymous:        config.Username == "",
+		credentialStore:  cs,
+		challengeManager: challengeManager,
+		transport:        newUpstreamTransport(),
+		breaker:          newCircuitBreaker(breakerThreshold, breakerCooldown),
 	}, nil
 }
 
+// parsePrefix turns a prefix such as "quay/*" into the name prefix "quay/".
+// The prefix "*" matches all repositories.
+func parsePrefix(pattern string) (string, error) {
+	if pattern == "*" {
+		return "", nil
+	}
+
+	if !strings.HasSuffix(pattern, "/*") || len(pattern) == len("/*") {
+		return "", fmt.Errorf("proxy: invalid upstream prefix %q, expected a form such as \"quay/*\"", pattern)
+	}
+
+	return strings.TrimSuffix(pattern, "*"), nil
+}
+
+// remoteName returns the name of the repository on the upstream, or false
+// if the upstream does not mirror it.
+func (u *upstream) remoteName(name string) (string, bool) {
+	if !strings.HasPrefix(name, u.prefix) || name == u.prefix {
+		return "", false
+	}
+
+	return u.remotePrefix + strings.TrimPrefix(name, u.prefix), true
+}
+
+type byPrefixLength []*upstream
+
+func (b byPrefixLength) Len() int           { return len(b) }
+func (b byPrefixLength) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPrefixLength) Less(i, j int) bool { return len(b[i].prefix) > len(b[j].prefix) }
+
+// route returns the upstream mirroring the named repository, along with the
+// name of the repository on the upstream.
+func (pr *proxyingRegistry) route(name string) (*upstream, string, bool) {
+	for _, u := range pr.upstreams {
+		if remoteName, ok := u.remoteName(name); ok {
+			return u, remoteName, true
+		}
+	}
+
+	return nil, "", false
+}
+
+// ttl returns how long content pulled for the named repository from the
+// upstream is cached: the ttl of the first matching policy, or else that of
+// the upstream.
+func (pr *proxyingRegistry) ttl(u *upstream, name string) time.Duration {
+	for _, policy := range pr.ttlPolicies {
+		if matched, _ := path.Match(policy.Repository, name); matched {
+			return policy.TTL
+		}
+	}
+
+	return u.ttl
+}
+
+// Close stops the expiry scheduler, writing its state to storage
+func (pr *proxyingRegistry) Close() error {
+	pr.scheduler.Stop()
+	return nil
+}
+
 func (pr *proxyingRegistry) Scope() distribution.Scope {
 	return distribution.GlobalScope
 }
@@ -71,8 +279,22 @@ func (pr *proxyingRegistry) Repositories(ctx context.Context, repos []string, la
 }
 
 func (pr *proxyingRegistry) Repository(ctx context.Context, name string) (distribution.Repository, error) {
-	tr := transport.NewTransport(http.DefaultTransport,
-		auth.NewAuthorizer(pr.challengeManager, auth.NewTokenHandler(http.DefaultTransport, pr.credentialStore, name, "pull")))
+	for _, prefix := range pr.localPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return pr.embedded.Repository(ctx, name)
+		}
+	}
+
+	u, remoteName, ok := pr.route(name)
+	if !ok {
+		if pr.mixed {
+			return pr.embedded.Repository(ctx, name)
+		}
+		return nil, distribution.ErrRepositoryUnknown{Name: name}
+	}
+
+	tr := transport.NewTransport(u.transport,
+		auth.NewAuthorizer(u.challengeManager, auth.NewTokenHandler(u.transport, u.credentialStore, remoteName, "pull")))
 
 	localRepo, err := pr.embedded.Repository(ctx, name)
 	if err != nil {
@@ -83,7 +305,7 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name string) (distri
 		return nil, err
 	}
 
-	remoteRepo, err := client.NewRepository(ctx, name, pr.remoteURL, tr)
+	remoteRepo, err := client.NewRepository(ctx, remoteName, u.remoteURL, tr)
 	if err != nil {
 		return nil, err
 	}
@@ -93,11 +315,31 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name string) (distri
 		return nil, err
 	}
 
+	if pr.mixed && !pr.scheduler.HasManifest(name) {
+		local, ok := pr.locality.get(name)
+		if !ok {
+			local, err = isLocal(localManifests, remoteManifests, u.anonymous)
+			if err != nil {
+				return nil, err
+			}
+			pr.locality.set(name, local)
+		}
+
+		if local {
+			return localRepo, nil
+		}
+	}
+
+	ttl := pr.ttl(u, name)
+
 	return &proxiedRepository{
 		blobStore: proxyBlobStore{
 			localStore:  localRepo.Blobs(ctx),
 			remoteStore: remoteRepo.Blobs(ctx),
 			scheduler:   pr.scheduler,
+			origin:      u.remoteURL,
+			ttl:         ttl,
+			spoolDir:    pr.spoolDir,
 		},
 		manifests: proxyManifestStore{
 			repositoryName:  name,
@@ -105,12 +347,125 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name string) (distri
 			remoteManifests: remoteManifests,
 			ctx:             ctx,
 			scheduler:       pr.scheduler,
+			origin:          u.remoteURL,
+			ttl:             ttl,
+			breaker:         u.breaker,
 		},
 		name:       name,
 		signatures: localRepo.Signatures(),
 	}, nil
 }
 
+// localityTTL is how long the decision to host a repository locally, or to
+// pull it through the cache, is kept before the upstream is asked again.
+const localityTTL = 10 * time.Minute
+
+// localityCache holds whether repositories are hosted locally, so that the
+// upstream is not asked on every request for a repository, such as each
+// chunk of an upload.
+type localityCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]localityEntry
+}
+
+type localityEntry struct {
+	local   bool
+	expires time.Time
+}
+
+func newLocalityCache(ttl time.Duration) *localityCache {
+	return &localityCache{
+		ttl:     ttl,
+		entries: make(map[string]localityEntry),
+	}
+}
+
+// get returns whether the named repository is hosted locally, and false if
+// unknown or expired.
+func (lc *localityCache) get(name string) (local bool, ok bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	entry, ok := lc.entries[name]
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+	return entry.local, true
+}
+
+// set records whether the named repository is hosted locally, removing the
+// expired entries.
+func (lc *localityCache) set(name string, local bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	now := time.Now()
+	for n, entry := range lc.entries {
+		if now.After(entry.expires) {
+			delete(lc.entries, n)
+		}
+	}
+
+	lc.entries[name] = localityEntry{local: local, expires: now.Add(lc.ttl)}
+}
+
+// isLocal returns true if a repository that was not pulled through the cache
+// should be served locally: either it has been pushed already, or it does not
+// exist on the remote registry. For anonymous upstreams, authorization
+// failures are taken to mean that the repository does not exist, since that
+// is how the Docker Hub responds to requests for missing repositories. With
+// credentials, they may be invalid or expired, and the error is returned
+// rather than letting a local push shadow the remote repository.
+func isLocal(localManifests, remoteManifests distribution.ManifestService, anonymous bool) (bool, error) {
+	tags, err := localManifests.Tags()
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+			return false, err
+		}
+	}
+
+	if len(tags) > 0 {
+		return true, nil
+	}
+
+	tags, err = remoteManifests.Tags()
+	if err != nil {
+		if isNotFound(err, anonymous) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return len(tags) == 0, nil
+}
+
+// isNotFound returns true if err reports that a remote repository is unknown,
+// or, if unauthorized is true, that access to it was refused.
+func isNotFound(err error, unauthorized bool) bool {
+	switch err := err.(type) {
+	case errcode.Errors:
+		for _, e := range err {
+			if !isNotFound(e, unauthorized) {
+				return false
+			}
+		}
+		return len(err) > 0
+	case errcode.Error:
+		return isNotFound(err.Code, unauthorized)
+	case errcode.ErrorCode:
+		switch err {
+		case v2.ErrorCodeNameUnknown:
+			return true
+		case errcode.ErrorCodeUnauthorized:
+			return unauthorized
+		}
+	}
+
+	return false
+}
+
 // proxiedRepository uses proxying blob and manifest services to serve content
 // locally, or pulling it through from a remote and caching it locally if it doesn't
 // already exist
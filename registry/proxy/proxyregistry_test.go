@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/cache/memory"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func newTestUpstream(realm string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`",service="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+}
+
+func TestProxyUpstreamRouting(t *testing.T) {
+	ctx := context.Background()
+
+	hub := newTestUpstream("https://auth.hub.example.com/token")
+	defer hub.Close()
+	quay := newTestUpstream("https://quay.example.com/v2/auth")
+	defer quay.Close()
+	partner := newTestUpstream("https://auth.partner.example.com/token")
+	defer partner.Close()
+
+	driver := inmemory.New()
+	localRegistry, err := storage.NewRegistry(ctx, driver, storage.BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	config := configuration.Proxy{
+		RemoteURL: hub.URL,
+		Upstreams: []configuration.ProxyUpstream{
+			{Prefix: "quay/*", RemoteURL: quay.URL, Username: "quayuser", Password: "quaypass"},
+			{Prefix: "partner/*", RemotePrefix: "mirror/*", RemoteURL: partner.URL},
+			{Prefix: "partner/special/*", RemoteURL: hub.URL},
+		},
+	}
+
+	namespace, err := NewRegistryPullThroughCache(ctx, localRegistry, driver, config)
+	if err != nil {
+		t.Fatalf("error creating pull through cache: %v", err)
+	}
+	pr := namespace.(*proxyingRegistry)
+
+	for _, tc := range []struct {
+		name       string
+		remoteURL  string
+		remoteName string
+	}{
+		{"library/ubuntu", hub.URL, "library/ubuntu"},
+		{"quay/coreos/etcd", quay.URL, "coreos/etcd"},
+		{"quay", hub.URL, "quay"},
+		{"partner/app", partner.URL, "mirror/app"},
+		{"partner/special/app", hub.URL, "app"},
+	} {
+		u, remoteName, ok := pr.route(tc.name)
+		if !ok {
+			t.Fatalf("no upstream for %q", tc.name)
+		}
+
+		if u.remoteURL != tc.remoteURL || remoteName != tc.remoteName {
+			t.Fatalf("unexpected route for %q: %s %s, expected %s %s", tc.name, u.remoteURL, remoteName, tc.remoteURL, tc.remoteName)
+		}
+
+		if u.ttl != repositoryTTL {
+			t.Fatalf("unexpected ttl for %q: %v", tc.name, u.ttl)
+		}
+	}
+
+	// Credentials are offered to the token realm of each upstream
+	u, _, _ := pr.route("quay/coreos/etcd")
+	realm, _ := url.Parse("https://quay.example.com/v2/auth")
+	if username, password := u.credentialStore.Basic(realm); username != "quayuser" || password != "quaypass" {
+		t.Fatalf("unexpected credentials for quay realm: %q %q", username, password)
+	}
+
+	// Without a default remote, unmatched repositories are unknown
+	config.RemoteURL = ""
+	namespace, err = NewRegistryPullThroughCache(ctx, localRegistry, inmemory.New(), config)
+	if err != nil {
+		t.Fatalf("error creating pull through cache: %v", err)
+	}
+
+	if _, err := namespace.Repository(ctx, "library/ubuntu"); err == nil {
+		t.Fatalf("expected error for repository without upstream")
+	} else if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+		t.Fatalf("unexpected error for repository without upstream: %v", err)
+	}
+
+	for _, upstreams := range [][]configuration.ProxyUpstream{
+		{{Prefix: "quay", RemoteURL: quay.URL}},
+		{{Prefix: "quay/*", RemoteURL: quay.URL}, {Prefix: "quay/*", RemoteURL: hub.URL}},
+	} {
+		config.Upstreams = upstreams
+		if _, err := NewRegistryPullThroughCache(ctx, localRegistry, inmemory.New(), config); err == nil {
+			t.Fatalf("expected error with upstreams %v", upstreams)
+		}
+	}
+}
+
+func TestProxyMixedMode(t *testing.T) {
+	ctx := context.Background()
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/library/ubuntu/tags/list":
+			w.Write([]byte(`{"name": "library/ubuntu", "tags": ["latest"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer remote.Close()
+
+	pushable := func(namespace distribution.Namespace, name string) bool {
+		repo, err := namespace.Repository(ctx, name)
+		if err != nil {
+			t.Fatalf("error getting repository %q: %v", name, err)
+		}
+
+		bw, err := repo.Blobs(ctx).Create(ctx)
+		if err == distribution.ErrUnsupported {
+			return false
+		} else if err != nil {
+			t.Fatalf("error creating blob writer for %q: %v", name, err)
+		}
+		bw.Cancel(ctx)
+
+		return true
+	}
+
+	for _, mixed := range []bool{true, false} {
+		driver := inmemory.New()
+		localRegistry, err := storage.NewRegistry(ctx, driver, storage.BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+		if err != nil {
+			t.Fatalf("error creating registry: %v", err)
+		}
+
+		namespace, err := NewRegistryPullThroughCache(ctx, localRegistry, driver, configuration.Proxy{
+			RemoteURL: remote.URL,
+			Local:     []string{"library/private/*"},
+			Mixed:     mixed,
+		})
+		if err != nil {
+			t.Fatalf("error creating pull through cache: %v", err)
+		}
+
+		for name, expected := range map[string]bool{
+			"library/ubuntu":       false,
+			"library/private/app":  true,
+			"ourteam/app":          mixed,
+			"library/unknown-repo": mixed,
+		} {
+			if pushable(namespace, name) != expected {
+				t.Fatalf("unexpected pushability of %q with mixed=%v: expected %v", name, mixed, expected)
+			}
+		}
+	}
+}
+
+// TestProxyMixedModeLocalityCached checks that the upstream is asked once
+// whether a repository exists, so that pushes to a local repository go on
+// while the upstream is down.
+func TestProxyMixedModeLocalityCached(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		mu       sync.Mutex
+		tagLists int
+	)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		default:
+			mu.Lock()
+			tagLists++
+			mu.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	driver := inmemory.New()
+	localRegistry, err := storage.NewRegistry(ctx, driver, storage.BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	namespace, err := NewRegistryPullThroughCache(ctx, localRegistry, driver, configuration.Proxy{
+		RemoteURL: remote.URL,
+		Mixed:     true,
+	})
+	if err != nil {
+		t.Fatalf("error creating pull through cache: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			remote.Close()
+		}
+
+		repo, err := namespace.Repository(ctx, "ourteam/app")
+		if err != nil {
+			t.Fatalf("error getting repository: %v", err)
+		}
+		bw, err := repo.Blobs(ctx).Create(ctx)
+		if err != nil {
+			t.Fatalf("error creating blob writer: %v", err)
+		}
+		bw.Cancel(ctx)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if tagLists != 1 {
+		t.Fatalf("unexpected requests to the upstream: %d", tagLists)
+	}
+}
+
+// TestProxyMixedModeUnauthorized checks that a repository refused by the
+// upstream is hosted locally only if no credentials are configured.
+func TestProxyMixedModeUnauthorized(t *testing.T) {
+	ctx := context.Background()
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors": [{"code": "UNAUTHORIZED", "message": "authentication required"}]}`))
+		}
+	}))
+	defer remote.Close()
+
+	for _, username := range []string{"", "user"} {
+		driver := inmemory.New()
+		localRegistry, err := storage.NewRegistry(ctx, driver, storage.BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+		if err != nil {
+			t.Fatalf("error creating registry: %v", err)
+		}
+
+		namespace, err := NewRegistryPullThroughCache(ctx, localRegistry, driver, configuration.Proxy{
+			RemoteURL: remote.URL,
+			Username:  username,
+			Password:  "pass",
+			Mixed:     true,
+		})
+		if err != nil {
+			t.Fatalf("error creating pull through cache: %v", err)
+		}
+
+		repo, err := namespace.Repository(ctx, "ourteam/app")
+		if username != "" {
+			if err == nil {
+				t.Fatalf("expected an error with credentials refused by the upstream")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("error getting repository: %v", err)
+		}
+
+		bw, err := repo.Blobs(ctx).Create(ctx)
+		if err != nil {
+			t.Fatalf("error creating blob writer: %v", err)
+		}
+		bw.Cancel(ctx)
+	}
+}
@@ -1,8 +1,11 @@
 package scheduler
 
 import (
+	"container/list"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/docker/distribution/context"
@@ -17,20 +20,35 @@ const (
 	entryTypeManifest
 )
 
+// stateFlushInterval is how often access times are saved to the state file
+const stateFlushInterval = time.Minute
+
 // schedulerEntry represents an entry in the scheduler
 // fields are exported for serialization
 type schedulerEntry struct {
 	Key       string    `json:"Key"`
 	Expiry    time.Time `json:"ExpiryData"`
 	EntryType int       `json:"EntryType"`
+
+	// Origin is the url of the remote registry the entry was pulled from
+	Origin string `json:"Origin,omitempty"`
+
+	// Size is the number of bytes pulled for the entry
+	Size int64 `json:"Size,omitempty"`
+
+	// LastAccess is when the entry was last pulled by a client
+	LastAccess time.Time `json:"LastAccess,omitempty"`
 }
 
 // New returns a new instance of the scheduler
 func New(ctx context.Context, driver driver.StorageDriver, path string) *TTLExpirationScheduler {
 	return &TTLExpirationScheduler{
 		entries:         make(map[string]schedulerEntry),
+		elements:        make(map[string]*list.Element),
+		order:           list.New(),
 		addChan:         make(chan schedulerEntry),
 		stopChan:        make(chan bool),
+		doneChan:        make(chan struct{}),
 		driver:          driver,
 		pathToStateFile: path,
 		ctx:             ctx,
@@ -41,9 +59,24 @@ func New(ctx context.Context, driver driver.StorageDriver, path string) *TTLExpi
 // TTLExpirationScheduler is a scheduler used to perform actions
 // when TTLs expire
 type TTLExpirationScheduler struct {
-	entries  map[string]schedulerEntry
+	mu      sync.Mutex // protects entries, elements, order, size and dirty
+	entries map[string]schedulerEntry
+	dirty   bool // access times changed since the state was written
+
+	// elements holds the keys of the entries with a size, ordered by
+	// access, least recently accessed at the front of order, so that
+	// entries are evicted without scanning them all. size is their total.
+	elements map[string]*list.Element
+	order    *list.List
+	size     int64
+
 	addChan  chan schedulerEntry
 	stopChan chan bool
+	doneChan chan struct{} // closed when the mainloop returns
+
+	// maxSize is the budget for the total size of entries, or 0 if the
+	// size is not bounded
+	maxSize int64
 
 	driver          driver.StorageDriver
 	ctx             context.Context
@@ -71,39 +104,130 @@ func (ttles *TTLExpirationScheduler) OnManifestExpire(f expiryFunc) {
 	ttles.onManifestExpire = f
 }
 
-// AddBlob schedules a blob cleanup after ttl expires
-func (ttles *TTLExpirationScheduler) AddBlob(dgst string, ttl time.Duration) error {
+// SetMaxSize sets a budget, in bytes, for the total size of the scheduled
+// entries. When it is exceeded, the least recently accessed entries are
+// cleaned up before their TTL expires. It must be called before the
+// scheduler is started.
+func (ttles *TTLExpirationScheduler) SetMaxSize(maxSize int64) {
+	ttles.maxSize = maxSize
+}
+
+// AddBlob schedules a blob of the given size pulled from origin for cleanup
+// after ttl expires
+func (ttles *TTLExpirationScheduler) AddBlob(dgst, origin string, size int64, ttl time.Duration) error {
 	if ttles.stopped {
 		return fmt.Errorf("scheduler not started")
 	}
-	ttles.add(dgst, ttl, entryTypeBlob)
+	ttles.add(dgst, origin, size, ttl, entryTypeBlob)
 	return nil
 }
 
-// AddManifest schedules a manifest cleanup after ttl expires
-func (ttles *TTLExpirationScheduler) AddManifest(repoName string, ttl time.Duration) error {
+// AddManifest schedules the manifests of a repository, of the given size and
+// pulled from origin, for cleanup after ttl expires
+func (ttles *TTLExpirationScheduler) AddManifest(repoName, origin string, size int64, ttl time.Duration) error {
 	if ttles.stopped {
 		return fmt.Errorf("scheduler not started")
 	}
 
-	ttles.add(repoName, ttl, entryTypeManifest)
+	ttles.add(repoName, origin, size, ttl, entryTypeManifest)
 	return nil
 }
 
+// AccessBlob records that a scheduled blob was pulled by a client
+func (ttles *TTLExpirationScheduler) AccessBlob(dgst string) {
+	ttles.access(dgst, entryTypeBlob)
+}
+
+// AccessManifest records that the manifests of a scheduled repository were
+// pulled by a client
+func (ttles *TTLExpirationScheduler) AccessManifest(repoName string) {
+	ttles.access(repoName, entryTypeManifest)
+}
+
+// HasManifest returns true if the manifests of the repository are scheduled
+// for cleanup, that is, if the repository was pulled from a remote registry
+func (ttles *TTLExpirationScheduler) HasManifest(repoName string) bool {
+	ttles.mu.Lock()
+	defer ttles.mu.Unlock()
+
+	entry, ok := ttles.entries[repoName]
+	return ok && entry.EntryType == entryTypeManifest
+}
+
 // Start starts the scheduler
 func (ttles *TTLExpirationScheduler) Start() error {
 	return ttles.start()
 }
 
-func (ttles *TTLExpirationScheduler) add(key string, ttl time.Duration, eType int) {
+func (ttles *TTLExpirationScheduler) add(key, origin string, size int64, ttl time.Duration, eType int) {
+	now := time.Now()
 	entry := schedulerEntry{
-		Key:       key,
-		Expiry:    time.Now().Add(ttl),
-		EntryType: eType,
+		Key:        key,
+		Expiry:     now.Add(ttl),
+		EntryType:  eType,
+		Origin:     origin,
+		Size:       size,
+		LastAccess: now,
 	}
 	ttles.addChan <- entry
 }
 
+// access updates the access time of an entry. The state is written
+// periodically rather than on every access.
+func (ttles *TTLExpirationScheduler) access(key string, eType int) {
+	ttles.mu.Lock()
+	defer ttles.mu.Unlock()
+
+	entry, ok := ttles.entries[key]
+	if !ok || entry.EntryType != eType {
+		return
+	}
+
+	entry.LastAccess = time.Now()
+	ttles.entries[key] = entry
+	if elem, ok := ttles.elements[key]; ok {
+		ttles.order.MoveToBack(elem)
+	}
+	ttles.dirty = true
+}
+
+// setEntry adds or replaces an entry as the most recently accessed one. The
+// caller must hold the lock.
+func (ttles *TTLExpirationScheduler) setEntry(entry schedulerEntry) {
+	ttles.removeEntry(entry.Key)
+
+	ttles.entries[entry.Key] = entry
+	if entry.Size > 0 {
+		ttles.elements[entry.Key] = ttles.order.PushBack(entry.Key)
+		ttles.size += entry.Size
+	}
+}
+
+// removeEntry removes an entry, if present. The caller must hold the lock.
+func (ttles *TTLExpirationScheduler) removeEntry(key string) {
+	entry, ok := ttles.entries[key]
+	if !ok {
+		return
+	}
+
+	delete(ttles.entries, key)
+	if elem, ok := ttles.elements[key]; ok {
+		ttles.order.Remove(elem)
+		delete(ttles.elements, key)
+		ttles.size -= entry.Size
+	}
+}
+
+// Stop stops the scheduler, returning once its state has been written
+func (ttles *TTLExpirationScheduler) Stop() {
+	if ttles.stopped {
+		return
+	}
+
+	ttles.stop()
+	<-ttles.doneChan
+}
+
 func (ttles *TTLExpirationScheduler) stop() {
 	ttles.stopChan <- true
 }
@@ -129,13 +253,22 @@ func (ttles *TTLExpirationScheduler) start() error {
 // is spent in waiting on a TTL to expire but can be interrupted when TTLs
 // are added.
 func (ttles *TTLExpirationScheduler) mainloop() {
+	defer close(ttles.doneChan)
+
+	flush := time.NewTicker(stateFlushInterval)
+	defer flush.Stop()
+
 	for {
 		if ttles.stopped {
 			return
 		}
 
+		ttles.mu.Lock()
 		nextEntry, ttl := nextExpiringEntry(ttles.entries)
-		if len(ttles.entries) == 0 {
+		numEntries := len(ttles.entries)
+		ttles.mu.Unlock()
+
+		if numEntries == 0 {
 			context.GetLogger(ttles.ctx).Infof("scheduler mainloop(): Nothing to do, sleeping...")
 		} else {
 			context.GetLogger(ttles.ctx).Infof("scheduler mainloop(): Sleeping for %s until cleanup of %s", ttl, nextEntry.Key)
@@ -143,44 +276,93 @@ func (ttles *TTLExpirationScheduler) mainloop() {
 
 		select {
 		case <-time.After(ttl):
-			var f expiryFunc
-
-			switch nextEntry.EntryType {
-			case entryTypeBlob:
-				f = ttles.onBlobExpire
-			case entryTypeManifest:
-				f = ttles.onManifestExpire
-			default:
-				f = func(repoName string) error {
-					return fmt.Errorf("Unexpected scheduler entry type")
-				}
-			}
+			ttles.expire(*nextEntry)
 
-			if err := f(nextEntry.Key); err != nil {
-				context.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", nextEntry.Key, err)
-			}
-
-			delete(ttles.entries, nextEntry.Key)
+			ttles.mu.Lock()
+			ttles.removeEntry(nextEntry.Key)
 			if err := ttles.writeState(); err != nil {
 				context.GetLogger(ttles.ctx).Errorf("Error writing scheduler state: %s", err)
 			}
+			ttles.mu.Unlock()
 		case entry := <-ttles.addChan:
-			context.GetLogger(ttles.ctx).Infof("Adding new scheduler entry for %s with ttl=%s", entry.Key, entry.Expiry.Sub(time.Now()))
-			ttles.entries[entry.Key] = entry
+			context.GetLogger(ttles.ctx).Infof("Adding new scheduler entry for %s from %s with ttl=%s", entry.Key, entry.Origin, entry.Expiry.Sub(time.Now()))
+			ttles.mu.Lock()
+			ttles.setEntry(entry)
+			evicted := ttles.evict(entry.Key)
 			if err := ttles.writeState(); err != nil {
 				context.GetLogger(ttles.ctx).Errorf("Error writing scheduler state: %s", err)
 			}
-			break
+			ttles.mu.Unlock()
+
+			for _, e := range evicted {
+				context.GetLogger(ttles.ctx).Infof("Evicting scheduler entry for %s to stay within size budget", e.Key)
+				ttles.expire(e)
+			}
+
+		case <-flush.C:
+			ttles.mu.Lock()
+			if ttles.dirty {
+				if err := ttles.writeState(); err != nil {
+					context.GetLogger(ttles.ctx).Errorf("Error writing scheduler state: %s", err)
+				}
+			}
+			ttles.mu.Unlock()
 
 		case <-ttles.stopChan:
+			ttles.mu.Lock()
 			if err := ttles.writeState(); err != nil {
 				context.GetLogger(ttles.ctx).Errorf("Error writing scheduler state: %s", err)
 			}
+			ttles.mu.Unlock()
 			ttles.stopped = true
 		}
 	}
 }
 
+// expire calls the expiry function for the type of the entry
+func (ttles *TTLExpirationScheduler) expire(entry schedulerEntry) {
+	var f expiryFunc
+
+	switch entry.EntryType {
+	case entryTypeBlob:
+		f = ttles.onBlobExpire
+	case entryTypeManifest:
+		f = ttles.onManifestExpire
+	default:
+		f = func(repoName string) error {
+			return fmt.Errorf("Unexpected scheduler entry type")
+		}
+	}
+
+	if err := f(entry.Key); err != nil {
+		context.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", entry.Key, err)
+	}
+}
+
+// evict removes the least recently accessed entries, from the front of the
+// access order, until the total size is within the budget, returning the
+// removed entries. The entry with the key given is kept, so that content just
+// pulled is not removed. The caller must hold the lock.
+func (ttles *TTLExpirationScheduler) evict(keep string) []schedulerEntry {
+	if ttles.maxSize <= 0 {
+		return nil
+	}
+
+	var evicted []schedulerEntry
+	for elem := ttles.order.Front(); elem != nil && ttles.size > ttles.maxSize; {
+		key := elem.Value.(string)
+		elem = elem.Next()
+		if key == keep {
+			continue
+		}
+
+		evicted = append(evicted, ttles.entries[key])
+		ttles.removeEntry(key)
+	}
+
+	return evicted
+}
+
 func nextExpiringEntry(entries map[string]schedulerEntry) (*schedulerEntry, time.Duration) {
 	if len(entries) == 0 {
 		return nil, 24 * time.Hour
@@ -213,6 +395,8 @@ func nextExpiringEntry(entries map[string]schedulerEntry) (*schedulerEntry, time
 	return &nextEntry, nextEntry.Expiry.Sub(time.Now())
 }
 
+// writeState saves the entries to the state file. The caller must hold the
+// lock.
 func (ttles *TTLExpirationScheduler) writeState() error {
 	jsonBytes, err := json.Marshal(ttles.entries)
 	if err != nil {
@@ -223,6 +407,8 @@ func (ttles *TTLExpirationScheduler) writeState() error {
 	if err != nil {
 		return err
 	}
+
+	ttles.dirty = false
 	return nil
 }
 
@@ -241,10 +427,28 @@ func (ttles *TTLExpirationScheduler) readState() error {
 		return err
 	}
 
-	err = json.Unmarshal(bytes, &ttles.entries)
+	var entries map[string]schedulerEntry
+	err = json.Unmarshal(bytes, &entries)
 	if err != nil {
 		return err
 	}
 
+	sorted := make([]schedulerEntry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Sort(byLastAccess(sorted))
+
+	for _, entry := range sorted {
+		ttles.setEntry(entry)
+	}
+
 	return nil
 }
+
+// byLastAccess sorts entries from the least recently accessed
+type byLastAccess []schedulerEntry
+
+func (b byLastAccess) Len() int           { return len(b) }
+func (b byLastAccess) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastAccess) Less(i, j int) bool { return b[i].LastAccess.Before(b[j].LastAccess) }
@@ -3,6 +3,8 @@ package scheduler
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -38,11 +40,11 @@ func TestSchedule(t *testing.T) {
 		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
 	}
 
-	s.add("testBlob1", 3*timeUnit, entryTypeBlob)
-	s.add("testBlob2", 1*timeUnit, entryTypeBlob)
+	s.add("testBlob1", "", 0, 3*timeUnit, entryTypeBlob)
+	s.add("testBlob2", "", 0, 1*timeUnit, entryTypeBlob)
 
 	func() {
-		s.add("ch00", 1*timeUnit, entryTypeBlob)
+		s.add("ch00", "", 0, 1*timeUnit, entryTypeBlob)
 
 	}()
 
@@ -128,8 +130,8 @@ func TestStopRestore(t *testing.T) {
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	s.add("testBlob1", 300*timeUnit, entryTypeBlob)
-	s.add("testBlob2", 100*timeUnit, entryTypeBlob)
+	s.add("testBlob1", "", 0, 300*timeUnit, entryTypeBlob)
+	s.add("testBlob2", "", 0, 100*timeUnit, entryTypeBlob)
 
 	// Start and stop before all operations complete
 	// state will be written to fs
@@ -163,3 +165,111 @@ func TestDoubleStart(t *testing.T) {
 		t.Fatalf("Scheduler started twice without error")
 	}
 }
+
+func TestSizeEviction(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		removed []string
+	)
+	expire := func(key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		removed = append(removed, key)
+		return nil
+	}
+
+	fs := inmemory.New()
+	s := New(context.Background(), fs, "/ttl")
+	s.onBlobExpire = expire
+	s.onManifestExpire = expire
+	s.SetMaxSize(100)
+
+	if err := s.start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+
+	s.add("blob1", "", 40, time.Hour, entryTypeBlob)
+	s.add("repo1", "", 10, time.Hour, entryTypeManifest)
+	s.add("blob2", "", 40, time.Hour, entryTypeBlob)
+
+	// blob1 is now the most recently accessed, leaving repo1 and then blob2
+	// to be evicted first
+	time.Sleep(time.Millisecond)
+	s.AccessBlob("blob1")
+	s.AccessManifest("blob1") // wrong type, ignored
+
+	s.add("blob3", "", 30, time.Hour, entryTypeBlob)
+	s.add("blob4", "", 200, time.Hour, entryTypeBlob)
+	s.stop()
+
+	expected := []string{"repo1", "blob2", "blob1", "blob3"}
+	mu.Lock()
+	if !reflect.DeepEqual(removed, expected) {
+		t.Fatalf("unexpected evictions: %v != %v", removed, expected)
+	}
+	mu.Unlock()
+
+	// The entry too large for the budget is kept, and the state records
+	// sizes and access times
+	p, err := fs.GetContent(context.Background(), "/ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries map[string]schedulerEntry
+	if err := json.Unmarshal(p, &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries["blob4"].Size != 200 || entries["blob4"].LastAccess.IsZero() {
+		t.Fatalf("unexpected scheduler state: %#v", entries)
+	}
+}
+
+func TestSizeEvictionAfterRestart(t *testing.T) {
+	var removed []string
+	expire := func(key string) error {
+		removed = append(removed, key)
+		return nil
+	}
+
+	now := time.Now()
+	state := map[string]schedulerEntry{
+		"blob1": {Key: "blob1", Expiry: now.Add(time.Hour), EntryType: entryTypeBlob, Size: 40, LastAccess: now.Add(-time.Minute)},
+		"blob2": {Key: "blob2", Expiry: now.Add(time.Hour), EntryType: entryTypeBlob, Size: 40, LastAccess: now.Add(-time.Hour)},
+		"repo1": {Key: "repo1", Expiry: now.Add(time.Hour), EntryType: entryTypeManifest, LastAccess: now.Add(-2 * time.Hour)},
+	}
+	p, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := inmemory.New()
+	if err := fs.PutContent(context.Background(), "/ttl", p); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(context.Background(), fs, "/ttl")
+	s.onBlobExpire = expire
+	s.onManifestExpire = expire
+	s.SetMaxSize(100)
+
+	if err := s.start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+
+	// The restored entries are evicted in the order of their last access,
+	// and entries without a size are never evicted
+	s.add("blob3", "", 30, time.Hour, entryTypeBlob)
+	s.add("blob4", "", 50, time.Hour, entryTypeBlob)
+	s.stop()
+
+	expected := []string{"blob2", "blob1"}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Fatalf("unexpected evictions: %v != %v", removed, expected)
+	}
+
+	if s.size != 80 || s.order.Len() != 2 || len(s.entries) != 3 {
+		t.Fatalf("unexpected scheduler entries: size=%d, ordered=%d, entries=%d", s.size, s.order.Len(), len(s.entries))
+	}
+}
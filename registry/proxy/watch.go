@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+)
+
+// defaultWatchInterval is the time between polls of a watched repository
+// when none is configured
+const defaultWatchInterval = 10 * time.Minute
+
+// SyncFunc is called with the manifest of each tag of a watched repository
+// pulled into the cache because it is new or has changed on the remote.
+type SyncFunc func(repo string, sm *schema1.SignedManifest)
+
+// Watcher polls the remote registry for the tags of watched repositories,
+// pulling new and changed tags, and the blobs they reference, into the cache
+// ahead of clients.
+type Watcher struct {
+	ctx      context.Context
+	registry distribution.Namespace
+	watches  []configuration.ProxyWatch
+	onSync   SyncFunc
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewWatcher returns a watcher of the configured repositories of registry,
+// which must be a pull through cache. The onSync function, if not nil, is
+// called for every tag synced.
+func NewWatcher(ctx context.Context, registry distribution.Namespace, watches []configuration.ProxyWatch, onSync SyncFunc) (*Watcher, error) {
+	watches = append([]configuration.ProxyWatch(nil), watches...)
+	for i, watch := range watches {
+		if watch.Repository == "" {
+			return nil, fmt.Errorf("proxy: watch requires a repository")
+		}
+
+		for _, pattern := range watch.Tags {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("proxy: invalid tag pattern %q for watch of %s: %v", pattern, watch.Repository, err)
+			}
+		}
+
+		if watch.Interval < 0 {
+			return nil, fmt.Errorf("proxy: invalid interval for watch of %s: %v", watch.Repository, watch.Interval)
+		}
+		if watch.Interval == 0 {
+			watches[i].Interval = defaultWatchInterval
+		}
+	}
+
+	return &Watcher{
+		ctx:      ctx,
+		registry: registry,
+		watches:  watches,
+		onSync:   onSync,
+		stopChan: make(chan struct{}),
+	}, nil
+}
+
+// Start polls each watched repository in the background, starting now
+func (w *Watcher) Start() {
+	for _, watch := range w.watches {
+		w.wg.Add(1)
+		go w.poll(watch)
+	}
+}
+
+// Stop stops polling, waiting for syncs in progress to complete
+func (w *Watcher) Stop() {
+	close(w.stopChan)
+	w.wg.Wait()
+}
+
+func (w *Watcher) poll(watch configuration.ProxyWatch) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(watch.Interval)
+	defer ticker.Stop()
+
+	for {
+		synced, err := w.sync(watch)
+		if err != nil {
+			context.GetLogger(w.ctx).Errorf("Error syncing watched repository %s: %v", watch.Repository, err)
+		} else if synced > 0 {
+			context.GetLogger(w.ctx).Infof("Synced %d tags of watched repository %s", synced, watch.Repository)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// sync pulls the tags of the watched repository that are new or have changed
+// on the remote, returning the number of tags synced. Tags that fail to sync
+// are retried on the next poll.
+func (w *Watcher) sync(watch configuration.ProxyWatch) (int, error) {
+	repo, err := w.registry.Repository(w.ctx, watch.Repository)
+	if err != nil {
+		return 0, err
+	}
+
+	pr, ok := repo.(*proxiedRepository)
+	if !ok {
+		return 0, fmt.Errorf("repository is not proxied")
+	}
+	pms := pr.manifests.(proxyManifestStore)
+	pbs := pr.blobStore.(proxyBlobStore)
+
+	tags, err := pms.remoteManifests.Tags()
+	if err != nil {
+		return 0, err
+	}
+
+	synced := 0
+	for _, tag := range tags {
+		if !matchTag(watch.Tags, tag) {
+			continue
+		}
+
+		select {
+		case <-w.stopChan:
+			return synced, nil
+		default:
+		}
+
+		sm, err := w.syncTag(pms, pbs, tag)
+		if err != nil {
+			context.GetLogger(w.ctx).Errorf("Error syncing %s:%s: %v", watch.Repository, tag, err)
+			continue
+		}
+
+		if sm == nil {
+			continue
+		}
+
+		synced++
+		if w.onSync != nil {
+			w.onSync(watch.Repository, sm)
+		}
+	}
+
+	return synced, nil
+}
+
+// syncTag pulls the manifest of the tag, and its blobs, unless the cached
+// manifest is the latest and complete, in which case nil is returned.
+func (w *Watcher) syncTag(pms proxyManifestStore, pbs proxyBlobStore, tag string) (*schema1.SignedManifest, error) {
+	var localDigest digest.Digest
+
+	localManifest, err := pms.localManifests.GetByTag(tag)
+	switch err.(type) {
+	case distribution.ErrManifestUnknown, distribution.ErrManifestUnknownRevision:
+	case nil:
+		localDigest, err = manifestDigest(localManifest)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	sm, err := pms.pullByTag(tag, localDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remotes that ignore the etag return the manifest even if unchanged
+	if sm != nil && localDigest != "" {
+		dgst, err := manifestDigest(sm)
+		if err != nil {
+			return nil, err
+		}
+		if dgst == localDigest {
+			sm = nil
+		}
+	}
+
+	if sm == nil {
+		// The cached manifest is the latest, but a previous sync may have
+		// failed before pulling all of its blobs
+		complete, err := hasLayers(w.ctx, pbs, localManifest)
+		if err != nil || complete {
+			return nil, err
+		}
+		sm = localManifest
+	}
+
+	if err := fetchLayers(w.ctx, pbs, sm, nil); err != nil {
+		return nil, err
+	}
+
+	return sm, nil
+}
+
+// hasLayers returns true if all the blobs referenced by the manifest are in
+// the cache
+func hasLayers(ctx context.Context, pbs proxyBlobStore, sm *schema1.SignedManifest) (bool, error) {
+	for _, layer := range sm.FSLayers {
+		_, err := pbs.localStore.Stat(ctx, layer.BlobSum)
+		if err == distribution.ErrBlobUnknown {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchTag returns true if the tag matches one of the patterns, or if there
+// are no patterns
+func matchTag(patterns []string, tag string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest/schema1"
+)
+
+func TestWatcherSync(t *testing.T) {
+	ctx := context.Background()
+	name := "foo/bar"
+
+	namespace, localRepo, truthRepo := newProxiedTestRepo(t, name)
+	for _, tag := range []string{"1.0", "2.0", "latest"} {
+		pushTestManifest(t, truthRepo, tag)
+	}
+
+	var (
+		mu     sync.Mutex
+		synced []string
+	)
+	onSync := func(repo string, sm *schema1.SignedManifest) {
+		mu.Lock()
+		defer mu.Unlock()
+		synced = append(synced, repo+":"+sm.Tag)
+	}
+
+	watch := configuration.ProxyWatch{
+		Repository: name,
+		Tags:       []string{"1.*", "2.*"},
+	}
+
+	w, err := NewWatcher(ctx, namespace, []configuration.ProxyWatch{watch}, onSync)
+	if err != nil {
+		t.Fatalf("error creating watcher: %v", err)
+	}
+
+	if w.watches[0].Interval != defaultWatchInterval {
+		t.Fatalf("unexpected default interval: %v", w.watches[0].Interval)
+	}
+
+	checkSync := func(expected ...string) {
+		synced = nil
+		n, err := w.sync(w.watches[0])
+		if err != nil {
+			t.Fatalf("unexpected error syncing: %v", err)
+		}
+
+		sort.Strings(synced)
+		if n != len(expected) || (len(expected) > 0 && !reflect.DeepEqual(synced, expected)) {
+			t.Fatalf("unexpected tags synced: %d %v, expected %v", n, synced, expected)
+		}
+	}
+
+	checkSync(name+":1.0", name+":2.0")
+
+	localManifests, err := localRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := localManifests.Tags()
+	if err != nil {
+		t.Fatalf("unexpected error listing local tags: %v", err)
+	}
+	sort.Strings(tags)
+	if !reflect.DeepEqual(tags, []string{"1.0", "2.0"}) {
+		t.Fatalf("unexpected local tags: %v", tags)
+	}
+
+	// Unchanged tags are not synced again
+	checkSync()
+
+	// A changed tag is synced with its blobs
+	_, layers := pushTestManifest(t, truthRepo, "2.0")
+	checkSync(name + ":2.0")
+
+	for _, desc := range layers {
+		if _, err := localRepo.Blobs(ctx).Stat(ctx, desc.Digest); err != nil {
+			t.Fatalf("blob %s not synced: %v", desc.Digest, err)
+		}
+	}
+
+	// A blob missing from an earlier sync is pulled on the next one
+	if err := localRepo.Blobs(ctx).Delete(ctx, layers[1].Digest); err != nil {
+		t.Fatalf("unexpected error deleting blob: %v", err)
+	}
+	checkSync(name + ":2.0")
+
+	w.Start()
+	w.Stop()
+}
+
+func TestWatcherInvalid(t *testing.T) {
+	for _, watch := range []configuration.ProxyWatch{
+		{Tags: []string{"*"}},
+		{Repository: "foo/bar", Tags: []string{"["}},
+		{Repository: "foo/bar", Interval: -1},
+	} {
+		if _, err := NewWatcher(context.Background(), nil, []configuration.ProxyWatch{watch}, nil); err == nil {
+			t.Fatalf("expected error creating watcher for %#v", watch)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+)
+
+type layeredBlobDescriptorCacheProvider struct {
+	layeredBlobDescriptorCache
+	front, back BlobDescriptorCacheProvider
+}
+
+// NewLayeredBlobDescriptorCacheProvider returns a cache provider that keeps
+// the descriptors of back, typically shared between registry instances, in
+// front, typically a small in process cache. Descriptors are written through
+// to both, and read from back only on a miss in front. Clearing a descriptor
+// removes it from both, but not from the front caches of other instances.
+func NewLayeredBlobDescriptorCacheProvider(front, back BlobDescriptorCacheProvider) BlobDescriptorCacheProvider {
+	return &layeredBlobDescriptorCacheProvider{
+		layeredBlobDescriptorCache: layeredBlobDescriptorCache{
+			front: front,
+			back:  back,
+		},
+		front: front,
+		back:  back,
+	}
+}
+
+func (lbdcp *layeredBlobDescriptorCacheProvider) RepositoryScoped(repo string) (distribution.BlobDescriptorService, error) {
+	front, err := lbdcp.front.RepositoryScoped(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	back, err := lbdcp.back.RepositoryScoped(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &layeredBlobDescriptorCache{
+		front: front,
+		back:  back,
+	}, nil
+}
+
+// layeredBlobDescriptorCache layers two descriptor caches of the same scope
+type layeredBlobDescriptorCache struct {
+	front, back distribution.BlobDescriptorService
+}
+
+func (lbdc *layeredBlobDescriptorCache) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	desc, err := lbdc.front.Stat(ctx, dgst)
+	if err == nil {
+		return desc, nil
+	}
+
+	if err != distribution.ErrBlobUnknown {
+		context.GetLogger(ctx).Errorf("error retrieving descriptor from front cache: %v", err)
+	}
+
+	desc, err = lbdc.back.Stat(ctx, dgst)
+	if err != nil {
+		return desc, err
+	}
+
+	if err := lbdc.front.SetDescriptor(ctx, dgst, desc); err != nil {
+		context.GetLogger(ctx).Errorf("error adding descriptor %v to front cache: %v", desc.Digest, err)
+	}
+
+	return desc, nil
+}
+
+func (lbdc *layeredBlobDescriptorCache) Clear(ctx context.Context, dgst digest.Digest) error {
+	if err := lbdc.front.Clear(ctx, dgst); err != nil && err != distribution.ErrBlobUnknown {
+		return err
+	}
+
+	return lbdc.back.Clear(ctx, dgst)
+}
+
+func (lbdc *layeredBlobDescriptorCache) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+	if err := lbdc.back.SetDescriptor(ctx, dgst, desc); err != nil {
+		return err
+	}
+
+	return lbdc.front.SetDescriptor(ctx, dgst, desc)
+}
@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"container/list"
 	"sync"
 
 	"github.com/docker/distribution"
@@ -10,18 +11,28 @@ import (
 	"github.com/docker/distribution/registry/storage/cache"
 )
 
+// entryOverhead approximates the memory used by a cache entry in addition to
+// its strings, for the purpose of enforcing a bound in bytes
+const entryOverhead = 128
+
 type inMemoryBlobDescriptorCacheProvider struct {
-	global       *mapBlobDescriptorCache
-	repositories map[string]*mapBlobDescriptorCache
-	mu           sync.RWMutex
+	lru *lruBlobDescriptorCache
 }
 
 // NewInMemoryBlobDescriptorCacheProvider returns a new mapped-based cache for
 // storing blob descriptor data.
 func NewInMemoryBlobDescriptorCacheProvider() cache.BlobDescriptorCacheProvider {
+	return NewBoundedInMemoryBlobDescriptorCacheProvider(0, 0)
+}
+
+// NewBoundedInMemoryBlobDescriptorCacheProvider returns a new cache for
+// storing blob descriptor data, holding at most maxEntries descriptors, and
+// using about maxBytes of memory. The least recently used descriptors, of
+// all repositories, are evicted to stay within these bounds. A bound of zero
+// is no bound.
+func NewBoundedInMemoryBlobDescriptorCacheProvider(maxEntries int, maxBytes int64) cache.BlobDescriptorCacheProvider {
 	return &inMemoryBlobDescriptorCacheProvider{
-		global:       newMapBlobDescriptorCache(),
-		repositories: make(map[string]*mapBlobDescriptorCache),
+		lru: newLRUBlobDescriptorCache(maxEntries, maxBytes),
 	}
 }
 
@@ -30,37 +41,33 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) RepositoryScoped(repo string)
 		return nil, err
 	}
 
-	imbdcp.mu.RLock()
-	defer imbdcp.mu.RUnlock()
-
 	return &repositoryScopedInMemoryBlobDescriptorCache{
-		repo:       repo,
-		parent:     imbdcp,
-		repository: imbdcp.repositories[repo],
+		repo:   repo,
+		parent: imbdcp,
 	}, nil
 }
 
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
-	return imbdcp.global.Stat(ctx, dgst)
+	return imbdcp.lru.Stat(ctx, "", dgst)
 }
 
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) Clear(ctx context.Context, dgst digest.Digest) error {
-	return imbdcp.global.Clear(ctx, dgst)
+	return imbdcp.lru.Clear(ctx, "", dgst)
 }
 
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
-	_, err := imbdcp.Stat(ctx, dgst)
+	_, err := imbdcp.lru.peek("", dgst)
 	if err == distribution.ErrBlobUnknown {
 
 		if dgst.Algorithm() != desc.Digest.Algorithm() && dgst != desc.Digest {
 			// if the digests differ, set the other canonical mapping
-			if err := imbdcp.global.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			if err := imbdcp.lru.SetDescriptor(ctx, "", desc.Digest, desc); err != nil {
 				return err
 			}
 		}
 
 		// unknown, just set it
-		return imbdcp.global.SetDescriptor(ctx, dgst, desc)
+		return imbdcp.lru.SetDescriptor(ctx, "", dgst, desc)
 	}
 
 	// we already know it, do nothing
@@ -68,92 +75,117 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) SetDescriptor(ctx context.Con
 }
 
 // repositoryScopedInMemoryBlobDescriptorCache provides the request scoped
-// repository cache. Instances are not thread-safe but the delegated
-// operations are.
+// repository cache. The descriptors of all repositories are held in the
+// cache of the parent, so that they share its bounds.
 type repositoryScopedInMemoryBlobDescriptorCache struct {
-	repo       string
-	parent     *inMemoryBlobDescriptorCacheProvider // allows lazy allocation of repo's map
-	repository *mapBlobDescriptorCache
+	repo   string
+	parent *inMemoryBlobDescriptorCacheProvider
 }
 
 func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
-	if rsimbdcp.repository == nil {
-		return distribution.Descriptor{}, distribution.ErrBlobUnknown
-	}
-
-	return rsimbdcp.repository.Stat(ctx, dgst)
+	return rsimbdcp.parent.lru.Stat(ctx, rsimbdcp.repo, dgst)
 }
 
 func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Clear(ctx context.Context, dgst digest.Digest) error {
-	if rsimbdcp.repository == nil {
-		return distribution.ErrBlobUnknown
-	}
-
-	return rsimbdcp.repository.Clear(ctx, dgst)
+	return rsimbdcp.parent.lru.Clear(ctx, rsimbdcp.repo, dgst)
 }
 
 func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
-	if rsimbdcp.repository == nil {
-		// allocate map since we are setting it now.
-		rsimbdcp.parent.mu.Lock()
-		var ok bool
-		// have to read back value since we may have allocated elsewhere.
-		rsimbdcp.repository, ok = rsimbdcp.parent.repositories[rsimbdcp.repo]
-		if !ok {
-			rsimbdcp.repository = newMapBlobDescriptorCache()
-			rsimbdcp.parent.repositories[rsimbdcp.repo] = rsimbdcp.repository
-		}
-
-		rsimbdcp.parent.mu.Unlock()
-	}
-
-	if err := rsimbdcp.repository.SetDescriptor(ctx, dgst, desc); err != nil {
+	if err := rsimbdcp.parent.lru.SetDescriptor(ctx, rsimbdcp.repo, dgst, desc); err != nil {
 		return err
 	}
 
 	return rsimbdcp.parent.SetDescriptor(ctx, dgst, desc)
 }
 
-// mapBlobDescriptorCache provides a simple map-based implementation of the
-// descriptor cache.
-type mapBlobDescriptorCache struct {
-	descriptors map[digest.Digest]distribution.Descriptor
-	mu          sync.RWMutex
+// entryKey identifies a descriptor in a repository, or in the global cache
+// if repo is empty
+type entryKey struct {
+	repo string
+	dgst digest.Digest
+}
+
+type lruEntry struct {
+	key  entryKey
+	desc distribution.Descriptor
+}
+
+// size approximates the memory used by the entry
+func (e *lruEntry) size() int64 {
+	return int64(len(e.key.repo)+len(e.key.dgst)+len(e.desc.Digest)+len(e.desc.MediaType)) + entryOverhead
+}
+
+// lruBlobDescriptorCache holds descriptors, evicting the least recently used
+// when its bounds are exceeded.
+type lruBlobDescriptorCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu      sync.Mutex
+	entries map[entryKey]*list.Element
+	order   *list.List // most recently used at the front
+	bytes   int64
+}
+
+func newLRUBlobDescriptorCache(maxEntries int, maxBytes int64) *lruBlobDescriptorCache {
+	return &lruBlobDescriptorCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[entryKey]*list.Element),
+		order:      list.New(),
+	}
 }
 
-var _ distribution.BlobDescriptorService = &mapBlobDescriptorCache{}
+func (lbdc *lruBlobDescriptorCache) Stat(ctx context.Context, repo string, dgst digest.Digest) (distribution.Descriptor, error) {
+	if err := dgst.Validate(); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	lbdc.mu.Lock()
+	defer lbdc.mu.Unlock()
 
-func newMapBlobDescriptorCache() *mapBlobDescriptorCache {
-	return &mapBlobDescriptorCache{
-		descriptors: make(map[digest.Digest]distribution.Descriptor),
+	elem, ok := lbdc.entries[entryKey{repo, dgst}]
+	if !ok {
+		cacheMetrics.miss()
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
 	}
+
+	cacheMetrics.hit()
+	lbdc.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).desc, nil
 }
 
-func (mbdc *mapBlobDescriptorCache) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+// peek returns the descriptor without counting a request or marking it
+// recently used
+func (lbdc *lruBlobDescriptorCache) peek(repo string, dgst digest.Digest) (distribution.Descriptor, error) {
 	if err := dgst.Validate(); err != nil {
 		return distribution.Descriptor{}, err
 	}
 
-	mbdc.mu.RLock()
-	defer mbdc.mu.RUnlock()
+	lbdc.mu.Lock()
+	defer lbdc.mu.Unlock()
 
-	desc, ok := mbdc.descriptors[dgst]
+	elem, ok := lbdc.entries[entryKey{repo, dgst}]
 	if !ok {
 		return distribution.Descriptor{}, distribution.ErrBlobUnknown
 	}
 
-	return desc, nil
+	return elem.Value.(*lruEntry).desc, nil
 }
 
-func (mbdc *mapBlobDescriptorCache) Clear(ctx context.Context, dgst digest.Digest) error {
-	mbdc.mu.Lock()
-	defer mbdc.mu.Unlock()
+// Clear removes the descriptor. Since it may have been evicted, clearing an
+// unknown descriptor is not an error.
+func (lbdc *lruBlobDescriptorCache) Clear(ctx context.Context, repo string, dgst digest.Digest) error {
+	lbdc.mu.Lock()
+	defer lbdc.mu.Unlock()
 
-	delete(mbdc.descriptors, dgst)
+	if elem, ok := lbdc.entries[entryKey{repo, dgst}]; ok {
+		lbdc.remove(elem)
+	}
 	return nil
 }
 
-func (mbdc *mapBlobDescriptorCache) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+func (lbdc *lruBlobDescriptorCache) SetDescriptor(ctx context.Context, repo string, dgst digest.Digest, desc distribution.Descriptor) error {
 	if err := dgst.Validate(); err != nil {
 		return err
 	}
@@ -162,9 +194,34 @@ func (mbdc *mapBlobDescriptorCache) SetDescriptor(ctx context.Context, dgst dige
 		return err
 	}
 
-	mbdc.mu.Lock()
-	defer mbdc.mu.Unlock()
+	lbdc.mu.Lock()
+	defer lbdc.mu.Unlock()
+
+	key := entryKey{repo, dgst}
+	if elem, ok := lbdc.entries[key]; ok {
+		lbdc.remove(elem)
+	}
+
+	entry := &lruEntry{key: key, desc: desc}
+	lbdc.entries[key] = lbdc.order.PushFront(entry)
+	lbdc.bytes += entry.size()
+
+	for lbdc.order.Len() > 1 && lbdc.exceeded() {
+		lbdc.remove(lbdc.order.Back())
+		cacheMetrics.evict()
+	}
 
-	mbdc.descriptors[dgst] = desc
 	return nil
 }
+
+// exceeded returns true if the cache is over one of its bounds
+func (lbdc *lruBlobDescriptorCache) exceeded() bool {
+	return (lbdc.maxEntries > 0 && lbdc.order.Len() > lbdc.maxEntries) ||
+		(lbdc.maxBytes > 0 && lbdc.bytes > lbdc.maxBytes)
+}
+
+func (lbdc *lruBlobDescriptorCache) remove(elem *list.Element) {
+	entry := lbdc.order.Remove(elem).(*lruEntry)
+	delete(lbdc.entries, entry.key)
+	lbdc.bytes -= entry.size()
+}
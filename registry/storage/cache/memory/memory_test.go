@@ -1,8 +1,12 @@
 package memory
 
 import (
+	"fmt"
 	"testing"
 
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
 	"github.com/docker/distribution/registry/storage/cache"
 )
 
@@ -10,4 +14,109 @@ import (
 // correctly.
 func TestInMemoryBlobInfoCache(t *testing.T) {
 	cache.CheckBlobDescriptorCache(t, NewInMemoryBlobDescriptorCacheProvider())
+	cache.CheckBlobDescriptorCache(t, NewBoundedInMemoryBlobDescriptorCacheProvider(100, 1<<20))
+}
+
+// TestLayeredBlobInfoCache checks an in memory cache layered in front of
+// another.
+func TestLayeredBlobInfoCache(t *testing.T) {
+	cache.CheckBlobDescriptorCache(t, cache.NewLayeredBlobDescriptorCacheProvider(
+		NewBoundedInMemoryBlobDescriptorCacheProvider(100, 0),
+		NewInMemoryBlobDescriptorCacheProvider()))
+
+	ctx := context.Background()
+	front := NewBoundedInMemoryBlobDescriptorCacheProvider(2, 0)
+	back := NewInMemoryBlobDescriptorCacheProvider()
+	layered := cache.NewLayeredBlobDescriptorCacheProvider(front, back)
+
+	descs := testDescriptors(3)
+	for _, desc := range descs {
+		if err := layered.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			t.Fatalf("unexpected error setting descriptor: %v", err)
+		}
+	}
+
+	// The first descriptor was evicted from the front, and is read back from
+	// the back
+	if _, err := front.Stat(ctx, descs[0].Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected descriptor to be evicted from front: %v", err)
+	}
+
+	if desc, err := layered.Stat(ctx, descs[0].Digest); err != nil || desc != descs[0] {
+		t.Fatalf("unexpected descriptor: %v %v", desc, err)
+	}
+
+	if _, err := front.Stat(ctx, descs[0].Digest); err != nil {
+		t.Fatalf("expected descriptor to be added back to front: %v", err)
+	}
+
+	if err := layered.Clear(ctx, descs[0].Digest); err != nil {
+		t.Fatalf("unexpected error clearing descriptor: %v", err)
+	}
+
+	for _, provider := range []cache.BlobDescriptorCacheProvider{front, back, layered} {
+		if _, err := provider.Stat(ctx, descs[0].Digest); err != distribution.ErrBlobUnknown {
+			t.Fatalf("expected cleared descriptor to be unknown: %v", err)
+		}
+	}
+}
+
+func TestInMemoryBlobInfoCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	descs := testDescriptors(4)
+
+	for _, provider := range []cache.BlobDescriptorCacheProvider{
+		NewBoundedInMemoryBlobDescriptorCacheProvider(3, 0),
+		NewBoundedInMemoryBlobDescriptorCacheProvider(0, 3*(&lruEntry{desc: descs[0], key: entryKey{dgst: descs[0].Digest}}).size()),
+	} {
+		before := cacheMetrics.Metrics()
+
+		for _, desc := range descs[:3] {
+			if err := provider.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+				t.Fatalf("unexpected error setting descriptor: %v", err)
+			}
+		}
+
+		// The first descriptor is now the most recently used
+		if _, err := provider.Stat(ctx, descs[0].Digest); err != nil {
+			t.Fatalf("unexpected error getting descriptor: %v", err)
+		}
+
+		if err := provider.SetDescriptor(ctx, descs[3].Digest, descs[3]); err != nil {
+			t.Fatalf("unexpected error setting descriptor: %v", err)
+		}
+
+		for i, desc := range descs {
+			_, err := provider.Stat(ctx, desc.Digest)
+			if i == 1 {
+				if err != distribution.ErrBlobUnknown {
+					t.Fatalf("expected least recently used descriptor to be evicted: %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error getting descriptor %d: %v", i, err)
+			}
+		}
+
+		// Clearing an evicted descriptor is not an error
+		if err := provider.Clear(ctx, descs[1].Digest); err != nil {
+			t.Fatalf("unexpected error clearing evicted descriptor: %v", err)
+		}
+
+		after := cacheMetrics.Metrics()
+		if after.Hits-before.Hits != 4 || after.Misses-before.Misses != 1 || after.Evictions-before.Evictions != 1 {
+			t.Fatalf("unexpected metrics: %+v, before %+v", after, before)
+		}
+	}
+}
+
+func testDescriptors(n int) []distribution.Descriptor {
+	var descs []distribution.Descriptor
+	for i := 0; i < n; i++ {
+		descs = append(descs, distribution.Descriptor{
+			Digest:    digest.Digest(fmt.Sprintf("sha256:%064d", i)),
+			Size:      10,
+			MediaType: "application/octet-stream",
+		})
+	}
+	return descs
 }
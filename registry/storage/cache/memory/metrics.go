@@ -0,0 +1,65 @@
+package memory
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// Metrics counts the requests to the in memory blob descriptor caches, and
+// the descriptors evicted to stay within their bounds.
+type Metrics struct {
+	Requests  uint64
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+type metricsCollector struct {
+	metrics Metrics
+}
+
+func (mc *metricsCollector) hit() {
+	atomic.AddUint64(&mc.metrics.Requests, 1)
+	atomic.AddUint64(&mc.metrics.Hits, 1)
+}
+
+func (mc *metricsCollector) miss() {
+	atomic.AddUint64(&mc.metrics.Requests, 1)
+	atomic.AddUint64(&mc.metrics.Misses, 1)
+}
+
+func (mc *metricsCollector) evict() {
+	atomic.AddUint64(&mc.metrics.Evictions, 1)
+}
+
+// Metrics returns a copy of the counters
+func (mc *metricsCollector) Metrics() Metrics {
+	return Metrics{
+		Requests:  atomic.LoadUint64(&mc.metrics.Requests),
+		Hits:      atomic.LoadUint64(&mc.metrics.Hits),
+		Misses:    atomic.LoadUint64(&mc.metrics.Misses),
+		Evictions: atomic.LoadUint64(&mc.metrics.Evictions),
+	}
+}
+
+// cacheMetrics is kept globally, for all in memory caches of the process,
+// and made available via expvar.
+var cacheMetrics = &metricsCollector{}
+
+func init() {
+	registry := expvar.Get("registry")
+	if registry == nil {
+		registry = expvar.NewMap("registry")
+	}
+
+	cache := registry.(*expvar.Map).Get("cache")
+	if cache == nil {
+		cache = &expvar.Map{}
+		cache.(*expvar.Map).Init()
+		registry.(*expvar.Map).Set("cache", cache)
+	}
+
+	cache.(*expvar.Map).Set("memory", expvar.Func(func() interface{} {
+		return cacheMetrics.Metrics()
+	}))
+}
@@ -39,22 +39,27 @@ package base
 
 import (
 	"io"
+	"time"
 
 	"github.com/docker/distribution/context"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 )
 
 // Base provides a wrapper around a storagedriver implementation that provides
-// common path and bounds checking.
+// common path and bounds checking, and collects metrics of the calls to the
+// storage driver.
 type Base struct {
 	storagedriver.StorageDriver
 }
 
 // GetContent wraps GetContent of underlying storage driver.
-func (base *Base) GetContent(ctx context.Context, path string) ([]byte, error) {
+func (base *Base) GetContent(ctx context.Context, path string) (content []byte, err error) {
 	ctx, done := context.WithTrace(ctx)
 	defer done("%s.GetContent(%q)", base.Name(), path)
 
+	mm := driverMetrics.method(base.Name(), "GetContent")
+	defer func(start time.Time) { mm.observe(start, int64(len(content)), err) }(time.Now())
+
 	if !storagedriver.PathRegexp.MatchString(path) {
 		return nil, storagedriver.InvalidPathError{Path: path}
 	}
@@ -63,10 +68,19 @@ func (base *Base) GetContent(ctx context.Context, path string) ([]byte, error) {
 }
 
 // PutContent wraps PutContent of underlying storage driver.
-func (base *Base) PutContent(ctx context.Context, path string, content []byte) error {
+func (base *Base) PutContent(ctx context.Context, path string, content []byte) (err error) {
 	ctx, done := context.WithTrace(ctx)
 	defer done("%s.PutContent(%q)", base.Name(), path)
 
+	mm := driverMetrics.method(base.Name(), "PutContent")
+	defer func(start time.Time) {
+		var written int64
+		if err == nil {
+			written = int64(len(content))
+		}
+		mm.observe(start, written, err)
+	}(time.Now())
+
 	if !storagedriver.PathRegexp.MatchString(path) {
 		return storagedriver.InvalidPathError{Path: path}
 	}
@@ -75,10 +89,20 @@ func (base *Base) PutContent(ctx context.Context, path string, content []byte) e
 }
 
 // ReadStream wraps ReadStream of underlying storage driver.
-func (base *Base) ReadStream(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+func (base *Base) ReadStream(ctx context.Context, path string, offset int64) (rc io.ReadCloser, err error) {
 	ctx, done := context.WithTrace(ctx)
 	defer done("%s.ReadStream(%q, %d)", base.Name(), path, offset)
 
+	// The latency is the time to open the stream, while the content is
+	// counted as it is read
+	mm := driverMetrics.method(base.Name(), "ReadStream")
+	defer func(start time.Time) {
+		mm.observe(start, 0, err)
+		if rc != nil {
+			rc = &countingReadCloser{ReadCloser: rc, mm: mm}
+		}
+	}(time.Now())
+
 	if offset < 0 {
 		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
 	}
@@ -95,6 +119,9 @@ func (base *Base) WriteStream(ctx context.Context, path string, offset int64, re
 	ctx, done := context.WithTrace(ctx)
 	defer done("%s.WriteStream(%q, %d)", base.Name(), path, offset)
 
+	mm := driverMetrics.method(base.Name(), "WriteStream")
+	defer func(start time.Time) { mm.observe(start, nn, err) }(time.Now())
+
 	if offset < 0 {
 		return 0, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
 	}
@@ -107,10 +134,13 @@ func (base *Base) WriteStream(ctx context.Context, path string, offset int64, re
 }
 
 // Stat wraps Stat of underlying storage driver.
-func (base *Base) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+func (base *Base) Stat(ctx context.Context, path string) (fi storagedriver.FileInfo, err error) {
 	ctx, done := context.WithTrace(ctx)
 	defer done("%s.Stat(%q)", base.Name(), path)
 
+	mm := driverMetrics.method(base.Name(), "Stat")
+	defer func(start time.Time) { mm.observe(start, 0, err) }(time.Now())
+
 	if !storagedriver.PathRegexp.MatchString(path) {
 		return nil, storagedriver.InvalidPathError{Path: path}
 	}
@@ -119,10 +149,13 @@ func (base *Base) Stat(ctx context.Context, path string) (storagedriver.FileInfo
 }
 
 // List wraps List of underlying storage driver.
-func (base *Base) List(ctx context.Context, path string) ([]string, error) {
+func (base *Base) List(ctx context.Context, path string) (children []string, err error) {
 	ctx, done := context.WithTrace(ctx)
 	defer done("%s.List(%q)", base.Name(), path)
 
+	mm := driverMetrics.method(base.Name(), "List")
+	defer func(start time.Time) { mm.observe(start, 0, err) }(time.Now())
+
 	if !storagedriver.PathRegexp.MatchString(path) && path != "/" {
 		return nil, storagedriver.InvalidPathError{Path: path}
 	}
@@ -131,10 +164,13 @@ func (base *Base) List(ctx context.Context, path string) ([]string, error) {
 }
 
 // Move wraps Move of underlying storage driver.
-func (base *Base) Move(ctx context.Context, sourcePath string, destPath string) error {
+func (base *Base) Move(ctx context.Context, sourcePath string, destPath string) (err error) {
 	ctx, done := context.WithTrace(ctx)
 	defer done("%s.Move(%q, %q", base.Name(), sourcePath, destPath)
 
+	mm := driverMetrics.method(base.Name(), "Move")
+	defer func(start time.Time) { mm.observe(start, 0, err) }(time.Now())
+
 	if !storagedriver.PathRegexp.MatchString(sourcePath) {
 		return storagedriver.InvalidPathError{Path: sourcePath}
 	} else if !storagedriver.PathRegexp.MatchString(destPath) {
@@ -145,10 +181,13 @@ func (base *Base) Move(ctx context.Context, sourcePath string, destPath string)
 }
 
 // Delete wraps Delete of underlying storage driver.
-func (base *Base) Delete(ctx context.Context, path string) error {
+func (base *Base) Delete(ctx context.Context, path string) (err error) {
 	ctx, done := context.WithTrace(ctx)
 	defer done("%s.Delete(%q)", base.Name(), path)
 
+	mm := driverMetrics.method(base.Name(), "Delete")
+	defer func(start time.Time) { mm.observe(start, 0, err) }(time.Now())
+
 	if !storagedriver.PathRegexp.MatchString(path) {
 		return storagedriver.InvalidPathError{Path: path}
 	}
@@ -157,10 +196,13 @@ func (base *Base) Delete(ctx context.Context, path string) error {
 }
 
 // URLFor wraps URLFor of underlying storage driver.
-func (base *Base) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+func (base *Base) URLFor(ctx context.Context, path string, options map[string]interface{}) (url string, err error) {
 	ctx, done := context.WithTrace(ctx)
 	defer done("%s.URLFor(%q)", base.Name(), path)
 
+	mm := driverMetrics.method(base.Name(), "URLFor")
+	defer func(start time.Time) { mm.observe(start, 0, err) }(time.Now())
+
 	if !storagedriver.PathRegexp.MatchString(path) {
 		return "", storagedriver.InvalidPathError{Path: path}
 	}
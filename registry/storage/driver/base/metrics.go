@@ -0,0 +1,300 @@
+package base
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms of calls
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// MethodMetrics counts the calls to a method of a storage driver
+type MethodMetrics struct {
+	Calls uint64
+
+	// Errors counts the calls returning an error, by type of error
+	Errors map[string]uint64
+
+	// Bytes counts the content read or written by the calls
+	Bytes uint64
+
+	// Latency is the histogram of the durations of the calls
+	Latency Histogram
+}
+
+// Histogram counts observations in buckets, the last one unbounded
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+// methodMetrics collects the metrics of a method of a storage driver
+type methodMetrics struct {
+	calls   uint64
+	bytes   uint64
+	sum     int64 // nanoseconds
+	buckets []uint64
+
+	mu     sync.Mutex
+	errors map[string]uint64
+}
+
+func newMethodMetrics() *methodMetrics {
+	return &methodMetrics{
+		buckets: make([]uint64, len(latencyBuckets)+1),
+		errors:  make(map[string]uint64),
+	}
+}
+
+// observe records a call that started at start
+func (mm *methodMetrics) observe(start time.Time, bytes int64, err error) {
+	elapsed := time.Since(start)
+
+	atomic.AddUint64(&mm.calls, 1)
+	atomic.AddInt64(&mm.sum, int64(elapsed))
+	mm.addBytes(bytes)
+
+	seconds := elapsed.Seconds()
+	bucket := sort.SearchFloat64s(latencyBuckets, seconds)
+	atomic.AddUint64(&mm.buckets[bucket], 1)
+
+	if err != nil {
+		mm.mu.Lock()
+		mm.errors[errorType(err)]++
+		mm.mu.Unlock()
+	}
+}
+
+func (mm *methodMetrics) addBytes(bytes int64) {
+	if bytes > 0 {
+		atomic.AddUint64(&mm.bytes, uint64(bytes))
+	}
+}
+
+// snapshot returns a copy of the metrics
+func (mm *methodMetrics) snapshot() MethodMetrics {
+	m := MethodMetrics{
+		Calls:  atomic.LoadUint64(&mm.calls),
+		Bytes:  atomic.LoadUint64(&mm.bytes),
+		Errors: make(map[string]uint64),
+		Latency: Histogram{
+			Buckets: latencyBuckets,
+			Counts:  make([]uint64, len(mm.buckets)),
+			Sum:     time.Duration(atomic.LoadInt64(&mm.sum)).Seconds(),
+		},
+	}
+
+	for i := range mm.buckets {
+		m.Latency.Counts[i] = atomic.LoadUint64(&mm.buckets[i])
+		m.Latency.Count += m.Latency.Counts[i]
+	}
+
+	mm.mu.Lock()
+	for errType, count := range mm.errors {
+		m.Errors[errType] = count
+	}
+	mm.mu.Unlock()
+
+	return m
+}
+
+// errorType returns the name under which an error is counted
+func errorType(err error) string {
+	switch err.(type) {
+	case storagedriver.PathNotFoundError:
+		return "PathNotFound"
+	case storagedriver.InvalidPathError:
+		return "InvalidPath"
+	case storagedriver.InvalidOffsetError:
+		return "InvalidOffset"
+	}
+
+	if err == storagedriver.ErrUnsupportedMethod {
+		return "UnsupportedMethod"
+	}
+
+	return "Other"
+}
+
+// metricsCollector holds the metrics of the methods of storage drivers, by
+// driver name
+type metricsCollector struct {
+	mu      sync.Mutex
+	drivers map[string]map[string]*methodMetrics
+}
+
+// method returns the metrics of the method of the driver
+func (mc *metricsCollector) method(driver, method string) *methodMetrics {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	methods, ok := mc.drivers[driver]
+	if !ok {
+		methods = make(map[string]*methodMetrics)
+		mc.drivers[driver] = methods
+	}
+
+	mm, ok := methods[method]
+	if !ok {
+		mm = newMethodMetrics()
+		methods[method] = mm
+	}
+
+	return mm
+}
+
+// Metrics returns a copy of the metrics of the methods of each driver
+func (mc *metricsCollector) Metrics() map[string]map[string]MethodMetrics {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	drivers := make(map[string]map[string]MethodMetrics, len(mc.drivers))
+	for driver, methods := range mc.drivers {
+		drivers[driver] = make(map[string]MethodMetrics, len(methods))
+		for method, mm := range methods {
+			drivers[driver][method] = mm.snapshot()
+		}
+	}
+
+	return drivers
+}
+
+// driverMetrics is kept globally, for all storage drivers of the process,
+// and made available via expvar and MetricsHandler.
+var driverMetrics = &metricsCollector{drivers: make(map[string]map[string]*methodMetrics)}
+
+func init() {
+	registry := expvar.Get("registry")
+	if registry == nil {
+		registry = expvar.NewMap("registry")
+	}
+
+	storage := registry.(*expvar.Map).Get("storage")
+	if storage == nil {
+		storage = &expvar.Map{}
+		storage.(*expvar.Map).Init()
+		registry.(*expvar.Map).Set("storage", storage)
+	}
+
+	storage.(*expvar.Map).Set("drivers", expvar.Func(func() interface{} {
+		return driverMetrics.Metrics()
+	}))
+}
+
+// Observe records a call, started at start, made by a storage driver to its
+// backend, so that the slowest backend operations of drivers can be found
+// along with the calls to the driver.
+func Observe(driver, operation string, start time.Time, err error) {
+	driverMetrics.method(driver, operation).observe(start, 0, err)
+}
+
+// countingReadCloser counts the content read from a stream
+type countingReadCloser struct {
+	io.ReadCloser
+	mm *methodMetrics
+}
+
+func (crc *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := crc.ReadCloser.Read(p)
+	crc.mm.addBytes(int64(n))
+	return n, err
+}
+
+// MetricsHandler serves the metrics of the storage drivers in the
+// Prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes the metrics of the storage drivers in the
+// Prometheus text format.
+func WritePrometheus(w io.Writer) {
+	drivers := driverMetrics.Metrics()
+
+	type series struct {
+		labels string
+		m      MethodMetrics
+	}
+	var all []series
+	for _, driver := range sortedKeys(drivers) {
+		methods := drivers[driver]
+		names := make([]string, 0, len(methods))
+		for method := range methods {
+			names = append(names, method)
+		}
+		sort.Strings(names)
+
+		for _, method := range names {
+			all = append(all, series{
+				labels: fmt.Sprintf("driver=%q,method=%q", driver, method),
+				m:      methods[method],
+			})
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP registry_storage_driver_calls_total Calls to storage driver methods.")
+	fmt.Fprintln(w, "# TYPE registry_storage_driver_calls_total counter")
+	for _, s := range all {
+		fmt.Fprintf(w, "registry_storage_driver_calls_total{%s} %d\n", s.labels, s.m.Calls)
+	}
+
+	fmt.Fprintln(w, "# HELP registry_storage_driver_errors_total Calls to storage driver methods returning an error, by type of error.")
+	fmt.Fprintln(w, "# TYPE registry_storage_driver_errors_total counter")
+	for _, s := range all {
+		errTypes := make([]string, 0, len(s.m.Errors))
+		for errType := range s.m.Errors {
+			errTypes = append(errTypes, errType)
+		}
+		sort.Strings(errTypes)
+
+		for _, errType := range errTypes {
+			fmt.Fprintf(w, "registry_storage_driver_errors_total{%s,type=%q} %d\n", s.labels, errType, s.m.Errors[errType])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP registry_storage_driver_bytes_total Content read or written by storage driver methods.")
+	fmt.Fprintln(w, "# TYPE registry_storage_driver_bytes_total counter")
+	for _, s := range all {
+		fmt.Fprintf(w, "registry_storage_driver_bytes_total{%s} %d\n", s.labels, s.m.Bytes)
+	}
+
+	fmt.Fprintln(w, "# HELP registry_storage_driver_duration_seconds Latency of calls to storage driver methods.")
+	fmt.Fprintln(w, "# TYPE registry_storage_driver_duration_seconds histogram")
+	for _, s := range all {
+		var cumulative uint64
+		for i, count := range s.m.Latency.Counts {
+			cumulative += count
+
+			le := "+Inf"
+			if i < len(s.m.Latency.Buckets) {
+				le = fmt.Sprint(s.m.Latency.Buckets[i])
+			}
+			fmt.Fprintf(w, "registry_storage_driver_duration_seconds_bucket{%s,le=%q} %d\n", s.labels, le, cumulative)
+		}
+		fmt.Fprintf(w, "registry_storage_driver_duration_seconds_sum{%s} %g\n", s.labels, s.m.Latency.Sum)
+		fmt.Fprintf(w, "registry_storage_driver_duration_seconds_count{%s} %d\n", s.labels, s.m.Latency.Count)
+	}
+}
+
+func sortedKeys(drivers map[string]map[string]MethodMetrics) []string {
+	keys := make([]string, 0, len(drivers))
+	for key := range drivers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
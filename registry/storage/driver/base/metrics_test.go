@@ -0,0 +1,87 @@
+package base
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// testDriver serves a single file
+type testDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d *testDriver) Name() string {
+	return "metricstest"
+}
+
+func (d *testDriver) ReadStream(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if path != "/file" {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return ioutil.NopCloser(strings.NewReader("content"[offset:])), nil
+}
+
+func (d *testDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	driver := &Base{StorageDriver: &testDriver{}}
+
+	rc, err := driver.ReadStream(ctx, "/file", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rc); err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	if _, err := driver.ReadStream(ctx, "/missing", 0); err == nil {
+		t.Fatal("expected error reading missing file")
+	}
+	if _, err := driver.ReadStream(ctx, "/file", -1); err == nil {
+		t.Fatal("expected error reading at negative offset")
+	}
+	if _, err := driver.URLFor(ctx, "/file", nil); err == nil {
+		t.Fatal("expected error getting url")
+	}
+
+	metrics := driverMetrics.Metrics()["metricstest"]
+
+	readStream := metrics["ReadStream"]
+	if readStream.Calls != 3 || readStream.Bytes != 5 {
+		t.Fatalf("unexpected ReadStream metrics: %#v", readStream)
+	}
+	if readStream.Errors["PathNotFound"] != 1 || readStream.Errors["InvalidOffset"] != 1 || len(readStream.Errors) != 2 {
+		t.Fatalf("unexpected ReadStream errors: %v", readStream.Errors)
+	}
+	if readStream.Latency.Count != 3 || len(readStream.Latency.Counts) != len(latencyBuckets)+1 {
+		t.Fatalf("unexpected ReadStream latency: %#v", readStream.Latency)
+	}
+
+	if metrics["URLFor"].Errors["UnsupportedMethod"] != 1 {
+		t.Fatalf("unexpected URLFor metrics: %#v", metrics["URLFor"])
+	}
+
+	var buf bytes.Buffer
+	WritePrometheus(&buf)
+	for _, expected := range []string{
+		`registry_storage_driver_calls_total{driver="metricstest",method="ReadStream"} 3`,
+		`registry_storage_driver_errors_total{driver="metricstest",method="ReadStream",type="PathNotFound"} 1`,
+		`registry_storage_driver_bytes_total{driver="metricstest",method="ReadStream"} 5`,
+		`registry_storage_driver_duration_seconds_bucket{driver="metricstest",method="ReadStream",le="+Inf"} 3`,
+		`registry_storage_driver_duration_seconds_count{driver="metricstest",method="ReadStream"} 3`,
+	} {
+		if !strings.Contains(buf.String(), expected+"\n") {
+			t.Errorf("expected %q in:\n%s", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package filesystem
+
+import (
+	"errors"
+	"os"
+)
+
+// clone is not supported on this platform, content is copied
+func clone(dst, src *os.File) error {
+	return errors.New("reflinks not supported")
+}
@@ -1,12 +1,16 @@
 package filesystem
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/docker/distribution/context"
@@ -18,6 +22,30 @@ import (
 const driverName = "filesystem"
 const defaultRootDirectory = "/var/lib/registry"
 
+// tempFilePrefix prefixes the names of the temporary files written by
+// PutContent, hidden from List. Paths of the registry never start with it.
+const tempFilePrefix = ".tmp-"
+
+// staleTempFileAge is the age past which temporary files are taken to be
+// left by a crash, rather than being written, and removed.
+const staleTempFileAge = time.Hour
+
+// Dedup modes, for moves of blobs to a path already holding a blob of the
+// same digest, and copies between filesystems
+const (
+	// DedupNone always moves the blob, replacing the existing one
+	DedupNone = ""
+	// DedupReflink keeps the existing blob, and clones the content of blobs
+	// moved, on the same filesystem or between filesystems
+	DedupReflink = "reflink"
+	// DedupHardlink hard links the blob moved, keeping the existing blob
+	DedupHardlink = "hardlink"
+)
+
+// blobDataPathRegexp matches the paths of blob data, addressed by the digest
+// of the content: the content moved to an existing path is the same.
+var blobDataPathRegexp = regexp.MustCompile(`/blobs/[a-z0-9]+/[0-9a-f]{2}/[0-9a-f]+/data$`)
+
 func init() {
 	factory.Register(driverName, &filesystemDriverFactory{})
 }
@@ -26,11 +54,35 @@ func init() {
 type filesystemDriverFactory struct{}
 
 func (factory *filesystemDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
-	return FromParameters(parameters), nil
+	return NewFromParameters(parameters)
+}
+
+// DriverParameters is a struct that encapsulates all of the driver parameters
+// after all values have been set
+type DriverParameters struct {
+	RootDirectory string
+
+	// Fsync makes writes durable before returning, by syncing the files
+	// written by WriteStream, and the directories of files created, moved or
+	// replaced. Files written by PutContent are always synced.
+	Fsync bool
+
+	// Dedup is the mode of deduplication of blobs: DedupNone, DedupReflink
+	// or DedupHardlink.
+	Dedup string
+
+	// URLSecret enables URLFor, returning URLs starting with URLBase signed
+	// with the secret, valid for URLExpiry, as served by NewURLHandler.
+	URLSecret string
+	URLBase   string
+	URLExpiry time.Duration
 }
 
 type driver struct {
 	rootDirectory string
+	fsync         bool
+	dedup         string
+	urls          *urlSigner
 }
 
 type baseEmbed struct {
@@ -43,27 +95,166 @@ type Driver struct {
 	baseEmbed
 }
 
-// FromParameters constructs a new Driver with a given parameters map
+// FromParameters constructs a new Driver with a given parameters map, as
+// NewFromParameters does. It panics if the parameters are invalid.
+func FromParameters(parameters map[string]interface{}) *Driver {
+	d, err := NewFromParameters(parameters)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// NewFromParameters constructs a new Driver with a given parameters map
 // Optional Parameters:
 // - rootdirectory
-func FromParameters(parameters map[string]interface{}) *Driver {
-	var rootDirectory = defaultRootDirectory
+// - fsync
+// - dedup
+// - urlsecret, urlbase, urlexpiry
+// - urladdr, accelredirect, served by URLServerFromParameters
+func NewFromParameters(parameters map[string]interface{}) (*Driver, error) {
+	params, err := fromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithParameters(params), nil
+}
+
+// URLServerFromParameters returns the address given by the urladdr parameter,
+// and a handler serving the URLs returned by URLFor with the path of the URL
+// base stripped, for the registry to serve. The address is empty if urladdr
+// is not set.
+func URLServerFromParameters(parameters map[string]interface{}) (string, http.Handler, error) {
+	params, err := fromParameters(parameters)
+	if err != nil {
+		return "", nil, err
+	}
+
+	addr, ok := parameters["urladdr"]
+	if !ok {
+		return "", nil, nil
+	}
+
+	accelRedirect := ""
+	if a, ok := parameters["accelredirect"]; ok {
+		accelRedirect = fmt.Sprint(a)
+	}
+
+	u, err := url.Parse(params.URLBase)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprint(addr), http.StripPrefix(strings.TrimRight(u.Path, "/"), NewURLHandler(params, accelRedirect)), nil
+}
+
+// fromParameters parses the parameters of NewFromParameters
+func fromParameters(parameters map[string]interface{}) (DriverParameters, error) {
+	params := DriverParameters{
+		RootDirectory: defaultRootDirectory,
+		URLExpiry:     defaultURLExpiry,
+	}
 	if parameters != nil {
 		rootDir, ok := parameters["rootdirectory"]
 		if ok {
-			rootDirectory = fmt.Sprint(rootDir)
+			params.RootDirectory = fmt.Sprint(rootDir)
+		}
+
+		fsync, ok := parameters["fsync"]
+		if ok {
+			switch fsync := fsync.(type) {
+			case bool:
+				params.Fsync = fsync
+			case string:
+				params.Fsync = fsync == "true"
+			default:
+				return params, fmt.Errorf("The fsync parameter should be a boolean")
+			}
+		}
+
+		dedup, ok := parameters["dedup"]
+		if ok {
+			switch dedup := fmt.Sprint(dedup); dedup {
+			case DedupNone, DedupReflink, DedupHardlink:
+				params.Dedup = dedup
+			default:
+				return params, fmt.Errorf("The dedup parameter should be reflink or hardlink: %s", dedup)
+			}
+		}
+
+		if err := urlParameters(parameters, &params); err != nil {
+			return params, err
+		}
+	}
+
+	if _, ok := parameters["urladdr"]; ok && params.URLSecret == "" {
+		return params, fmt.Errorf("The urladdr parameter requires urlsecret")
+	}
+
+	return params, nil
+}
+
+// urlParameters sets the parameters of the URLs returned by URLFor
+func urlParameters(parameters map[string]interface{}, params *DriverParameters) error {
+	secret, ok := parameters["urlsecret"]
+	if !ok {
+		return nil
+	}
+	params.URLSecret = fmt.Sprint(secret)
+
+	base, ok := parameters["urlbase"]
+	if !ok {
+		return fmt.Errorf("No urlbase parameter provided")
+	}
+	params.URLBase = fmt.Sprint(base)
+	if u, err := url.Parse(params.URLBase); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("The urlbase parameter should be an absolute URL: %s", params.URLBase)
+	}
+
+	if expiry, ok := parameters["urlexpiry"]; ok {
+		switch expiry := expiry.(type) {
+		case time.Duration:
+			params.URLExpiry = expiry
+		case string:
+			d, err := time.ParseDuration(expiry)
+			if err != nil {
+				return fmt.Errorf("Invalid urlexpiry: %s", err)
+			}
+			params.URLExpiry = d
+		default:
+			return fmt.Errorf("The urlexpiry parameter should be a duration")
 		}
 	}
-	return New(rootDirectory)
+
+	return nil
 }
 
 // New constructs a new Driver with a given rootDirectory
 func New(rootDirectory string) *Driver {
+	return NewWithParameters(DriverParameters{RootDirectory: rootDirectory})
+}
+
+// NewWithParameters constructs a new Driver with the given parameters
+func NewWithParameters(params DriverParameters) *Driver {
+	var urls *urlSigner
+	if params.URLSecret != "" {
+		urls = &urlSigner{
+			secret:  []byte(params.URLSecret),
+			baseURL: params.URLBase,
+			expiry:  params.URLExpiry,
+		}
+		if urls.expiry <= 0 {
+			urls.expiry = defaultURLExpiry
+		}
+	}
+
 	return &Driver{
 		baseEmbed: baseEmbed{
 			Base: base.Base{
 				StorageDriver: &driver{
-					rootDirectory: rootDirectory,
+					rootDirectory: params.RootDirectory,
+					fsync:         params.Fsync,
+					dedup:         params.Dedup,
+					urls:          urls,
 				},
 			},
 		},
@@ -93,12 +284,100 @@ func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
 }
 
 // PutContent stores the []byte content at a location designated by "path".
+// The content is written to a temporary file, renamed to the path once
+// complete, so that a crash never leaves partial content at the path.
 func (d *driver) PutContent(ctx context.Context, subPath string, contents []byte) error {
-	if _, err := d.WriteStream(ctx, subPath, 0, bytes.NewReader(contents)); err != nil {
+	fullPath := d.fullPath(subPath)
+	parentDir := path.Dir(fullPath)
+	if err := os.MkdirAll(parentDir, 0755); err != nil {
+		return err
+	}
+
+	err := d.writeFile(fullPath, func(fp *os.File) error {
+		_, err := fp.Write(contents)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.syncDir(parentDir)
+}
+
+// writeFile writes the file at fullPath with write, to a temporary file in
+// the same directory renamed to fullPath once complete. The temporary file is
+// always synced before the rename, which may otherwise be committed to disk
+// before its content, leaving an empty file after a crash of the host.
+func (d *driver) writeFile(fullPath string, write func(fp *os.File) error) error {
+	fp, err := ioutil.TempFile(path.Dir(fullPath), tempFilePrefix+path.Base(fullPath)+"-")
+	if err != nil {
+		return err
+	}
+
+	err = fp.Chmod(0644)
+	if err == nil {
+		err = write(fp)
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), fullPath)
+	}
+
+	if err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+
+	removeStaleTempFiles(fullPath)
+	return nil
+}
+
+// removeStaleTempFiles removes the temporary files of fullPath older than
+// staleTempFileAge, left by crashes while writing it. Errors are ignored, the
+// files being removed on the next write.
+func removeStaleTempFiles(fullPath string) {
+	dir, err := os.Open(path.Dir(fullPath))
+	if err != nil {
+		return
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return
+	}
+
+	prefix := tempFilePrefix + path.Base(fullPath) + "-"
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		tempPath := path.Join(path.Dir(fullPath), name)
+		if fi, err := os.Lstat(tempPath); err == nil && time.Since(fi.ModTime()) > staleTempFileAge {
+			os.Remove(tempPath)
+		}
+	}
+}
+
+// syncDir syncs the directory, to make the creation, removal or renaming of
+// its files durable, if fsync is enabled
+func (d *driver) syncDir(dir string) error {
+	if !d.fsync {
+		return nil
+	}
+
+	fp, err := os.Open(dir)
+	if err != nil {
 		return err
 	}
+	defer fp.Close()
 
-	return os.Truncate(d.fullPath(subPath), int64(len(contents)))
+	return fp.Sync()
 }
 
 // ReadStream retrieves an io.ReadCloser for the content stored at "path" with a
@@ -158,7 +437,16 @@ func (d *driver) WriteStream(ctx context.Context, subPath string, offset int64,
 		return 0, fmt.Errorf("bad seek to %v, expected %v in fp=%v", offset, nn, fp)
 	}
 
-	return io.Copy(fp, reader)
+	nn, err = io.Copy(fp, reader)
+	if err != nil || !d.fsync {
+		return nn, err
+	}
+
+	if err := fp.Sync(); err != nil {
+		return nn, err
+	}
+
+	return nn, d.syncDir(parentDir)
 }
 
 // Stat retrieves the FileInfo for the given path, including the current size
@@ -206,6 +494,10 @@ func (d *driver) List(ctx context.Context, subPath string) ([]string, error) {
 
 	keys := make([]string, 0, len(fileNames))
 	for _, fileName := range fileNames {
+		if strings.HasPrefix(fileName, tempFilePrefix) {
+			// Written by PutContent, or left by a crash during it
+			continue
+		}
 		keys = append(keys, path.Join(subPath, fileName))
 	}
 
@@ -213,7 +505,7 @@ func (d *driver) List(ctx context.Context, subPath string) ([]string, error) {
 }
 
 // Move moves an object stored at sourcePath to destPath, removing the original
-// object.
+// object. With fsync, the directories of both paths are synced.
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
 	source := d.fullPath(sourcePath)
 	dest := d.fullPath(destPath)
@@ -226,8 +518,116 @@ func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) e
 		return err
 	}
 
+	if err := d.move(source, dest, blobDataPathRegexp.MatchString(destPath)); err != nil {
+		return err
+	}
+
+	if err := d.syncDir(path.Dir(dest)); err != nil {
+		return err
+	}
+
+	if path.Dir(source) == path.Dir(dest) {
+		return nil
+	}
+
+	return d.syncDir(path.Dir(source))
+}
+
+// move renames the file at source to dest, or copies it if they are on
+// different filesystems. With dedup, the content addressed file existing at
+// dest is kept, only removing the source: of concurrent pushes of a blob, the
+// first committed wins.
+func (d *driver) move(source, dest string, contentAddressed bool) error {
+	if source == dest {
+		return nil
+	}
+
+	if contentAddressed {
+		switch d.dedup {
+		case DedupHardlink:
+			// Unlike rename, link never replaces dest
+			err := os.Link(source, dest)
+			if err == nil || os.IsExist(err) {
+				return os.Remove(source)
+			}
+			// Links unsupported, or across filesystems: rename or copy
+		case DedupReflink:
+			if _, err := os.Lstat(dest); err == nil {
+				return os.Remove(source)
+			}
+			if err := d.cloneFile(source, dest); err == nil {
+				return os.Remove(source)
+			}
+			// Reflinks unsupported, or across filesystems: rename or copy
+		}
+	}
+
 	err := os.Rename(source, dest)
-	return err
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	if err := d.copyFile(source, dest); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
+
+// cloneFile clones the file at source to a temporary file beside dest, then
+// links it to dest. Like the link of hardlink dedup, and unlike rename, this
+// never replaces a blob committed concurrently, which is kept. The clone
+// shares the extents of source rather than copying them, and fails where
+// reflinks are not supported.
+func (d *driver) cloneFile(source, dest string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fp, err := ioutil.TempFile(path.Dir(dest), tempFilePrefix+path.Base(dest)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+
+	err = fp.Chmod(0644)
+	if err == nil {
+		err = clone(fp, src)
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Link(fp.Name(), dest); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copyFile copies the file at source to dest, on another filesystem. With
+// reflink dedup, the content is cloned rather than copied if the filesystems
+// support it.
+func (d *driver) copyFile(source, dest string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return d.writeFile(dest, func(fp *os.File) error {
+		if d.dedup == DedupReflink && clone(fp, src) == nil {
+			return nil
+		}
+		_, err := io.Copy(fp, src)
+		return err
+	})
 }
 
 // Delete recursively deletes all objects stored at "path" and its subpaths.
@@ -246,9 +646,31 @@ func (d *driver) Delete(ctx context.Context, subPath string) error {
 }
 
 // URLFor returns a URL which may be used to retrieve the content stored at the given path.
-// May return an UnsupportedMethodErr in certain StorageDriver implementations.
-func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
-	return "", storagedriver.ErrUnsupportedMethod
+// Returns an UnsupportedMethodErr unless a URL secret is configured, URLs
+// being signed to be served by the handler of NewURLHandler.
+func (d *driver) URLFor(ctx context.Context, subPath string, options map[string]interface{}) (string, error) {
+	if d.urls == nil {
+		return "", storagedriver.ErrUnsupportedMethod
+	}
+
+	method, ok := options["method"]
+	if ok {
+		methodString, ok := method.(string)
+		if !ok || (methodString != "GET" && methodString != "HEAD") {
+			return "", storagedriver.ErrUnsupportedMethod
+		}
+	}
+
+	expiresTime := time.Now().Add(d.urls.expiry)
+	expires, ok := options["expiry"]
+	if ok {
+		et, ok := expires.(time.Time)
+		if ok {
+			expiresTime = et
+		}
+	}
+
+	return d.urls.urlFor(subPath, expiresTime), nil
 }
 
 // fullPath returns the absolute path of a key within the Driver's storage.
@@ -1,10 +1,21 @@
 package filesystem
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/docker/distribution/context"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/testsuites"
 	. "gopkg.in/check.v1"
@@ -23,4 +34,549 @@ func init() {
 	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
 		return New(root), nil
 	}, testsuites.NeverSkip)
+
+	fsyncRoot, err := ioutil.TempDir("", "driver-fsync-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(fsyncRoot)
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return NewFromParameters(map[string]interface{}{
+			"rootdirectory": fsyncRoot,
+			"fsync":         true,
+		})
+	}, testsuites.NeverSkip)
+
+	urlsRoot, err := ioutil.TempDir("", "driver-urls-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(urlsRoot)
+
+	params := DriverParameters{RootDirectory: urlsRoot, URLSecret: "secret"}
+	params.URLBase = httptest.NewServer(NewURLHandler(params, "")).URL
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return NewWithParameters(params), nil
+	}, testsuites.NeverSkip)
+}
+
+func TestFromParameters(t *testing.T) {
+	if fd := FromParameters(map[string]interface{}{"rootdirectory": "/tmp/registry"}).Base.StorageDriver.(*driver); fd.rootDirectory != "/tmp/registry" {
+		t.Fatalf("unexpected driver: %#v", fd)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected FromParameters to panic for invalid parameters")
+			}
+		}()
+		FromParameters(map[string]interface{}{"fsync": 1})
+	}()
+
+	d, err := NewFromParameters(map[string]interface{}{"fsync": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd := d.Base.StorageDriver.(*driver); !fd.fsync || fd.rootDirectory != defaultRootDirectory {
+		t.Fatalf("unexpected driver: %#v", fd)
+	}
+
+	if _, err := NewFromParameters(map[string]interface{}{"fsync": 1}); err == nil {
+		t.Fatal("expected error for invalid fsync parameter")
+	}
+
+	d, err = NewFromParameters(map[string]interface{}{"dedup": "hardlink"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd := d.Base.StorageDriver.(*driver); fd.dedup != DedupHardlink {
+		t.Fatalf("unexpected driver: %#v", fd)
+	}
+
+	if _, err := NewFromParameters(map[string]interface{}{"dedup": "copy"}); err == nil {
+		t.Fatal("expected error for invalid dedup parameter")
+	}
+
+	d, err = NewFromParameters(map[string]interface{}{
+		"urlsecret": "secret",
+		"urlbase":   "https://blobs.example.com/registry",
+		"urlexpiry": "1m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd := d.Base.StorageDriver.(*driver); fd.urls == nil || fd.urls.expiry != time.Minute {
+		t.Fatalf("unexpected driver: %#v", fd)
+	}
+
+	for _, parameters := range []map[string]interface{}{
+		{"urlsecret": "secret"},
+		{"urlsecret": "secret", "urlbase": "/registry"},
+		{"urlsecret": "secret", "urlbase": "https://blobs.example.com", "urlexpiry": 60},
+		{"urladdr": "127.0.0.1:0"},
+	} {
+		if _, err := NewFromParameters(parameters); err == nil {
+			t.Errorf("expected error for parameters %v", parameters)
+		}
+	}
+}
+
+// TestURLHandler checks that only the URLs signed, and not expired, are
+// served
+func TestURLHandler(t *testing.T) {
+	root, err := ioutil.TempDir("", "driver-urls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	params := DriverParameters{RootDirectory: root, URLSecret: "secret", URLBase: "https://blobs.example.com/registry"}
+	handler := NewURLHandler(params, "")
+	accelHandler := NewURLHandler(params, "/internal")
+
+	ctx := context.Background()
+	d := NewWithParameters(params)
+	if err := d.PutContent(ctx, testBlobPath, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(handler http.Handler, method, u string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, strings.TrimPrefix(u, params.URLBase), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	u, err := d.URLFor(ctx, testBlobPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u, params.URLBase+testBlobPath+"?") {
+		t.Fatalf("unexpected url: %s", u)
+	}
+
+	if w := serve(handler, "GET", u); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Fatalf("unexpected response: %d %q", w.Code, w.Body.String())
+	}
+	w := serve(accelHandler, "GET", u)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("X-Accel-Redirect") != "/internal"+testBlobPath {
+		t.Fatalf("unexpected response: %d %v", w.Code, w.Header())
+	}
+	if w := serve(handler, "DELETE", u); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected response to DELETE: %d", w.Code)
+	}
+
+	// Signed for another path
+	other := strings.Replace(u, "/data?", "/link?", 1)
+	if w := serve(handler, "GET", other); w.Code != http.StatusForbidden {
+		t.Fatalf("unexpected response for another path: %d", w.Code)
+	}
+
+	// Signed with another secret
+	forged, err := NewWithParameters(DriverParameters{RootDirectory: root, URLSecret: "forged", URLBase: params.URLBase}).URLFor(ctx, testBlobPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(handler, "GET", forged); w.Code != http.StatusForbidden {
+		t.Fatalf("unexpected response for another secret: %d", w.Code)
+	}
+
+	expired, err := d.URLFor(ctx, testBlobPath, map[string]interface{}{"expiry": time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(handler, "GET", expired); w.Code != http.StatusForbidden {
+		t.Fatalf("unexpected response for expired url: %d", w.Code)
+	}
+
+	if _, err := d.URLFor(ctx, testBlobPath, map[string]interface{}{"method": "PUT"}); err != storagedriver.ErrUnsupportedMethod {
+		t.Fatalf("unexpected error for PUT: %v", err)
+	}
+}
+
+const testBlobPath = "/docker/registry/v2/blobs/sha256/ab/abcdef/data"
+
+// TestURLServerFromParameters checks that the URL server parameters are
+// parsed without the driver listening, and that the handler strips the path
+// of the URL base
+func TestURLServerFromParameters(t *testing.T) {
+	root, err := ioutil.TempDir("", "driver-urls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	parameters := map[string]interface{}{
+		"rootdirectory": root,
+		"urlsecret":     "secret",
+		"urlbase":       "https://blobs.example.com/registry/",
+	}
+	if addr, handler, err := URLServerFromParameters(parameters); err != nil || addr != "" || handler != nil {
+		t.Fatalf("unexpected url server without urladdr: %q %v %v", addr, handler, err)
+	}
+
+	parameters["urladdr"] = "127.0.0.1:0"
+	for i := 0; i < 2; i++ {
+		if _, err := NewFromParameters(parameters); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addr, handler, err := URLServerFromParameters(parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "127.0.0.1:0" {
+		t.Fatalf("unexpected address: %s", addr)
+	}
+
+	ctx := context.Background()
+	d, err := NewFromParameters(parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, testBlobPath, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	u, err := d.URLFor(ctx, testBlobPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Fatalf("unexpected response: %d %q", w.Code, w.Body.String())
+	}
+}
+
+// TestMoveDedup moves two uploads of the same blob, checking that the blob
+// moved first is kept
+func TestMoveDedup(t *testing.T) {
+	for _, dedup := range []string{DedupReflink, DedupHardlink} {
+		root, err := ioutil.TempDir("", "driver-dedup-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+
+		ctx := context.Background()
+		d := NewWithParameters(DriverParameters{RootDirectory: root, Dedup: dedup})
+		for _, upload := range []string{"/uploads/a/data", "/uploads/b/data"} {
+			if err := d.PutContent(ctx, upload, []byte("content")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := d.Move(ctx, "/uploads/a/data", testBlobPath); err != nil {
+			t.Fatal(err)
+		}
+		first, err := os.Stat(root + testBlobPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := d.Move(ctx, "/uploads/b/data", testBlobPath); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Stat(ctx, "/uploads/b/data"); err == nil {
+			t.Fatalf("%s: expected source removed", dedup)
+		}
+		fi, err := os.Stat(root + testBlobPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(first, fi) {
+			t.Fatalf("%s: expected blob moved first kept", dedup)
+		}
+
+		// Other paths are replaced
+		if err := d.PutContent(ctx, "/uploads/c/data", []byte("new content")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.PutContent(ctx, "/repository/link", []byte("old content")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Move(ctx, "/uploads/c/data", "/repository/link"); err != nil {
+			t.Fatal(err)
+		}
+		content, err := d.GetContent(ctx, "/repository/link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "new content" {
+			t.Fatalf("%s: unexpected content: %q", dedup, content)
+		}
+	}
+}
+
+// TestCopyFile copies files as moves across filesystems do, with clones
+// falling back to copies where reflinks are not supported
+func TestCopyFile(t *testing.T) {
+	for _, dedup := range []string{DedupNone, DedupReflink} {
+		root, err := ioutil.TempDir("", "driver-copy-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+
+		content := bytes.Repeat([]byte("content"), 10000)
+		source := root + "/source"
+		if err := ioutil.WriteFile(source, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewWithParameters(DriverParameters{RootDirectory: root, Dedup: dedup}).Base.StorageDriver.(*driver)
+		if err := d.copyFile(source, root+"/dest"); err != nil {
+			t.Fatal(err)
+		}
+
+		copied, err := ioutil.ReadFile(root + "/dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(copied, content) {
+			t.Fatalf("%q: unexpected content copied: %d bytes", dedup, len(copied))
+		}
+
+		files, err := ioutil.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Fatalf("%q: unexpected files: %d", dedup, len(files))
+		}
+	}
+}
+
+// TestCloneFile clones files as reflink dedup does on the same filesystem,
+// checking that a blob committed concurrently is kept. Where reflinks are not
+// supported, the clone fails without leaving temporary files.
+func TestCloneFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "driver-clone-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	content := bytes.Repeat([]byte("content"), 10000)
+	for _, name := range []string{"/a", "/b"} {
+		if err := ioutil.WriteFile(root+name, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewWithParameters(DriverParameters{RootDirectory: root, Dedup: DedupReflink}).Base.StorageDriver.(*driver)
+	cloneErr := d.cloneFile(root+"/a", root+"/dest")
+
+	if cloneErr == nil {
+		first, err := os.Stat(root + "/dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cloned, err := ioutil.ReadFile(root + "/dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cloned, content) {
+			t.Fatalf("unexpected content cloned: %d bytes", len(cloned))
+		}
+
+		if err := d.cloneFile(root+"/b", root+"/dest"); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(root + "/dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(first, fi) {
+			t.Fatal("expected blob cloned first kept")
+		}
+	}
+
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), tempFilePrefix) {
+			t.Fatalf("unexpected temporary file: %s", fi.Name())
+		}
+	}
+
+	if cloneErr != nil {
+		t.Skipf("reflinks not supported: %v", cloneErr)
+	}
+}
+
+// crashRootEnv is the environment variable giving the root directory to
+// TestPutContentCrashHelper
+const crashRootEnv = "FILESYSTEM_CRASH_ROOT"
+
+// linkContent returns content recognizable as written whole: a header
+// giving the length and the byte repeated in the body
+func linkContent(i int) []byte {
+	length := 1<<20 + i%1000
+	header := fmt.Sprintf("%d %d\n", length, 'a'+i%26)
+	return append([]byte(header), bytes.Repeat([]byte{byte('a' + i%26)}, length)...)
+}
+
+// checkLinkContent returns an error if the content is not entirely written
+// by linkContent
+func checkLinkContent(content []byte) error {
+	parts := bytes.SplitN(content, []byte("\n"), 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("partial header: %d bytes", len(content))
+	}
+
+	var length, b int
+	if _, err := fmt.Sscanf(string(parts[0]), "%d %d", &length, &b); err != nil {
+		return fmt.Errorf("invalid header %q: %v", parts[0], err)
+	}
+
+	body := parts[1]
+	if len(body) != length || !bytes.Equal(body, bytes.Repeat([]byte{byte(b)}, length)) {
+		return fmt.Errorf("partial content: %d bytes of %d", len(body), length)
+	}
+
+	return nil
+}
+
+// TestPutContentCrash kills a process overwriting a file with PutContent
+// while it writes, checking that the file is never partially written.
+func TestPutContentCrash(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "driver-crash-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	d := NewWithParameters(DriverParameters{RootDirectory: root})
+	for i := 0; i < 10; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPutContentCrashHelper$")
+		cmd.Env = append(os.Environ(), crashRootEnv+"="+root)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for the first file written, then kill the process
+		// while it writes the following ones
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		if err != nil || line != "ready\n" {
+			cmd.Process.Kill()
+			cmd.Wait()
+			t.Fatalf("unexpected output of helper process: %q, %v", line, err)
+		}
+		time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		content, err := d.GetContent(ctx, "/repository/link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkLinkContent(content); err != nil {
+			t.Fatalf("iteration %d: %v", i, err)
+		}
+
+		// Temporary files left by the crash are not listed
+		children, err := d.List(ctx, "/repository")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(children) != 1 || children[0] != "/repository/link" {
+			t.Fatalf("unexpected children: %v", children)
+		}
+	}
+}
+
+// TestRemoveStaleTempFiles checks that PutContent removes the temporary files
+// of the path left by crashes, and not those being written or of other paths.
+func TestRemoveStaleTempFiles(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "driver-stale-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := path.Join(root, "repository")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := time.Now().Add(-2 * staleTempFileAge)
+	tempFiles := map[string]bool{
+		tempFilePrefix + "link-stale":      false,
+		tempFilePrefix + "link-writing":    true,
+		tempFilePrefix + "other-stale":     true,
+		tempFilePrefix + "linked-stale":    true,
+		tempFilePrefix + "link-stale-also": false,
+	}
+	for name := range tempFiles {
+		p := path.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(name, "stale") {
+			if err := os.Chtimes(p, stale, stale); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	d := NewWithParameters(DriverParameters{RootDirectory: root})
+	if err := d.PutContent(ctx, "/repository/link", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, kept := range tempFiles {
+		_, err := os.Stat(path.Join(dir, name))
+		if exists := err == nil; exists != kept {
+			t.Errorf("unexpected existence of %s: %v", name, exists)
+		}
+	}
+
+	children, err := d.List(ctx, "/repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 1 || children[0] != "/repository/link" {
+		t.Fatalf("unexpected children: %v", children)
+	}
+}
+
+// TestPutContentCrashHelper overwrites a file until killed by
+// TestPutContentCrash.
+func TestPutContentCrashHelper(t *testing.T) {
+	root := os.Getenv(crashRootEnv)
+	if root == "" {
+		t.Skip("run by TestPutContentCrash")
+	}
+
+	ctx := context.Background()
+	d := NewWithParameters(DriverParameters{RootDirectory: root})
+	for i := 0; ; i++ {
+		if err := d.PutContent(ctx, "/repository/link", linkContent(i)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if i == 0 {
+			fmt.Println("ready")
+		}
+	}
 }
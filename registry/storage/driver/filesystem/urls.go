@@ -0,0 +1,136 @@
+package filesystem
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultURLExpiry = 20 * time.Minute
+
+// urlSigner signs the URLs returned by URLFor with an hmac secret, for the
+// URL handler to verify them.
+type urlSigner struct {
+	secret  []byte
+	baseURL string
+	expiry  time.Duration
+}
+
+// signature returns the hmac digest of the path and expiry
+func (s *urlSigner) signature(subPath string, expires int64) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%d", subPath, expires)
+	return mac.Sum(nil)
+}
+
+// urlFor returns the signed URL of the path, expiring at the given time
+func (s *urlSigner) urlFor(subPath string, expiresTime time.Time) string {
+	expires := expiresTime.Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", base64.URLEncoding.EncodeToString(s.signature(subPath, expires)))
+
+	return strings.TrimRight(s.baseURL, "/") + (&url.URL{Path: subPath}).EscapedPath() + "?" + query.Encode()
+}
+
+// verify returns an error unless the query holds a valid signature of the
+// path, not expired.
+func (s *urlSigner) verify(subPath string, query url.Values) error {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid expiry")
+	}
+
+	signature, err := base64.URLEncoding.DecodeString(query.Get("signature"))
+	if err != nil {
+		return fmt.Errorf("Invalid signature")
+	}
+	if !hmac.Equal(signature, s.signature(subPath, expires)) {
+		return fmt.Errorf("Invalid signature")
+	}
+
+	if time.Now().Unix() > expires {
+		return fmt.Errorf("URL expired")
+	}
+
+	return nil
+}
+
+// urlHandler serves the files of the root directory at the URLs signed by
+// the driver.
+type urlHandler struct {
+	rootDirectory string
+	signer        *urlSigner
+	accelRedirect string
+}
+
+// NewURLHandler returns a handler serving the content of a driver with the
+// given parameters at the URLs returned by its URLFor, relative to the
+// URLBase, rejecting the URLs whose signature is invalid or expired. It
+// only depends on the root directory and secret, so that it can run apart
+// from the registry.
+//
+// If accelRedirect is not empty, the handler does not serve the content, but
+// responds with an X-Accel-Redirect header to the path under the
+// accelRedirect location, for nginx fronting the handler to serve the file.
+func NewURLHandler(params DriverParameters, accelRedirect string) http.Handler {
+	return &urlHandler{
+		rootDirectory: params.RootDirectory,
+		signer:        &urlSigner{secret: []byte(params.URLSecret)},
+		accelRedirect: accelRedirect,
+	}
+}
+
+func (h *urlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	subPath := r.URL.Path
+	if err := h.signer.verify(subPath, r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Signed paths are paths of the driver, never outside of the root
+	subPath = path.Clean("/" + subPath)
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if h.accelRedirect != "" {
+		w.Header().Set("X-Accel-Redirect", path.Join(h.accelRedirect, subPath))
+		return
+	}
+
+	fp, err := os.Open(path.Join(h.rootDirectory, subPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, "", fi.ModTime(), fp)
+}
@@ -24,7 +24,7 @@ func init() {
 type inMemoryDriverFactory struct{}
 
 func (factory *inMemoryDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
-	return New(), nil
+	return FromParameters(parameters)
 }
 
 type driver struct {
@@ -41,9 +41,30 @@ type baseEmbed struct {
 // Intended solely for example and testing purposes.
 type Driver struct {
 	baseEmbed // embedded, hidden base driver.
+
+	// snapshotPath is the file the content of the driver is loaded from
+	// when created, and saved to when closed.
+	snapshotPath string
 }
 
 var _ storagedriver.StorageDriver = &Driver{}
+var _ io.Closer = &Driver{}
+
+// FromParameters constructs a new Driver with a given parameters map.
+// Optional Parameters:
+// - snapshotpath
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	d := New()
+
+	if snapshotPath, ok := parameters["snapshotpath"]; ok {
+		d.snapshotPath = fmt.Sprint(snapshotPath)
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
 
 // New constructs a new Driver.
 func New() *Driver {
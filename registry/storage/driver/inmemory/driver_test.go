@@ -1,8 +1,14 @@
 package inmemory
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/docker/distribution/context"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/testsuites"
 	"gopkg.in/check.v1"
@@ -17,3 +23,140 @@ func init() {
 	}
 	testsuites.RegisterSuite(inmemoryDriverConstructor, testsuites.NeverSkip)
 }
+
+var testContent = map[string]string{
+	"/a/b/c":   "content of c",
+	"/a/b/d":   "",
+	"/a/e":     "content of e",
+	"/f/g/h/i": "content of i",
+	"/j":       "content of j",
+	"/a/b/k/l": "content of l",
+}
+
+func newTestDriver(t *testing.T) *Driver {
+	ctx := context.Background()
+	d := New()
+	for p, content := range testContent {
+		if err := d.PutContent(ctx, p, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+// checkContent fails unless the driver holds the content of the test
+// driver, with the same modification times to the second
+func checkContent(t *testing.T, d *Driver, expected *Driver) {
+	ctx := context.Background()
+	for p, content := range testContent {
+		read, err := d.GetContent(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(read) != content {
+			t.Fatalf("unexpected content of %s: %q", p, read)
+		}
+	}
+
+	for _, p := range []string{"/", "/a", "/a/b", "/f/g"} {
+		children, err := d.List(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedChildren, _ := expected.List(ctx, p)
+		if !reflect.DeepEqual(children, expectedChildren) {
+			t.Fatalf("unexpected children of %s: %v != %v", p, children, expectedChildren)
+		}
+	}
+
+	for _, p := range []string{"/a/b", "/a/b/c", "/f/g/h"} {
+		fi, err := d.Stat(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedFi, _ := expected.Stat(ctx, p)
+		if fi.IsDir() != expectedFi.IsDir() || fi.Size() != expectedFi.Size() || !fi.ModTime().Equal(expectedFi.ModTime().Truncate(time.Second)) {
+			t.Fatalf("unexpected file info of %s: %#v", p, fi)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDriver(t)
+
+	snapshot, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Content not in the snapshot is removed
+	restored := New()
+	if err := restored.PutContent(ctx, "/a/removed", []byte("removed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, restored, d)
+	if _, err := restored.Stat(ctx, "/a/removed"); err == nil {
+		t.Fatal("expected content removed by restore")
+	}
+
+	// The snapshot is not shared with the driver restored
+	if err := restored.PutContent(ctx, "/a/e", []byte("new content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, restored, d)
+
+	if err := restored.Restore([]byte("not a snapshot")); err == nil {
+		t.Fatal("expected error restoring invalid snapshot")
+	}
+	checkContent(t, restored, d)
+}
+
+func TestSnapshotPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inmemory-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPath := filepath.Join(dir, "snapshot.tar")
+
+	// Empty until saved
+	d, err := FromParameters(map[string]interface{}{"snapshotpath": snapshotPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if children, err := d.List(context.Background(), "/"); err != nil || len(children) != 0 {
+		t.Fatalf("unexpected children: %v, %v", children, err)
+	}
+
+	expected := newTestDriver(t)
+	snapshot, err := expected.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := FromParameters(map[string]interface{}{"snapshotpath": snapshotPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, loaded, expected)
+
+	if err := ioutil.WriteFile(snapshotPath, []byte("not a snapshot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FromParameters(map[string]interface{}{"snapshotpath": snapshotPath}); err == nil {
+		t.Fatal("expected error loading invalid snapshot")
+	}
+}
@@ -0,0 +1,196 @@
+package inmemory
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot returns the content of the driver as a tar archive of its
+// directories and files, which Restore loads. Modification times are kept
+// to the second.
+func (d *Driver) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := d.mfs().snapshot(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore replaces the content of the driver with a snapshot returned by
+// Snapshot.
+func (d *Driver) Restore(snapshot []byte) error {
+	return d.mfs().restore(bytes.NewReader(snapshot))
+}
+
+// Close saves a snapshot of the driver to the snapshot path, if configured.
+func (d *Driver) Close() error {
+	if d.snapshotPath == "" {
+		return nil
+	}
+
+	snapshot, err := d.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	// Written to a temporary file renamed over the previous snapshot, not to
+	// lose it on failure
+	fp, err := ioutil.TempFile(path.Dir(d.snapshotPath), path.Base(d.snapshotPath)+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = fp.Write(snapshot)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), d.snapshotPath)
+	}
+
+	if err != nil {
+		os.Remove(fp.Name())
+	}
+	return err
+}
+
+// load restores the snapshot at the snapshot path, if it exists
+func (d *Driver) load() error {
+	snapshot, err := ioutil.ReadFile(d.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := d.Restore(snapshot); err != nil {
+		return fmt.Errorf("Invalid snapshot %s: %v", d.snapshotPath, err)
+	}
+	return nil
+}
+
+func (d *Driver) mfs() *driver {
+	return d.baseEmbed.Base.StorageDriver.(*driver)
+}
+
+// snapshot writes the tree of the driver to w as a tar archive
+func (d *driver) snapshot(w io.Writer) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	tw := tar.NewWriter(w)
+	if err := writeTree(tw, d.root); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeTree writes the children of d, depth first in order of names
+func writeTree(tw *tar.Writer, d *dir) error {
+	names := make([]string, 0, len(d.children))
+	for name := range d.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch n := d.children[name].(type) {
+		case *dir:
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     strings.TrimPrefix(n.path(), "/") + "/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  n.modtime().Truncate(time.Second),
+			}); err != nil {
+				return err
+			}
+
+			if err := writeTree(tw, n); err != nil {
+				return err
+			}
+		case *file:
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     strings.TrimPrefix(n.path(), "/"),
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     int64(len(n.data)),
+				ModTime:  n.modtime().Truncate(time.Second),
+			}); err != nil {
+				return err
+			}
+
+			if _, err := tw.Write(n.data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// restore replaces the tree of the driver with the tar archive read from r
+func (d *driver) restore(r io.Reader) error {
+	root := &dir{
+		common: common{
+			p:   "/",
+			mod: time.Now(),
+		},
+	}
+
+	// Adding children updates the modification time of directories, set
+	// once all are added
+	dirs := make(map[*dir]time.Time)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		p := normalize(hdr.Name)
+		if p == "/" || path.Clean(p) != p {
+			return fmt.Errorf("invalid path %q", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dd, err := root.mkdirs(p)
+			if err != nil {
+				return fmt.Errorf("%s: %v", p, err)
+			}
+			dirs[dd] = hdr.ModTime
+		case tar.TypeReg:
+			f, err := root.mkfile(p)
+			if err != nil {
+				return fmt.Errorf("%s: %v", p, err)
+			}
+
+			if f.data, err = ioutil.ReadAll(tr); err != nil {
+				return err
+			}
+			f.mod = hdr.ModTime
+		default:
+			return fmt.Errorf("%s: unsupported type %q", p, hdr.Typeflag)
+		}
+	}
+
+	for dd, mod := range dirs {
+		dd.mod = mod
+	}
+
+	d.mutex.Lock()
+	d.root = root
+	d.mutex.Unlock()
+	return nil
+}
@@ -111,7 +111,7 @@ func (d *driver) publishChild(ipnskey, dirname, hash string) error {
 		return err
 	}
 
-	newIpnsRoot, err := d.shell.PatchLink(val, dirname, hash, true)
+	newIpnsRoot, err := d.patchLink(val, dirname, hash, true)
 	if err != nil {
 		return err
 	}
@@ -124,6 +124,15 @@ func (d *driver) publishChild(ipnskey, dirname, hash string) error {
 	return nil
 }
 
+// patchLink calls PatchLink of the shell, recording its latency, which adds
+// to the latency of all writes.
+func (d *driver) patchLink(root, path, childhash string, create bool) (string, error) {
+	start := time.Now()
+	newroot, err := d.shell.PatchLink(root, path, childhash, create)
+	base.Observe(driverName, "PatchLink", start, err)
+	return newroot, err
+}
+
 type baseEmbed struct {
 	base.Base
 }
@@ -251,7 +260,7 @@ func (d *driver) PutContent(ctx context.Context, path string, contents []byte) e
 
 	d.rootlock.Lock()
 	defer d.rootlock.Unlock()
-	nroot, err := d.shell.PatchLink(d.roothash, path, contentHash, true)
+	nroot, err := d.patchLink(d.roothash, path, contentHash, true)
 	if err != nil {
 		return err
 	}
@@ -322,7 +331,7 @@ func (d *driver) WriteStream(ctx context.Context, path string, offset int64, rea
 
 	d.rootlock.Lock()
 	defer d.rootlock.Unlock()
-	k, err := d.shell.PatchLink(d.roothash, path, contentHash, true)
+	k, err := d.patchLink(d.roothash, path, contentHash, true)
 	if err != nil {
 		return 0, err
 	}
@@ -406,7 +415,7 @@ func (d *driver) Move(ctx context.Context, source string, dest string) error {
 
 	// remove leading slash
 	dest = dest[1:]
-	newroot, err = d.shell.PatchLink(newroot, dest, srchash, true)
+	newroot, err = d.patchLink(newroot, dest, srchash, true)
 	if err != nil {
 		return err
 	}
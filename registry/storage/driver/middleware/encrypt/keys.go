@@ -0,0 +1,94 @@
+package encrypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// maxKeyIDLength is the longest key id, which is stored in the header of
+// each file
+const maxKeyIDLength = 32
+
+// keyring holds the master keys, by id, that wrap the data keys of files.
+// New files are encrypted with the current key, while files encrypted with
+// any key in the ring can be read.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// readKeyfile reads a keyring from a file with a key on each line: an id,
+// followed by white space and the base64 encoding of a 16, 24 or 32 byte AES
+// key. Empty lines and lines starting with "#" are ignored. The first key is
+// the current one.
+func readKeyfile(path string) (*keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kr := &keyring{keys: make(map[string]cipher.AEAD)}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key id and key", path, line)
+		}
+		id := fields[0]
+
+		if len(id) > maxKeyIDLength {
+			return nil, fmt.Errorf("%s:%d: key id longer than %d characters", path, line, maxKeyIDLength)
+		}
+
+		if _, exists := kr.keys[id]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %q", path, line, id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %v", path, line, err)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %v", path, line, err)
+		}
+
+		if kr.current == "" {
+			kr.current = id
+		}
+		kr.keys[id] = aead
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if kr.current == "" {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+
+	return kr, nil
+}
+
+// newAEAD returns AES-GCM with the given key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,697 @@
+// Package encrypt provides a storage middleware that encrypts the content of
+// files at rest with AES-GCM.
+//
+// Each file is encrypted with its own random data key, which is stored in the
+// header of the file wrapped with a master key read from a keyfile. Content
+// is encrypted in chunks, so that streams can be read from any offset and
+// appended to without decrypting the whole file. The last chunk is sealed as
+// final, so that files truncated at a chunk boundary are detected, and files
+// with no content hold a single empty chunk. Master keys are identified
+// by an id in the header, so that new keys can be added to the keyfile
+// without losing access to files encrypted with older ones.
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+const (
+	// magic identifies encrypted files
+	magic = "DENC"
+
+	// version is the version of the format of encrypted files
+	version = 1
+
+	// dataKeySize is the size of the AES-256 key generated for each file
+	dataKeySize = 32
+
+	// nonceSize and tagSize are the overhead of AES-GCM
+	nonceSize = 12
+	tagSize   = 16
+
+	// headerPrefixSize is the size of the magic, version, key id length and
+	// padded key id, which authenticate the wrapped data key
+	headerPrefixSize = 4 + 2 + maxKeyIDLength
+
+	// headerSize is the size of the header of an encrypted file: the prefix
+	// followed by the data key, sealed with the master key
+	headerSize = headerPrefixSize + nonceSize + dataKeySize + tagSize
+
+	// chunkSize is the size of the plaintext of each chunk
+	chunkSize = 64 << 10
+
+	// encryptedChunkSize is the size of a full chunk once sealed
+	encryptedChunkSize = nonceSize + chunkSize + tagSize
+)
+
+// encryptStorageMiddleware encrypts content written to, and decrypts content
+// read from, the wrapped storage driver.
+type encryptStorageMiddleware struct {
+	storagedriver.StorageDriver
+	keys *keyring
+}
+
+var _ storagedriver.StorageDriver = &encryptStorageMiddleware{}
+
+// newEncryptStorageMiddleware constructs and returns a new encrypting
+// storage middleware.
+// Required options: keyfile
+// Optional options: keyid
+func newEncryptStorageMiddleware(storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	kf, ok := options["keyfile"]
+	if !ok {
+		return nil, fmt.Errorf("No keyfile provided")
+	}
+	keyfile, ok := kf.(string)
+	if !ok {
+		return nil, fmt.Errorf("keyfile must be a string")
+	}
+
+	keys, err := readKeyfile(keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read keyfile: %s", err)
+	}
+
+	if kid, ok := options["keyid"]; ok {
+		keyID, ok := kid.(string)
+		if !ok {
+			return nil, fmt.Errorf("keyid must be a string")
+		}
+		if _, ok := keys.keys[keyID]; !ok {
+			return nil, fmt.Errorf("keyid %q not found in keyfile", keyID)
+		}
+		keys.current = keyID
+	}
+
+	return &encryptStorageMiddleware{
+		StorageDriver: storageDriver,
+		keys:          keys,
+	}, nil
+}
+
+// GetContent retrieves and decrypts the content stored at "path"
+func (esm *encryptStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	rc, err := esm.ReadStream(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// PutContent encrypts the content with a new data key and stores it at
+// "path"
+func (esm *encryptStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	header, aead, err := esm.newHeader()
+	if err != nil {
+		return err
+	}
+
+	encrypted := make([]byte, 0, encryptedSize(int64(len(content))))
+	encrypted = append(encrypted, header...)
+	for index := int64(0); ; index++ {
+		n := chunkSize
+		if len(content) < n {
+			n = len(content)
+		}
+		final := n == len(content)
+
+		encrypted, err = sealChunk(encrypted, aead, index, final, content[:n])
+		if err != nil {
+			return err
+		}
+		content = content[n:]
+
+		if final {
+			break
+		}
+	}
+
+	return esm.StorageDriver.PutContent(ctx, path, encrypted)
+}
+
+// ReadStream returns a reader of the decrypted content stored at "path",
+// starting at offset
+func (esm *encryptStorageMiddleware) ReadStream(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+
+	fi, err := esm.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%q is a directory", path)
+	}
+
+	size, err := plaintextSize(path, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if offset >= size {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	aead, err := esm.readHeader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	index := offset / chunkSize
+	rc, err := esm.StorageDriver.ReadStream(ctx, path, headerSize+index*encryptedChunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		rc:    rc,
+		path:  path,
+		aead:  aead,
+		index: index,
+		last:  (size - 1) / chunkSize,
+		skip:  int(offset % chunkSize),
+	}, nil
+}
+
+// WriteStream encrypts the content of the reader and stores it at "path",
+// starting at offset. Since content is encrypted in chunks, writing starts at
+// the beginning of the chunk containing offset, which is decrypted and
+// rewritten. Writing content ending before the end of the file rewrites the
+// rest of the file, which is held in memory.
+func (esm *encryptStorageMiddleware) WriteStream(ctx context.Context, path string, offset int64, reader io.Reader) (nn int64, err error) {
+	if offset < 0 {
+		return 0, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+
+	var (
+		header []byte
+		aead   cipher.AEAD
+		size   int64
+	)
+
+	fi, err := esm.StorageDriver.Stat(ctx, path)
+	switch err.(type) {
+	case nil:
+		if fi.IsDir() {
+			return 0, fmt.Errorf("%q is a directory", path)
+		}
+
+		size, err = plaintextSize(path, fi.Size())
+		if err != nil {
+			return 0, err
+		}
+
+		aead, err = esm.readHeader(ctx, path)
+		if err != nil {
+			return 0, err
+		}
+	case storagedriver.PathNotFoundError:
+		header, aead, err = esm.newHeader()
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, err
+	}
+
+	// Start writing at the beginning of the chunk containing offset, or
+	// containing the end of the file if offset is past it. Appending at a
+	// chunk boundary rewrites the last chunk, no longer final.
+	start := offset
+	if start > size {
+		start = size
+	}
+	index := start / chunkSize
+	if size > 0 && index*chunkSize == size {
+		index--
+	}
+
+	var prefix []byte
+	if start > index*chunkSize {
+		chunk, err := esm.readChunk(ctx, path, aead, index)
+		if err != nil {
+			return 0, err
+		}
+		prefix = chunk[:start-index*chunkSize]
+	}
+
+	src := &countingReader{r: reader}
+	plaintext := io.MultiReader(
+		bytes.NewReader(prefix),
+		io.LimitReader(zeroReader{}, offset-start),
+		src)
+
+	// Content overlapping the existing content is read first, since if it
+	// ends before the end of the file, the rest of the file is rewritten
+	// after it: the chunk containing the end must be completed, and drivers
+	// may truncate the file at the end of the write. This cannot be read
+	// while the wrapped driver is writing.
+	if overlap := size - index*chunkSize; overlap > 0 {
+		buf := make([]byte, overlap)
+		n, err := io.ReadFull(plaintext, buf)
+		switch err {
+		case nil:
+			plaintext = io.MultiReader(bytes.NewReader(buf), plaintext)
+		case io.EOF, io.ErrUnexpectedEOF:
+			rest, err := esm.readFrom(ctx, path, index*chunkSize+int64(n))
+			if err != nil {
+				return 0, err
+			}
+			plaintext = bytes.NewReader(append(buf[:n], rest...))
+		default:
+			return 0, err
+		}
+	}
+
+	er := &encryptingReader{
+		plaintext: bufio.NewReader(plaintext),
+		header:    header,
+		aead:      aead,
+		index:     index,
+	}
+
+	headerLength := int64(len(header))
+	encryptedOffset := int64(0)
+	if header == nil {
+		encryptedOffset = headerSize + index*encryptedChunkSize
+	}
+
+	written, err := esm.StorageDriver.WriteStream(ctx, path, encryptedOffset, er)
+	if err == nil {
+		err = er.err
+	}
+	if err != nil {
+		// Only count the content of the chunks written in full
+		var chunks int64
+		if written > headerLength {
+			chunks = (written - headerLength) / encryptedChunkSize
+		}
+		nn = (index+chunks)*chunkSize - offset
+		if nn < 0 {
+			nn = 0
+		}
+		if nn > src.n {
+			nn = src.n
+		}
+		return nn, err
+	}
+
+	return src.n, nil
+}
+
+// Stat returns info about the file at "path", with the size of its
+// decrypted content
+func (esm *encryptStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := esm.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() {
+		return fi, err
+	}
+
+	size, err := plaintextSize(path, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    size,
+		ModTime: fi.ModTime(),
+		IsDir:   false,
+	}}, nil
+}
+
+// URLFor is not supported, since content served from the storage backend
+// directly would not be decrypted
+func (esm *encryptStorageMiddleware) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod
+}
+
+// newHeader generates a data key, returning the header of a new file holding
+// it, sealed with the current master key
+func (esm *encryptStorageMiddleware) newHeader() ([]byte, cipher.AEAD, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, headerPrefixSize, headerSize)
+	copy(header, magic)
+	header[len(magic)] = version
+	header[len(magic)+1] = byte(len(esm.keys.current))
+	copy(header[len(magic)+2:], esm.keys.current)
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	header = append(header, nonce...)
+	header = esm.keys.keys[esm.keys.current].Seal(header, nonce, dataKey, header[:headerPrefixSize])
+
+	return header, aead, nil
+}
+
+// readHeader reads the header of the file at "path", returning the cipher
+// of its unwrapped data key
+func (esm *encryptStorageMiddleware) readHeader(ctx context.Context, path string) (cipher.AEAD, error) {
+	rc, err := esm.StorageDriver.ReadStream(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(rc, header); err != nil {
+		return nil, corruptError(path, "short header")
+	}
+
+	if string(header[:len(magic)]) != magic {
+		return nil, corruptError(path, "not encrypted")
+	}
+	if header[len(magic)] != version {
+		return nil, corruptError(path, fmt.Sprintf("unknown version %d", header[len(magic)]))
+	}
+
+	idLength := int(header[len(magic)+1])
+	if idLength > maxKeyIDLength {
+		return nil, corruptError(path, "invalid key id")
+	}
+	keyID := string(header[len(magic)+2 : len(magic)+2+idLength])
+
+	master, ok := esm.keys.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encrypt: %s: unknown key id %q", path, keyID)
+	}
+
+	nonce := header[headerPrefixSize : headerPrefixSize+nonceSize]
+	dataKey, err := master.Open(nil, nonce, header[headerPrefixSize+nonceSize:], header[:headerPrefixSize])
+	if err != nil {
+		return nil, corruptError(path, "invalid data key")
+	}
+
+	return newAEAD(dataKey)
+}
+
+// readFrom returns the decrypted content of the file at "path" from offset
+func (esm *encryptStorageMiddleware) readFrom(ctx context.Context, path string, offset int64) ([]byte, error) {
+	rc, err := esm.ReadStream(ctx, path, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// readChunk returns the decrypted content of a chunk of the file at "path"
+func (esm *encryptStorageMiddleware) readChunk(ctx context.Context, path string, aead cipher.AEAD, index int64) ([]byte, error) {
+	rc, err := esm.StorageDriver.ReadStream(ctx, path, headerSize+index*encryptedChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	sealed := make([]byte, encryptedChunkSize)
+	n, err := io.ReadFull(rc, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	// The chunk is rewritten, so either flag is accepted, for writes
+	// interrupted before sealing their final chunk to be resumed
+	plaintext, err := openChunk(path, aead, index, true, sealed[:n])
+	if err != nil {
+		plaintext, err = openChunk(path, aead, index, false, sealed[:n])
+	}
+	return plaintext, err
+}
+
+// decryptingReader decrypts the chunks read from the wrapped reader,
+// skipping content before the offset read from, up to the last chunk, which
+// must be sealed as final
+type decryptingReader struct {
+	rc    io.ReadCloser
+	path  string
+	aead  cipher.AEAD
+	index int64
+	last  int64
+	skip  int
+
+	sealed []byte
+	buf    []byte
+	err    error
+}
+
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		dr.fill()
+	}
+
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+// fill reads and decrypts the next chunk
+func (dr *decryptingReader) fill() {
+	if dr.sealed == nil {
+		dr.sealed = make([]byte, encryptedChunkSize)
+	}
+
+	n, err := io.ReadFull(dr.rc, dr.sealed)
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+		dr.err = io.EOF
+	default:
+		dr.err = err
+		return
+	}
+
+	if n == 0 {
+		return
+	}
+
+	plaintext, err := openChunk(dr.path, dr.aead, dr.index, dr.index == dr.last, dr.sealed[:n])
+	if err != nil {
+		dr.err = err
+		return
+	}
+	dr.index++
+
+	if dr.skip > len(plaintext) {
+		dr.skip = len(plaintext)
+	}
+	dr.buf = plaintext[dr.skip:]
+	dr.skip = 0
+}
+
+func (dr *decryptingReader) Close() error {
+	return dr.rc.Close()
+}
+
+// encryptingReader reads the header, if any, followed by the content of the
+// plaintext reader encrypted in chunks, the last one sealed as final.
+type encryptingReader struct {
+	plaintext *bufio.Reader
+	header    []byte
+	aead      cipher.AEAD
+	index     int64
+
+	chunk []byte
+	buf   []byte
+	done  bool
+
+	// err holds an error encountered encrypting, as the wrapped driver
+	// may not report errors of its reader
+	err error
+}
+
+func (er *encryptingReader) Read(p []byte) (int, error) {
+	if len(er.header) > 0 {
+		n := copy(p, er.header)
+		er.header = er.header[n:]
+		return n, nil
+	}
+
+	for len(er.buf) == 0 {
+		if er.err != nil {
+			return 0, er.err
+		}
+		if er.done {
+			return 0, io.EOF
+		}
+		er.fill()
+	}
+
+	n := copy(p, er.buf)
+	er.buf = er.buf[n:]
+	return n, nil
+}
+
+// fill reads and encrypts the next chunk. The chunk is final if no content
+// follows it, or if reading the plaintext failed, so that the content read
+// before the error is kept readable.
+func (er *encryptingReader) fill() {
+	if er.chunk == nil {
+		er.chunk = make([]byte, chunkSize)
+	}
+
+	n, err := io.ReadFull(er.plaintext, er.chunk)
+	if err == nil {
+		_, err = er.plaintext.Peek(1)
+	}
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		er.done = true
+	default:
+		er.err = err
+		er.done = true
+	}
+
+	// Only files with no content hold an empty chunk
+	if n == 0 && er.index > 0 {
+		return
+	}
+
+	er.buf, err = sealChunk(er.buf[:0], er.aead, er.index, er.done, er.chunk[:n])
+	if err != nil {
+		er.err = err
+		return
+	}
+	er.index++
+}
+
+// sealChunk appends the encrypted chunk, with a random nonce, to dst
+func sealChunk(dst []byte, aead cipher.AEAD, index int64, final bool, chunk []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, chunk, chunkAdditionalData(index, final)), nil
+}
+
+// openChunk decrypts an encrypted chunk, which must be sealed as final if
+// final is true, and not otherwise
+func openChunk(path string, aead cipher.AEAD, index int64, final bool, sealed []byte) ([]byte, error) {
+	if len(sealed) < nonceSize+tagSize || len(sealed) == nonceSize+tagSize && index > 0 {
+		return nil, corruptError(path, fmt.Sprintf("short chunk %d", index))
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], chunkAdditionalData(index, final))
+	if err != nil {
+		if final {
+			return nil, corruptError(path, fmt.Sprintf("invalid or truncated chunk %d", index))
+		}
+		return nil, corruptError(path, fmt.Sprintf("invalid chunk %d", index))
+	}
+
+	return plaintext, nil
+}
+
+// chunkAdditionalData authenticates the position of a chunk, so that chunks
+// cannot be reordered, and whether it is the last one, so that files cannot
+// be truncated
+func chunkAdditionalData(index int64, final bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, uint64(index))
+	if final {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// plaintextSize returns the size of the content of an encrypted file
+func plaintextSize(path string, size int64) (int64, error) {
+	if size == 0 {
+		// Drivers may create empty files before writing to them
+		return 0, nil
+	}
+
+	size -= headerSize
+	if size < 0 {
+		return 0, corruptError(path, "short header")
+	}
+	if size == 0 {
+		return 0, corruptError(path, "missing final chunk")
+	}
+	if size == nonceSize+tagSize {
+		// A single empty chunk
+		return 0, nil
+	}
+
+	last := size % encryptedChunkSize
+	if last > 0 && last <= nonceSize+tagSize {
+		return 0, corruptError(path, "short chunk")
+	}
+	if last > 0 {
+		last -= nonceSize + tagSize
+	}
+
+	return size/encryptedChunkSize*chunkSize + last, nil
+}
+
+// encryptedSize returns the size of an encrypted file with content of the
+// given size
+func encryptedSize(size int64) int64 {
+	encrypted := headerSize + size/chunkSize*encryptedChunkSize
+	if last := size % chunkSize; last > 0 || size == 0 {
+		encrypted += nonceSize + last + tagSize
+	}
+	return encrypted
+}
+
+func corruptError(path, reason string) error {
+	return fmt.Errorf("encrypt: %s: corrupt encrypted file: %s", path, reason)
+}
+
+// countingReader counts the bytes read from the wrapped reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// zeroReader reads zeros, filling the gap when writing past the end of a
+// file
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// init registers the encrypt storage middleware.
+func init() {
+	storagemiddleware.Register("encrypt", storagemiddleware.InitFunc(newEncryptStorageMiddleware))
+}
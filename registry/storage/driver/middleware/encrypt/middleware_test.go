@@ -0,0 +1,378 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/filesystem"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	keyfile, err := writeKeyfile("", "suite")
+	if err != nil {
+		panic(err)
+	}
+
+	encryptDriverConstructor := func() (storagedriver.StorageDriver, error) {
+		return newEncryptStorageMiddleware(inmemory.New(), map[string]interface{}{
+			"keyfile": keyfile,
+		})
+	}
+	testsuites.RegisterSuite(encryptDriverConstructor, testsuites.NeverSkip)
+}
+
+// writeKeyfile writes a keyfile with a random key for each id to a temporary
+// directory, or to path if not empty, returning its path
+func writeKeyfile(path string, ids ...string) (string, error) {
+	if path == "" {
+		dir, err := ioutil.TempDir("", "encrypt-test")
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(dir, "keys")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "# test keys")
+	for _, id := range ids {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&buf, "%s %s\n", id, base64.StdEncoding.EncodeToString(key))
+	}
+
+	return path, ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+func TestEncryptedAtRest(t *testing.T) {
+	ctx := context.Background()
+
+	keyfile, err := writeKeyfile("", "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(keyfile))
+
+	backend := inmemory.New()
+	driver, err := newEncryptStorageMiddleware(backend, map[string]interface{}{"keyfile": keyfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("plaintext content "), chunkSize/8)
+	if err := driver.PutContent(ctx, "/a", content); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := backend.GetContent(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("plaintext")) {
+		t.Fatal("content stored in plaintext")
+	}
+	if int64(len(stored)) != encryptedSize(int64(len(content))) {
+		t.Fatalf("unexpected encrypted size: %d != %d", len(stored), encryptedSize(int64(len(content))))
+	}
+
+	// Tampering with a chunk must be detected
+	stored[len(stored)-1] ^= 0xff
+	if err := backend.PutContent(ctx, "/a", stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.GetContent(ctx, "/a"); err == nil {
+		t.Fatal("expected error reading tampered content")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+
+	keyfile, err := writeKeyfile("", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(keyfile))
+
+	backend := inmemory.New()
+	driver, err := newEncryptStorageMiddleware(backend, map[string]interface{}{"keyfile": keyfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("written with the old key")
+	if err := driver.PutContent(ctx, "/old", content); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate, keeping the old key to decrypt existing files
+	oldKeys, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeKeyfile(keyfile, "new"); err != nil {
+		t.Fatal(err)
+	}
+	newKeys, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyfile, append(newKeys, oldKeys...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := newEncryptStorageMiddleware(backend, map[string]interface{}{"keyfile": keyfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := rotated.GetContent(ctx, "/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatalf("unexpected content: %q != %q", received, content)
+	}
+
+	// Appending keeps the key of the file
+	if _, err := rotated.WriteStream(ctx, "/old", int64(len(content)), bytes.NewReader([]byte("!"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.GetContent(ctx, "/old"); err != nil {
+		t.Fatalf("unexpected error reading appended file with old key: %v", err)
+	}
+
+	if err := rotated.PutContent(ctx, "/new", content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.GetContent(ctx, "/new"); err == nil {
+		t.Fatal("expected error reading file encrypted with unknown key")
+	}
+}
+
+func TestRewriteWithinContent(t *testing.T) {
+	ctx := context.Background()
+
+	keyfile, err := writeKeyfile("", "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(keyfile))
+
+	driver, err := newEncryptStorageMiddleware(inmemory.New(), map[string]interface{}{"keyfile": keyfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*chunkSize+100)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.PutContent(ctx, "/a", content); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite a range spanning a chunk boundary, ending within a chunk
+	patch := bytes.Repeat([]byte{0xaa}, chunkSize)
+	offset := int64(chunkSize + chunkSize/2)
+	nn, err := driver.WriteStream(ctx, "/a", offset, bytes.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nn != int64(len(patch)) {
+		t.Fatalf("unexpected bytes written: %d != %d", nn, len(patch))
+	}
+	copy(content[offset:], patch)
+
+	received, err := driver.GetContent(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatal("unexpected content after rewrite")
+	}
+
+	rc, err := driver.ReadStream(ctx, "/a", offset+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	received, err = ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content[offset+10:]) {
+		t.Fatal("unexpected content read from offset")
+	}
+}
+
+// TestTruncation checks that files truncated at a chunk boundary are
+// rejected, as their last chunk is not sealed as final
+func TestTruncation(t *testing.T) {
+	ctx := context.Background()
+
+	keyfile, err := writeKeyfile("", "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(keyfile))
+
+	backend := inmemory.New()
+	driver, err := newEncryptStorageMiddleware(backend, map[string]interface{}{"keyfile": keyfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 100, chunkSize, 2*chunkSize + 100, 3 * chunkSize} {
+		content := make([]byte, size)
+		if _, err := rand.Read(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := driver.PutContent(ctx, "/a", content); err != nil {
+			t.Fatal(err)
+		}
+
+		received, err := driver.GetContent(ctx, "/a")
+		if err != nil {
+			t.Fatalf("unexpected error reading %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(received, content) {
+			t.Fatalf("unexpected content of %d bytes", size)
+		}
+
+		stored, err := backend.GetContent(ctx, "/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for chunks := 0; headerSize+chunks*encryptedChunkSize < len(stored); chunks++ {
+			if err := backend.PutContent(ctx, "/b", stored[:headerSize+chunks*encryptedChunkSize]); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := driver.GetContent(ctx, "/b"); err == nil {
+				t.Errorf("expected error reading %d bytes truncated to %d chunks", size, chunks)
+			}
+		}
+	}
+}
+
+// failingReader returns the content of r, then err
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err == io.EOF {
+		err = fr.err
+	}
+	return n, err
+}
+
+// TestAppendAfterFinalChunk checks that appending to a file, at a chunk
+// boundary or after a write interrupted by its reader, unmarks the previous
+// last chunk. The filesystem driver keeps the content written before the
+// interruption, and the inmemory driver none of it.
+func TestAppendAfterFinalChunk(t *testing.T) {
+	ctx := context.Background()
+
+	keyfile, err := writeKeyfile("", "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(keyfile))
+
+	root, err := ioutil.TempDir("", "encrypt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	content := make([]byte, 2*chunkSize+100)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, backend := range []storagedriver.StorageDriver{inmemory.New(), filesystem.New(root)} {
+		driver, err := newEncryptStorageMiddleware(backend, map[string]interface{}{"keyfile": keyfile})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := driver.WriteStream(ctx, "/a", 0, bytes.NewReader(content[:chunkSize])); err != nil {
+			t.Fatal(err)
+		}
+		interrupted := fmt.Errorf("interrupted")
+		if _, err := driver.WriteStream(ctx, "/a", chunkSize, &failingReader{r: bytes.NewReader(content[chunkSize : 2*chunkSize-10]), err: interrupted}); err == nil {
+			t.Fatalf("%s: expected error of interrupted write", backend.Name())
+		}
+
+		// Content written before the interruption is readable
+		received, err := driver.GetContent(ctx, "/a")
+		if err != nil {
+			t.Fatalf("%s: %v", backend.Name(), err)
+		}
+		if len(received) < chunkSize || !bytes.Equal(received, content[:len(received)]) {
+			t.Fatalf("%s: unexpected content after interrupted write: %d bytes", backend.Name(), len(received))
+		}
+
+		offset := int64(len(received))
+		if _, err := driver.WriteStream(ctx, "/a", offset, bytes.NewReader(content[offset:])); err != nil {
+			t.Fatal(err)
+		}
+		received, err = driver.GetContent(ctx, "/a")
+		if err != nil {
+			t.Fatalf("%s: %v", backend.Name(), err)
+		}
+		if !bytes.Equal(received, content) {
+			t.Fatalf("%s: unexpected content after resumed write", backend.Name())
+		}
+	}
+}
+
+func TestInvalidKeyfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, keys := range []string{
+		"",
+		"# only comments\n",
+		"key1\n",
+		"key1 notbase64!\n",
+		"key1 " + base64.StdEncoding.EncodeToString([]byte("short")) + "\n",
+		"key1 " + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\nkey1 " + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\n",
+	} {
+		keyfile := filepath.Join(dir, "keys")
+		if err := ioutil.WriteFile(keyfile, []byte(keys), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := newEncryptStorageMiddleware(inmemory.New(), map[string]interface{}{"keyfile": keyfile}); err == nil {
+			t.Errorf("expected error for keyfile %q", keys)
+		}
+	}
+
+	if _, err := newEncryptStorageMiddleware(inmemory.New(), map[string]interface{}{}); err == nil {
+		t.Error("expected error without keyfile")
+	}
+}
@@ -0,0 +1,324 @@
+// Package faulty provides a storage middleware injecting faults in the calls
+// to the wrapped driver, to test how the registry copes with failures of its
+// storage backend: errors, latency, truncated reads, short writes and stale
+// results of Stat and List, as returned by eventually consistent backends.
+//
+// Faults are injected according to rules, each applying to some methods of
+// the driver for the paths matching a regular expression, with a
+// probability. The middleware must not be configured in production.
+package faulty
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+// FaultError is the error injected in a call to a storage driver
+type FaultError struct {
+	Method string
+	Path   string
+}
+
+func (err FaultError) Error() string {
+	return fmt.Sprintf("faulty: injected error in %s %s", err.Method, err.Path)
+}
+
+// faultyStorageMiddleware injects faults in the calls to the wrapped driver.
+type faultyStorageMiddleware struct {
+	storagedriver.StorageDriver
+	rules []*rule
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	// stats and lists hold the last results of Stat and List for each path,
+	// returned by stale faults
+	stats map[string]statResult
+	lists map[string]listResult
+}
+
+type statResult struct {
+	fi  storagedriver.FileInfo
+	err error
+}
+
+type listResult struct {
+	children []string
+	err      error
+}
+
+var _ storagedriver.StorageDriver = &faultyStorageMiddleware{}
+
+// newFaultyStorageMiddleware constructs and returns a new fault injecting
+// storage middleware.
+// Required options: faults
+// Optional options: seed
+func newFaultyStorageMiddleware(storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	faults, ok := options["faults"]
+	if !ok {
+		return nil, fmt.Errorf("No faults provided")
+	}
+	rules, err := parseRules(faults)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := time.Now().UnixNano()
+	if s, ok := options["seed"]; ok {
+		i, ok := s.(int)
+		if !ok {
+			return nil, fmt.Errorf("seed must be an integer")
+		}
+		seed = int64(i)
+	}
+
+	return &faultyStorageMiddleware{
+		StorageDriver: storageDriver,
+		rules:         rules,
+		rand:          rand.New(rand.NewSource(seed)),
+		stats:         make(map[string]statResult),
+		lists:         make(map[string]listResult),
+	}, nil
+}
+
+// faults are the faults to inject in a call
+type faults struct {
+	err        bool
+	latency    time.Duration
+	truncate   bool
+	shortWrite bool
+	stale      bool
+}
+
+// inject determines the faults to inject in the call to the method for the
+// path, and injects the latency and error
+func (fsm *faultyStorageMiddleware) inject(ctx context.Context, method, path string) (faults, error) {
+	var f faults
+
+	fsm.mu.Lock()
+	for _, r := range fsm.rules {
+		if !r.methods[method] || !r.pattern.MatchString(path) || r.remaining == 0 {
+			continue
+		}
+		if r.probability < 1 && fsm.rand.Float64() >= r.probability {
+			continue
+		}
+		if r.remaining > 0 {
+			r.remaining--
+		}
+
+		switch r.fault {
+		case faultError:
+			f.err = true
+		case faultLatency:
+			f.latency += r.latency
+		case faultTruncate:
+			f.truncate = true
+		case faultShortWrite:
+			f.shortWrite = true
+		case faultStale:
+			f.stale = true
+		}
+	}
+	fsm.mu.Unlock()
+
+	if f.latency > 0 {
+		timer := time.NewTimer(f.latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	if f.err {
+		context.GetLogger(ctx).Warnf("faulty: injecting error in %s %s", method, path)
+		return f, FaultError{Method: method, Path: path}
+	}
+
+	return f, nil
+}
+
+// prefix returns a random length shorter than size, if positive
+func (fsm *faultyStorageMiddleware) prefix(size int64) int64 {
+	if size <= 0 {
+		return size
+	}
+
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	return fsm.rand.Int63n(size)
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (fsm *faultyStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	f, err := fsm.inject(ctx, "GetContent", path)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := fsm.StorageDriver.GetContent(ctx, path)
+	if err == nil && f.truncate {
+		content = content[:fsm.prefix(int64(len(content)))]
+	}
+	return content, err
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (fsm *faultyStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	f, err := fsm.inject(ctx, "PutContent", path)
+	if err != nil {
+		return err
+	}
+
+	if f.shortWrite {
+		content = content[:fsm.prefix(int64(len(content)))]
+	}
+	return fsm.StorageDriver.PutContent(ctx, path, content)
+}
+
+// ReadStream retrieves an io.ReadCloser for the content stored at "path" with
+// a given byte offset.
+func (fsm *faultyStorageMiddleware) ReadStream(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	f, err := fsm.inject(ctx, "ReadStream", path)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := fsm.StorageDriver.ReadStream(ctx, path, offset)
+	if err != nil || !f.truncate {
+		return rc, err
+	}
+
+	fi, err := fsm.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return truncatedReadCloser{
+		Reader: io.LimitReader(rc, fsm.prefix(fi.Size()-offset)),
+		Closer: rc,
+	}, nil
+}
+
+// truncatedReadCloser ends the content of a stream early
+type truncatedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// WriteStream stores the contents of the provided io.Reader at a location
+// designated by the given path. A short write reads all of the reader, but
+// stores only a prefix of it, reporting the length of the prefix written.
+func (fsm *faultyStorageMiddleware) WriteStream(ctx context.Context, path string, offset int64, reader io.Reader) (int64, error) {
+	f, err := fsm.inject(ctx, "WriteStream", path)
+	if err != nil {
+		return 0, err
+	}
+
+	if !f.shortWrite {
+		return fsm.StorageDriver.WriteStream(ctx, path, offset, reader)
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+	content = content[:fsm.prefix(int64(len(content)))]
+	return fsm.StorageDriver.WriteStream(ctx, path, offset, bytes.NewReader(content))
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (fsm *faultyStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	f, err := fsm.inject(ctx, "Stat", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.stale {
+		fsm.mu.Lock()
+		defer fsm.mu.Unlock()
+
+		if result, ok := fsm.stats[path]; ok {
+			return result.fi, result.err
+		}
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+
+	fi, err := fsm.StorageDriver.Stat(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok || err == nil {
+		fsm.mu.Lock()
+		fsm.stats[path] = statResult{fi: fi, err: err}
+		fsm.mu.Unlock()
+	}
+	return fi, err
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (fsm *faultyStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	f, err := fsm.inject(ctx, "List", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.stale {
+		fsm.mu.Lock()
+		defer fsm.mu.Unlock()
+
+		if result, ok := fsm.lists[path]; ok {
+			return append([]string(nil), result.children...), result.err
+		}
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+
+	children, err := fsm.StorageDriver.List(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok || err == nil {
+		fsm.mu.Lock()
+		fsm.lists[path] = listResult{children: append([]string(nil), children...), err: err}
+		fsm.mu.Unlock()
+	}
+	return children, err
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (fsm *faultyStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if _, err := fsm.inject(ctx, "Move", sourcePath); err != nil {
+		return err
+	}
+	return fsm.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (fsm *faultyStorageMiddleware) Delete(ctx context.Context, path string) error {
+	if _, err := fsm.inject(ctx, "Delete", path); err != nil {
+		return err
+	}
+	return fsm.StorageDriver.Delete(ctx, path)
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at
+// the given path.
+func (fsm *faultyStorageMiddleware) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	if _, err := fsm.inject(ctx, "URLFor", path); err != nil {
+		return "", err
+	}
+	return fsm.StorageDriver.URLFor(ctx, path, options)
+}
+
+// init registers the faulty storage middleware.
+func init() {
+	storagemiddleware.Register("faulty", storagemiddleware.InitFunc(newFaultyStorageMiddleware))
+}
@@ -0,0 +1,253 @@
+package faulty
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	faultyDriverConstructor := func() (storagedriver.StorageDriver, error) {
+		// Faults never injected
+		return newFaultyStorageMiddleware(inmemory.New(), map[string]interface{}{
+			"faults": []interface{}{
+				map[string]interface{}{"fault": "error", "probability": 0},
+				map[string]interface{}{"fault": "stale", "pattern": "^/never/"},
+			},
+		})
+	}
+	testsuites.RegisterSuite(faultyDriverConstructor, testsuites.NeverSkip)
+}
+
+func newTestFaulty(t *testing.T, faults ...map[string]interface{}) (*faultyStorageMiddleware, storagedriver.StorageDriver) {
+	list := make([]interface{}, len(faults))
+	for i, f := range faults {
+		list[i] = f
+	}
+
+	backend := inmemory.New()
+	fsm, err := newFaultyStorageMiddleware(backend, map[string]interface{}{
+		"faults": list,
+		"seed":   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fsm.(*faultyStorageMiddleware), backend
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	fsm, backend := newTestFaulty(t, map[string]interface{}{
+		"fault":   "error",
+		"methods": []interface{}{"GetContent", "PutContent"},
+		"pattern": "^/faulty/",
+		"count":   2,
+	})
+
+	if err := fsm.PutContent(ctx, "/healthy", []byte("content")); err != nil {
+		t.Fatalf("unexpected error for path not matching: %v", err)
+	}
+
+	if err := fsm.PutContent(ctx, "/faulty/a", []byte("content")); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(FaultError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := backend.Stat(ctx, "/faulty/a"); err == nil {
+		t.Fatal("expected content not written")
+	}
+
+	if _, err := fsm.GetContent(ctx, "/faulty/a"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Only count errors are injected
+	if err := fsm.PutContent(ctx, "/faulty/a", []byte("content")); err != nil {
+		t.Fatalf("unexpected error after count: %v", err)
+	}
+	if _, err := fsm.Stat(ctx, "/faulty/a"); err != nil {
+		t.Fatalf("unexpected error for method not matching: %v", err)
+	}
+}
+
+func TestProbability(t *testing.T) {
+	ctx := context.Background()
+	fsm, _ := newTestFaulty(t, map[string]interface{}{
+		"fault":       "error",
+		"probability": 0.5,
+	})
+
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := fsm.List(ctx, "/"); err != nil {
+			if _, ok := err.(FaultError); ok {
+				failed++
+			}
+		}
+	}
+	if failed < 400 || failed > 600 {
+		t.Fatalf("unexpected number of errors injected: %d", failed)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	ctx := context.Background()
+	fsm, _ := newTestFaulty(t, map[string]interface{}{
+		"fault":   "latency",
+		"latency": "50ms",
+	})
+
+	start := time.Now()
+	if err := fsm.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("call not delayed: %s", elapsed)
+	}
+}
+
+func TestTruncatedReads(t *testing.T) {
+	ctx := context.Background()
+	fsm, backend := newTestFaulty(t, map[string]interface{}{
+		"fault": "truncate",
+	})
+
+	content := bytes.Repeat([]byte("content"), 100)
+	if err := backend.PutContent(ctx, "/a", content); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := fsm.GetContent(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) >= len(content) || !bytes.Equal(read, content[:len(read)]) {
+		t.Fatalf("expected a prefix of the content: %d bytes", len(read))
+	}
+
+	rc, err := fsm.ReadStream(ctx, "/a", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	read, err = ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) >= len(content)-10 || !bytes.Equal(read, content[10:10+len(read)]) {
+		t.Fatalf("expected a prefix of the content: %d bytes", len(read))
+	}
+}
+
+func TestShortWrites(t *testing.T) {
+	ctx := context.Background()
+	fsm, backend := newTestFaulty(t, map[string]interface{}{
+		"fault":   "shortwrite",
+		"methods": []interface{}{"WriteStream"},
+	})
+
+	content := bytes.Repeat([]byte("content"), 100)
+	nn, err := fsm.WriteStream(ctx, "/a", 0, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nn >= int64(len(content)) {
+		t.Fatalf("expected a short write: %d bytes", nn)
+	}
+
+	written, err := backend.GetContent(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, content[:nn]) {
+		t.Fatalf("unexpected content written: %d bytes", len(written))
+	}
+}
+
+func TestStaleResults(t *testing.T) {
+	ctx := context.Background()
+	fsm, backend := newTestFaulty(t, map[string]interface{}{
+		"fault":   "stale",
+		"pattern": "^/stale",
+		"count":   1,
+	}, map[string]interface{}{
+		"fault":   "stale",
+		"pattern": "^/dir$",
+		"count":   1,
+	})
+
+	if err := backend.PutContent(ctx, "/dir/a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not observed yet
+	if err := backend.PutContent(ctx, "/stale", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsm.Stat(ctx, "/stale"); err == nil {
+		t.Fatal("expected path not found")
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectSize(t, fsm, "/stale", 3)
+
+	// The previous result
+	if err := backend.PutContent(ctx, "/stale", []byte("new content")); err != nil {
+		t.Fatal(err)
+	}
+	fsm.rules[0].remaining = 1
+	expectSize(t, fsm, "/stale", 3)
+	expectSize(t, fsm, "/stale", 11)
+
+	children, err := fsm.List(ctx, "/dir")
+	if err == nil {
+		t.Fatalf("expected path not found: %v", children)
+	}
+	children, err = fsm.List(ctx, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 1 {
+		t.Fatalf("unexpected children: %v", children)
+	}
+}
+
+func expectSize(t *testing.T, driver storagedriver.StorageDriver, path string, size int64) {
+	fi, err := driver.Stat(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != size {
+		t.Fatalf("unexpected size of %s: %d != %d", path, fi.Size(), size)
+	}
+}
+
+func TestInvalidFaults(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"faults": "error"},
+		{"faults": []interface{}{map[string]interface{}{"fault": "crash"}}},
+		{"faults": []interface{}{map[string]interface{}{"fault": "stale", "methods": []interface{}{"GetContent"}}}},
+		{"faults": []interface{}{map[string]interface{}{"fault": "error", "pattern": "("}}},
+		{"faults": []interface{}{map[string]interface{}{"fault": "error", "probability": 2}}},
+		{"faults": []interface{}{map[string]interface{}{"fault": "latency"}}},
+		{"faults": []interface{}{map[interface{}]interface{}{"fault": "error", "count": -1}}},
+	} {
+		if _, err := newFaultyStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Errorf("expected error for options %v", options)
+		}
+	}
+}
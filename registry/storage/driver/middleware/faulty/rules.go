@@ -0,0 +1,180 @@
+package faulty
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Kinds of faults
+const (
+	// faultError fails the call with a FaultError
+	faultError = "error"
+	// faultLatency delays the call
+	faultLatency = "latency"
+	// faultTruncate returns a prefix of the content read
+	faultTruncate = "truncate"
+	// faultShortWrite stores a prefix of the content written, without error
+	faultShortWrite = "shortwrite"
+	// faultStale returns the result of the previous call for the path, or a
+	// path not found error if there was none
+	faultStale = "stale"
+)
+
+// methods lists the methods of the storage driver in which each kind of
+// fault can be injected
+var methods = map[string][]string{
+	faultError:      {"GetContent", "PutContent", "ReadStream", "WriteStream", "Stat", "List", "Move", "Delete", "URLFor"},
+	faultLatency:    {"GetContent", "PutContent", "ReadStream", "WriteStream", "Stat", "List", "Move", "Delete", "URLFor"},
+	faultTruncate:   {"GetContent", "ReadStream"},
+	faultShortWrite: {"PutContent", "WriteStream"},
+	faultStale:      {"Stat", "List"},
+}
+
+// rule injects a fault in the calls to the methods for the paths matching
+// the pattern, with a probability
+type rule struct {
+	fault       string
+	methods     map[string]bool
+	pattern     *regexp.Regexp
+	probability float64
+	latency     time.Duration
+
+	// remaining is the number of faults left to inject, or negative if
+	// unlimited
+	remaining int
+}
+
+// parseRules parses the list of faults of the options
+func parseRules(faults interface{}) ([]*rule, error) {
+	list, ok := faults.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("faults must be a list")
+	}
+
+	rules := make([]*rule, 0, len(list))
+	for i, f := range list {
+		options, err := toMap(f)
+		if err != nil {
+			return nil, fmt.Errorf("fault %d: %s", i, err)
+		}
+
+		r, err := parseRule(options)
+		if err != nil {
+			return nil, fmt.Errorf("fault %d: %s", i, err)
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func toMap(v interface{}) (map[string]interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, v := range v {
+			m[fmt.Sprint(k)] = v
+		}
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("must be a map")
+}
+
+func parseRule(options map[string]interface{}) (*rule, error) {
+	fault, ok := options["fault"].(string)
+	if !ok {
+		return nil, fmt.Errorf("fault must be a string")
+	}
+	supported, ok := methods[fault]
+	if !ok {
+		return nil, fmt.Errorf("unknown fault %q", fault)
+	}
+
+	r := &rule{
+		fault:       fault,
+		methods:     make(map[string]bool),
+		probability: 1,
+		remaining:   -1,
+	}
+
+	if m, ok := options["methods"]; ok {
+		list, ok := m.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("methods must be a list")
+		}
+		for _, method := range list {
+			method := fmt.Sprint(method)
+			if !contains(supported, method) {
+				return nil, fmt.Errorf("fault %s cannot be injected in %s", fault, method)
+			}
+			r.methods[method] = true
+		}
+	} else {
+		for _, method := range supported {
+			r.methods[method] = true
+		}
+	}
+
+	pattern := ""
+	if p, ok := options["pattern"]; ok {
+		if pattern, ok = p.(string); !ok {
+			return nil, fmt.Errorf("pattern must be a string")
+		}
+	}
+	var err error
+	if r.pattern, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("Invalid pattern: %s", err)
+	}
+
+	if p, ok := options["probability"]; ok {
+		switch p := p.(type) {
+		case float64:
+			r.probability = p
+		case int:
+			r.probability = float64(p)
+		default:
+			return nil, fmt.Errorf("probability must be a number")
+		}
+		if r.probability < 0 || r.probability > 1 {
+			return nil, fmt.Errorf("probability must be between 0 and 1")
+		}
+	}
+
+	if c, ok := options["count"]; ok {
+		count, ok := c.(int)
+		if !ok || count < 0 {
+			return nil, fmt.Errorf("count must be a positive integer")
+		}
+		if count > 0 {
+			r.remaining = count
+		}
+	}
+
+	if fault == faultLatency {
+		switch l := options["latency"].(type) {
+		case time.Duration:
+			r.latency = l
+		case string:
+			if r.latency, err = time.ParseDuration(l); err != nil {
+				return nil, fmt.Errorf("Invalid latency: %s", err)
+			}
+		default:
+			return nil, fmt.Errorf("latency must be a duration")
+		}
+	}
+
+	return r, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,401 @@
+package localcache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// errTooLarge is returned when filling the cache with content larger than
+// the cache
+var errTooLarge = errors.New("content larger than cache")
+
+// diskCache holds copies of files of a storage driver on local disk,
+// removing the least recently used when its size is exceeded.
+type diskCache struct {
+	root    string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // most recently used at the front
+	size    int64
+	fills   map[string]*fill
+
+	// generation is incremented by removals, so that fills started before a
+	// removal do not add back content that may have been removed
+	generation uint64
+}
+
+type cacheEntry struct {
+	path string
+	size int64
+}
+
+// fill is a fill of the cache in progress, copying a file of the driver to
+// a temporary file read by the readers of the path as it is written
+type fill struct {
+	tmp string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written int64
+	done    bool
+	err     error
+}
+
+// newDiskCache returns a cache in the root directory, holding the content
+// left in it by a previous process.
+func newDiskCache(root string, maxSize int64) (*diskCache, error) {
+	dc := &diskCache{
+		root:    root,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		fills:   make(map[string]*fill),
+	}
+
+	// Remove fills interrupted by the exit of a previous process
+	if err := os.RemoveAll(dc.tempDir()); err != nil {
+		return nil, err
+	}
+
+	if err := dc.load(); err != nil {
+		return nil, err
+	}
+
+	return dc, nil
+}
+
+// load adds the files in the cache directory to the cache, in the order of
+// their modification time, which is updated when they are read
+func (dc *diskCache) load() error {
+	var entries []cacheEntry
+	var modTimes []time.Time
+
+	dataDir := dc.dataDir()
+	err := filepath.Walk(dataDir, func(local string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && local == dataDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			entries = append(entries, cacheEntry{
+				path: filepath.ToSlash(strings.TrimPrefix(local, dataDir)),
+				size: fi.Size(),
+			})
+			modTimes = append(modTimes, fi.ModTime())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(byModTime{entries, modTimes})
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	for _, entry := range entries {
+		dc.add(entry)
+	}
+
+	return nil
+}
+
+// open returns a reader of the cached content of the file at path, starting
+// at offset, or false if it is not cached
+func (dc *diskCache) open(path string, offset int64) (io.ReadCloser, bool) {
+	dc.mu.Lock()
+	elem, ok := dc.entries[path]
+	if ok {
+		dc.order.MoveToFront(elem)
+	}
+	dc.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	local := dc.localPath(path)
+	f, err := os.Open(local)
+	if err != nil {
+		// Removed from the disk behind our back
+		dc.remove(path)
+		return nil, false
+	}
+
+	if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+		f.Close()
+		return nil, false
+	}
+
+	// Record the use for the order of eviction after a restart
+	now := time.Now()
+	os.Chtimes(local, now, now)
+
+	return &servingReader{f}, true
+}
+
+// fill returns a reader of the file at path starting at offset, served
+// while the file is copied from the driver into the cache. Concurrent fills
+// of the same path are done once, read by all callers.
+func (dc *diskCache) fill(ctx context.Context, driver storagedriver.StorageDriver, path string, offset int64) (io.ReadCloser, error) {
+	fi, err := driver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%q is a directory", path)
+	}
+	if dc.maxSize > 0 && fi.Size() > dc.maxSize {
+		return nil, errTooLarge
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	f, ok := dc.fills[path]
+	if !ok {
+		if err := os.MkdirAll(dc.tempDir(), 0755); err != nil {
+			return nil, err
+		}
+		tmp, err := ioutil.TempFile(dc.tempDir(), "fill")
+		if err != nil {
+			return nil, err
+		}
+
+		f = &fill{tmp: tmp.Name()}
+		f.cond = sync.NewCond(&f.mu)
+		dc.fills[path] = f
+		go dc.copyFrom(ctx, driver, path, fi.Size(), tmp, f)
+	}
+
+	// The temporary file is renamed or removed once the fill is no longer
+	// in the fills, under dc.mu
+	file, err := os.Open(f.tmp)
+	if err != nil {
+		return nil, err
+	}
+	return &fillReader{f: f, file: file, offset: offset}, nil
+}
+
+// copyFrom copies the file at path from the driver to the temporary file of
+// the fill, and adds it to the cache once complete
+func (dc *diskCache) copyFrom(ctx context.Context, driver storagedriver.StorageDriver, path string, size int64, tmp *os.File, f *fill) {
+	dc.mu.Lock()
+	generation := dc.generation
+	dc.mu.Unlock()
+
+	n, err := dc.copyTo(ctx, driver, path, tmp, f)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	// The content of blobs does not change, so a difference in size is a
+	// truncated read
+	if err == nil && n != size {
+		err = fmt.Errorf("read %d bytes of %q, expected %d", n, path, size)
+	}
+
+	local := dc.localPath(path)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(local), 0755)
+	}
+
+	dc.mu.Lock()
+	delete(dc.fills, path)
+	if err == nil && dc.generation == generation {
+		err = os.Rename(tmp.Name(), local)
+		if err == nil {
+			dc.add(cacheEntry{path: path, size: n})
+			cacheMetrics.fill(uint64(n))
+		}
+	}
+	dc.mu.Unlock()
+
+	// Readers with the temporary file open can complete their read
+	os.Remove(tmp.Name())
+
+	if err != nil {
+		cacheMetrics.fillError()
+		context.GetLogger(ctx).Errorf("Error filling local cache with %s: %v", path, err)
+	}
+
+	f.mu.Lock()
+	f.done = true
+	f.err = err
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// copyTo copies the file at path from the driver to w, recording the content
+// written in the fill for its readers
+func (dc *diskCache) copyTo(ctx context.Context, driver storagedriver.StorageDriver, path string, w io.Writer, f *fill) (int64, error) {
+	rc, err := driver.ReadStream(ctx, path, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	var n int64
+	buf := make([]byte, 32<<10)
+	for {
+		nr, rerr := rc.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+
+			f.mu.Lock()
+			f.written = n
+			f.cond.Broadcast()
+			f.mu.Unlock()
+
+			if werr != nil {
+				return n, werr
+			}
+		}
+
+		if rerr == io.EOF {
+			return n, nil
+		} else if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// fillReader reads the temporary file of a fill, waiting for the content not
+// written yet
+type fillReader struct {
+	f      *fill
+	file   *os.File
+	offset int64
+}
+
+func (fr *fillReader) Read(p []byte) (int, error) {
+	fr.f.mu.Lock()
+	for fr.offset >= fr.f.written && !fr.f.done {
+		fr.f.cond.Wait()
+	}
+	written, err := fr.f.written, fr.f.err
+	fr.f.mu.Unlock()
+
+	if fr.offset >= written {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > written-fr.offset {
+		p = p[:written-fr.offset]
+	}
+	n, err := fr.file.ReadAt(p, fr.offset)
+	fr.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (fr *fillReader) Close() error {
+	return fr.file.Close()
+}
+
+// remove removes the file at path, or the files in the directory at path,
+// from the cache
+func (dc *diskCache) remove(path string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	dc.generation++
+
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p, elem := range dc.entries {
+		if p == path || strings.HasPrefix(p, prefix) {
+			dc.removeElement(elem)
+		}
+	}
+}
+
+// add adds an entry to the cache, evicting the least recently used entries
+// if the cache is over its size. dc.mu must be held.
+func (dc *diskCache) add(entry cacheEntry) {
+	if elem, ok := dc.entries[entry.path]; ok {
+		dc.order.Remove(elem)
+		dc.size -= elem.Value.(*cacheEntry).size
+	}
+
+	dc.entries[entry.path] = dc.order.PushFront(&entry)
+	dc.size += entry.size
+
+	for dc.maxSize > 0 && dc.size > dc.maxSize && dc.order.Len() > 1 {
+		dc.removeElement(dc.order.Back())
+		cacheMetrics.evict()
+	}
+}
+
+// removeElement removes an entry, and its file, from the cache. dc.mu must
+// be held.
+func (dc *diskCache) removeElement(elem *list.Element) {
+	entry := dc.order.Remove(elem).(*cacheEntry)
+	delete(dc.entries, entry.path)
+	dc.size -= entry.size
+
+	// Readers with the file open can complete their read
+	os.Remove(dc.localPath(entry.path))
+}
+
+func (dc *diskCache) localPath(path string) string {
+	return filepath.Join(dc.dataDir(), filepath.FromSlash(path))
+}
+
+func (dc *diskCache) dataDir() string {
+	return filepath.Join(dc.root, "data")
+}
+
+func (dc *diskCache) tempDir() string {
+	return filepath.Join(dc.root, "tmp")
+}
+
+// servingReader counts the content served from the cache
+type servingReader struct {
+	*os.File
+}
+
+func (sr *servingReader) Read(p []byte) (int, error) {
+	n, err := sr.File.Read(p)
+	cacheMetrics.serve(uint64(n))
+	return n, err
+}
+
+// byModTime sorts entries by the modification time of their file, oldest
+// first
+type byModTime struct {
+	entries  []cacheEntry
+	modTimes []time.Time
+}
+
+func (b byModTime) Len() int { return len(b.entries) }
+
+func (b byModTime) Less(i, j int) bool { return b.modTimes[i].Before(b.modTimes[j]) }
+
+func (b byModTime) Swap(i, j int) {
+	b.entries[i], b.entries[j] = b.entries[j], b.entries[i]
+	b.modTimes[i], b.modTimes[j] = b.modTimes[j], b.modTimes[i]
+}
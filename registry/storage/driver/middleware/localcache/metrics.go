@@ -0,0 +1,99 @@
+package localcache
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// Metrics counts the reads served by local disk caches, the fills of the
+// caches from the wrapped drivers, and the content evicted to stay within
+// their bounds.
+type Metrics struct {
+	Requests   uint64
+	Hits       uint64
+	Misses     uint64
+	Fills      uint64
+	FillErrors uint64
+	Evictions  uint64
+
+	// BytesFilled counts the content read from the wrapped drivers into the
+	// caches, and BytesServed the content served from the caches
+	BytesFilled uint64
+	BytesServed uint64
+
+	// HitRate is the ratio of hits to requests
+	HitRate float64
+}
+
+type metricsCollector struct {
+	metrics Metrics
+}
+
+func (mc *metricsCollector) hit() {
+	atomic.AddUint64(&mc.metrics.Requests, 1)
+	atomic.AddUint64(&mc.metrics.Hits, 1)
+}
+
+func (mc *metricsCollector) miss() {
+	atomic.AddUint64(&mc.metrics.Requests, 1)
+	atomic.AddUint64(&mc.metrics.Misses, 1)
+}
+
+func (mc *metricsCollector) fill(bytesFilled uint64) {
+	atomic.AddUint64(&mc.metrics.Fills, 1)
+	atomic.AddUint64(&mc.metrics.BytesFilled, bytesFilled)
+}
+
+func (mc *metricsCollector) fillError() {
+	atomic.AddUint64(&mc.metrics.FillErrors, 1)
+}
+
+func (mc *metricsCollector) serve(bytesServed uint64) {
+	atomic.AddUint64(&mc.metrics.BytesServed, bytesServed)
+}
+
+func (mc *metricsCollector) evict() {
+	atomic.AddUint64(&mc.metrics.Evictions, 1)
+}
+
+// Metrics returns a copy of the counters
+func (mc *metricsCollector) Metrics() Metrics {
+	m := Metrics{
+		Requests:    atomic.LoadUint64(&mc.metrics.Requests),
+		Hits:        atomic.LoadUint64(&mc.metrics.Hits),
+		Misses:      atomic.LoadUint64(&mc.metrics.Misses),
+		Fills:       atomic.LoadUint64(&mc.metrics.Fills),
+		FillErrors:  atomic.LoadUint64(&mc.metrics.FillErrors),
+		Evictions:   atomic.LoadUint64(&mc.metrics.Evictions),
+		BytesFilled: atomic.LoadUint64(&mc.metrics.BytesFilled),
+		BytesServed: atomic.LoadUint64(&mc.metrics.BytesServed),
+	}
+
+	if m.Requests > 0 {
+		m.HitRate = float64(m.Hits) / float64(m.Requests)
+	}
+
+	return m
+}
+
+// cacheMetrics is kept globally, for all local disk caches of the process,
+// and made available via expvar.
+var cacheMetrics = &metricsCollector{}
+
+func init() {
+	registry := expvar.Get("registry")
+	if registry == nil {
+		registry = expvar.NewMap("registry")
+	}
+
+	cache := registry.(*expvar.Map).Get("cache")
+	if cache == nil {
+		cache = &expvar.Map{}
+		cache.(*expvar.Map).Init()
+		registry.(*expvar.Map).Set("cache", cache)
+	}
+
+	cache.(*expvar.Map).Set("localcache", expvar.Func(func() interface{} {
+		return cacheMetrics.Metrics()
+	}))
+}
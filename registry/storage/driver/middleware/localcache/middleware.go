@@ -0,0 +1,185 @@
+// Package localcache provides a storage middleware that caches the content of
+// blobs read from the wrapped driver on local disk.
+//
+// Only paths under "/docker/registry/v2/blobs/" are cached, as they are
+// content addressed: their content never changes, only their presence. Other
+// paths, such as uploads and the links of repositories, are always read from
+// the wrapped driver. Writes, moves and deletes through the middleware remove
+// the affected paths from the cache.
+package localcache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+// defaultMaxSize is the size of the cache when none is configured
+const defaultMaxSize = 10 << 30
+
+// localCacheStorageMiddleware serves reads of blobs from a cache on local
+// disk, filling it from the wrapped driver on misses.
+type localCacheStorageMiddleware struct {
+	storagedriver.StorageDriver
+	cache *diskCache
+}
+
+var _ storagedriver.StorageDriver = &localCacheStorageMiddleware{}
+
+// newLocalCacheStorageMiddleware constructs and returns a new local disk
+// caching storage middleware.
+// Required options: rootdirectory
+// Optional options: maxsize
+func newLocalCacheStorageMiddleware(storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	rd, ok := options["rootdirectory"]
+	if !ok {
+		return nil, fmt.Errorf("No rootdirectory provided")
+	}
+	rootDirectory, ok := rd.(string)
+	if !ok || rootDirectory == "" {
+		return nil, fmt.Errorf("rootdirectory must be a non-empty string")
+	}
+
+	maxSize := int64(defaultMaxSize)
+	if ms, ok := options["maxsize"]; ok {
+		switch ms := ms.(type) {
+		case int:
+			maxSize = int64(ms)
+		case int64:
+			maxSize = ms
+		case string:
+			var err error
+			maxSize, err = strconv.ParseInt(ms, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid maxsize: %s", err)
+			}
+		default:
+			return nil, fmt.Errorf("maxsize must be an integer")
+		}
+
+		if maxSize <= 0 {
+			return nil, fmt.Errorf("maxsize must be positive")
+		}
+	}
+
+	cache, err := newDiskCache(rootDirectory, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load cache: %s", err)
+	}
+
+	return &localCacheStorageMiddleware{
+		StorageDriver: storageDriver,
+		cache:         cache,
+	}, nil
+}
+
+// GetContent retrieves the content stored at "path", from the cache if it
+// is cacheable
+func (lcsm *localCacheStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if !cacheable(path) {
+		return lcsm.StorageDriver.GetContent(ctx, path)
+	}
+
+	rc, err := lcsm.ReadStream(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// ReadStream returns a reader of the content stored at "path", starting at
+// offset. The content of cacheable paths is read from the cache, which is
+// filled from the wrapped driver on a miss, the content being served as it is
+// copied.
+func (lcsm *localCacheStorageMiddleware) ReadStream(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if !cacheable(path) || offset < 0 {
+		return lcsm.StorageDriver.ReadStream(ctx, path, offset)
+	}
+
+	if rc, ok := lcsm.cache.open(path, offset); ok {
+		cacheMetrics.hit()
+		return rc, nil
+	}
+	cacheMetrics.miss()
+
+	rc, err := lcsm.cache.fill(ctx, lcsm.StorageDriver, path, offset)
+	if err == nil {
+		return rc, nil
+	}
+
+	switch err.(type) {
+	case storagedriver.PathNotFoundError:
+		return nil, err
+	}
+	if err != errTooLarge {
+		cacheMetrics.fillError()
+		context.GetLogger(ctx).Errorf("Error filling local cache with %s: %v", path, err)
+	}
+
+	return lcsm.StorageDriver.ReadStream(ctx, path, offset)
+}
+
+// PutContent stores the content at "path", removing it from the cache
+func (lcsm *localCacheStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	defer lcsm.invalidate(path)
+	return lcsm.StorageDriver.PutContent(ctx, path, content)
+}
+
+// WriteStream stores the content of the reader at "path", removing it from
+// the cache
+func (lcsm *localCacheStorageMiddleware) WriteStream(ctx context.Context, path string, offset int64, reader io.Reader) (int64, error) {
+	defer lcsm.invalidate(path)
+	return lcsm.StorageDriver.WriteStream(ctx, path, offset, reader)
+}
+
+// Move moves the content at sourcePath to destPath, removing both from the
+// cache
+func (lcsm *localCacheStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	defer lcsm.invalidate(sourcePath)
+	defer lcsm.invalidate(destPath)
+	return lcsm.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+// Delete deletes the content at "path", and all content under it, removing
+// it from the cache
+func (lcsm *localCacheStorageMiddleware) Delete(ctx context.Context, path string) error {
+	defer lcsm.invalidate(path)
+	return lcsm.StorageDriver.Delete(ctx, path)
+}
+
+// invalidate removes the path, and any path under it, from the cache
+func (lcsm *localCacheStorageMiddleware) invalidate(path string) {
+	if cacheable(path) || containsBlobs(path) {
+		lcsm.cache.remove(path)
+	}
+}
+
+// blobsPrefix is the prefix of the paths of blobs in the registry storage.
+// Repositories may have any name, including "v2/blobs", so the prefix is
+// matched from the root.
+const blobsPrefix = "/docker/registry/v2/blobs/"
+
+// cacheable returns true if the path is under the directory of the content
+// addressed blobs
+func cacheable(path string) bool {
+	return strings.HasPrefix(path, blobsPrefix)
+}
+
+// containsBlobs returns true if the path is the directory of the blobs, or
+// one of its parents
+func containsBlobs(path string) bool {
+	return strings.HasPrefix(blobsPrefix, strings.TrimSuffix(path, "/")+"/")
+}
+
+// init registers the localcache storage middleware.
+func init() {
+	storagemiddleware.Register("localcache", storagemiddleware.InitFunc(newLocalCacheStorageMiddleware))
+}
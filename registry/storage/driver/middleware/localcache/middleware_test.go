@@ -0,0 +1,405 @@
+package localcache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/cache/memory"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"github.com/docker/libtrust"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	root, err := ioutil.TempDir("", "localcache-test")
+	if err != nil {
+		panic(err)
+	}
+
+	localCacheDriverConstructor := func() (storagedriver.StorageDriver, error) {
+		return newLocalCacheStorageMiddleware(inmemory.New(), map[string]interface{}{
+			"rootdirectory": root,
+		})
+	}
+	testsuites.RegisterSuite(localCacheDriverConstructor, testsuites.NeverSkip)
+}
+
+// countingDriver counts the reads of the wrapped driver
+type countingDriver struct {
+	storagedriver.StorageDriver
+	reads int32
+}
+
+func (cd *countingDriver) ReadStream(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	atomic.AddInt32(&cd.reads, 1)
+	return cd.StorageDriver.ReadStream(ctx, path, offset)
+}
+
+const (
+	blobPath  = "/docker/registry/v2/blobs/sha256/ab/abcd/data"
+	blobPath2 = "/docker/registry/v2/blobs/sha256/ef/ef01/data"
+	linkPath  = "/docker/registry/v2/repositories/foo/_layers/sha256/abcd/link"
+)
+
+func newTestMiddleware(t *testing.T, root string, maxSize int) (storagedriver.StorageDriver, *countingDriver) {
+	backend := &countingDriver{StorageDriver: inmemory.New()}
+	driver, err := newLocalCacheStorageMiddleware(backend, map[string]interface{}{
+		"rootdirectory": root,
+		"maxsize":       maxSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return driver, backend
+}
+
+func readAt(t *testing.T, driver storagedriver.StorageDriver, path string, offset int64) []byte {
+	rc, err := driver.ReadStream(context.Background(), path, offset)
+	if err != nil {
+		t.Fatalf("unexpected error reading %s: %v", path, err)
+	}
+	defer rc.Close()
+
+	p, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("unexpected error reading %s: %v", path, err)
+	}
+	return p
+}
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "localcache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	driver, backend := newTestMiddleware(t, root, 1<<20)
+	before := cacheMetrics.Metrics()
+
+	content := []byte("blob content")
+	if err := backend.PutContent(ctx, blobPath, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.PutContent(ctx, linkPath, []byte("sha256:abcd")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if p := readAt(t, driver, blobPath, 5); !bytes.Equal(p, content[5:]) {
+			t.Fatalf("unexpected content: %q", p)
+		}
+		if p := readAt(t, driver, linkPath, 0); string(p) != "sha256:abcd" {
+			t.Fatalf("unexpected content: %q", p)
+		}
+	}
+
+	// The blob is filled once, links are always read
+	if backend.reads != 4 {
+		t.Fatalf("unexpected reads of the wrapped driver: %d != 4", backend.reads)
+	}
+
+	metrics := cacheMetrics.Metrics()
+	if metrics.Hits-before.Hits != 2 || metrics.Misses-before.Misses != 1 {
+		t.Fatalf("unexpected metrics: %#v", metrics)
+	}
+
+	// Content written through the middleware is not served stale
+	content = []byte("new content")
+	if err := driver.PutContent(ctx, blobPath, content); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := driver.GetContent(ctx, blobPath); err != nil || !bytes.Equal(p, content) {
+		t.Fatalf("unexpected content: %q, %v", p, err)
+	}
+
+	// Deleted content is not served
+	if err := driver.Delete(ctx, "/docker/registry/v2/blobs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.ReadStream(ctx, blobPath, 0); err == nil {
+		t.Fatal("expected error reading deleted blob")
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Fatalf("unexpected error reading deleted blob: %v", err)
+	}
+}
+
+func TestConcurrentFills(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "localcache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	driver, backend := newTestMiddleware(t, root, 1<<20)
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	if err := backend.PutContent(ctx, blobPath, content); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := driver.GetContent(ctx, blobPath)
+			if err != nil {
+				t.Errorf("unexpected error reading %s: %v", blobPath, err)
+			} else if !bytes.Equal(p, content) {
+				t.Errorf("unexpected content of %d bytes", len(p))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Readers missing while the blob is filled wait for the fill
+	if backend.reads != 1 {
+		t.Fatalf("unexpected reads of the wrapped driver: %d != 1", backend.reads)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "localcache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	driver, backend := newTestMiddleware(t, root, 150)
+
+	for _, path := range []string{blobPath, blobPath2} {
+		if err := backend.PutContent(ctx, path, bytes.Repeat([]byte("a"), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	large := "/docker/registry/v2/blobs/sha256/12/1234/data"
+	if err := backend.PutContent(ctx, large, bytes.Repeat([]byte("a"), 200)); err != nil {
+		t.Fatal(err)
+	}
+
+	readAt(t, driver, blobPath, 0)
+	readAt(t, driver, blobPath2, 0) // evicts blobPath
+	readAt(t, driver, blobPath2, 0)
+	if backend.reads != 2 {
+		t.Fatalf("unexpected reads of the wrapped driver: %d != 2", backend.reads)
+	}
+
+	readAt(t, driver, blobPath, 0)
+	if backend.reads != 3 {
+		t.Fatalf("unexpected reads of the wrapped driver: %d != 3", backend.reads)
+	}
+
+	// Content larger than the cache is read from the wrapped driver
+	readAt(t, driver, large, 0)
+	readAt(t, driver, large, 0)
+	if backend.reads != 5 {
+		t.Fatalf("unexpected reads of the wrapped driver: %d != 5", backend.reads)
+	}
+
+	// The cache is kept across restarts
+	restarted, backend := newTestMiddleware(t, root, 150)
+	if err := backend.PutContent(ctx, blobPath, bytes.Repeat([]byte("a"), 100)); err != nil {
+		t.Fatal(err)
+	}
+	readAt(t, restarted, blobPath, 0)
+	if backend.reads != 0 {
+		t.Fatalf("unexpected reads of the wrapped driver: %d != 0", backend.reads)
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	for path, expected := range map[string]bool{
+		blobPath: true,
+		linkPath: false,
+		"/docker/registry/v2/repositories/foo/_uploads/1234/data":                             false,
+		"/docker/registry/v2/repositories/foo/_manifests/tags/latest/current/link":            false,
+		"/docker/registry/v2/repositories/foo/v2/blobs/x/_uploads/1234/data":                  false,
+		"/docker/registry/v2/repositories/foo/v2/blobs/x/_manifests/tags/latest/current/link": false,
+	} {
+		if cacheable(path) != expected {
+			t.Errorf("cacheable(%q) != %v", path, expected)
+		}
+	}
+
+	for path, expected := range map[string]bool{
+		"/":                                    true,
+		"/docker/registry/v2":                  true,
+		"/docker/registry/v2/blobs":            true,
+		"/docker/registry/v2/repositories/foo": false,
+		"/docker/registry/v2/repositories/foo/v2/blobs": false,
+		"/other": false,
+	} {
+		if containsBlobs(path) != expected {
+			t.Errorf("containsBlobs(%q) != %v", path, expected)
+		}
+	}
+}
+
+// TestRepositoryNamedBlobs pushes to a repository whose name contains
+// "v2/blobs" from a registry, checking that a retag is seen by another one
+// sharing the storage through its cache.
+func TestRepositoryNamedBlobs(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+
+	newNode := func() distribution.Namespace {
+		root, err := ioutil.TempDir("", "localcache-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		driver, err := newLocalCacheStorageMiddleware(backend, map[string]interface{}{
+			"rootdirectory": root,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver, storage.BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return registry
+	}
+	pusher, puller := newNode(), newNode()
+
+	pk, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "foo/v2/blobs/x"
+	for _, architecture := range []string{"amd64", "arm"} {
+		sm, err := schema1.Sign(&schema1.Manifest{
+			Versioned:    manifest.Versioned{SchemaVersion: 1},
+			Name:         name,
+			Tag:          "latest",
+			Architecture: architecture,
+		}, pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repo, err := pusher.Repository(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests, err := repo.Manifests(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := manifests.Put(sm); err != nil {
+			t.Fatal(err)
+		}
+
+		repo, err = puller.Repository(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests, err = repo.Manifests(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pulled, err := manifests.GetByTag("latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pulled.Architecture != architecture {
+			t.Fatalf("stale tag pulled: %s != %s", pulled.Architecture, architecture)
+		}
+	}
+}
+
+// blockingDriver blocks reads of the wrapped driver past the first byte until
+// released
+type blockingDriver struct {
+	storagedriver.StorageDriver
+	release chan struct{}
+}
+
+func (bd *blockingDriver) ReadStream(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	rc, err := bd.StorageDriver.ReadStream(ctx, path, offset)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(io.MultiReader(io.LimitReader(rc, 1), &blockingReader{rc, bd.release})), nil
+}
+
+type blockingReader struct {
+	io.Reader
+	release chan struct{}
+}
+
+func (br *blockingReader) Read(p []byte) (int, error) {
+	<-br.release
+	return br.Reader.Read(p)
+}
+
+// TestStreamWhileFilling checks that content is served while the cache is
+// filled, before the whole blob is copied
+func TestStreamWhileFilling(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "localcache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	backend := &blockingDriver{StorageDriver: inmemory.New(), release: make(chan struct{})}
+	driver, err := newLocalCacheStorageMiddleware(backend, map[string]interface{}{
+		"rootdirectory": root,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	if err := backend.PutContent(ctx, blobPath, content); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := driver.ReadStream(ctx, blobPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	p := make([]byte, 1)
+	if _, err := io.ReadFull(rc, p); err != nil || p[0] != content[0] {
+		t.Fatalf("unexpected first byte: %q, %v", p, err)
+	}
+
+	close(backend.release)
+	rest, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(p, rest...), content) {
+		t.Fatalf("unexpected content of %d bytes", len(rest)+1)
+	}
+
+	// Filled once complete
+	if p := readAt(t, driver, blobPath, 10); !bytes.Equal(p, content[10:]) {
+		t.Fatalf("unexpected content of %d bytes", len(p))
+	}
+}
@@ -0,0 +1,181 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// BackfillEvent reports a file of the source of a backfill missing, or with
+// a different size, in the destination, and whether it was copied.
+type BackfillEvent struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Size   int64  `json:"size"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Statuses of BackfillEvent
+const (
+	BackfillStatusMissing    = "missing"
+	BackfillStatusMismatched = "mismatched"
+	BackfillStatusCopied     = "copied"
+	BackfillStatusError      = "error"
+)
+
+// BackfillResult counts the files walked by a backfill
+type BackfillResult struct {
+	Files      int
+	Missing    int
+	Mismatched int
+	Copied     int
+	Failed     int
+}
+
+// Backfill walks the files of the source driver, copying those missing in the
+// destination driver, or with a different size, to it. Events are written to
+// w as JSON lines. If dryRun is true, files are only reported, not copied.
+// To verify a mirror and repair writes not replicated, the primary is the
+// source; to migrate content to a new backend, the secondary is.
+func Backfill(ctx context.Context, from, to storagedriver.StorageDriver, dryRun bool, w io.Writer) (BackfillResult, error) {
+	b := &backfill{
+		from:    from,
+		to:      to,
+		dryRun:  dryRun,
+		encoder: json.NewEncoder(w),
+	}
+
+	if err := b.walk(ctx, "/"); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return b.result, err
+		}
+		// The source is empty
+	}
+
+	if b.result.Failed > 0 {
+		return b.result, fmt.Errorf("failed to copy %d files", b.result.Failed)
+	}
+
+	return b.result, nil
+}
+
+type backfill struct {
+	from, to storagedriver.StorageDriver
+	dryRun   bool
+	encoder  *json.Encoder
+	result   BackfillResult
+}
+
+func (b *backfill) walk(ctx context.Context, path string) error {
+	children, err := b.from.List(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		fi, err := b.from.Stat(ctx, child)
+		switch err.(type) {
+		case nil:
+		case storagedriver.PathNotFoundError:
+			// Deleted since listed
+			continue
+		default:
+			return err
+		}
+
+		if fi.IsDir() {
+			if err := b.walk(ctx, child); err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := b.check(ctx, fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// check copies the file if missing, or with a different size, in the
+// destination
+func (b *backfill) check(ctx context.Context, fi storagedriver.FileInfo) error {
+	b.result.Files++
+
+	status := BackfillStatusMismatched
+	tfi, err := b.to.Stat(ctx, fi.Path())
+	switch err.(type) {
+	case nil:
+		if !tfi.IsDir() && tfi.Size() == fi.Size() {
+			return nil
+		}
+		b.result.Mismatched++
+	case storagedriver.PathNotFoundError:
+		status = BackfillStatusMissing
+		b.result.Missing++
+	default:
+		return err
+	}
+
+	if err := b.report(fi, status, nil); err != nil || b.dryRun {
+		return err
+	}
+
+	if err := copyFile(ctx, b.from, b.to, fi.Path()); err != nil {
+		b.result.Failed++
+		return b.report(fi, BackfillStatusError, err)
+	}
+
+	b.result.Copied++
+	return b.report(fi, BackfillStatusCopied, nil)
+}
+
+func (b *backfill) report(fi storagedriver.FileInfo, status string, err error) error {
+	event := BackfillEvent{
+		Path:   fi.Path(),
+		Status: status,
+		Size:   fi.Size(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	return b.encoder.Encode(event)
+}
+
+// copyFile copies the file at path from one driver to the other, replacing
+// any content at path in the destination
+func copyFile(ctx context.Context, from, to storagedriver.StorageDriver, path string) error {
+	fi, err := from.Stat(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	rc, err := from.ReadStream(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := to.Delete(ctx, path); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+
+	nn, err := to.WriteStream(ctx, path, 0, rc)
+	if err != nil {
+		return err
+	}
+	if nn != fi.Size() {
+		return fmt.Errorf("copied %d bytes of %s, expected %d", nn, path, fi.Size())
+	}
+
+	return nil
+}
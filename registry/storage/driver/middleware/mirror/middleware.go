@@ -0,0 +1,412 @@
+// Package mirror provides a storage middleware that mirrors the content
+// written to the wrapped driver, the primary, to a secondary driver.
+//
+// Writes to the primary are replicated to the secondary synchronously, or
+// asynchronously by a background worker. Reads are served by the primary,
+// falling back to the secondary for paths not found in the primary, and
+// listings merge the children found in both, so that the middleware can be
+// used to migrate between storage backends: the old backend is configured as
+// the secondary, and content not yet copied by Backfill is read from it.
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+// defaultQueueSize is the number of writes waiting to be replicated
+// asynchronously when none is configured
+const defaultQueueSize = 10000
+
+// mirrorStorageMiddleware replicates writes to the wrapped driver to a
+// secondary driver.
+type mirrorStorageMiddleware struct {
+	storagedriver.StorageDriver
+	secondary storagedriver.StorageDriver
+
+	// queue holds the writes to replicate asynchronously, or is nil if
+	// writes are replicated synchronously
+	queue chan operation
+
+	// mu guards closed against writes queued while the queue is closed
+	mu     sync.RWMutex
+	closed bool
+
+	// stopped is closed once the queue is drained after Close
+	stopped chan struct{}
+}
+
+var _ storagedriver.StorageDriver = &mirrorStorageMiddleware{}
+var _ io.Closer = &mirrorStorageMiddleware{}
+
+// newMirrorStorageMiddleware constructs and returns a new mirroring storage
+// middleware.
+// Required options: driver
+// Optional options: parameters, async, queuesize
+func newMirrorStorageMiddleware(storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	secondary, err := Secondary(options)
+	if err != nil {
+		return nil, err
+	}
+
+	msm := &mirrorStorageMiddleware{
+		StorageDriver: storageDriver,
+		secondary:     secondary,
+	}
+
+	async := false
+	if a, ok := options["async"]; ok {
+		switch a := a.(type) {
+		case bool:
+			async = a
+		case string:
+			async = a == "true"
+		default:
+			return nil, fmt.Errorf("async must be a boolean")
+		}
+	}
+
+	if async {
+		queueSize := defaultQueueSize
+		if qs, ok := options["queuesize"]; ok {
+			switch qs := qs.(type) {
+			case int:
+				queueSize = qs
+			default:
+				return nil, fmt.Errorf("queuesize must be an integer")
+			}
+
+			if queueSize <= 0 {
+				return nil, fmt.Errorf("queuesize must be positive")
+			}
+		}
+
+		msm.queue = make(chan operation, queueSize)
+		msm.stopped = make(chan struct{})
+		go msm.replicate()
+	}
+
+	return msm, nil
+}
+
+// Secondary creates the secondary driver of the mirror middleware with the
+// given options: the name of the driver, and its parameters.
+func Secondary(options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	d, ok := options["driver"]
+	if !ok {
+		return nil, fmt.Errorf("No driver provided")
+	}
+	driverName, ok := d.(string)
+	if !ok {
+		return nil, fmt.Errorf("driver must be a string")
+	}
+
+	parameters := make(map[string]interface{})
+	if p, ok := options["parameters"]; ok && p != nil {
+		switch p := p.(type) {
+		case map[string]interface{}:
+			parameters = p
+		case map[interface{}]interface{}:
+			for k, v := range p {
+				parameters[fmt.Sprint(k)] = v
+			}
+		default:
+			return nil, fmt.Errorf("parameters must be a map")
+		}
+	}
+
+	secondary, err := factory.Create(driverName, parameters)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create secondary driver: %s", err)
+	}
+
+	return secondary, nil
+}
+
+// GetContent retrieves the content stored at "path" in the primary, or in
+// the secondary if not found
+func (msm *mirrorStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := msm.StorageDriver.GetContent(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return msm.secondary.GetContent(ctx, path)
+	}
+	return content, err
+}
+
+// ReadStream retrieves a reader of the content stored at "path" in the
+// primary, or in the secondary if not found
+func (msm *mirrorStorageMiddleware) ReadStream(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	rc, err := msm.StorageDriver.ReadStream(ctx, path, offset)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return msm.secondary.ReadStream(ctx, path, offset)
+	}
+	return rc, err
+}
+
+// Stat retrieves info about the path in the primary, or in the secondary if
+// not found
+func (msm *mirrorStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := msm.StorageDriver.Stat(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return msm.secondary.Stat(ctx, path)
+	}
+	return fi, err
+}
+
+// List lists the children of the path in both the primary and the secondary,
+// so that children not migrated yet are listed along the ones written since.
+// The path is not found only if found in neither.
+func (msm *mirrorStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	children, err := msm.StorageDriver.List(ctx, path)
+	_, primaryNotFound := err.(storagedriver.PathNotFoundError)
+	if err != nil && !primaryNotFound {
+		return nil, err
+	}
+
+	secondaryChildren, err := msm.secondary.List(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		if primaryNotFound {
+			return nil, err
+		}
+		return children, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]bool, len(children))
+	for _, child := range children {
+		listed[child] = true
+	}
+	for _, child := range secondaryChildren {
+		if !listed[child] {
+			listed[child] = true
+			children = append(children, child)
+		}
+	}
+
+	return children, nil
+}
+
+// PutContent stores the content at "path" in the primary, and replicates it
+// to the secondary
+func (msm *mirrorStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := msm.StorageDriver.PutContent(ctx, path, content); err != nil {
+		return err
+	}
+
+	if msm.queue != nil {
+		msm.enqueue(ctx, operation{kind: opPut, path: path})
+		return nil
+	}
+
+	return msm.secondary.PutContent(ctx, path, content)
+}
+
+// WriteStream stores the content of the reader at "path" in the primary, and
+// replicates the content written to the secondary. The content is read back
+// from the primary to be replicated, so that the reader is not held in
+// memory.
+func (msm *mirrorStorageMiddleware) WriteStream(ctx context.Context, path string, offset int64, reader io.Reader) (int64, error) {
+	nn, err := msm.StorageDriver.WriteStream(ctx, path, offset, reader)
+	if nn == 0 && err != nil {
+		return nn, err
+	}
+
+	op := operation{kind: opWrite, path: path, offset: offset, length: nn}
+	if msm.queue != nil {
+		msm.enqueue(ctx, op)
+		return nn, err
+	}
+
+	if rerr := msm.apply(ctx, op); rerr != nil && err == nil {
+		// The content is stored in the primary, so it is reported written
+		// along with the error: the secondary lacks it until it is written
+		// again or repaired by Backfill
+		return nn, rerr
+	}
+
+	return nn, err
+}
+
+// Move moves the content at sourcePath to destPath in the primary, and in
+// the secondary. Content found only in the secondary is moved in it.
+func (msm *mirrorStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	err := msm.StorageDriver.Move(ctx, sourcePath, destPath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return msm.secondary.Move(ctx, sourcePath, destPath)
+	} else if err != nil {
+		return err
+	}
+
+	op := operation{kind: opMove, path: sourcePath, destPath: destPath}
+	if msm.queue != nil {
+		msm.enqueue(ctx, op)
+		return nil
+	}
+
+	return msm.apply(ctx, op)
+}
+
+// Delete deletes the content at "path" in the primary and in the secondary.
+// Content found only in the secondary is deleted from it.
+func (msm *mirrorStorageMiddleware) Delete(ctx context.Context, path string) error {
+	err := msm.StorageDriver.Delete(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		// The content may not have been copied from the secondary yet
+		return msm.secondary.Delete(ctx, path)
+	} else if err != nil {
+		return err
+	}
+
+	op := operation{kind: opDelete, path: path}
+	if msm.queue != nil {
+		msm.enqueue(ctx, op)
+		return nil
+	}
+
+	return msm.apply(ctx, op)
+}
+
+type operationKind int
+
+const (
+	opPut operationKind = iota
+	opWrite
+	opMove
+	opDelete
+)
+
+// operation is a write to the primary to replicate to the secondary
+type operation struct {
+	kind     operationKind
+	path     string
+	destPath string
+	offset   int64
+	length   int64
+
+	// done, if not nil, is closed once all previous operations are
+	// replicated
+	done chan struct{}
+}
+
+// apply replicates the operation to the secondary, reading the content
+// written from the primary
+func (msm *mirrorStorageMiddleware) apply(ctx context.Context, op operation) error {
+	switch op.kind {
+	case opPut:
+		content, err := msm.StorageDriver.GetContent(ctx, op.path)
+		if err != nil {
+			return err
+		}
+		return msm.secondary.PutContent(ctx, op.path, content)
+	case opWrite:
+		rc, err := msm.StorageDriver.ReadStream(ctx, op.path, op.offset)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		nn, err := msm.secondary.WriteStream(ctx, op.path, op.offset, io.LimitReader(rc, op.length))
+		if err == nil && nn != op.length {
+			err = fmt.Errorf("replicated %d bytes of %s at %d, expected %d", nn, op.path, op.offset, op.length)
+		}
+		return err
+	case opMove:
+		err := msm.secondary.Move(ctx, op.path, op.destPath)
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			// The source was not replicated, copy the destination instead
+			return copyFile(ctx, msm.StorageDriver, msm.secondary, op.destPath)
+		}
+		return err
+	case opDelete:
+		err := msm.secondary.Delete(ctx, op.path)
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	return fmt.Errorf("unknown operation %d", op.kind)
+}
+
+// enqueue queues the operation to be replicated asynchronously. If the queue
+// is full, the write waits for room, unless the request is done first. An
+// operation not queued, because the request is done or the middleware is
+// closed, is logged and dropped, leaving the secondary to be repaired by
+// Backfill.
+func (msm *mirrorStorageMiddleware) enqueue(ctx context.Context, op operation) {
+	msm.mu.RLock()
+	defer msm.mu.RUnlock()
+
+	if msm.closed {
+		context.GetLogger(ctx).Errorf("mirror: closed, dropping replication of %s", op.path)
+		return
+	}
+
+	select {
+	case msm.queue <- op:
+	case <-ctx.Done():
+		context.GetLogger(ctx).Errorf("mirror: %v waiting for the replication queue, dropping replication of %s", ctx.Err(), op.path)
+	}
+}
+
+// replicate replicates the queued operations to the secondary, until the
+// queue is closed and drained
+func (msm *mirrorStorageMiddleware) replicate() {
+	defer close(msm.stopped)
+	ctx := context.Background()
+
+	for op := range msm.queue {
+		if op.done != nil {
+			close(op.done)
+			continue
+		}
+
+		if err := msm.apply(ctx, op); err != nil {
+			switch err.(type) {
+			case storagedriver.PathNotFoundError:
+				// Written content since moved or deleted in the primary,
+				// which is replicated by the following operations
+				continue
+			}
+			context.GetLogger(ctx).Errorf("mirror: error replicating %s: %v", op.path, err)
+		}
+	}
+}
+
+// Close stops queueing writes to replicate asynchronously, and waits for the
+// writes already queued to be replicated. Writes made afterwards are no
+// longer replicated. The secondary is closed, if it keeps state to write on
+// shutdown.
+func (msm *mirrorStorageMiddleware) Close() error {
+	if msm.queue != nil {
+		msm.mu.Lock()
+		closed := msm.closed
+		if !closed {
+			msm.closed = true
+			close(msm.queue)
+		}
+		msm.mu.Unlock()
+
+		if closed {
+			return fmt.Errorf("mirror: already closed")
+		}
+		<-msm.stopped
+	}
+
+	if closer, ok := msm.secondary.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// init registers the mirror storage middleware.
+func init() {
+	storagemiddleware.Register("mirror", storagemiddleware.InitFunc(newMirrorStorageMiddleware))
+}
@@ -0,0 +1,338 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	gocontext "golang.org/x/net/context"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	mirrorDriverConstructor := func() (storagedriver.StorageDriver, error) {
+		return newMirrorStorageMiddleware(inmemory.New(), map[string]interface{}{
+			"driver": "inmemory",
+		})
+	}
+	testsuites.RegisterSuite(mirrorDriverConstructor, testsuites.NeverSkip)
+}
+
+// drain waits for the operations queued to be replicated
+func (msm *mirrorStorageMiddleware) drain() {
+	if msm.queue == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	msm.queue <- operation{done: done}
+	<-done
+}
+
+func newTestMirror(t *testing.T, options map[string]interface{}) *mirrorStorageMiddleware {
+	options["driver"] = "inmemory"
+	driver, err := newMirrorStorageMiddleware(inmemory.New(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return driver.(*mirrorStorageMiddleware)
+}
+
+func expectContent(t *testing.T, driver storagedriver.StorageDriver, path string, expected []byte) {
+	content, err := driver.GetContent(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected error getting %s: %v", path, err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Fatalf("unexpected content of %s: %q != %q", path, content, expected)
+	}
+}
+
+func expectNotFound(t *testing.T, driver storagedriver.StorageDriver, path string) {
+	_, err := driver.Stat(context.Background(), path)
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Fatalf("expected %s not found: %v", path, err)
+	}
+}
+
+func testReplication(t *testing.T, msm *mirrorStorageMiddleware) {
+	ctx := context.Background()
+
+	if err := msm.PutContent(ctx, "/a/put", []byte("put")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msm.WriteStream(ctx, "/a/upload", 0, bytes.NewReader([]byte("first"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msm.WriteStream(ctx, "/a/upload", 5, bytes.NewReader([]byte(" second"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := msm.Move(ctx, "/a/upload", "/b/data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msm.PutContent(ctx, "/a/deleted", []byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := msm.Delete(ctx, "/a/deleted"); err != nil {
+		t.Fatal(err)
+	}
+	msm.drain()
+
+	for _, driver := range []storagedriver.StorageDriver{msm.StorageDriver, msm.secondary} {
+		expectContent(t, driver, "/a/put", []byte("put"))
+		expectContent(t, driver, "/b/data", []byte("first second"))
+		expectNotFound(t, driver, "/a/upload")
+		expectNotFound(t, driver, "/a/deleted")
+	}
+}
+
+func TestSyncReplication(t *testing.T) {
+	testReplication(t, newTestMirror(t, map[string]interface{}{}))
+}
+
+func TestAsyncReplication(t *testing.T) {
+	testReplication(t, newTestMirror(t, map[string]interface{}{"async": true}))
+}
+
+// failingDriver fails every write
+type failingDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (failingDriver) WriteStream(ctx context.Context, path string, offset int64, reader io.Reader) (int64, error) {
+	return 0, errors.New("write failed")
+}
+
+// TestSyncReplicationFailure checks that a write failing to replicate is
+// reported with the length written to the primary
+func TestSyncReplicationFailure(t *testing.T) {
+	ctx := context.Background()
+	msm := newTestMirror(t, map[string]interface{}{})
+	msm.secondary = failingDriver{msm.secondary}
+
+	nn, err := msm.WriteStream(ctx, "/a/upload", 0, bytes.NewReader([]byte("content")))
+	if err == nil {
+		t.Fatal("expected replication error")
+	}
+	if nn != 7 {
+		t.Fatalf("unexpected length written: %d != 7", nn)
+	}
+	expectContent(t, msm.StorageDriver, "/a/upload", []byte("content"))
+}
+
+// TestAsyncQueueFull checks that writes wait for room in a full queue, until
+// their request is done
+func TestAsyncQueueFull(t *testing.T) {
+	msm := &mirrorStorageMiddleware{
+		StorageDriver: inmemory.New(),
+		secondary:     inmemory.New(),
+		queue:         make(chan operation, 1),
+	}
+	msm.enqueue(context.Background(), operation{kind: opDelete, path: "/first"})
+
+	// Dropped once the request is done
+	ctx, cancel := gocontext.WithCancel(context.Background())
+	cancel()
+	msm.enqueue(ctx, operation{kind: opDelete, path: "/dropped"})
+
+	queued := make(chan struct{})
+	go func() {
+		msm.enqueue(context.Background(), operation{kind: opDelete, path: "/second"})
+		close(queued)
+	}()
+
+	select {
+	case <-queued:
+		t.Fatal("expected write to wait for room in the queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	for _, expected := range []string{"/first", "/second"} {
+		if op := <-msm.queue; op.path != expected {
+			t.Fatalf("unexpected operation queued: %s != %s", op.path, expected)
+		}
+	}
+	<-queued
+}
+
+// TestClose checks that writes queued before Close are replicated
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	msm := newTestMirror(t, map[string]interface{}{"async": true})
+
+	for i := 0; i < 10; i++ {
+		if err := msm.PutContent(ctx, fmt.Sprintf("/a/%d", i), []byte("put")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := msm.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		expectContent(t, msm.secondary, fmt.Sprintf("/a/%d", i), []byte("put"))
+	}
+
+	// Written to the primary only
+	if err := msm.PutContent(ctx, "/a/closed", []byte("put")); err != nil {
+		t.Fatal(err)
+	}
+	expectNotFound(t, msm.secondary, "/a/closed")
+
+	if err := msm.Close(); err == nil {
+		t.Fatal("expected error closing twice")
+	}
+}
+
+func TestReadFallback(t *testing.T) {
+	ctx := context.Background()
+	msm := newTestMirror(t, map[string]interface{}{})
+
+	// Content only in the secondary, not migrated yet
+	if err := msm.secondary.PutContent(ctx, "/old/data", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectContent(t, msm, "/old/data", []byte("old"))
+
+	fi, err := msm.Stat(ctx, "/old/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 3 {
+		t.Fatalf("unexpected size: %d", fi.Size())
+	}
+
+	children, err := msm.List(ctx, "/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 1 || children[0] != "/old/data" {
+		t.Fatalf("unexpected children: %v", children)
+	}
+
+	if err := msm.Move(ctx, "/old/data", "/old/moved"); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, msm, "/old/moved", []byte("old"))
+
+	if err := msm.Delete(ctx, "/old"); err != nil {
+		t.Fatal(err)
+	}
+	expectNotFound(t, msm, "/old/moved")
+}
+
+// TestListMerged checks that the children of a path partially migrated are
+// listed from both drivers, once each
+func TestListMerged(t *testing.T) {
+	ctx := context.Background()
+	msm := newTestMirror(t, map[string]interface{}{})
+
+	// Written since the migration started, and replicated
+	if err := msm.PutContent(ctx, "/tags/new/link", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	// Not migrated yet
+	if err := msm.secondary.PutContent(ctx, "/tags/old/link", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	// Migrated
+	if err := msm.StorageDriver.PutContent(ctx, "/tags/migrated/link", []byte("migrated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := msm.secondary.PutContent(ctx, "/tags/migrated/link", []byte("migrated")); err != nil {
+		t.Fatal(err)
+	}
+
+	children, err := msm.List(ctx, "/tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(children)
+	if strings.Join(children, ",") != "/tags/migrated,/tags/new,/tags/old" {
+		t.Fatalf("unexpected children: %v", children)
+	}
+
+	if _, err := msm.List(ctx, "/missing"); err == nil {
+		t.Fatal("expected an error listing a missing path")
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Fatalf("unexpected error listing a missing path: %v", err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	from, to := inmemory.New(), inmemory.New()
+
+	for path, content := range map[string]string{
+		"/a/b/missing":    "missing",
+		"/a/mismatched":   "mismatched",
+		"/a/b/c/matching": "matching",
+	} {
+		if err := from.PutContent(ctx, path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := to.PutContent(ctx, "/a/mismatched", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := to.PutContent(ctx, "/a/b/c/matching", []byte("matching")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	result, err := Backfill(ctx, from, to, true, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (BackfillResult{Files: 3, Missing: 1, Mismatched: 1}) {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	expectNotFound(t, to, "/a/b/missing")
+
+	events := make(map[string]string)
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var event BackfillEvent
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		events[event.Path] = event.Status
+	}
+	if events["/a/b/missing"] != BackfillStatusMissing || events["/a/mismatched"] != BackfillStatusMismatched || len(events) != 2 {
+		t.Fatalf("unexpected events: %v", events)
+	}
+
+	result, err = Backfill(ctx, from, to, false, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (BackfillResult{Files: 3, Missing: 1, Mismatched: 1, Copied: 2}) {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	expectContent(t, to, "/a/b/missing", []byte("missing"))
+	expectContent(t, to, "/a/mismatched", []byte("mismatched"))
+
+	result, err = Backfill(ctx, from, to, false, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (BackfillResult{Files: 3}) {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+}
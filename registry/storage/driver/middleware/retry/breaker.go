@@ -0,0 +1,88 @@
+package retry
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitOpenError is returned for calls to a driver rejected by its
+// circuit breaker, without reaching the backend.
+type CircuitOpenError struct {
+	DriverName string
+	Until      time.Time
+}
+
+func (err CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: circuit breaker open until %s, after repeated backend failures", err.DriverName, err.Until.Format(time.RFC3339))
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is a circuit breaker, opened after threshold consecutive backend
+// failures. While open, calls are rejected; once the cooldown has passed, a
+// single call is let through to probe the backend, closing the breaker if it
+// succeeds, or opening it again if it fails.
+type breaker struct {
+	driverName string
+	threshold  int
+	cooldown   time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	until    time.Time
+}
+
+// allow returns a CircuitOpenError if a call must be rejected
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.until) {
+			return CircuitOpenError{DriverName: b.driverName, Until: b.until}
+		}
+		b.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		// A probe is in flight
+		return CircuitOpenError{DriverName: b.driverName, Until: b.until}
+	}
+
+	return nil
+}
+
+// record records the result of a call allowed by the breaker. failed is
+// true if the backend failed, not merely rejected the call.
+func (b *breaker) record(failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.until = time.Now().Add(b.cooldown)
+	}
+}
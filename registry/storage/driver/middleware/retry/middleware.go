@@ -0,0 +1,355 @@
+// Package retry provides a storage middleware retrying the calls to the
+// wrapped driver failing with transient backend errors, with exponential
+// backoff, behind a circuit breaker.
+//
+// Idempotent calls are retried: GetContent, Stat, List, ReadStream, URLFor
+// and Delete. WriteStream is retried only when the content stored, according
+// to the size of the file, shows where to resume writing. PutContent and Move
+// are not retried.
+//
+// Once the breaker opens, after consecutive backend failures, calls fail
+// immediately with a CircuitOpenError until a probe succeeds, and so does the
+// storage driver health check of the registry, which lists the root of the
+// driver.
+package retry
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+// Defaults of the options
+const (
+	defaultMaxAttempts      = 3
+	defaultInitialBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff       = 5 * time.Second
+	defaultBreakerThreshold = 10
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// retryStorageMiddleware retries the failed calls to the wrapped driver.
+type retryStorageMiddleware struct {
+	storagedriver.StorageDriver
+
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	breaker        *breaker
+}
+
+var _ storagedriver.StorageDriver = &retryStorageMiddleware{}
+
+// newRetryStorageMiddleware constructs and returns a new retrying storage
+// middleware.
+// Optional options: maxattempts, initialbackoff, maxbackoff, breakerthreshold,
+// breakercooldown
+func newRetryStorageMiddleware(storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	maxAttempts, err := intOption(options, "maxattempts", defaultMaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("maxattempts must be positive")
+	}
+
+	initialBackoff, err := durationOption(options, "initialbackoff", defaultInitialBackoff)
+	if err != nil {
+		return nil, err
+	}
+	maxBackoff, err := durationOption(options, "maxbackoff", defaultMaxBackoff)
+	if err != nil {
+		return nil, err
+	}
+	if initialBackoff <= 0 || maxBackoff < initialBackoff {
+		return nil, fmt.Errorf("initialbackoff must be positive, and not greater than maxbackoff")
+	}
+
+	// A threshold of 0 disables the breaker
+	threshold, err := intOption(options, "breakerthreshold", defaultBreakerThreshold)
+	if err != nil {
+		return nil, err
+	}
+	cooldown, err := durationOption(options, "breakercooldown", defaultBreakerCooldown)
+	if err != nil {
+		return nil, err
+	}
+
+	return &retryStorageMiddleware{
+		StorageDriver:  storageDriver,
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		breaker: &breaker{
+			driverName: storageDriver.Name(),
+			threshold:  threshold,
+			cooldown:   cooldown,
+		},
+	}, nil
+}
+
+func intOption(options map[string]interface{}, name string, defaultValue int) (int, error) {
+	v, ok := options[name]
+	if !ok {
+		return defaultValue, nil
+	}
+
+	i, ok := v.(int)
+	if !ok {
+		return 0, fmt.Errorf("%s must be an integer", name)
+	}
+	return i, nil
+}
+
+func durationOption(options map[string]interface{}, name string, defaultValue time.Duration) (time.Duration, error) {
+	v, ok := options[name]
+	if !ok {
+		return defaultValue, nil
+	}
+
+	switch v := v.(type) {
+	case time.Duration:
+		return v, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid %s: %s", name, err)
+		}
+		return d, nil
+	}
+
+	return 0, fmt.Errorf("%s must be a duration", name)
+}
+
+// permanent returns true if the error is an answer of the backend, not a
+// failure to retry
+func permanent(err error) bool {
+	switch err.(type) {
+	case storagedriver.PathNotFoundError, storagedriver.InvalidPathError, storagedriver.InvalidOffsetError, CircuitOpenError:
+		return true
+	}
+
+	return err == storagedriver.ErrUnsupportedMethod
+}
+
+// call makes a single call to the wrapped driver through the breaker
+func (rsm *retryStorageMiddleware) call(f func() error) error {
+	if err := rsm.breaker.allow(); err != nil {
+		return err
+	}
+
+	err := f()
+	rsm.breaker.record(err != nil && !permanent(err))
+	return err
+}
+
+// retry calls f until it succeeds, fails with a permanent error, or
+// maxattempts calls were made
+func (rsm *retryStorageMiddleware) retry(ctx context.Context, method, path string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := rsm.call(f)
+		if err == nil || permanent(err) || attempt >= rsm.maxAttempts {
+			return err
+		}
+
+		if !rsm.wait(ctx, method, path, attempt, err) {
+			return err
+		}
+	}
+}
+
+// backoff returns the time to wait after the given failed attempt: the
+// initial backoff doubled after each attempt up to the maximum, of which a
+// random half is waited so that clients do not retry in step
+func (rsm *retryStorageMiddleware) backoff(attempt int) time.Duration {
+	d := rsm.initialBackoff
+	for i := 1; i < attempt && d < rsm.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > rsm.maxBackoff {
+		d = rsm.maxBackoff
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// wait waits before retrying the failed attempt, returning false if the
+// context is done first
+func (rsm *retryStorageMiddleware) wait(ctx context.Context, method, path string, attempt int, err error) bool {
+	d := rsm.backoff(attempt)
+	context.GetLogger(ctx).Warnf("retry: %s %s failed (attempt %d of %d), retrying in %s: %v", method, path, attempt, rsm.maxAttempts, d, err)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (rsm *retryStorageMiddleware) GetContent(ctx context.Context, path string) (content []byte, err error) {
+	err = rsm.retry(ctx, "GetContent", path, func() (err error) {
+		content, err = rsm.StorageDriver.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// It is not retried.
+func (rsm *retryStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	return rsm.call(func() error {
+		return rsm.StorageDriver.PutContent(ctx, path, content)
+	})
+}
+
+// ReadStream retrieves an io.ReadCloser for the content stored at "path" with
+// a given byte offset. Only opening the stream is retried, not reading it.
+func (rsm *retryStorageMiddleware) ReadStream(ctx context.Context, path string, offset int64) (rc io.ReadCloser, err error) {
+	err = rsm.retry(ctx, "ReadStream", path, func() (err error) {
+		rc, err = rsm.StorageDriver.ReadStream(ctx, path, offset)
+		return err
+	})
+	return rc, err
+}
+
+// WriteStream stores the contents of the provided io.Reader at a location
+// designated by the given path. After a failed write, the size of the file
+// is compared with the content read from the reader: if all of it is
+// stored, the write is resumed with the rest of the reader, and if the
+// reader is an io.Seeker and the content before offset is intact, it is
+// rewound to write it all again. Otherwise, the write is not retried.
+func (rsm *retryStorageMiddleware) WriteStream(ctx context.Context, path string, offset int64, reader io.Reader) (int64, error) {
+	cr := &countingReader{Reader: reader}
+
+	seeker, _ := reader.(io.Seeker)
+	var seekStart int64
+	if seeker != nil {
+		var err error
+		if seekStart, err = seeker.Seek(0, os.SEEK_CUR); err != nil {
+			seeker = nil
+		}
+	}
+
+	// pos is where the next byte of the reader is written
+	pos := offset
+	for attempt := 1; ; attempt++ {
+		var nn int64
+		err := rsm.call(func() (err error) {
+			nn, err = rsm.StorageDriver.WriteStream(ctx, path, pos, cr)
+			return err
+		})
+		if err == nil || permanent(err) || attempt >= rsm.maxAttempts {
+			return pos - offset + nn, err
+		}
+
+		if !rsm.wait(ctx, "WriteStream", path, attempt, err) {
+			return pos - offset + nn, err
+		}
+
+		var size int64
+		fi, serr := rsm.Stat(ctx, path)
+		switch serr.(type) {
+		case nil:
+			size = fi.Size()
+		case storagedriver.PathNotFoundError:
+		default:
+			return pos - offset + nn, err
+		}
+
+		read := offset + cr.n
+		switch {
+		case size == read:
+			pos = read
+		case seeker != nil && size >= offset:
+			if _, serr := seeker.Seek(seekStart, os.SEEK_SET); serr != nil {
+				return pos - offset + nn, err
+			}
+			cr.n = 0
+			pos = offset
+		default:
+			// The content stored does not show where to resume
+			return pos - offset + nn, err
+		}
+	}
+}
+
+// countingReader counts the content read from the reader
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (rsm *retryStorageMiddleware) Stat(ctx context.Context, path string) (fi storagedriver.FileInfo, err error) {
+	err = rsm.retry(ctx, "Stat", path, func() (err error) {
+		fi, err = rsm.StorageDriver.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (rsm *retryStorageMiddleware) List(ctx context.Context, path string) (children []string, err error) {
+	err = rsm.retry(ctx, "List", path, func() (err error) {
+		children, err = rsm.StorageDriver.List(ctx, path)
+		return err
+	})
+	return children, err
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object. It is not retried.
+func (rsm *retryStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return rsm.call(func() error {
+		return rsm.StorageDriver.Move(ctx, sourcePath, destPath)
+	})
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+// A retry not finding the path is successful, as the path was deleted by
+// the failed attempt.
+func (rsm *retryStorageMiddleware) Delete(ctx context.Context, path string) error {
+	failed := false
+	return rsm.retry(ctx, "Delete", path, func() error {
+		err := rsm.StorageDriver.Delete(ctx, path)
+		if _, ok := err.(storagedriver.PathNotFoundError); ok && failed {
+			return nil
+		}
+		failed = err != nil
+		return err
+	})
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at
+// the given path.
+func (rsm *retryStorageMiddleware) URLFor(ctx context.Context, path string, options map[string]interface{}) (url string, err error) {
+	err = rsm.retry(ctx, "URLFor", path, func() (err error) {
+		url, err = rsm.StorageDriver.URLFor(ctx, path, options)
+		return err
+	})
+	return url, err
+}
+
+// init registers the retry storage middleware.
+func init() {
+	storagemiddleware.Register("retry", storagemiddleware.InitFunc(newRetryStorageMiddleware))
+}
@@ -0,0 +1,285 @@
+package retry
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	retryDriverConstructor := func() (storagedriver.StorageDriver, error) {
+		return newRetryStorageMiddleware(inmemory.New(), map[string]interface{}{
+			"initialbackoff": "1ms",
+			"maxbackoff":     "10ms",
+		})
+	}
+	testsuites.RegisterSuite(retryDriverConstructor, testsuites.NeverSkip)
+}
+
+var errBackend = errors.New("backend unavailable")
+
+// flakyDriver fails the calls to its methods a given number of times
+type flakyDriver struct {
+	storagedriver.StorageDriver
+
+	mu       sync.Mutex
+	failures map[string]int
+	calls    map[string]int
+
+	// writeBefore is the content of the reader written by WriteStream before
+	// failing, or -1 for the whole content read without being written
+	writeBefore int64
+}
+
+func newFlakyDriver() *flakyDriver {
+	return &flakyDriver{
+		StorageDriver: inmemory.New(),
+		failures:      make(map[string]int),
+		calls:         make(map[string]int),
+	}
+}
+
+func (d *flakyDriver) fail(method string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.calls[method]++
+	if d.failures[method] > 0 {
+		d.failures[method]--
+		return errBackend
+	}
+	return nil
+}
+
+func (d *flakyDriver) count(method string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls[method]
+}
+
+func (d *flakyDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := d.fail("GetContent"); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *flakyDriver) List(ctx context.Context, path string) ([]string, error) {
+	if err := d.fail("List"); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.List(ctx, path)
+}
+
+func (d *flakyDriver) Delete(ctx context.Context, path string) error {
+	err := d.StorageDriver.Delete(ctx, path)
+	if ferr := d.fail("Delete"); ferr != nil {
+		// Deleted, but reported failed
+		return ferr
+	}
+	return err
+}
+
+func (d *flakyDriver) WriteStream(ctx context.Context, path string, offset int64, reader io.Reader) (int64, error) {
+	if err := d.fail("WriteStream"); err != nil {
+		if d.writeBefore < 0 {
+			io.Copy(ioutil.Discard, reader)
+			return 0, err
+		}
+		nn, _ := d.StorageDriver.WriteStream(ctx, path, offset, io.LimitReader(reader, d.writeBefore))
+		return nn, err
+	}
+	return d.StorageDriver.WriteStream(ctx, path, offset, reader)
+}
+
+func newTestRetry(t *testing.T, driver storagedriver.StorageDriver, options map[string]interface{}) *retryStorageMiddleware {
+	options["initialbackoff"] = time.Millisecond
+	options["maxbackoff"] = 5 * time.Millisecond
+	rsm, err := newRetryStorageMiddleware(driver, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsm.(*retryStorageMiddleware)
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	d := newFlakyDriver()
+	rsm := newTestRetry(t, d, map[string]interface{}{"maxattempts": 3})
+
+	if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.failures["GetContent"] = 2
+	content, err := rsm.GetContent(ctx, "/a")
+	if err != nil {
+		t.Fatalf("unexpected error after 2 failures: %v", err)
+	}
+	if string(content) != "content" || d.count("GetContent") != 3 {
+		t.Fatalf("unexpected content %q after %d calls", content, d.count("GetContent"))
+	}
+
+	d.failures["GetContent"] = 3
+	if _, err := rsm.GetContent(ctx, "/a"); err != errBackend {
+		t.Fatalf("expected backend error after 3 failures: %v", err)
+	}
+	if d.count("GetContent") != 6 {
+		t.Fatalf("unexpected calls: %d", d.count("GetContent"))
+	}
+
+	if _, err := rsm.GetContent(ctx, "/missing"); err == nil {
+		t.Fatal("expected error for missing path")
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.count("GetContent") != 7 {
+		t.Fatalf("path not found was retried: %d calls", d.count("GetContent"))
+	}
+
+	// The path deleted by a failed attempt is not found by the retry
+	d.failures["Delete"] = 1
+	if err := rsm.Delete(ctx, "/a"); err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+	if _, err := d.Stat(ctx, "/a"); err == nil {
+		t.Fatal("expected /a deleted")
+	}
+}
+
+func TestWriteStreamResume(t *testing.T) {
+	ctx := context.Background()
+	d := newFlakyDriver()
+	rsm := newTestRetry(t, d, map[string]interface{}{})
+
+	content := []byte("0123456789abcdefghij")
+	if err := d.PutContent(ctx, "/upload", content[:5]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Part of the content read is stored: the reader, not an io.Seeker,
+	// is resumed
+	d.writeBefore = 5
+	d.failures["WriteStream"] = 2
+	nn, err := rsm.WriteStream(ctx, "/upload", 5, struct{ io.Reader }{bytes.NewReader(content[5:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nn != 15 || d.count("WriteStream") != 3 {
+		t.Fatalf("unexpected bytes written %d after %d calls", nn, d.count("WriteStream"))
+	}
+
+	stored, err := d.GetContent(ctx, "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Fatalf("unexpected content: %q != %q", stored, content)
+	}
+}
+
+func TestWriteStreamNotResumable(t *testing.T) {
+	ctx := context.Background()
+	d := newFlakyDriver()
+	rsm := newTestRetry(t, d, map[string]interface{}{})
+
+	// The content read is lost
+	d.writeBefore = -1
+	d.failures["WriteStream"] = 1
+	if _, err := rsm.WriteStream(ctx, "/upload", 0, struct{ io.Reader }{bytes.NewReader([]byte("content"))}); err != errBackend {
+		t.Fatalf("expected write not retried: %v", err)
+	}
+	if d.count("WriteStream") != 1 {
+		t.Fatalf("unexpected calls: %d", d.count("WriteStream"))
+	}
+
+	// Unless the reader can be rewound
+	d.failures["WriteStream"] = 1
+	nn, err := rsm.WriteStream(ctx, "/upload", 0, bytes.NewReader([]byte("content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nn != 7 || d.count("WriteStream") != 3 {
+		t.Fatalf("unexpected bytes written %d after %d calls", nn, d.count("WriteStream"))
+	}
+
+	stored, err := d.GetContent(ctx, "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != "content" {
+		t.Fatalf("unexpected content: %q", stored)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	d := newFlakyDriver()
+	rsm := newTestRetry(t, d, map[string]interface{}{
+		"maxattempts":      2,
+		"breakerthreshold": 3,
+		"breakercooldown":  "50ms",
+	})
+
+	if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 attempts, then 1 opening the breaker, then rejected
+	d.failures["List"] = 100
+	for i := 0; i < 2; i++ {
+		if _, err := rsm.List(ctx, "/"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if d.count("List") != 3 {
+		t.Fatalf("unexpected calls: %d", d.count("List"))
+	}
+
+	// All calls are rejected while open, as the health check of the driver
+	if _, err := rsm.GetContent(ctx, "/a"); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(CircuitOpenError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.count("GetContent") != 0 {
+		t.Fatalf("unexpected calls: %d", d.count("GetContent"))
+	}
+
+	// After the cooldown, a successful probe closes the breaker
+	time.Sleep(60 * time.Millisecond)
+	d.failures["List"] = 0
+	if _, err := rsm.List(ctx, "/"); err != nil {
+		t.Fatalf("unexpected error probing: %v", err)
+	}
+	if _, err := rsm.GetContent(ctx, "/a"); err != nil {
+		t.Fatalf("unexpected error after closing: %v", err)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"maxattempts": 0},
+		{"maxattempts": "3"},
+		{"initialbackoff": "soon"},
+		{"initialbackoff": "10s", "maxbackoff": "1s"},
+		{"breakercooldown": 30},
+	} {
+		if _, err := newRetryStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Errorf("expected error for options %v", options)
+		}
+	}
+}
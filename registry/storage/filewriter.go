@@ -120,7 +120,13 @@ func (fw *fileWriter) ReadFrom(r io.Reader) (n int64, err error) {
 		return 0, fw.err
 	}
 
-	nn, err := fw.driver.WriteStream(fw.ctx, fw.path, fw.offset, r)
+	cr := &countingReader{Reader: r}
+	nn, err := fw.driver.WriteStream(fw.ctx, fw.path, fw.offset, cr)
+	if err == nil && nn < cr.n {
+		// The driver stored less than it read: the content read, such as
+		// digested by the caller, does not match the content stored.
+		err = io.ErrShortWrite
+	}
 
 	// We should forward the offset, whether or not there was an error.
 	// Basically, we keep the filewriter in sync with the reader's head. If an
@@ -178,3 +184,15 @@ func (fw *fileWriter) Close() error {
 
 	return nil
 }
+
+// countingReader counts the bytes read from the reader
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 
@@ -198,6 +199,37 @@ func TestBufferedFileWriter(t *testing.T) {
 	}
 }
 
+// shortWriteDriver stores half of the content written
+type shortWriteDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d shortWriteDriver) WriteStream(ctx context.Context, path string, offset int64, reader io.Reader) (int64, error) {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+	return d.StorageDriver.WriteStream(ctx, path, offset, bytes.NewReader(content[:len(content)/2]))
+}
+
+// TestShortWrite ensures that content read, but not stored, by the driver
+// is reported as an error.
+func TestShortWrite(t *testing.T) {
+	ctx := context.Background()
+	fw, err := newFileWriter(ctx, shortWriteDriver{inmemory.New()}, "/random")
+	if err != nil {
+		t.Fatalf("unexpected error creating fileWriter: %v", err)
+	}
+
+	nn, err := fw.ReadFrom(bytes.NewReader(make([]byte, 1024)))
+	if err != io.ErrShortWrite {
+		t.Fatalf("expected short write error: %v", err)
+	}
+	if nn != 512 || fw.offset != 512 {
+		t.Fatalf("unexpected write length: %d, offset %d", nn, fw.offset)
+	}
+}
+
 func BenchmarkFileWriter(b *testing.B) {
 	b.StopTimer() // not sure how long setup above will take
 	for i := 0; i < b.N; i++ {